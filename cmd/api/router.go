@@ -1,6 +1,7 @@
 package api
 
 import (
+	"flag"
 	"fmt"
 	blockchainpkg "github.com/keithzetterstrom/BibCoin/internal/pkg/blockchain"
 	networkpkg "github.com/keithzetterstrom/BibCoin/internal/pkg/network"
@@ -8,8 +9,8 @@ import (
 	"github.com/keithzetterstrom/BibCoin/tools/base58"
 	clipkg "github.com/keithzetterstrom/BibCoin/tools/cli"
 	"log"
-	"os"
 	"strconv"
+	"time"
 )
 
 type router struct {
@@ -38,14 +39,22 @@ func NewRouter(
 	}
 }
 
-// Start starts cli
+// Start starts cli, flags must be already parsed
 func (r * router) Start() {
-	r.cli.FlagsCLI()
+	r.network.Plaintext = r.cli.Plaintext
+
+	if r.cli.Prune > 0 {
+		err := r.blockchain.EnablePruning(r.cli.Prune)
+		if err != nil {
+			fmt.Println("Failed:", err)
+			return
+		}
+	}
 
 	switch {
-	case r.cli.SendCmd != "" && os.Args[3] != "" && os.Args[4] != "":
-		coins, _ := strconv.Atoi(os.Args[4])
-		r.send(r.cli.SendCmd, os.Args[3], coins, false)
+	case r.cli.SendCmd != "" && flag.NArg() >= 2:
+		coins, _ := strconv.Atoi(flag.Arg(1))
+		r.send(r.cli.SendCmd, flag.Arg(0), coins, r.cli.Mine)
 
 	case r.cli.PrintChainCmd:
 		r.printChain()
@@ -68,6 +77,51 @@ func (r * router) Start() {
 	case r.cli.StartFullNode:
 		r.startFullNode()
 
+	case r.cli.DumpUTXO > 0 && flag.Arg(0) != "":
+		r.dumpUTXO(r.cli.DumpUTXO, flag.Arg(0))
+
+	case r.cli.LoadUTXO != "":
+		r.loadUTXO(r.cli.LoadUTXO)
+
+	case r.cli.Generate > 0 && flag.Arg(0) != "":
+		r.generate(r.cli.Generate, flag.Arg(0))
+
+	case r.cli.Warp > 0:
+		r.warp(r.cli.Warp)
+
+	case r.cli.ListBanned:
+		r.listBanned()
+
+	case r.cli.Ban != "":
+		r.ban(r.cli.Ban, r.cli.BanTime)
+
+	case r.cli.ClearBanned:
+		r.clearBanned()
+
+	case r.cli.GetMempoolInfo:
+		r.getMempoolInfo(flag.Arg(0))
+
+	case r.cli.GetRawMempool:
+		r.getRawMempool(flag.Arg(0))
+
+	case r.cli.NodeKey:
+		r.nodeKey()
+
+	case r.cli.Pin != "" && flag.Arg(0) != "":
+		r.pin(r.cli.Pin, flag.Arg(0))
+
+	case r.cli.ListPinned:
+		r.listPinned()
+
+	case r.cli.GetPeerInfo:
+		r.getPeerInfo(flag.Arg(0))
+
+	case r.cli.GetOnlineStake:
+		r.getOnlineStake(flag.Arg(0))
+
+	case r.cli.Delegate != "" && flag.Arg(0) != "":
+		r.delegate(r.cli.Delegate, flag.Arg(0))
+
 	default:
 		r.cli.PrintUsage()
 	}
@@ -75,7 +129,7 @@ func (r * router) Start() {
 
 // getBalance returns balance of the given address
 func (r * router) getBalance(address string) {
-	if !walletpkg.ValidateAddress(address) {
+	if !walletpkg.ValidateAddress(address, r.blockchain.Params.AddressVersion) {
 		log.Panic("invalid address")
 	}
 
@@ -98,12 +152,12 @@ func (r * router) getBalance(address string) {
 // If mineNow - true: node appends new block with new transaction locally
 // bypassing mining stage and follow the satoshi stage
 func (r * router) send(from, to string, amount int, mineNow bool) {
-	if !walletpkg.ValidateAddress(from) {
+	if !walletpkg.ValidateAddress(from, r.blockchain.Params.AddressVersion) {
 		fmt.Println("Invalid address")
 		return
 	}
 
-	if !walletpkg.ValidateAddress(to) {
+	if !walletpkg.ValidateAddress(to, r.blockchain.Params.AddressVersion) {
 		fmt.Println("Invalid address")
 		return
 	}
@@ -114,22 +168,58 @@ func (r * router) send(from, to string, amount int, mineNow bool) {
 		return
 	}
 	if mineNow {
+		wallet, err := r.wallets.GetWallet(from)
+		if err != nil {
+			fmt.Println("Failed:", err)
+			return
+		}
+
 		lastIndex, err := r.blockchain.GetLastSatoshiIndex()
 		if err != nil {
 			fmt.Println("Failed:", err)
 			return
 		}
-		cbTx := blockchainpkg.NewCoinbaseTX(from, from, "", lastIndex)
+		cbTx := blockchainpkg.NewCoinbaseTX(from, from, "", lastIndex, r.blockchain.Params.Subsidy)
 		txs := []*blockchainpkg.Transaction{cbTx, tx}
 
 		block := r.blockchain.MineBlock(from)
-		_, err = r.blockchain.AddNewBlock(block, txs, from)
+		_, err = r.blockchain.AddNewBlock(block, txs, &wallet)
 		if err != nil {
 			fmt.Println(err)
 			return
 		}
 	} else {
-		r.network.SendTx(r.network.KnownNodes[0], tx)
+		err = r.network.BroadcastTx(tx)
+		r.network.Close()
+		if err != nil {
+			fmt.Println("Failed:", err)
+			return
+		}
+	}
+
+	fmt.Println("Success!")
+}
+
+// delegate lets the staking address sign extensions for the current outputs of the wallet,
+// the staking address can not spend them and rewards of their stakes are paid to the wallet
+func (r * router) delegate(from, stakeAddr string) {
+	if !walletpkg.ValidateAddress(from, r.blockchain.Params.AddressVersion) ||
+		!walletpkg.ValidateAddress(stakeAddr, r.blockchain.Params.AddressVersion) {
+		fmt.Println("Invalid address")
+		return
+	}
+
+	tx, err := blockchainpkg.NewDelegationTransaction(from, stakeAddr, r.blockchain)
+	if err != nil {
+		fmt.Println("Failed:", err)
+		return
+	}
+
+	err = r.network.BroadcastTx(tx)
+	r.network.Close()
+	if err != nil {
+		fmt.Println("Failed:", err)
+		return
 	}
 
 	fmt.Println("Success!")
@@ -140,7 +230,7 @@ func (r * router) printChain() {
 	iterator := r.blockchain.NewIterator()
 	fmt.Println("-------------------------------- BlockChain --------------------------------")
 	for {
-		block := iterator.Next()
+		block := iterator.NextHeader()
 
 		fmt.Printf("Prev. hash: %x\n", block.PrevBlockHash)
 		fmt.Printf("Hash: %x\n", block.Hash)
@@ -175,7 +265,260 @@ func (r * router) startMiningNode()  {
 	r.network.StartMineServer()
 }
 
-// startFullNode starts full node
+// startFullNode starts full node, the key of the node's wallet signs extensions of blocks it stakes
 func (r * router) startFullNode()  {
+	wallet, err := r.wallets.GetWallet(r.network.Address)
+	if err != nil {
+		fmt.Println("Wallet of the node is not found, the node will not stake:", err)
+	} else {
+		r.network.Wallet = &wallet
+	}
+
 	r.network.StartFullServer()
 }
+
+// dumpUTXO writes snapshot of the UTXO set at the given height to file
+func (r * router) dumpUTXO(height int, file string) {
+	hash, err := r.blockchain.DumpUTXO(height, file)
+	if err != nil {
+		fmt.Println("Failed:", err)
+		return
+	}
+
+	fmt.Printf("Snapshot at height %d: %x\n", height, hash)
+}
+
+// loadUTXO loads snapshot of the UTXO set into blockchain with genesis block only, blocks below
+// the snapshot are downloaded when the node is started
+func (r * router) loadUTXO(file string) {
+	err := r.blockchain.LoadSnapshot(file)
+	if err != nil {
+		fmt.Println("Failed:", err)
+		return
+	}
+
+	fmt.Println("Success!")
+}
+
+// generate appends n blocks to the local chain paying both rewards to the address,
+// extensions are signed by the wallet of the address, works only in regtest
+func (r * router) generate(n int, address string) {
+	if !walletpkg.ValidateAddress(address, r.blockchain.Params.AddressVersion) {
+		fmt.Println("Invalid address")
+		return
+	}
+
+	wallet, err := r.wallets.GetWallet(address)
+	if err != nil {
+		fmt.Println("Failed:", err)
+		return
+	}
+
+	hashes, err := r.blockchain.GenerateBlocks(n, &wallet, nil)
+	for _, hash := range hashes {
+		fmt.Printf("%x\n", hash)
+	}
+	if err != nil {
+		fmt.Println("Failed:", err)
+		return
+	}
+
+	fmt.Println("Success!")
+}
+
+// warp moves the clock of the node forward, works only in regtest
+func (r * router) warp(seconds int64) {
+	err := r.blockchain.WarpTime(seconds)
+	if err != nil {
+		fmt.Println("Failed:", err)
+		return
+	}
+
+	fmt.Printf("Time of the node: %s\n", r.blockchain.Now().Format(time.RFC3339))
+}
+
+// listBanned prints banned hosts with the time their bans expire
+func (r * router) listBanned() {
+	bans := r.network.BanList.List()
+	for _, ban := range bans {
+		fmt.Printf("%s until %s\n", ban.Host, time.Unix(ban.Until, 0).Format(time.RFC3339))
+	}
+
+	fmt.Printf("Banned hosts: %d\n", len(bans))
+}
+
+// ban bans the host for the given number of seconds
+func (r * router) ban(host string, seconds int64) {
+	if seconds <= 0 {
+		fmt.Println("Invalid ban time")
+		return
+	}
+
+	err := r.network.BanList.Ban(host, time.Duration(seconds) * time.Second)
+	if err != nil {
+		fmt.Println("Failed:", err)
+		return
+	}
+
+	fmt.Println("Success!")
+}
+
+// clearBanned removes all bans
+func (r * router) clearBanned() {
+	err := r.network.BanList.Clear()
+	if err != nil {
+		fmt.Println("Failed:", err)
+		return
+	}
+
+	fmt.Println("Success!")
+}
+
+// nodeKey prints static key of the node other nodes may pin
+func (r * router) nodeKey() {
+	fmt.Printf("Node key: %x\n", r.network.PublicKey())
+}
+
+// pin requires the node to authenticate with the key
+func (r * router) pin(node, key string) {
+	err := r.network.PinnedKeys.Pin(node, key)
+	if err != nil {
+		fmt.Println("Failed:", err)
+		return
+	}
+
+	fmt.Println("Success!")
+}
+
+// listPinned prints nodes with pinned keys
+func (r * router) listPinned() {
+	keys := r.network.PinnedKeys.List()
+	for _, key := range keys {
+		fmt.Printf("%s %s\n", key.Addr, key.Key)
+	}
+
+	fmt.Printf("Pinned keys: %d\n", len(keys))
+}
+
+// requestedNode returns the node which state is requested, a known node by default
+func (r * router) requestedNode(node string) string {
+	if node != "" {
+		return node
+	}
+
+	return r.network.KnownNodes[0]
+}
+
+// getMempoolInfo prints the state of mem pool of the node
+func (r * router) getMempoolInfo(node string) {
+	node = r.requestedNode(node)
+
+	info, _, err := r.network.RequestMempool(node)
+	if err != nil {
+		fmt.Println("Failed:", err)
+		return
+	}
+
+	fmt.Printf("Mem pool of %s\n", node)
+	fmt.Printf("Transactions: %d\n", info.Size)
+	fmt.Printf("Bytes: %d of %d\n", info.Bytes, info.MaxBytes)
+	fmt.Printf("Min fee rate: %d satoshies/kB\n", info.MinFeeRate)
+}
+
+// getRawMempool prints transactions in mem pool of the node, parents go before their children
+func (r * router) getRawMempool(node string) {
+	node = r.requestedNode(node)
+
+	_, entries, err := r.network.RequestMempool(node)
+	if err != nil {
+		fmt.Println("Failed:", err)
+		return
+	}
+
+	for _, entry := range entries {
+		fmt.Printf("Transaction: %s\n", entry.ID)
+		fmt.Printf("Size: %d, fee: %d, height: %d, time: %s\n",
+			entry.Size, entry.Fee, entry.Height, time.Unix(entry.Time, 0).Format(time.RFC3339))
+		fmt.Printf("Ancestors: %d, descendants: %d\n", entry.AncestorCount, entry.DescendantCount)
+		for _, id := range entry.Depends {
+			fmt.Printf("Depends on: %s\n", id)
+		}
+		fmt.Println()
+	}
+
+	fmt.Printf("Transactions in mem pool: %d\n", len(entries))
+}
+
+// getPeerInfo prints peers of the node with their latency and traffic
+func (r * router) getPeerInfo(node string) {
+	node = r.requestedNode(node)
+
+	peers, err := r.network.RequestPeerInfo(node)
+	if err != nil {
+		fmt.Println("Failed:", err)
+		return
+	}
+
+	for _, peer := range peers {
+		direction := "outbound"
+		if peer.Inbound {
+			direction = "inbound, listens on " + peer.ListenAddr
+		}
+		encryption := "plaintext"
+		if peer.Encrypted {
+			encryption = "encrypted"
+		}
+
+		fmt.Printf("Peer: %s, %s, %s\n", peer.Addr, direction, encryption)
+		fmt.Printf("Version: %d %s, services: %s, height: %d\n",
+			peer.Version, peer.UserAgent, networkpkg.ServicesString(peer.Services), peer.StartHeight)
+		fmt.Printf("Ping: %s, min ping: %s", peer.PingTime, peer.MinPing)
+		if peer.PingWait > 0 {
+			fmt.Printf(", waiting for pong: %s", peer.PingWait.Round(time.Millisecond))
+		}
+		fmt.Println()
+		fmt.Printf("Bytes sent: %d, received: %d\n", peer.BytesSent, peer.BytesReceived)
+		fmt.Printf("Last send: %s, last receive: %s, connected: %s\n",
+			formatUnixTime(peer.LastSend), formatUnixTime(peer.LastReceive), formatUnixTime(peer.Connected))
+		fmt.Println()
+	}
+
+	fmt.Printf("Peers of %s: %d\n", node, len(peers))
+}
+
+// getOnlineStake prints stakeholders which announced to the node that they are online
+// and the share of satoshis they own
+func (r * router) getOnlineStake(node string) {
+	node = r.requestedNode(node)
+
+	stakes, total, err := r.network.RequestOnlineStake(node)
+	if err != nil {
+		fmt.Println("Failed:", err)
+		return
+	}
+
+	online := 0
+	for _, stake := range stakes {
+		fmt.Printf("Stakeholder: %x at %s\n", stake.PubKeyHash, stake.NetAddr)
+		fmt.Printf("Stake: %d, online until: %s\n", stake.Stake, formatUnixTime(stake.Expires))
+		fmt.Println()
+
+		online += stake.Stake
+	}
+
+	share := 0.0
+	if total > 0 {
+		share = float64(online) * 100 / float64(total)
+	}
+
+	fmt.Printf("Online stake known to %s: %d of %d satoshis (%.1f%%)\n", node, online, total, share)
+}
+
+// formatUnixTime formats unix time, zero time is shown as never
+func formatUnixTime(t int64) string {
+	if t == 0 {
+		return "never"
+	}
+
+	return time.Unix(t, 0).Format(time.RFC3339)
+}
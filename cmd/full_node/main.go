@@ -9,24 +9,36 @@ import (
 	"github.com/keithzetterstrom/BibCoin/internal/pkg/wallet"
 	clipkg "github.com/keithzetterstrom/BibCoin/tools/cli"
 	"io/ioutil"
+	"log"
+	"net"
 )
 
-const fullNodeAddress = "127.0.0.1:9000"
-const addrFile = "addr.json"
-const dbFile = "Blockchain.db"
-const walletFile = "wallet.dat"
+const fullNodeHost = "127.0.0.1"
+const addrFileName = "addr.json"
+const dbFileName = "Blockchain.db"
+const walletFileName = "wallet.dat"
 
 func main() {
-	wallets, err := wallet.NewWallets(addrFile, walletFile)
+	cli := clipkg.NewFlagCLI()
+	cli.FlagsCLI()
+
+	params, err := blockchain.GetChainParams(cli.Network)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	addrFile := params.DataFile(addrFileName)
+	dbFile := params.DataFile(dbFileName)
+	walletFile := params.DataFile(walletFileName)
+
+	wallets, err := wallet.NewWallets(addrFile, walletFile, params.AddressVersion)
 
-	bc, err := blockchain.NewBlockchain(dbFile, addrFile, walletFile)
+	bc, err := blockchain.NewBlockchain(dbFile, addrFile, walletFile, params)
 	if err != nil {
 		addr := wallets.CreateWallet()
 		wallets.SaveToFile()
-		bc = blockchain.CreateEmptyBlockchain(dbFile, addrFile, walletFile)
-
-		// for full node
-		bc.AddGenesisBlock(addr)
+		bc = blockchain.CreateEmptyBlockchain(dbFile, addrFile, walletFile, params)
+		bc.AddGenesisBlock()
 
 		fmt.Println("Your address:", addr)
 	}
@@ -36,11 +48,14 @@ func main() {
 	addr := &wallet.Address{}
 	_ = json.Unmarshal(addrByte, addr)
 
-	nw := network.NewNetwork(bc, fullNodeAddress, addr.Address)
+	nw := network.NewNetwork(bc, net.JoinHostPort(fullNodeHost, params.DefaultPort), addr.Address)
 
-	nw.StartFullServer()
+	stakeWallet, err := wallets.GetWallet(addr.Address)
+	if err == nil {
+		nw.Wallet = &stakeWallet
+	}
 
-	cli := clipkg.NewFlagCLI()
+	nw.StartFullServer()
 
 	router := api.NewRouter(bc, cli, wallets, nw)
 
@@ -6,37 +6,70 @@ import (
 	"github.com/keithzetterstrom/BibCoin/internal/pkg/blockchain"
 	"github.com/keithzetterstrom/BibCoin/internal/pkg/network"
 	"github.com/keithzetterstrom/BibCoin/internal/pkg/wallet"
+	"github.com/keithzetterstrom/BibCoin/tools/base58"
 	"golang.org/x/mobile/app"
 	"io/ioutil"
+	"log"
+	"net"
+	"time"
 )
 
-const fullNodeAddress = "192.168.1.64:9000"
+const mobileNodeHost = "192.168.1.64"
 const addrFile = "/sdcard/addr.json"
 const dbFile = "/sdcard/Blockchain.db"
 const walletFile = "/sdcard/wallet.dat"
+const balanceInterval = time.Minute
 
 func main() {
 	app.Main(func(a app.App) {
-		wallets, err := wallet.NewWallets(addrFile, walletFile)
+		params := &blockchain.MainNetParams
 
-		bc, err := blockchain.NewBlockchain(dbFile, addrFile, walletFile)
+		wallets, err := wallet.NewWallets(addrFile, walletFile, params.AddressVersion)
+
+		bc, err := blockchain.NewBlockchain(dbFile, addrFile, walletFile, params)
 		if err != nil {
-			addr := wallets.CreateWallet()
+			wallets.CreateWallet()
 			wallets.SaveToFile()
-			bc = blockchain.CreateEmptyBlockchain(dbFile, addrFile, walletFile)
-
-			// for full node
-			bc.AddGenesisBlock(addr)
+			bc = blockchain.CreateEmptyBlockchain(dbFile, addrFile, walletFile, params)
+			bc.AddGenesisBlock()
 		}
 		defer bc.Db.Close()
 
+		// телефон хранит только заголовки и транзакции своего кошелька
+		err = bc.EnableLightMode()
+		if err != nil {
+			log.Panic(err)
+		}
+
 		addrByte, _ := ioutil.ReadFile(addrFile)
 		addr := &wallet.Address{}
 		_ = json.Unmarshal(addrByte, addr)
 
 		fmt.Println("Your address:", addr.Address)
-		nw := network.NewNetwork(bc, fullNodeAddress, addr.Address)
+		nw := network.NewNetwork(bc, net.JoinHostPort(mobileNodeHost, params.DefaultPort), addr.Address)
+
+		for _, w := range wallets.Wallets {
+			nw.WalletKeys = append(nw.WalletKeys, base58.HashPubKey(w.PublicKey))
+		}
 
-		nw.StartFullServer()
+		go printBalance(bc, nw.WalletKeys)
+
+		nw.StartLightServer()
 	})
 }
+
+// printBalance prints balance of the wallet computed from downloaded transactions
+func printBalance(bc *blockchain.Blockchain, pubKeyHashes [][]byte) {
+	for {
+		time.Sleep(balanceInterval)
+
+		balance := 0
+		for _, pubKeyHash := range pubKeyHashes {
+			for _, out := range bc.FindFilteredUnspentOutputs(pubKeyHash) {
+				balance += len(out.Value)
+			}
+		}
+
+		fmt.Println("Balance:", balance)
+	}
+}
@@ -9,21 +9,36 @@ import (
 	"github.com/keithzetterstrom/BibCoin/internal/pkg/wallet"
 	clipkg "github.com/keithzetterstrom/BibCoin/tools/cli"
 	"io/ioutil"
+	"log"
+	"net"
 )
 
-const nodeAddress = "172.20.10.9:9001"
-const addrFile = "addr.json"
-const dbFile = "Blockchain.db"
-const walletFile = "wallet.dat"
+const nodeHost = "172.20.10.9"
+const addrFileName = "addr.json"
+const dbFileName = "Blockchain.db"
+const walletFileName = "wallet.dat"
 
 func main() {
-	wallets, err := wallet.NewWallets(addrFile, walletFile)
+	cli := clipkg.NewFlagCLI()
+	cli.FlagsCLI()
+
+	params, err := blockchain.GetChainParams(cli.Network)
+	if err != nil {
+		log.Panic(err)
+	}
 
-	bc, err := blockchain.NewBlockchain(dbFile, addrFile, walletFile)
+	addrFile := params.DataFile(addrFileName)
+	dbFile := params.DataFile(dbFileName)
+	walletFile := params.DataFile(walletFileName)
+
+	wallets, err := wallet.NewWallets(addrFile, walletFile, params.AddressVersion)
+
+	bc, err := blockchain.NewBlockchain(dbFile, addrFile, walletFile, params)
 	if err != nil {
 		addr := wallets.CreateWallet()
 		wallets.SaveToFile()
-		bc = blockchain.CreateEmptyBlockchain(dbFile, addrFile, walletFile)
+		bc = blockchain.CreateEmptyBlockchain(dbFile, addrFile, walletFile, params)
+		bc.AddGenesisBlock()
 		fmt.Println("Your address:", addr)
 	}
 	defer bc.Db.Close()
@@ -32,9 +47,7 @@ func main() {
 	addr := &wallet.Address{}
 	_ = json.Unmarshal(addrByte, addr)
 
-	nw := network.NewNetwork(bc, nodeAddress, addr.Address)
-
-	cli := clipkg.NewFlagCLI()
+	nw := network.NewNetwork(bc, net.JoinHostPort(nodeHost, params.DefaultPort), addr.Address)
 
 	router := api.NewRouter(bc, cli, wallets, nw)
 	router.Start()
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"github.com/keithzetterstrom/BibCoin/internal/pkg/blockchain"
+	"github.com/keithzetterstrom/BibCoin/internal/pkg/network"
+	clipkg "github.com/keithzetterstrom/BibCoin/tools/cli"
+	"log"
+	"net"
+)
+
+const seederHost = "0.0.0.0"
+const seederFileName = "seeder.json"
+
+func main() {
+	cli := clipkg.NewFlagCLI()
+	cli.FlagsCLI()
+
+	params, err := blockchain.GetChainParams(cli.Network)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	seeder := network.NewSeeder(params, net.JoinHostPort(seederHost, params.SeederPort), params.DataFile(seederFileName))
+
+	log.Printf("Seeder of %s network is listening on %s\n", params.Name, seeder.NetAddr)
+
+	seeder.Start()
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/keithzetterstrom/BibCoin/internal/pkg/simulation"
+	"io/ioutil"
+	"log"
+	"os"
+	"time"
+)
+
+func main() {
+	name := flag.String("scenario", "", "scenario to run, all scenarios by default")
+	seed := flag.Int64("seed", 1, "seed of random delays and losses")
+	latency := flag.Duration("latency", time.Millisecond * 20, "delay of messages")
+	jitter := flag.Duration("jitter", time.Millisecond * 10, "random part of the delay")
+	loss := flag.Float64("loss", 0, "probability that a message or a connection is lost")
+	verbose := flag.Bool("v", false, "print logs of nodes")
+	flag.Parse()
+
+	if !*verbose {
+		log.SetOutput(ioutil.Discard)
+	}
+
+	scenarios := simulation.Scenarios
+	if *name != "" {
+		scenario, ok := simulation.FindScenario(*name)
+		if !ok {
+			fmt.Printf("Unknown scenario %s\n", *name)
+			os.Exit(2)
+		}
+		scenarios = []simulation.Scenario{scenario}
+	}
+
+	failed := false
+	for _, scenario := range scenarios {
+		fmt.Printf("%s: %s\n", scenario.Name, scenario.Description)
+
+		s, err := simulation.New(*seed)
+		if err != nil {
+			fmt.Println("Failed:", err)
+			os.Exit(1)
+		}
+		s.Net.SetLatency(*latency, *jitter)
+		s.Net.SetLoss(*loss)
+
+		start := time.Now()
+		err = scenario.Run(s)
+		s.Close()
+
+		if err != nil {
+			fmt.Printf("%s failed in %s: %s\n", scenario.Name, time.Since(start).Round(time.Millisecond), err)
+			failed = true
+			continue
+		}
+		fmt.Printf("%s passed in %s\n", scenario.Name, time.Since(start).Round(time.Millisecond))
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+}
@@ -2,10 +2,12 @@ package blockchain
 
 import (
 	"bytes"
+	"crypto/ecdsa"
 	"crypto/sha256"
 	"encoding/gob"
+	"fmt"
+	"github.com/keithzetterstrom/BibCoin/tools/base58"
 	"log"
-	"time"
 )
 
 type Block struct {
@@ -15,24 +17,42 @@ type Block struct {
 	Nonce         int
 	Height        int
 	MinerAddress string
+	// MerkleRoot is the root of the merkle tree of ids of transactions added by the stakeholder,
+	// like transactions it is not covered by proof of work. Blocks stored before it was
+	// introduced have no root
+	MerkleRoot []byte
+	// ParentRoot is MerkleRoot of the parent block, it is covered by proof of work,
+	// so the root of the block is trusted by light nodes when the next block is mined on it
+	ParentRoot []byte
 }
 
 type ExtensionBlock struct {
 	Block
 	Transactions    []*Transaction
 	StakeholderHash []byte
+	// Attempt is the attempt of the round in which the stakeholder was chosen,
+	// the stakeholder signs the extension with StakeholderPubKey. Blocks generated
+	// without a round are not signed
+	Attempt           int
+	StakeholderPubKey []byte
+	Signature         []byte
+	// VRFProof proves the output of the verifiable random function of the hash computed
+	// by the stakeholder, stakeholders of the next block are chosen by it
+	VRFProof []byte
 }
 
-// NewBlock mines and returns empty Block
-func NewBlock(prevBlockHash []byte, height int, address string) *Block {
+// NewBlock mines and returns empty Block with the given timestamp
+// committing to the merkle root of the parent
+func NewBlock(prevBlockHash, parentRoot []byte, height int, address string, targetBits int, timestamp int64) *Block {
 	block := &Block{
-		Timestamp: time.Now().Unix(),
+		Timestamp: timestamp,
 		MinerAddress: address,
 		PrevBlockHash: prevBlockHash,
 		Height: height,
+		ParentRoot: parentRoot,
 	}
 
-	pow := NewProofOfWork(block)
+	pow := NewProofOfWork(block, targetBits)
 	nonce, hash := pow.Run()
 
 	block.Hash = hash[:]
@@ -49,10 +69,63 @@ func NewExtensionBlock(transactions []*Transaction, block *Block) *ExtensionBloc
 	}
 
 	extensionBlock.StakeholderHash = []byte("hash[:]")
+	extensionBlock.MerkleRoot = MerkleRoot(transactionIDs(transactions))
 
 	return extensionBlock
 }
 
+// Sign signs the extension with the key of the stakeholder
+// and proves the VRF output of the block
+func (b *ExtensionBlock) Sign(privKey ecdsa.PrivateKey, pubKey []byte) {
+	b.StakeholderPubKey = pubKey
+	b.StakeholderHash = base58.HashPubKey(pubKey)
+	b.VRFProof = VRFProve(privKey, pubKey, b.Hash)
+	b.Signature = signData(privKey, b.signedData())
+}
+
+// VRFOutput returns the VRF output of the block proved by its stakeholder,
+// error is returned if the block has no valid proof
+func (b *ExtensionBlock) VRFOutput() ([]byte, error) {
+	return VRFVerify(b.StakeholderPubKey, b.Hash, b.VRFProof)
+}
+
+// signedData returns hash of the fields of the extension covered by the signature,
+// transactions are covered by the merkle root. Height is signed too, so the signature
+// can not be claimed for another height in evidence of double signing
+func (b *ExtensionBlock) signedData() []byte {
+	data := sha256.Sum256(bytes.Join(
+		[][]byte{b.Hash, IntToHex(int64(b.Height)), IntToHex(int64(b.Attempt)), b.MerkleRoot, b.StakeholderPubKey, b.VRFProof},
+		[]byte{},
+	))
+
+	return data[:]
+}
+
+// VerifySignature returns InvalidBlockError if the extension is not signed,
+// signed wrong or its VRF proof is invalid. The proof is required if vrf is true,
+// that is when stakeholders of the next block are chosen by it
+func (b *ExtensionBlock) VerifySignature(vrf bool) error {
+	if len(b.Signature) == 0 {
+		return &InvalidBlockError{fmt.Sprintf("Extension of block %x is not signed ", b.Hash)}
+	}
+
+	if !bytes.Equal(b.StakeholderHash, base58.HashPubKey(b.StakeholderPubKey)) ||
+		!verifyData(b.StakeholderPubKey, b.signedData(), b.Signature) {
+		return &InvalidBlockError{fmt.Sprintf("Extension of block %x has invalid signature ", b.Hash)}
+	}
+
+	if !vrf && len(b.VRFProof) == 0 {
+		return nil
+	}
+
+	_, err := b.VRFOutput()
+	if err != nil {
+		return &InvalidBlockError{fmt.Sprintf("Extension of block %x has no valid VRF proof ", b.Hash)}
+	}
+
+	return nil
+}
+
 // Serialize serializes ExtensionBlock into bytes
 func (b *ExtensionBlock) Serialize() []byte {
 	var result bytes.Buffer
@@ -105,6 +178,19 @@ func DeserializeExtensionBlock(d []byte) (*ExtensionBlock, error) {
 	return &block, nil
 }
 
+// checkMerkleRoot returns InvalidBlockError if transactions of the block do not match its merkle root
+func (b *ExtensionBlock) checkMerkleRoot() error {
+	if len(b.MerkleRoot) == 0 {
+		return nil
+	}
+
+	if !bytes.Equal(b.MerkleRoot, MerkleRoot(transactionIDs(b.Transactions))) {
+		return &InvalidBlockError{fmt.Sprintf("Block %x has wrong merkle root ", b.Hash)}
+	}
+
+	return nil
+}
+
 // HashTransactions returns sum256 hash of Transactions in ExtensionBlock
 func (b *ExtensionBlock) HashTransactions() []byte {
 	var txHashes [][]byte
@@ -3,31 +3,56 @@ package blockchain
 import (
 	"bytes"
 	"crypto/ecdsa"
-	"encoding/hex"
 	"errors"
 	"fmt"
 	"github.com/boltdb/bolt"
+	walletpkg "github.com/keithzetterstrom/BibCoin/internal/pkg/wallet"
 	"github.com/keithzetterstrom/BibCoin/tools/base58"
-	"io"
 	"log"
 	"os"
+	"sync"
 )
 
 const (
 	errorDataBaseNotExist         = "database is not exists"
 	errorStakeholderIndexNotFound = "Stakeholder index not found "
+	errorBlockExists              = "Block already exists "
 )
 
+// ErrStakeholderIndexNotFound is returned by ExtendBlock when the node does not own
+// the satoshi chosen by the block, so it is not the stakeholder of the block
+var ErrStakeholderIndexNotFound = errors.New(errorStakeholderIndexNotFound)
+
+// ErrBlockExists is returned by AddBlock when the block is already stored
+var ErrBlockExists = errors.New(errorBlockExists)
+
+// InvalidBlockError is returned when the block breaks consensus rules,
+// unlike other errors it means that the node sent the block is misbehaving
+type InvalidBlockError struct {
+	Reason string
+}
+
+func (e *InvalidBlockError) Error() string {
+	return e.Reason
+}
+
 type Blockchain struct {
 	Tip []byte
 	Db  *bolt.DB
 	AddrFile, WalletFile string
-}
-
-// newGenesisBlock returns newly created genesis block
-func newGenesisBlock(coinbase *Transaction) *ExtensionBlock {
-	block := NewBlock([]byte{}, 1, "")
-	return NewExtensionBlock([]*Transaction{coinbase}, block)
+	Params *ChainParams
+	// PruneDepth is the number of last blocks stored with full data, 0 - all blocks are stored
+	PruneDepth int
+	// Light is true if only headers and transactions of the wallet are stored
+	Light bool
+
+	// connected and disconnected are blocks added to the chain and removed
+	// from it by reorganizations, mem pool is updated with their transactions
+	mu           sync.Mutex
+	connected    []*ExtensionBlock
+	disconnected []*ExtensionBlock
+	// doubleSigns are evidence of stakeholders which signed two extensions at the same height
+	doubleSigns []*DoubleSign
 }
 
 // GetBlock returns ExtensionBlock from blockchain by block's hash
@@ -41,6 +66,9 @@ func (bc *Blockchain) GetBlock(blockHash []byte) (ExtensionBlock, error) {
 		blockData := b.Get(blockHash)
 
 		if blockData == nil {
+			if tx.Bucket([]byte(HeadersBucket)).Get(blockHash) != nil {
+				return errors.New(errorBlockPruned)
+			}
 			return errors.New("Block is not found. ")
 		}
 
@@ -52,39 +80,47 @@ func (bc *Blockchain) GetBlock(blockHash []byte) (ExtensionBlock, error) {
 		return nil
 	})
 	if err != nil {
-		return *block, err
+		return ExtensionBlock{}, err
 	}
 
 	return *block, nil
 }
 
-// GetBlockHashes returns all blocks hashes from blockchain
-func (bc *Blockchain) GetBlockHashes() [][]byte {
-	var blocks [][]byte
-	bci := bc.NewIterator()
+// HasBlock returns true if full data of the block is stored in blockchain
+func (bc *Blockchain) HasBlock(blockHash []byte) bool {
+	exists := false
 
-	for {
-		block := bci.Next()
+	_ = bc.Db.View(func(tx *bolt.Tx) error {
+		exists = tx.Bucket([]byte(BlocksBucket)).Get(blockHash) != nil
+		return nil
+	})
 
-		blocks = append(blocks, block.Hash)
+	return exists
+}
 
-		if len(block.PrevBlockHash) == 0 {
-			break
-		}
-	}
+// HasHeader returns true if header of the block is stored in blockchain
+func (bc *Blockchain) HasHeader(blockHash []byte) bool {
+	exists := false
 
-	return blocks
+	_ = bc.Db.View(func(tx *bolt.Tx) error {
+		exists = tx.Bucket([]byte(HeadersBucket)).Get(blockHash) != nil
+		return nil
+	})
+
+	return exists
 }
 
 // MineBlock mines and returns empty Block
 func (bc *Blockchain) MineBlock(minerAddress string) *Block {
-	var lastHash []byte
+	var lastHash, lastRoot []byte
 	var lastHeight int
+	var lastTimestamp int64
 
 	// находим последний хнш и высоту относительно генезис блока
 	err := bc.Db.View(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(BlocksBucket))
-		lastHash = b.Get([]byte("l"))
+		// значения bolt действительны только внутри транзакции
+		lastHash = append([]byte{}, b.Get([]byte("l"))...)
 
 		blockData := b.Get(lastHash)
 		block, err := DeserializeExtensionBlock(blockData)
@@ -93,6 +129,8 @@ func (bc *Blockchain) MineBlock(minerAddress string) *Block {
 		}
 
 		lastHeight = block.Height
+		lastRoot = block.MerkleRoot
+		lastTimestamp = block.Timestamp
 
 		return nil
 	})
@@ -100,145 +138,211 @@ func (bc *Blockchain) MineBlock(minerAddress string) *Block {
 		log.Panic(err)
 	}
 
-	newBlock := NewBlock(lastHash, lastHeight + 1, minerAddress)
+	// the timestamp must be after the parent even if blocks are mined within a second
+	timestamp := bc.Now().Unix()
+	if timestamp <= lastTimestamp {
+		timestamp = lastTimestamp + 1
+	}
+
+	newBlock := NewBlock(lastHash, lastRoot, lastHeight + 1, minerAddress, bc.Params.TargetBits, timestamp)
 
 	return newBlock
 }
 
-// AddBlock adds given ExtensionBlock to blockchain
+// AddBlock adds given ExtensionBlock to blockchain, the block may be received
+// after its header, the tip is moved when all blocks below it are downloaded.
+// The stake of the block on top of the chain is checked before it is stored,
+// stakes of other blocks are checked when they are connected
 func (bc *Blockchain) AddBlock(block *ExtensionBlock) error {
-	err := bc.Db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(BlocksBucket))
-		blockInDb := b.Get(block.Hash)
+	if !NewProofOfWork(&block.Block, bc.Params.TargetBits).Validate() {
+		return &InvalidBlockError{fmt.Sprintf("Block %x has invalid proof of work ", block.Hash)}
+	}
 
-		if blockInDb != nil {
-			return errors.New("Block already exists ")
+	err := bc.checkTimestamp(&block.Block)
+	if err != nil {
+		return err
+	}
+
+	err = block.VerifySignature(bc.Params.StakeVRF)
+	if err != nil {
+		return err
+	}
+
+	err = bc.Db.Update(func(tx *bolt.Tx) error {
+		if bytes.Equal(block.PrevBlockHash, tx.Bucket([]byte(BlocksBucket)).Get([]byte("l"))) {
+			err := bc.connectedStake(tx, block)
+			if err != nil {
+				return err
+			}
 		}
 
-		blockData := block.Serialize()
-		err := b.Put(block.Hash, blockData)
+		err := bc.checkDoubleSign(tx, block)
 		if err != nil {
-			log.Panic(err)
+			return err
 		}
 
-		lastHash := b.Get([]byte("l"))
-		lastBlockData := b.Get(lastHash)
-		lastBlock, err := DeserializeExtensionBlock(lastBlockData)
-		if errors.Is(err, io.EOF) {
-			err = b.Put([]byte("l"), block.Hash)
-			if err != nil {
-				log.Panic(err)
+		if tx.Bucket([]byte(HeadersBucket)).Get(block.Hash) != nil {
+			if tx.Bucket([]byte(BlocksBucket)).Get(block.Hash) == nil {
+				return storeBody(tx, block)
 			}
-			bc.Tip = block.Hash
-			return nil
+			return ErrBlockExists
 		}
+
+		err = bc.storeBlock(tx, block)
 		if err != nil {
-			log.Panic(err)
+			return err
 		}
 
-		if block.Height > lastBlock.Height {
-			err = b.Put([]byte("l"), block.Hash)
-			if err != nil {
-				log.Panic(err)
-			}
-			bc.Tip = block.Hash
-			return nil
+		if tx.Bucket([]byte(BlocksBucket)).Get([]byte("l")) == nil {
+			return bc.setTip(tx, block.Hash)
 		}
 
 		return nil
 	})
-	return err
+	if err != nil {
+		return err
+	}
+
+	return bc.connectBestChain(block.Hash)
 }
 
-// AddNewBlock creates and adds ExtensionBlock to blockchain
-func (bc *Blockchain) AddNewBlock(newBlock *Block, transactions []*Transaction, address string) (*ExtensionBlock, error) {
+// checkTimestamp returns error if the block is mined too far ahead of the clock of the node,
+// the timestamp limits attempts of the block. The block may be accepted later
+func (bc *Blockchain) checkTimestamp(block *Block) error {
+	if block.Timestamp > bc.Now().Add(bc.Params.MaxTimeDrift).Unix() {
+		return fmt.Errorf("Block %x has timestamp too far in the future ", block.Hash)
+	}
+
+	return nil
+}
+
+// AddNewBlock creates, signs with the wallet and adds ExtensionBlock to blockchain
+func (bc *Blockchain) AddNewBlock(newBlock *Block, transactions []*Transaction, wallet *walletpkg.Wallet) (*ExtensionBlock, error) {
+	address := string(wallet.GetAddress(bc.Params.AddressVersion))
+
+	extensionBlock, err := bc.ExtendBlock(newBlock, 0, transactions, address)
+	if err != nil {
+		return nil, err
+	}
+	extensionBlock.Sign(wallet.PrivateKey, wallet.PublicKey)
+
+	// добавляем новый блок в бд
+	err = bc.Db.Update(func(tx *bolt.Tx) error {
+		err := bc.storeBlock(tx, extensionBlock)
+		if err != nil {
+			return err
+		}
+
+		return bc.setTip(tx, extensionBlock.Hash)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return extensionBlock, nil
+}
+
+// ExtendBlock returns ExtensionBlock with valid transactions for the attempt of the round
+// of the mined empty Block, ErrStakeholderIndexNotFound is returned if the address
+// is not the stakeholder chosen for the attempt. The extension is not stored
+func (bc *Blockchain) ExtendBlock(newBlock *Block, attempt int, transactions []*Transaction, address string) (*ExtensionBlock, error) {
 	// проверяем работу майнера
-	pow := NewProofOfWork(newBlock)
-	pow.prepareData(newBlock.Nonce)
+	pow := NewProofOfWork(newBlock, bc.Params.TargetBits)
 	if !pow.Validate() {
-		return nil, errors.New("Block invalid ")
+		return nil, &InvalidBlockError{"Block invalid "}
 	}
 
-	// проверяем, является ли стейклолдер избранным
-	lastIndex, err := bc.GetLastSatoshiIndex()
+	err := bc.checkTimestamp(newBlock)
 	if err != nil {
-		return nil, fmt.Errorf("Failed to add new block: %s ", err)
+		return nil, err
 	}
-	stakeholderIndex := GetStakeholderIndexByHash(newBlock.Hash, lastIndex)
 
+	// проверяем, является ли стейклолдер избранным
 	pubKeyHash := base58.DecodeBase58([]byte(address))
 	pubKeyHash = pubKeyHash[1 : len(pubKeyHash) - 4]
 
-	if !bc.checkStakeholderIndex(stakeholderIndex, pubKeyHash) {
-		return nil, errors.New(errorStakeholderIndexNotFound)
+	err = bc.CheckStakeholder(newBlock, attempt, pubKeyHash)
+	if err == ErrStakeholderIndexNotFound {
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to add new block: %s ", err)
 	}
 
 	// проверяем транзакции перед записью в блок
 	var validTx []*Transaction
+	spent := make(map[string]bool)
+	delegated := make(map[string]bool)
+	slashed := make(map[string]bool)
 
-	subsidyArr := make([]int, subsidy)
-	for i := 0; i < subsidy; i++  {
-		subsidyArr[i] = i + lastIndex
-	}
-
+Transactions:
 	for _, tx := range transactions {
 		if !bc.VerifyTransaction(tx) {
 			log.Println("Invalid transaction")
 			continue
 		}
-		validTx = append(validTx, tx)
-	}
 
-	extensionBlock := NewExtensionBlock(validTx, newBlock)
-
-	// добавляем новый блок в бд
-	err = bc.Db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(BlocksBucket))
-		err := b.Put(extensionBlock.Hash, extensionBlock.Serialize())
-		if err != nil {
-			log.Panic(err)
+		// outputs are delegated before they are spent by later transactions of the block
+		if tx.IsDelegation() {
+			delegation, _ := tx.Delegation()
+			for _, out := range delegation.Outputs {
+				key := fmt.Sprintf("%x:%d", out.TxID, out.Index)
+				if spent[key] || delegated[key] {
+					log.Println("Delegation of spent or delegated output")
+					continue Transactions
+				}
+			}
+			for _, out := range delegation.Outputs {
+				delegated[fmt.Sprintf("%x:%d", out.TxID, out.Index)] = true
+			}
 		}
 
-		err = b.Put([]byte("l"), extensionBlock.Hash)
-		if err != nil {
-			log.Panic(err)
+		// the same double signing is slashed once
+		if tx.IsEvidence() {
+			evidence, _ := tx.DoubleSign()
+			key := string(evidence.key())
+			if slashed[key] {
+				log.Println("Evidence of slashed double signing")
+				continue
+			}
+			slashed[key] = true
 		}
 
-		bc.Tip = extensionBlock.Hash
+		if !tx.IsCoinbase() && !tx.IsEvidence() && !tx.IsDelegation() {
+			for _, vin := range tx.Vin {
+				if spent[fmt.Sprintf("%x:%d", vin.OutTxID, vin.OutIndex)] {
+					log.Println("Double spending transaction")
+					continue Transactions
+				}
+			}
+			for _, vin := range tx.Vin {
+				spent[fmt.Sprintf("%x:%d", vin.OutTxID, vin.OutIndex)] = true
+			}
+		}
 
-		return nil
-	})
-	if err != nil {
-		return nil, err
+		validTx = append(validTx, tx)
 	}
 
+	extensionBlock := NewExtensionBlock(validTx, newBlock)
+	extensionBlock.Attempt = attempt
+
 	return extensionBlock, nil
 }
 
-// AddGenesisBlock adds genesis block to blockchain
-func (bc *Blockchain) AddGenesisBlock(address string) {
-	err := bc.Db.Update(func(tx *bolt.Tx) error {
-		lastIndex, err := bc.GetLastSatoshiIndex()
-		if err != nil {
-			fmt.Println(err)
-		}
-		cbtx := NewCoinbaseTX(address, address, genesisCoinbaseData, lastIndex)
-		genesis := newGenesisBlock(cbtx)
-
-		b := tx.Bucket([]byte(BlocksBucket))
-
-		err = b.Put(genesis.Hash, genesis.Serialize())
-		if err != nil {
-			log.Panic(err)
-		}
+// AddGenesisBlock adds genesis block of the network to blockchain
+func (bc *Blockchain) AddGenesisBlock() {
+	genesis, err := GenesisBlock(bc.Params)
+	if err != nil {
+		log.Panic(err)
+	}
 
-		err = b.Put([]byte("l"), genesis.Hash)
+	err = bc.Db.Update(func(tx *bolt.Tx) error {
+		err := bc.storeBlock(tx, genesis)
 		if err != nil {
-			log.Panic(err)
+			return err
 		}
-		bc.Tip = genesis.Hash
 
-		return nil
+		return bc.setTip(tx, genesis.Hash)
 	})
 
 	if err != nil {
@@ -252,6 +356,9 @@ func (bc *Blockchain) FindTransaction(ID []byte) (Transaction, error) {
 
 	for {
 		block := bci.Next()
+		if block == nil {
+			break
+		}
 
 		for _, tx := range block.Transactions {
 			if bytes.Compare(tx.ID, ID) == 0 {
@@ -267,93 +374,6 @@ func (bc *Blockchain) FindTransaction(ID []byte) (Transaction, error) {
 	return Transaction{}, errors.New("Transaction is not found ")
 }
 
-// FindUnspentTransactions returns unspent transactions found by public key hash
-func (bc *Blockchain) FindUnspentTransactions(pubKeyHash []byte) []Transaction {
-	var unspentTransactions []Transaction
-	spentTXOs := make(map[string][]int)
-	bci := bc.NewIterator()
-
-	for {
-		block := bci.Next()
-
-		for _, tx := range block.Transactions {
-			txID := hex.EncodeToString(tx.ID)
-
-		Outputs:
-			for outIdx, out := range tx.Vout {
-				if spentTXOs[txID] != nil {
-					for _, spentOut := range spentTXOs[txID] {
-						if spentOut == outIdx {
-							continue Outputs
-						}
-					}
-				}
-
-				if out.IsLockedWithKey(pubKeyHash) {
-					unspentTransactions = append(unspentTransactions, *tx)
-				}
-			}
-
-			if tx.IsCoinbase() == false {
-				for _, in := range tx.Vin {
-					if in.UsesKey(pubKeyHash) {
-						inTxID := hex.EncodeToString(in.OutTxID)
-						spentTXOs[inTxID] = append(spentTXOs[inTxID], in.OutIndex)
-					}
-				}
-			}
-		}
-
-		if len(block.PrevBlockHash) == 0 {
-			break
-		}
-	}
-
-	return unspentTransactions
-}
-
-// FindUnspentTxOutputs returns unspent transactions outputs found by public key hash
-func (bc *Blockchain) FindUnspentTxOutputs(pubKeyHash []byte) []TXOutput {
-	var txOutputs []TXOutput
-	unspentTransactions := bc.FindUnspentTransactions(pubKeyHash)
-
-	for _, tx := range unspentTransactions {
-		for _, out := range tx.Vout {
-			if out.IsLockedWithKey(pubKeyHash) {
-				txOutputs = append(txOutputs, out)
-			}
-		}
-	}
-
-	return txOutputs
-}
-
-// FindSpendableOutputs returns transactions outputs by public key hash
-// and amount of satoshies which could be spent
-func (bc *Blockchain) FindSpendableOutputs(pubKeyHash []byte, amount int) ([]int, map[string][]int) {
-	unspentOutputs := make(map[string][]int)
-	unspentTXs := bc.FindUnspentTransactions(pubKeyHash)
-	var accumulated []int
-
-Work:
-	for _, tx := range unspentTXs {
-		txID := hex.EncodeToString(tx.ID)
-
-		for outIdx, out := range tx.Vout {
-			if out.IsLockedWithKey(pubKeyHash) && len(accumulated) < amount {
-				accumulated = append(accumulated, out.Value...)
-				unspentOutputs[txID] = append(unspentOutputs[txID], outIdx)
-
-				if len(accumulated) >= amount {
-					break Work
-				}
-			}
-		}
-	}
-
-	return accumulated, unspentOutputs
-}
-
 // dbExists returns true if database exists
 func dbExists(dbFile string) bool {
 	if _, err := os.Stat(dbFile); os.IsNotExist(err) {
@@ -365,36 +385,34 @@ func dbExists(dbFile string) bool {
 
 // SignTransaction signs Transaction with ecdsa.PrivateKey
 func (bc *Blockchain) SignTransaction(tx *Transaction, privKey ecdsa.PrivateKey) {
-	prevTXs := make(map[string]Transaction)
-
-	for _, vin := range tx.Vin {
-		prevTX, err := bc.FindTransaction(vin.OutTxID)
-		if err != nil {
-			log.Panic(err)
-		}
-		prevTXs[hex.EncodeToString(prevTX.ID)] = prevTX
+	prevTXs, err := bc.getPrevTransactions(tx)
+	if err != nil {
+		log.Panic(err)
 	}
 
 	tx.Sign(privKey, prevTXs)
 }
 
 // VerifyTransaction returns true if Transaction is valid
-func (bc *Blockchain) VerifyTransaction(tx *Transaction) bool {
-	if tx.IsCoinbase() {
+func (bc *Blockchain) VerifyTransaction(tnx *Transaction) bool {
+	if tnx.IsCoinbase() {
 		return true
 	}
 
-	prevTXs := make(map[string]Transaction)
+	if tnx.IsEvidence() {
+		evidence, err := tnx.checkEvidence()
+		return err == nil && !bc.IsEvidenceProcessed(evidence)
+	}
 
-	for _, vin := range tx.Vin {
-		prevTX, err := bc.FindTransaction(vin.OutTxID)
-		if err != nil {
-			log.Panic(err)
-		}
-		prevTXs[hex.EncodeToString(prevTX.ID)] = prevTX
+	if tnx.IsDelegation() {
+		return bc.verifyDelegation(tnx) == nil
 	}
 
-	return tx.Verify(prevTXs)
+	err := bc.Db.View(func(tx *bolt.Tx) error {
+		return verifySpending(tx.Bucket([]byte(utxoBucket)), tnx)
+	})
+
+	return err == nil
 }
 
 // GetBestHeight returns best height of blockchain
@@ -440,8 +458,14 @@ func (bc *Blockchain) GetLastSatoshiIndex() (int, error) {
 		return 0, err
 	}
 
+	return lastSatoshiIndex(lastBlock), nil
+}
+
+// lastSatoshiIndex returns last satoshi index in the chain ending with the block,
+// it is the index of the first satoshi of the next block
+func lastSatoshiIndex(block *ExtensionBlock) int {
 	maxIndex := 0
-	for _, tx := range lastBlock.Transactions {
+	for _, tx := range block.Transactions {
 		if tx.IsCoinbase() {
 			for _, txOut := range tx.Vout{
 				max := txOut.Value.GetMaxIndex(txOut.Value)
@@ -452,23 +476,11 @@ func (bc *Blockchain) GetLastSatoshiIndex() (int, error) {
 		}
 	}
 
-	return maxIndex + 1, nil
-}
-
-// checkStakeholderIndex returns true if satoshi index is owned by the given public key
-func (bc *Blockchain) checkStakeholderIndex(stakeholderIndex int, pubKeyHash []byte) bool {
-	unspentTxOutputs := bc.FindUnspentTxOutputs(pubKeyHash)
-
-	for _, out := range unspentTxOutputs {
-		if out.Value.FindIndex(out.Value, stakeholderIndex) {
-			return true
-		}
-	}
-	return false
+	return maxIndex + 1
 }
 
 // NewBlockchain returns new instance of existing in database Blockchain
-func NewBlockchain(dbFile, addrFile, walletFile string) (*Blockchain, error) {
+func NewBlockchain(dbFile, addrFile, walletFile string, params *ChainParams) (*Blockchain, error) {
 	if !dbExists(dbFile) {
 		return nil, errors.New(errorDataBaseNotExist)
 	}
@@ -479,28 +491,48 @@ func NewBlockchain(dbFile, addrFile, walletFile string) (*Blockchain, error) {
 		log.Panic(err)
 	}
 
+	bc := Blockchain{
+		Db: db,
+		AddrFile: addrFile,
+		WalletFile: walletFile,
+		Params: params,
+	}
+
 	err = db.Update(func(tx *bolt.Tx) error {
+		err := createBuckets(tx)
+		if err != nil {
+			return err
+		}
+
 		b := tx.Bucket([]byte(BlocksBucket))
-		tip = b.Get([]byte("l"))
+		if lastHash := b.Get([]byte("l")); lastHash != nil {
+			tip = append([]byte{}, lastHash...)
+		}
+		bc.Tip = tip
+		bc.loadPruneDepth(tx)
+		bc.loadLightMode(tx)
 
-		return nil
+		err = bc.migrate(tx)
+		if err != nil {
+			return err
+		}
+
+		err = initHeaderChain(tx)
+		if err != nil {
+			return err
+		}
+
+		return bc.checkGenesis(tx)
 	})
 	if err != nil {
-		log.Println("Blockchain is empty")
-	}
-
-	bc := Blockchain{
-		Tip: tip,
-		Db: db,
-		AddrFile: addrFile,
-		WalletFile: walletFile,
+		log.Panic(err)
 	}
 
 	return &bc, nil
 }
 
 // CreateEmptyBlockchain creates empty Blockchain and returns Blockchain instance
-func CreateEmptyBlockchain(dbFile, addrFile, walletFile string) *Blockchain {
+func CreateEmptyBlockchain(dbFile, addrFile, walletFile string, params *ChainParams) *Blockchain {
 	if dbExists(dbFile) {
 		log.Println("Blockchain already exists.")
 		os.Exit(1)
@@ -513,7 +545,7 @@ func CreateEmptyBlockchain(dbFile, addrFile, walletFile string) *Blockchain {
 	}
 
 	err = db.Update(func(tx *bolt.Tx) error {
-		_, err := tx.CreateBucket([]byte(BlocksBucket))
+		err := createBuckets(tx)
 		if err != nil {
 			log.Panic(err)
 		}
@@ -526,6 +558,7 @@ func CreateEmptyBlockchain(dbFile, addrFile, walletFile string) *Blockchain {
 		Db: db,
 		AddrFile: addrFile,
 		WalletFile: walletFile,
+		Params: params,
 	}
 
 	return &bc
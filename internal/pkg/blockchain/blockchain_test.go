@@ -0,0 +1,76 @@
+package blockchain
+
+import (
+	walletpkg "github.com/keithzetterstrom/BibCoin/internal/pkg/wallet"
+	"github.com/keithzetterstrom/BibCoin/tools/base58"
+	"path/filepath"
+	"testing"
+)
+
+// newTestBlockchain returns regtest Blockchain with the given number of blocks
+// generated on genesis, the wallet gets all rewards and signs extensions
+func newTestBlockchain(t *testing.T, blocks int) (*Blockchain, *walletpkg.Wallet) {
+	t.Helper()
+
+	params := RegTestParams
+	dir := t.TempDir()
+
+	bc := CreateEmptyBlockchain(filepath.Join(dir, "blockchain.db"), filepath.Join(dir, "addr.json"), filepath.Join(dir, "wallet.dat"), &params)
+	t.Cleanup(func() {
+		bc.Db.Close()
+	})
+	bc.AddGenesisBlock()
+
+	wallet := walletpkg.NewWallet()
+	_, err := bc.GenerateBlocks(blocks, wallet, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return bc, wallet
+}
+
+// stakeTestBlock returns the block mined on the tip with the coinbase paying to the miner
+// and the transactions, it is signed by the wallet in the first attempt the wallet is chosen for.
+// Transactions are not verified and the block is not added
+func stakeTestBlock(t *testing.T, bc *Blockchain, wallet *walletpkg.Wallet, minerAddress string, transactions []*Transaction) *ExtensionBlock {
+	t.Helper()
+
+	address := string(wallet.GetAddress(bc.Params.AddressVersion))
+	block := bc.MineBlock(minerAddress)
+
+	lastIndex, err := bc.GetLastSatoshiIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cbTx := NewCoinbaseTX(minerAddress, address, "", lastIndex, bc.Params.Subsidy)
+
+	for attempt := 0; attempt < bc.Params.MaxStakeAttempts; attempt++ {
+		err = bc.CheckStakeholder(block, attempt, base58.HashPubKey(wallet.PublicKey))
+		if err == ErrStakeholderIndexNotFound {
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		extension := NewExtensionBlock(append([]*Transaction{cbTx}, transactions...), block)
+		extension.Attempt = attempt
+		extension.Sign(wallet.PrivateKey, wallet.PublicKey)
+
+		return extension
+	}
+
+	t.Fatal("Wallet is not chosen in any attempt")
+	return nil
+}
+
+// balance returns the number of satoshis of the wallet in the UTXO set
+func balance(bc *Blockchain, wallet *walletpkg.Wallet) int {
+	total := 0
+	for _, out := range bc.FindUnspentTxOutputs(base58.HashPubKey(wallet.PublicKey)) {
+		total += len(out.Value)
+	}
+
+	return total
+}
@@ -0,0 +1,395 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/boltdb/bolt"
+)
+
+const (
+	errorHeaderNotFound = "Block header is not found "
+	errorParentNotFound = "Parent block is not found "
+	errorBlockPruned    = "Block is pruned "
+)
+
+// maxRecordedBlocks is the number of connected and disconnected blocks kept for mem pool
+const maxRecordedBlocks = 100
+
+var pruneDepthKey = []byte("prunedepth")
+
+// getHeader returns header of the block with given hash
+func getHeader(tx *bolt.Tx, hash []byte) (*Block, error) {
+	data := tx.Bucket([]byte(HeadersBucket)).Get(hash)
+	if data == nil {
+		return nil, errors.New(errorHeaderNotFound)
+	}
+
+	return DeserializeBlock(data)
+}
+
+// getBody returns full ExtensionBlock with given hash
+func getBody(tx *bolt.Tx, hash []byte) (*ExtensionBlock, error) {
+	data := tx.Bucket([]byte(BlocksBucket)).Get(hash)
+	if data == nil {
+		return nil, errors.New(errorBlockPruned)
+	}
+
+	return DeserializeExtensionBlock(data)
+}
+
+// checkParentRoot returns InvalidBlockError if the block does not commit to the merkle
+// root of its parent, light nodes trust roots of blocks by the commitments of their children
+func checkParentRoot(tx *bolt.Tx, block *ExtensionBlock) error {
+	if len(block.PrevBlockHash) == 0 {
+		return nil
+	}
+
+	parent, err := getHeader(tx, block.PrevBlockHash)
+	if err != nil {
+		return err
+	}
+
+	if !bytes.Equal(parent.MerkleRoot, block.ParentRoot) {
+		return &InvalidBlockError{fmt.Sprintf("Block %x does not commit to merkle root of its parent ", block.Hash)}
+	}
+
+	return nil
+}
+
+// storeBlock puts header and body of the given block into database
+func (bc *Blockchain) storeBlock(tx *bolt.Tx, block *ExtensionBlock) error {
+	err := block.checkMerkleRoot()
+	if err != nil {
+		return err
+	}
+
+	err = bc.storeHeader(tx, &block.Block)
+	if err != nil {
+		return err
+	}
+
+	return tx.Bucket([]byte(BlocksBucket)).Put(block.Hash, block.Serialize())
+}
+
+// setTip makes the block with given hash the tip of the chain: blocks of the
+// old branch are disconnected from the UTXO set and blocks of the new branch are connected
+func (bc *Blockchain) setTip(tx *bolt.Tx, hash []byte) error {
+	b := tx.Bucket([]byte(BlocksBucket))
+
+	branch, err := getHeader(tx, hash)
+	if err != nil {
+		return err
+	}
+
+	var toConnect []*Block
+	var connected, disconnected []*ExtensionBlock
+
+	oldTipHash := b.Get([]byte("l"))
+	if oldTipHash == nil {
+		for {
+			toConnect = append(toConnect, branch)
+			if len(branch.PrevBlockHash) == 0 {
+				break
+			}
+
+			branch, err = getHeader(tx, branch.PrevBlockHash)
+			if err != nil {
+				return err
+			}
+		}
+	} else {
+		fork, err := getHeader(tx, oldTipHash)
+		if err != nil {
+			return err
+		}
+
+		for branch.Height > fork.Height {
+			toConnect = append(toConnect, branch)
+			branch, err = getHeader(tx, branch.PrevBlockHash)
+			if err != nil {
+				return err
+			}
+		}
+
+		for !bytes.Equal(fork.Hash, branch.Hash) {
+			if fork.Height >= branch.Height {
+				block, err := getBody(tx, fork.Hash)
+				if err != nil {
+					return err
+				}
+				disconnected = append(disconnected, block)
+
+				fork, err = disconnectBlock(tx, fork)
+				if err != nil {
+					return err
+				}
+			}
+
+			if branch.Height > fork.Height {
+				toConnect = append(toConnect, branch)
+				branch, err = getHeader(tx, branch.PrevBlockHash)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	for i := len(toConnect) - 1; i >= 0; i-- {
+		block, err := getBody(tx, toConnect[i].Hash)
+		if err != nil {
+			return err
+		}
+
+		err = checkParentRoot(tx, block)
+		if err != nil {
+			return err
+		}
+
+		err = bc.connectedStake(tx, block)
+		if err != nil {
+			return err
+		}
+
+		err = connectUTXO(tx, block, bc.Params.Subsidy)
+		if err != nil {
+			return err
+		}
+		connected = append(connected, block)
+	}
+
+	err = b.Put([]byte("l"), hash)
+	if err != nil {
+		return err
+	}
+	bc.Tip = hash
+	bc.recordChanges(connected, disconnected)
+
+	if bc.PruneDepth > 0 {
+		tip, err := getHeader(tx, hash)
+		if err != nil {
+			return err
+		}
+
+		return bc.prune(tx, tip)
+	}
+
+	return nil
+}
+
+// recordChanges remembers blocks connected to the chain and disconnected from it,
+// only the last maxRecordedBlocks of each are kept until they are taken
+func (bc *Blockchain) recordChanges(connected, disconnected []*ExtensionBlock) {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+
+	bc.connected = append(bc.connected, connected...)
+	if len(bc.connected) > maxRecordedBlocks {
+		bc.connected = bc.connected[len(bc.connected) - maxRecordedBlocks:]
+	}
+
+	bc.disconnected = append(bc.disconnected, disconnected...)
+	if len(bc.disconnected) > maxRecordedBlocks {
+		bc.disconnected = bc.disconnected[len(bc.disconnected) - maxRecordedBlocks:]
+	}
+}
+
+// TakeChainChanges returns blocks connected to the chain and disconnected from it
+// since the previous call. The update which changed the chain may have failed,
+// so transactions of the blocks must be validated again by their users
+func (bc *Blockchain) TakeChainChanges() ([]*ExtensionBlock, []*ExtensionBlock) {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+
+	connected, disconnected := bc.connected, bc.disconnected
+	bc.connected, bc.disconnected = nil, nil
+
+	return connected, disconnected
+}
+
+// disconnectBlock reverts the given block in the UTXO set and returns its parent header
+func disconnectBlock(tx *bolt.Tx, header *Block) (*Block, error) {
+	block, err := getBody(tx, header.Hash)
+	if err != nil {
+		return nil, err
+	}
+
+	err = disconnectUTXO(tx, block)
+	if err != nil {
+		return nil, err
+	}
+
+	return getHeader(tx, header.PrevBlockHash)
+}
+
+// prune deletes bodies and undo data of blocks which are deeper
+// than PruneDepth below the given tip, headers are kept
+func (bc *Blockchain) prune(tx *bolt.Tx, tip *Block) error {
+	var err error
+	header := tip
+
+	for i := 0; i < bc.PruneDepth; i++ {
+		if len(header.PrevBlockHash) == 0 {
+			return nil
+		}
+
+		header, err = getHeader(tx, header.PrevBlockHash)
+		if err != nil {
+			return err
+		}
+	}
+
+	return pruneBodies(tx, header)
+}
+
+// pruneBodies deletes bodies and undo data of the block and of all stored blocks below it.
+// Blocks from the base of the loaded snapshot down to genesis are kept
+// until ValidateSnapshot replays them
+func pruneBodies(tx *bolt.Tx, header *Block) error {
+	var err error
+
+	b := tx.Bucket([]byte(BlocksBucket))
+	ub := tx.Bucket([]byte(undoBucket))
+
+	snapshot := tx.Bucket([]byte(metaBucket)).Get(snapshotKey)
+	if snapshot != nil {
+		base, err := getHeader(tx, snapshot)
+		if err != nil {
+			return err
+		}
+		if header.Height <= base.Height {
+			return nil
+		}
+	}
+
+	for b.Get(header.Hash) != nil && !bytes.Equal(header.Hash, snapshot) {
+		err = b.Delete(header.Hash)
+		if err != nil {
+			return err
+		}
+
+		err = ub.Delete(header.Hash)
+		if err != nil {
+			return err
+		}
+
+		if len(header.PrevBlockHash) == 0 {
+			break
+		}
+
+		header, err = getHeader(tx, header.PrevBlockHash)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// EnablePruning switches Blockchain to pruned mode keeping only
+// the last depth blocks with full data, the mode can not be switched off
+func (bc *Blockchain) EnablePruning(depth int) error {
+	if depth < minPruneDepth {
+		return fmt.Errorf("Prune depth must be at least %d ", minPruneDepth)
+	}
+
+	return bc.Db.Update(func(tx *bolt.Tx) error {
+		meta := tx.Bucket([]byte(metaBucket))
+		err := meta.Put(pruneDepthKey, IntToHex(int64(depth)))
+		if err != nil {
+			return err
+		}
+		bc.PruneDepth = depth
+
+		if bc.Tip == nil {
+			return nil
+		}
+
+		tip, err := getHeader(tx, bc.Tip)
+		if err != nil {
+			return err
+		}
+
+		return bc.prune(tx, tip)
+	})
+}
+
+// IsPruned returns true if Blockchain keeps only the last blocks with full data
+func (bc *Blockchain) IsPruned() bool {
+	return bc.PruneDepth > 0
+}
+
+// createBuckets creates buckets which are missing in database
+func createBuckets(tx *bolt.Tx) error {
+	for _, name := range []string{BlocksBucket, HeadersBucket, utxoBucket, undoBucket, metaBucket, headerChainBucket, filteredBucket, signersBucket, evidenceBucket} {
+		_, err := tx.CreateBucketIfNotExists([]byte(name))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// migrate fills headers and UTXO set of database created
+// before they were introduced, it walks through all stored blocks
+func (bc *Blockchain) migrate(tx *bolt.Tx) error {
+	if bc.Tip == nil || tx.Bucket([]byte(HeadersBucket)).Get(bc.Tip) != nil {
+		return nil
+	}
+
+	var blocks []*ExtensionBlock
+	hash := bc.Tip
+
+	for len(hash) != 0 {
+		block, err := getBody(tx, hash)
+		if err != nil {
+			return err
+		}
+		blocks = append(blocks, block)
+		hash = block.PrevBlockHash
+	}
+
+	for i := len(blocks) - 1; i >= 0; i-- {
+		err := tx.Bucket([]byte(HeadersBucket)).Put(blocks[i].Hash, blocks[i].Block.Serialize())
+		if err != nil {
+			return err
+		}
+
+		err = connectUTXO(tx, blocks[i], bc.Params.Subsidy)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// loadPruneDepth reads prune depth saved in database
+func (bc *Blockchain) loadPruneDepth(tx *bolt.Tx) {
+	data := tx.Bucket([]byte(metaBucket)).Get(pruneDepthKey)
+	if data != nil {
+		bc.PruneDepth = int(binary.BigEndian.Uint64(data))
+	}
+}
+
+// checkGenesis returns error if the stored chain does not start
+// from the genesis block of the network
+func (bc *Blockchain) checkGenesis(tx *bolt.Tx) error {
+	if bc.Tip == nil {
+		return nil
+	}
+
+	genesis, err := GenesisBlock(bc.Params)
+	if err != nil {
+		return err
+	}
+
+	if tx.Bucket([]byte(HeadersBucket)).Get(genesis.Hash) == nil {
+		return errors.New(errorGenesisMismatch)
+	}
+
+	return nil
+}
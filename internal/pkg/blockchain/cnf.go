@@ -1,6 +1,25 @@
 package blockchain
 
 const BlocksBucket = "blocks"
-const subsidy = 10
-const genesisCoinbaseData = "We are ExtraSafe"
-const stakeholderConst = "so"
+const HeadersBucket = "headers"
+const utxoBucket = "chainstate"
+const undoBucket = "undo"
+const metaBucket = "meta"
+
+// headerChainBucket keeps hashes of the best header chain by their heights
+const headerChainBucket = "headerchain"
+
+// filteredBucket keeps transactions of blocks matching the filter of the wallet in light mode
+const filteredBucket = "filtered"
+
+// signersBucket keeps signed extensions of blocks by their heights and public key hashes
+// of stakeholders, another extension signed at the same height is double signing
+const signersBucket = "signers"
+
+// evidenceBucket keeps hashes of blocks which slashed stakeholders by public key hashes of offenders
+// and heights of double signing, evidence of the same double signing is not processed twice
+const evidenceBucket = "evidence"
+
+// minPruneDepth is the smallest number of full blocks a pruned node keeps,
+// reorganizations deeper than that can not be handled without block bodies
+const minPruneDepth = 10
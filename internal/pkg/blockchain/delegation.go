@@ -0,0 +1,387 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"github.com/boltdb/bolt"
+	walletpkg "github.com/keithzetterstrom/BibCoin/internal/pkg/wallet"
+	"github.com/keithzetterstrom/BibCoin/tools/base58"
+	"log"
+)
+
+// delegationIndex is the output index of the input of the delegation transaction,
+// the input keeps the serialized delegation in place of the public key
+const delegationIndex = -3
+
+// DelegatedOutput is the unspent output which satoshis are staked by the delegate
+type DelegatedOutput struct {
+	TxID  []byte
+	Index int
+}
+
+// Delegation authorizes the staking key to sign extensions for satoshis of the outputs of the owner.
+// The staking key can not spend the outputs, rewards of their stakes are paid to the owner.
+// Delegation ends when the output is spent, so outputs which are already delegated
+// can not be delegated again and old delegations can not be replayed
+type Delegation struct {
+	Outputs         []DelegatedOutput
+	StakePubKeyHash []byte
+	OwnerPubKey     []byte
+	Signature       []byte
+}
+
+// NewDelegation returns Delegation of the outputs to the staking key signed with the key of the owner
+func NewDelegation(outputs []DelegatedOutput, stakePubKeyHash []byte, wallet walletpkg.Wallet) *Delegation {
+	delegation := &Delegation{
+		Outputs: outputs,
+		StakePubKeyHash: stakePubKeyHash,
+		OwnerPubKey: wallet.PublicKey,
+	}
+	delegation.Signature = signData(wallet.PrivateKey, delegation.signedData())
+
+	return delegation
+}
+
+// signedData returns hash of the fields of Delegation covered by the signature
+func (d *Delegation) signedData() []byte {
+	var data [][]byte
+	for _, out := range d.Outputs {
+		data = append(data, out.TxID, IntToHex(int64(out.Index)))
+	}
+	data = append(data, d.StakePubKeyHash, d.OwnerPubKey)
+
+	hash := sha256.Sum256(bytes.Join(data, []byte{}))
+
+	return hash[:]
+}
+
+// Owner returns public key hash of the owner of the delegated outputs
+func (d *Delegation) Owner() []byte {
+	return base58.HashPubKey(d.OwnerPubKey)
+}
+
+// Verify returns error if Delegation is not signed by the owner or its outputs are repeated
+func (d *Delegation) Verify() error {
+	if len(d.Outputs) == 0 {
+		return errors.New("Delegation has no outputs ")
+	}
+
+	if len(d.StakePubKeyHash) != len(burnPubKeyHash) || bytes.Equal(d.StakePubKeyHash, burnPubKeyHash) {
+		return fmt.Errorf("Delegation has invalid staking key hash %x ", d.StakePubKeyHash)
+	}
+
+	if bytes.Equal(d.StakePubKeyHash, d.Owner()) {
+		return errors.New("Delegation to the owner ")
+	}
+
+	seen := make(map[string]bool)
+	for _, out := range d.Outputs {
+		key := fmt.Sprintf("%x:%d", out.TxID, out.Index)
+		if seen[key] {
+			return fmt.Errorf("Delegation has output %s twice ", key)
+		}
+		seen[key] = true
+	}
+
+	if !verifyData(d.OwnerPubKey, d.signedData(), d.Signature) {
+		return errors.New("Delegation has invalid signature ")
+	}
+
+	return nil
+}
+
+// Serialize serializes Delegation into bytes
+func (d *Delegation) Serialize() []byte {
+	var result bytes.Buffer
+
+	err := gob.NewEncoder(&result).Encode(d)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return result.Bytes()
+}
+
+// NewDelegationTX returns Transaction with the delegation, it has no outputs,
+// the delegate is set to the outputs when the block with it is connected
+func NewDelegationTX(delegation *Delegation) *Transaction {
+	txin := TXInput{
+		OutTxID: []byte{},
+		OutIndex: delegationIndex,
+		PubKey: delegation.Serialize(),
+	}
+
+	tx := Transaction{Vin: []TXInput{txin}}
+	tx.ID = tx.Hash()
+
+	return &tx
+}
+
+// NewDelegationTransaction returns Transaction delegating all undelegated outputs
+// of the wallet to the staking address
+func NewDelegationTransaction(from, stakeAddr string, bc *Blockchain) (*Transaction, error) {
+	wallets, err := walletpkg.NewWallets(bc.AddrFile, bc.WalletFile, bc.Params.AddressVersion)
+	if err != nil {
+		log.Panic(err)
+	}
+	wallet, err := wallets.GetWallet(from)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get wallet: %v ", err)
+	}
+
+	stakePubKeyHash := base58.DecodeBase58([]byte(stakeAddr))
+	stakePubKeyHash = stakePubKeyHash[1 : len(stakePubKeyHash) - 4]
+
+	outputs := bc.FindUndelegatedOutputs(base58.HashPubKey(wallet.PublicKey))
+	if len(outputs) == 0 {
+		return nil, errors.New("No outputs to delegate ")
+	}
+
+	return NewDelegationTX(NewDelegation(outputs, stakePubKeyHash, wallet)), nil
+}
+
+// Delegation returns delegation carried by Transaction
+func (tx *Transaction) Delegation() (*Delegation, error) {
+	if !tx.IsDelegation() {
+		return nil, fmt.Errorf("Transaction %x has no delegation ", tx.ID)
+	}
+
+	var delegation Delegation
+
+	err := gob.NewDecoder(bytes.NewReader(tx.Vin[0].PubKey)).Decode(&delegation)
+	if err != nil {
+		return nil, err
+	}
+
+	return &delegation, nil
+}
+
+// checkDelegation returns delegation of the transaction or error if the transaction is invalid,
+// outputs of the delegation are not checked
+func (tx *Transaction) checkDelegation() (*Delegation, error) {
+	if len(tx.Vout) != 0 || len(tx.Vin[0].Signature) != 0 {
+		return nil, fmt.Errorf("Delegation transaction %x has outputs or signature ", tx.ID)
+	}
+
+	if !bytes.Equal(tx.Hash(), tx.ID) {
+		return nil, fmt.Errorf("Delegation transaction %x has wrong id ", tx.ID)
+	}
+
+	delegation, err := tx.Delegation()
+	if err != nil {
+		return nil, err
+	}
+
+	err = delegation.Verify()
+	if err != nil {
+		return nil, err
+	}
+
+	return delegation, nil
+}
+
+// VerifyDelegation returns error if the delegation transaction is invalid,
+// outputs of the delegation are not checked
+func (tx *Transaction) VerifyDelegation() error {
+	_, err := tx.checkDelegation()
+
+	return err
+}
+
+// checkDelegatedOutput returns error if the output is not in the UTXO set kept in bucket b,
+// is not owned by the owner of the delegation or is already delegated
+func checkDelegatedOutput(b *bolt.Bucket, delegation *Delegation, out DelegatedOutput) (TXOutputs, error) {
+	data := b.Get(out.TxID)
+	if data == nil {
+		return TXOutputs{}, fmt.Errorf("Delegated output %x:%d is not found ", out.TxID, out.Index)
+	}
+
+	outs, err := DeserializeOutputs(data)
+	if err != nil {
+		return TXOutputs{}, err
+	}
+
+	output, ok := outs.Outputs[out.Index]
+	if !ok {
+		return TXOutputs{}, fmt.Errorf("Delegated output %x:%d is spent ", out.TxID, out.Index)
+	}
+
+	if !output.IsLockedWithKey(delegation.Owner()) {
+		return TXOutputs{}, fmt.Errorf("Delegated output %x:%d is not owned by %x ", out.TxID, out.Index, delegation.Owner())
+	}
+
+	if outs.Delegates[out.Index] != nil {
+		return TXOutputs{}, fmt.Errorf("Output %x:%d is already delegated ", out.TxID, out.Index)
+	}
+
+	return outs, nil
+}
+
+// delegateOutputs sets the staking key of the delegation to its outputs of the UTXO set kept in bucket b,
+// delegates are removed on disconnect by delegations of the block, so no undo data is needed
+func delegateOutputs(b *bolt.Bucket, block *ExtensionBlock, tnx *Transaction) error {
+	delegation, err := tnx.checkDelegation()
+	if err != nil {
+		return &InvalidBlockError{fmt.Sprintf("Block %x has invalid delegation: %s", block.Hash, err)}
+	}
+
+	for _, out := range delegation.Outputs {
+		outs, err := checkDelegatedOutput(b, delegation, out)
+		if err != nil {
+			return &InvalidBlockError{fmt.Sprintf("Block %x has invalid delegation: %s", block.Hash, err)}
+		}
+
+		if outs.Delegates == nil {
+			outs.Delegates = make(map[int][]byte)
+		}
+		outs.Delegates[out.Index] = delegation.StakePubKeyHash
+
+		err = b.Put(out.TxID, outs.Serialize())
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// undelegateOutputs removes delegates set by the delegation from the UTXO set kept in bucket b,
+// outputs spent by later blocks are already restored with their delegates
+func undelegateOutputs(b *bolt.Bucket, tnx *Transaction) error {
+	delegation, err := tnx.Delegation()
+	if err != nil {
+		return err
+	}
+
+	for _, out := range delegation.Outputs {
+		data := b.Get(out.TxID)
+		if data == nil {
+			continue
+		}
+
+		outs, err := DeserializeOutputs(data)
+		if err != nil {
+			return err
+		}
+
+		if outs.Delegates[out.Index] == nil {
+			continue
+		}
+		delete(outs.Delegates, out.Index)
+
+		err = b.Put(out.TxID, outs.Serialize())
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// verifyDelegation returns error if the delegation transaction is invalid
+// or its outputs can not be delegated on top of the chain
+func (bc *Blockchain) verifyDelegation(tnx *Transaction) error {
+	delegation, err := tnx.checkDelegation()
+	if err != nil {
+		return err
+	}
+
+	return bc.Db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(utxoBucket))
+
+		for _, out := range delegation.Outputs {
+			_, err := checkDelegatedOutput(b, delegation, out)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// FindDelegate returns public key hash of the staking key the output is delegated to,
+// nil is returned if the output is not delegated or not in the UTXO set
+func (bc *Blockchain) FindDelegate(txID []byte, index int) []byte {
+	var delegate []byte
+
+	err := bc.Db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket([]byte(utxoBucket)).Get(txID)
+		if data == nil {
+			return nil
+		}
+
+		outs, err := DeserializeOutputs(data)
+		if err != nil {
+			return err
+		}
+
+		delegate = outs.Delegates[index]
+
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return delegate
+}
+
+// FindUndelegatedOutputs returns unspent outputs of the public key hash which are not delegated
+func (bc *Blockchain) FindUndelegatedOutputs(pubKeyHash []byte) []DelegatedOutput {
+	var outputs []DelegatedOutput
+
+	err := bc.Db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(utxoBucket)).ForEach(func(k, v []byte) error {
+			outs, err := DeserializeOutputs(v)
+			if err != nil {
+				return err
+			}
+
+			for index, out := range outs.Outputs {
+				if out.IsLockedWithKey(pubKeyHash) && outs.Delegates[index] == nil {
+					outputs = append(outputs, DelegatedOutput{TxID: append([]byte{}, k...), Index: index})
+				}
+			}
+
+			return nil
+		})
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return outputs
+}
+
+// FindStakedTxOutputs returns unspent outputs staked by the key, that is outputs
+// delegated to it and outputs of the key which are not delegated
+func (bc *Blockchain) FindStakedTxOutputs(pubKeyHash []byte) []TXOutput {
+	var txOutputs []TXOutput
+
+	err := bc.Db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(utxoBucket)).ForEach(func(k, v []byte) error {
+			outs, err := DeserializeOutputs(v)
+			if err != nil {
+				return err
+			}
+
+			for index, out := range outs.Outputs {
+				delegate := outs.Delegates[index]
+				if bytes.Equal(delegate, pubKeyHash) || (delegate == nil && out.IsLockedWithKey(pubKeyHash)) {
+					txOutputs = append(txOutputs, out)
+				}
+			}
+
+			return nil
+		})
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return txOutputs
+}
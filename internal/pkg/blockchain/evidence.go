@@ -0,0 +1,308 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"github.com/keithzetterstrom/BibCoin/tools/base58"
+	"log"
+)
+
+// evidenceIndex is the output index of the input of the evidence transaction,
+// the input keeps the serialized evidence in place of the public key
+const evidenceIndex = -2
+
+// burnPubKeyHash locks outputs of slashed stakeholders, no public key hashes to it,
+// so the outputs can not be spent and their satoshis are never staked
+var burnPubKeyHash = make([]byte, 20)
+
+// DoubleSign proves that the stakeholder signed two different extensions at the same height.
+// Transactions of the extensions are left out, the signatures cover them by merkle roots
+type DoubleSign struct {
+	First  ExtensionBlock
+	Second ExtensionBlock
+}
+
+// NewDoubleSign returns evidence of the conflicting extensions, extensions are ordered
+// by their signed data, so every node makes the same evidence of them
+func NewDoubleSign(a, b *ExtensionBlock) *DoubleSign {
+	first, second := a.signedHeader(), b.signedHeader()
+	if bytes.Compare(first.signedData(), second.signedData()) > 0 {
+		first, second = second, first
+	}
+
+	return &DoubleSign{First: *first, Second: *second}
+}
+
+// signedHeader returns copy of the extension without transactions
+func (b *ExtensionBlock) signedHeader() *ExtensionBlock {
+	header := *b
+	header.Transactions = nil
+
+	return &header
+}
+
+// Offender returns public key hash of the stakeholder which signed both extensions
+func (e *DoubleSign) Offender() []byte {
+	return base58.HashPubKey(e.First.StakeholderPubKey)
+}
+
+// Verify returns error if the extensions are not different extensions
+// at the same height signed by the same stakeholder
+func (e *DoubleSign) Verify() error {
+	for _, b := range []*ExtensionBlock{&e.First, &e.Second} {
+		if len(b.Signature) == 0 || len(b.Transactions) != 0 {
+			return fmt.Errorf("Evidence has extension of block %x which is not signed header ", b.Hash)
+		}
+
+		// double signing is proved by signatures, the VRF proofs are not needed
+		err := b.VerifySignature(false)
+		if err != nil {
+			return err
+		}
+	}
+
+	if !bytes.Equal(e.First.StakeholderPubKey, e.Second.StakeholderPubKey) {
+		return fmt.Errorf("Extensions of blocks %x and %x are signed by different stakeholders ", e.First.Hash, e.Second.Hash)
+	}
+
+	if e.First.Height != e.Second.Height {
+		return fmt.Errorf("Extensions of blocks %x and %x have different heights ", e.First.Hash, e.Second.Hash)
+	}
+
+	if bytes.Compare(e.First.signedData(), e.Second.signedData()) >= 0 {
+		return fmt.Errorf("Extensions of blocks %x and %x are the same or not ordered ", e.First.Hash, e.Second.Hash)
+	}
+
+	return nil
+}
+
+// Serialize serializes DoubleSign into bytes
+func (e *DoubleSign) Serialize() []byte {
+	var result bytes.Buffer
+
+	err := gob.NewEncoder(&result).Encode(e)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return result.Bytes()
+}
+
+// NewEvidenceTX returns Transaction with evidence of double signing, it has no outputs,
+// outputs of the offender are burned when the block with it is connected
+func NewEvidenceTX(evidence *DoubleSign) *Transaction {
+	txin := TXInput{
+		OutTxID: []byte{},
+		OutIndex: evidenceIndex,
+		PubKey: evidence.Serialize(),
+	}
+
+	tx := Transaction{Vin: []TXInput{txin}}
+	tx.ID = tx.Hash()
+
+	return &tx
+}
+
+// DoubleSign returns evidence of double signing carried by Transaction
+func (tx *Transaction) DoubleSign() (*DoubleSign, error) {
+	if !tx.IsEvidence() {
+		return nil, fmt.Errorf("Transaction %x has no evidence ", tx.ID)
+	}
+
+	var evidence DoubleSign
+
+	err := gob.NewDecoder(bytes.NewReader(tx.Vin[0].PubKey)).Decode(&evidence)
+	if err != nil {
+		return nil, err
+	}
+
+	return &evidence, nil
+}
+
+// checkEvidence returns evidence of the transaction or error if the transaction is invalid
+func (tx *Transaction) checkEvidence() (*DoubleSign, error) {
+	if len(tx.Vout) != 0 || len(tx.Vin[0].Signature) != 0 {
+		return nil, fmt.Errorf("Evidence transaction %x has outputs or signature ", tx.ID)
+	}
+
+	if !bytes.Equal(tx.Hash(), tx.ID) {
+		return nil, fmt.Errorf("Evidence transaction %x has wrong id ", tx.ID)
+	}
+
+	evidence, err := tx.DoubleSign()
+	if err != nil {
+		return nil, err
+	}
+
+	err = evidence.Verify()
+	if err != nil {
+		return nil, err
+	}
+
+	return evidence, nil
+}
+
+// VerifyEvidence returns error if the evidence transaction is invalid
+func (tx *Transaction) VerifyEvidence() error {
+	_, err := tx.checkEvidence()
+
+	return err
+}
+
+// key returns the key of the evidence in evidenceBucket, double signing
+// of the stakeholder at the height is slashed only once
+func (e *DoubleSign) key() []byte {
+	return append(e.Offender(), heightKey(e.First.Height)...)
+}
+
+// IsEvidenceProcessed returns true if the double signing of the evidence
+// is already slashed in the chain
+func (bc *Blockchain) IsEvidenceProcessed(evidence *DoubleSign) bool {
+	processed := false
+
+	_ = bc.Db.View(func(tx *bolt.Tx) error {
+		processed = tx.Bucket([]byte(evidenceBucket)).Get(evidence.key()) != nil
+		return nil
+	})
+
+	return processed
+}
+
+// slashOutputs burns outputs of the UTXO set kept in bucket b locked with the key of the offender
+// or delegated to it, owners risk the stake they delegate. Burned outputs are added to undo data to restore them on disconnect.
+// The evidence is put into bucket eb, InvalidBlockError is returned if it is already there
+func slashOutputs(b, eb *bolt.Bucket, block *ExtensionBlock, tnx *Transaction, undo *undoData) error {
+	evidence, err := tnx.checkEvidence()
+	if err != nil {
+		return &InvalidBlockError{fmt.Sprintf("Block %x has invalid evidence: %s", block.Hash, err)}
+	}
+
+	if eb.Get(evidence.key()) != nil {
+		return &InvalidBlockError{fmt.Sprintf("Block %x has evidence of double signing at height %d which is already processed ", block.Hash, evidence.First.Height)}
+	}
+
+	err = eb.Put(evidence.key(), block.Hash)
+	if err != nil {
+		return err
+	}
+
+	offender := evidence.Offender()
+
+	// the bucket is not changed while it is iterated
+	var txIDs [][]byte
+	err = b.ForEach(func(k, v []byte) error {
+		outs, err := DeserializeOutputs(v)
+		if err != nil {
+			return err
+		}
+
+		for index, out := range outs.Outputs {
+			if out.IsLockedWithKey(offender) || bytes.Equal(outs.Delegates[index], offender) {
+				txIDs = append(txIDs, append([]byte{}, k...))
+				break
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, txID := range txIDs {
+		outs, err := DeserializeOutputs(b.Get(txID))
+		if err != nil {
+			return err
+		}
+
+		for index, out := range outs.Outputs {
+			if !out.IsLockedWithKey(offender) && !bytes.Equal(outs.Delegates[index], offender) {
+				continue
+			}
+			undo.Spent = append(undo.Spent, spentOutput{TxID: txID, Index: index, Output: out, Delegate: outs.Delegates[index]})
+
+			out.PubKeyHash = burnPubKeyHash
+			outs.Outputs[index] = out
+			delete(outs.Delegates, index)
+		}
+
+		err = b.Put(txID, outs.Serialize())
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// checkDoubleSign remembers the signed extension by its height and stakeholder,
+// evidence is recorded if the stakeholder has already signed another extension at the height
+func (bc *Blockchain) checkDoubleSign(tx *bolt.Tx, block *ExtensionBlock) error {
+	if len(block.Signature) == 0 {
+		return nil
+	}
+
+	sb := tx.Bucket([]byte(signersBucket))
+	key := append(heightKey(block.Height), block.StakeholderHash...)
+
+	data := sb.Get(key)
+	if data == nil {
+		return sb.Put(key, block.signedHeader().Serialize())
+	}
+
+	known, err := DeserializeExtensionBlock(data)
+	if err != nil {
+		return err
+	}
+
+	if !bytes.Equal(known.signedData(), block.signedData()) {
+		bc.recordDoubleSign(NewDoubleSign(known, block))
+	}
+
+	return nil
+}
+
+// recordDoubleSign remembers evidence of double signing, only the last
+// maxRecordedBlocks of them are kept until they are taken
+func (bc *Blockchain) recordDoubleSign(evidence *DoubleSign) {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+
+	bc.doubleSigns = append(bc.doubleSigns, evidence)
+	if len(bc.doubleSigns) > maxRecordedBlocks {
+		bc.doubleSigns = bc.doubleSigns[len(bc.doubleSigns) - maxRecordedBlocks:]
+	}
+}
+
+// TakeDoubleSigns returns evidence of double signing found in added blocks since the previous call
+func (bc *Blockchain) TakeDoubleSigns() []*DoubleSign {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+
+	evidence := bc.doubleSigns
+	bc.doubleSigns = nil
+
+	return evidence
+}
+
+// FindSigned returns the extension signed by the stakeholder at the height
+// which is stored in blockchain, nil is returned if there is no such extension
+func (bc *Blockchain) FindSigned(height int, pubKeyHash []byte) *ExtensionBlock {
+	var block *ExtensionBlock
+
+	_ = bc.Db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket([]byte(signersBucket)).Get(append(heightKey(height), pubKeyHash...))
+		if data == nil {
+			return nil
+		}
+
+		var err error
+		block, err = DeserializeExtensionBlock(data)
+
+		return err
+	})
+
+	return block
+}
@@ -0,0 +1,88 @@
+package blockchain
+
+import (
+	walletpkg "github.com/keithzetterstrom/BibCoin/internal/pkg/wallet"
+	"testing"
+)
+
+// signSibling returns the extension of the block at the height signed by the wallet,
+// the timestamp makes blocks at the same height different
+func signSibling(wallet *walletpkg.Wallet, height int, timestamp int64) *ExtensionBlock {
+	block := NewBlock([]byte("parent"), nil, height, "miner", 0, timestamp)
+
+	extension := NewExtensionBlock(nil, block)
+	extension.Sign(wallet.PrivateKey, wallet.PublicKey)
+
+	return extension
+}
+
+// TestEvidenceVerify checks that evidence proves only different extensions
+// at the same height signed by the same stakeholder
+func TestEvidenceVerify(t *testing.T) {
+	offender := walletpkg.NewWallet()
+	first, second := signSibling(offender, 5, 1000), signSibling(offender, 5, 1001)
+
+	if err := NewEvidenceTX(NewDoubleSign(first, second)).VerifyEvidence(); err != nil {
+		t.Errorf("Evidence of double signing is rejected: %s", err)
+	}
+
+	invalid := map[string]*DoubleSign{
+		"same extension": NewDoubleSign(first, first),
+		"different heights": NewDoubleSign(first, signSibling(offender, 6, 1001)),
+		"different stakeholders": NewDoubleSign(first, signSibling(walletpkg.NewWallet(), 5, 1001)),
+	}
+
+	forged := NewDoubleSign(first, second)
+	forged.Second.Attempt++
+	invalid["forged signature"] = forged
+
+	for name, evidence := range invalid {
+		if NewEvidenceTX(evidence).VerifyEvidence() == nil {
+			t.Errorf("Evidence with %s is accepted", name)
+		}
+	}
+}
+
+// TestEvidenceReplay checks that evidence burns outputs of the offender once,
+// the block replaying it is rejected and outputs the offender got after slashing are kept
+func TestEvidenceReplay(t *testing.T) {
+	bc, wallet := newTestBlockchain(t, 20)
+	offender := walletpkg.NewWallet()
+	offenderAddress := string(offender.GetAddress(bc.Params.AddressVersion))
+
+	tip := bc.NewIterator().Next()
+	evidence := NewDoubleSign(signSibling(offender, tip.Height, 1000), signSibling(offender, tip.Height, 1001))
+
+	// the reward of the offender in the block with evidence is burned too
+	slashing := stakeTestBlock(t, bc, wallet, offenderAddress, []*Transaction{NewEvidenceTX(evidence)})
+	if err := bc.AddBlock(slashing); err != nil {
+		t.Fatal(err)
+	}
+	if !bc.IsEvidenceProcessed(evidence) {
+		t.Fatal("Mined evidence is not processed")
+	}
+	if balance(bc, offender) != 0 {
+		t.Fatal("Outputs of the offender are not burned")
+	}
+
+	if bc.VerifyTransaction(NewEvidenceTX(evidence)) {
+		t.Error("Processed evidence is verified again")
+	}
+
+	reward := stakeTestBlock(t, bc, wallet, offenderAddress, nil)
+	if err := bc.AddBlock(reward); err != nil {
+		t.Fatal(err)
+	}
+	kept := balance(bc, offender)
+	if kept == 0 {
+		t.Fatal("Offender has no reward after slashing")
+	}
+
+	replay := stakeTestBlock(t, bc, wallet, string(wallet.GetAddress(bc.Params.AddressVersion)), []*Transaction{NewEvidenceTX(evidence)})
+	if _, ok := bc.AddBlock(replay).(*InvalidBlockError); !ok {
+		t.Error("Block replaying processed evidence is not rejected")
+	}
+	if bc.HasBlock(replay.Hash) || balance(bc, offender) != kept {
+		t.Error("Replayed evidence burned outputs of the offender")
+	}
+}
@@ -0,0 +1,40 @@
+package blockchain
+
+import (
+	"encoding/hex"
+	"fmt"
+)
+
+const errorGenesisMismatch = "Genesis block does not match the network "
+
+// GenesisBlock returns genesis block of the network. It is built only from
+// chain parameters, so every node of the network gets the same block, and its
+// coinbase has no outputs: first blocks are staked while no satoshi is owned
+func GenesisBlock(params *ChainParams) (*ExtensionBlock, error) {
+	coinbase := Transaction{
+		Vin: []TXInput{{
+			OutTxID: []byte{},
+			OutIndex: -1,
+			PubKey: []byte(params.GenesisCoinbaseData),
+		}},
+	}
+	coinbase.ID = coinbase.Hash()
+
+	block := &Block{
+		Timestamp: params.GenesisTimestamp,
+		PrevBlockHash: []byte{},
+		Height: 1,
+	}
+
+	pow := NewProofOfWork(block, params.TargetBits)
+	nonce, hash := pow.Run()
+
+	block.Hash = hash[:]
+	block.Nonce = nonce
+
+	if hex.EncodeToString(block.Hash) != params.GenesisHash {
+		return nil, fmt.Errorf("Genesis block of %s network has hash %x instead of %s ", params.Name, block.Hash, params.GenesisHash)
+	}
+
+	return NewExtensionBlock([]*Transaction{&coinbase}, block), nil
+}
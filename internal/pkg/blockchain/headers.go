@@ -0,0 +1,565 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"math/big"
+)
+
+// locatorDenseHashes is the number of the last headers put into block locator
+// one by one, the step between older headers is doubled
+const locatorDenseHashes = 10
+
+var headerTipKey = []byte("headertip")
+
+// heightKey returns key of the given height in the header chain bucket
+func heightKey(height int) []byte {
+	return IntToHex(int64(height))
+}
+
+// chainWork returns the work of the chain ending with the header. All blocks
+// of the network have the same target, so the work of the chain is the work
+// of one block times the number of blocks
+func (bc *Blockchain) chainWork(header *Block) *big.Int {
+	work := NewProofOfWork(header, bc.Params.TargetBits).work()
+
+	return work.Mul(work, big.NewInt(int64(header.Height + 1)))
+}
+
+// storeHeader validates the height and the timestamp of the header against its parent and puts it into database,
+// the best header chain is updated if the chain of the header has more work than its tip
+func (bc *Blockchain) storeHeader(tx *bolt.Tx, header *Block) error {
+	if len(header.PrevBlockHash) == 0 {
+		genesis, err := GenesisBlock(bc.Params)
+		if err != nil {
+			return err
+		}
+
+		if !bytes.Equal(header.Hash, genesis.Hash) {
+			return &InvalidBlockError{errorGenesisMismatch}
+		}
+	} else {
+		parent, err := getHeader(tx, header.PrevBlockHash)
+		if err != nil {
+			return errors.New(errorParentNotFound)
+		}
+
+		if header.Height != parent.Height + 1 {
+			return &InvalidBlockError{fmt.Sprintf("Block %x has wrong height %d ", header.Hash, header.Height)}
+		}
+
+		if header.Timestamp <= parent.Timestamp {
+			return &InvalidBlockError{fmt.Sprintf("Block %x has timestamp not after its parent ", header.Hash)}
+		}
+	}
+
+	err := tx.Bucket([]byte(HeadersBucket)).Put(header.Hash, header.Serialize())
+	if err != nil {
+		return err
+	}
+
+	best, err := headerTip(tx)
+	if err != nil {
+		return err
+	}
+
+	if best == nil || bc.chainWork(header).Cmp(bc.chainWork(best)) > 0 {
+		return setHeaderTip(tx, header)
+	}
+
+	return nil
+}
+
+// storeBody stores body of the block which header is already known,
+// it was received in headers message or loaded with snapshot. Proof of work commits
+// only to the hash of the header, the extension fields of the stored header may come
+// from another peer, so they are replaced by the fields of the body. Headers of
+// connected blocks come from their bodies and are not replaced
+func storeBody(tx *bolt.Tx, block *ExtensionBlock) error {
+	header, err := getHeader(tx, block.Hash)
+	if err != nil {
+		return err
+	}
+
+	if !sameCommitted(header, &block.Block) {
+		return &InvalidBlockError{fmt.Sprintf("Block %x does not match its header ", block.Hash)}
+	}
+
+	err = block.checkMerkleRoot()
+	if err != nil {
+		return err
+	}
+
+	if !bytes.Equal(tx.Bucket([]byte(HeadersBucket)).Get(block.Hash), block.Block.Serialize()) {
+		connected, err := isConnected(tx, header)
+		if err != nil {
+			return err
+		}
+		if connected {
+			return &InvalidBlockError{fmt.Sprintf("Block %x does not match its connected header ", block.Hash)}
+		}
+
+		err = tx.Bucket([]byte(HeadersBucket)).Put(block.Hash, block.Block.Serialize())
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Bucket([]byte(BlocksBucket)).Put(block.Hash, block.Serialize())
+}
+
+// sameCommitted returns true if the headers have the same fields committed by proof of work
+// and the same height, which is checked against the parent when the header is stored
+func sameCommitted(a, b *Block) bool {
+	return bytes.Equal(a.Hash, b.Hash) &&
+		bytes.Equal(a.PrevBlockHash, b.PrevBlockHash) &&
+		a.Timestamp == b.Timestamp &&
+		a.Nonce == b.Nonce &&
+		bytes.Equal(a.ParentRoot, b.ParentRoot) &&
+		a.Height == b.Height
+}
+
+// isConnected returns true if the block of the header is in the chain
+func isConnected(tx *bolt.Tx, header *Block) (bool, error) {
+	fork, err := headerFork(tx)
+	if err != nil || fork == nil || header.Height > fork.Height {
+		return false, err
+	}
+
+	return bytes.Equal(tx.Bucket([]byte(headerChainBucket)).Get(heightKey(header.Height)), header.Hash), nil
+}
+
+// setHeaderTip makes the header the tip of the best header chain,
+// hashes of the chain are indexed by height down to the fork with the previous one
+func setHeaderTip(tx *bolt.Tx, header *Block) error {
+	err := tx.Bucket([]byte(metaBucket)).Put(headerTipKey, header.Hash)
+	if err != nil {
+		return err
+	}
+
+	hc := tx.Bucket([]byte(headerChainBucket))
+
+	for !bytes.Equal(hc.Get(heightKey(header.Height)), header.Hash) {
+		err = hc.Put(heightKey(header.Height), header.Hash)
+		if err != nil {
+			return err
+		}
+
+		if len(header.PrevBlockHash) == 0 {
+			break
+		}
+
+		header, err = getHeader(tx, header.PrevBlockHash)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// initHeaderChain indexes the chain as the best header chain
+// in database created before headers were downloaded separately
+func initHeaderChain(tx *bolt.Tx) error {
+	if tx.Bucket([]byte(metaBucket)).Get(headerTipKey) != nil {
+		return nil
+	}
+
+	tip, err := chainTip(tx)
+	if err != nil || tip == nil {
+		return err
+	}
+
+	return setHeaderTip(tx, tip)
+}
+
+// chainTip returns header of the tip of the chain or nil if the chain is empty
+func chainTip(tx *bolt.Tx) (*Block, error) {
+	hash := tx.Bucket([]byte(BlocksBucket)).Get([]byte("l"))
+	if hash == nil {
+		return nil, nil
+	}
+
+	return getHeader(tx, hash)
+}
+
+// headerTip returns the tip of the best header chain, bodies of its blocks
+// above the fork with the chain may be not downloaded yet
+func headerTip(tx *bolt.Tx) (*Block, error) {
+	hash := tx.Bucket([]byte(metaBucket)).Get(headerTipKey)
+	if hash == nil {
+		return chainTip(tx)
+	}
+
+	return getHeader(tx, hash)
+}
+
+// headerFork returns the highest block of the chain which is in the best header chain
+func headerFork(tx *bolt.Tx) (*Block, error) {
+	fork, err := chainTip(tx)
+	if err != nil || fork == nil {
+		return nil, err
+	}
+
+	hc := tx.Bucket([]byte(headerChainBucket))
+
+	for !bytes.Equal(hc.Get(heightKey(fork.Height)), fork.Hash) {
+		fork, err = getHeader(tx, fork.PrevBlockHash)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return fork, nil
+}
+
+// GetHeaderHeight returns height of the best header chain
+func (bc *Blockchain) GetHeaderHeight() (int, error) {
+	height := 0
+
+	err := bc.Db.View(func(tx *bolt.Tx) error {
+		best, err := headerTip(tx)
+		if err != nil {
+			return err
+		}
+
+		if best == nil {
+			return errors.New(errorHeaderNotFound)
+		}
+		height = best.Height
+
+		return nil
+	})
+
+	return height, err
+}
+
+// BlockLocator returns hashes of the best header chain from its tip back
+// to genesis, the last headers go one by one and older ones with doubling step,
+// so the node which receives it finds the fork point in a few hashes
+func (bc *Blockchain) BlockLocator() [][]byte {
+	var locator [][]byte
+
+	_ = bc.Db.View(func(tx *bolt.Tx) error {
+		best, err := headerTip(tx)
+		if err != nil || best == nil {
+			return err
+		}
+
+		hc := tx.Bucket([]byte(headerChainBucket))
+
+		step := 1
+		for height := best.Height; ; height -= step {
+			if height < 0 {
+				height = 0
+			}
+
+			locator = append(locator, append([]byte{}, hc.Get(heightKey(height))...))
+			if height == 0 {
+				break
+			}
+
+			if len(locator) >= locatorDenseHashes {
+				step *= 2
+			}
+		}
+
+		return nil
+	})
+
+	return locator
+}
+
+// GetHeaders returns up to max headers of the chain following the newest block
+// of the locator which is in the chain, the headers end at the stop hash
+func (bc *Blockchain) GetHeaders(locator [][]byte, stop []byte, max int) []Block {
+	var headers []Block
+
+	known := make(map[string]bool)
+	for _, hash := range locator {
+		known[hex.EncodeToString(hash)] = true
+	}
+
+	_ = bc.Db.View(func(tx *bolt.Tx) error {
+		header, err := chainTip(tx)
+		if err != nil {
+			return err
+		}
+
+		var branch []*Block
+		for header != nil && !known[hex.EncodeToString(header.Hash)] {
+			branch = append(branch, header)
+			if len(header.PrevBlockHash) == 0 {
+				break
+			}
+
+			header, err = getHeader(tx, header.PrevBlockHash)
+			if err != nil {
+				return err
+			}
+		}
+
+		for i := len(branch) - 1; i >= 0 && len(headers) < max; i-- {
+			headers = append(headers, *branch[i])
+			if bytes.Equal(branch[i].Hash, stop) {
+				break
+			}
+		}
+
+		return nil
+	})
+
+	return headers
+}
+
+// AddHeaders validates headers and adds them to the header chain,
+// blocks are connected when their bodies are downloaded
+func (bc *Blockchain) AddHeaders(headers []Block) error {
+	for i := range headers {
+		if !NewProofOfWork(&headers[i], bc.Params.TargetBits).Validate() {
+			return &InvalidBlockError{fmt.Sprintf("Header %x has invalid proof of work ", headers[i].Hash)}
+		}
+	}
+
+	return bc.Db.Update(func(tx *bolt.Tx) error {
+		for i := range headers {
+			if tx.Bucket([]byte(HeadersBucket)).Get(headers[i].Hash) != nil {
+				continue
+			}
+
+			err := bc.storeHeader(tx, &headers[i])
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// BlocksToDownload returns up to max hashes of blocks of the best header chain
+// which bodies are not downloaded yet, starting from the oldest one
+func (bc *Blockchain) BlocksToDownload(max int) [][]byte {
+	var missing [][]byte
+
+	_ = bc.Db.View(func(tx *bolt.Tx) error {
+		fork, err := headerFork(tx)
+		if err != nil || fork == nil {
+			return err
+		}
+
+		best, err := headerTip(tx)
+		if err != nil {
+			return err
+		}
+
+		hc := tx.Bucket([]byte(headerChainBucket))
+		b := tx.Bucket([]byte(BlocksBucket))
+
+		for height := fork.Height + 1; height <= best.Height && len(missing) < max; height++ {
+			hash := hc.Get(heightKey(height))
+			if b.Get(hash) == nil {
+				missing = append(missing, append([]byte{}, hash...))
+			}
+		}
+
+		return nil
+	})
+
+	return missing
+}
+
+// HeaderFollows returns true if the header with the given hash is the header
+// of the ancestor block or follows it in its chain
+func (bc *Blockchain) HeaderFollows(hash, ancestor []byte) bool {
+	follows := false
+
+	_ = bc.Db.View(func(tx *bolt.Tx) error {
+		header, err := getHeader(tx, hash)
+		if err != nil {
+			return err
+		}
+		base, err := getHeader(tx, ancestor)
+		if err != nil {
+			return err
+		}
+
+		for header.Height > base.Height {
+			header, err = getHeader(tx, header.PrevBlockHash)
+			if err != nil {
+				return err
+			}
+		}
+
+		follows = bytes.Equal(header.Hash, base.Hash)
+
+		return nil
+	})
+
+	return follows
+}
+
+// RemoveHeaders removes the header with the given hash and the headers following it
+// from the best header chain if the block is not connected. It is used when bodies
+// of the blocks can not be downloaded, so the node does not wait for them forever
+func (bc *Blockchain) RemoveHeaders(hash []byte) error {
+	height := -1
+
+	err := bc.Db.View(func(tx *bolt.Tx) error {
+		header, err := getHeader(tx, hash)
+		if err != nil {
+			return err
+		}
+
+		if !bytes.Equal(tx.Bucket([]byte(headerChainBucket)).Get(heightKey(header.Height)), hash) {
+			return nil
+		}
+
+		connected, err := isConnected(tx, header)
+		if err != nil || connected {
+			return err
+		}
+		height = header.Height
+
+		return nil
+	})
+	if err != nil || height < 0 {
+		return err
+	}
+
+	return bc.removeBranch(height)
+}
+
+// connectBestChain moves the tip of the chain to the highest block of the best
+// header chain which has bodies of all blocks down to the fork. Blocks extending
+// the tip are connected one by one, switching to another branch is done at once.
+// The branch is removed from the invalid block, the error is returned as
+// InvalidBlockError only if the added block is invalid or completed the branch
+func (bc *Blockchain) connectBestChain(added []byte) error {
+	var run [][]byte
+	var fork *Block
+	reorg := false
+
+	err := bc.Db.View(func(tx *bolt.Tx) error {
+		tip, err := chainTip(tx)
+		if err != nil || tip == nil {
+			return err
+		}
+
+		best, err := headerTip(tx)
+		if err != nil {
+			return err
+		}
+
+		fork, err = headerFork(tx)
+		if err != nil {
+			return err
+		}
+
+		hc := tx.Bucket([]byte(headerChainBucket))
+		b := tx.Bucket([]byte(BlocksBucket))
+
+		for height := fork.Height + 1; height <= best.Height; height++ {
+			hash := hc.Get(heightKey(height))
+			if b.Get(hash) == nil {
+				break
+			}
+			run = append(run, append([]byte{}, hash...))
+		}
+
+		// the other branch is switched to only when it becomes higher
+		reorg = !bytes.Equal(fork.Hash, tip.Hash)
+		if reorg && fork.Height + len(run) <= tip.Height {
+			run = nil
+		}
+
+		return nil
+	})
+	if err != nil || len(run) == 0 {
+		return err
+	}
+
+	if reorg {
+		err = bc.Db.Update(func(tx *bolt.Tx) error {
+			return bc.setTip(tx, run[len(run) - 1])
+		})
+
+		guilty := false
+		for _, hash := range run {
+			guilty = guilty || bytes.Equal(hash, added)
+		}
+
+		return bc.checkConnected(err, fork.Height + 1, guilty)
+	}
+
+	for i, hash := range run {
+		err = bc.Db.Update(func(tx *bolt.Tx) error {
+			return bc.setTip(tx, hash)
+		})
+
+		err = bc.checkConnected(err, fork.Height + 1 + i, bytes.Equal(hash, added))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// checkConnected handles error of connecting blocks, if they are invalid the branch
+// is removed from the given height and the error is returned as InvalidBlockError
+// only if the block which was added is guilty
+func (bc *Blockchain) checkConnected(err error, height int, guilty bool) error {
+	if _, ok := err.(*InvalidBlockError); !ok {
+		return err
+	}
+
+	removeErr := bc.removeBranch(height)
+	if removeErr != nil {
+		return removeErr
+	}
+
+	if guilty {
+		return err
+	}
+
+	return fmt.Errorf("Branch is removed from height %d: %s ", height, err)
+}
+
+// removeBranch deletes headers and bodies of blocks of the best header chain
+// starting from the given height, so they are downloaded again from other nodes,
+// the chain becomes the best header chain
+func (bc *Blockchain) removeBranch(height int) error {
+	return bc.Db.Update(func(tx *bolt.Tx) error {
+		best, err := headerTip(tx)
+		if err != nil {
+			return err
+		}
+
+		hc := tx.Bucket([]byte(headerChainBucket))
+
+		for ; height <= best.Height; height++ {
+			hash := hc.Get(heightKey(height))
+
+			err = tx.Bucket([]byte(HeadersBucket)).Delete(hash)
+			if err != nil {
+				return err
+			}
+
+			err = tx.Bucket([]byte(BlocksBucket)).Delete(hash)
+			if err != nil {
+				return err
+			}
+		}
+
+		tip, err := chainTip(tx)
+		if err != nil {
+			return err
+		}
+
+		return setHeaderTip(tx, tip)
+	})
+}
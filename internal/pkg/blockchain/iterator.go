@@ -10,10 +10,24 @@ type Iterator struct {
 	db          *bolt.DB
 }
 
-// NewIterator returns Iterator to iterate over the Blockchain
+// NewIterator returns Iterator to iterate over the Blockchain,
+// the tip is read from database as Tip may be changed by another goroutine
 func (bc *Blockchain) NewIterator() *Iterator {
+	var tip []byte
+
+	err := bc.Db.View(func(tx *bolt.Tx) error {
+		if lastHash := tx.Bucket([]byte(BlocksBucket)).Get([]byte("l")); lastHash != nil {
+			tip = append([]byte{}, lastHash...)
+		}
+
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
 	bci := &Iterator{
-		currentHash: bc.Tip,
+		currentHash: tip,
 		db: bc.Db,
 	}
 
@@ -21,6 +35,7 @@ func (bc *Blockchain) NewIterator() *Iterator {
 }
 
 // Next returns next ExtensionBlock in Blockchain
+// or nil if the block body has been pruned
 func (i *Iterator) Next() *ExtensionBlock {
 	var block *ExtensionBlock
 	var err error
@@ -28,6 +43,10 @@ func (i *Iterator) Next() *ExtensionBlock {
 	err = i.db.View(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(BlocksBucket))
 		encodedBlock := b.Get(i.currentHash)
+		if encodedBlock == nil {
+			return nil
+		}
+
 		block, err = DeserializeExtensionBlock(encodedBlock)
 		if err != nil {
 			return err
@@ -39,6 +58,35 @@ func (i *Iterator) Next() *ExtensionBlock {
 		log.Panic(err)
 	}
 
+	if block == nil {
+		return nil
+	}
+
+	i.currentHash = block.PrevBlockHash
+
+	return block
+}
+
+// NextHeader returns header of the next block in Blockchain,
+// headers are kept for pruned blocks as well
+func (i *Iterator) NextHeader() *Block {
+	var block *Block
+	var err error
+
+	err = i.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(HeadersBucket))
+		encodedBlock := b.Get(i.currentHash)
+		block, err = DeserializeBlock(encodedBlock)
+		if err != nil {
+			return err
+		}
+
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
 	i.currentHash = block.PrevBlockHash
 
 	return block
@@ -0,0 +1,320 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"log"
+)
+
+var lightModeKey = []byte("light")
+
+// filteredTipKey keeps hash of the highest block of the best header chain
+// which has transactions of all blocks below it downloaded
+var filteredTipKey = []byte("filteredtip")
+
+// filteredBlock is transactions of the block matching the filter of the wallet
+type filteredBlock struct {
+	Transactions []*Transaction
+}
+
+// serialize serializes filteredBlock into bytes
+func (b filteredBlock) serialize() []byte {
+	var buff bytes.Buffer
+
+	enc := gob.NewEncoder(&buff)
+	err := enc.Encode(b)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return buff.Bytes()
+}
+
+// deserializeFilteredBlock deserializes filteredBlock from bytes
+func deserializeFilteredBlock(data []byte) (filteredBlock, error) {
+	var block filteredBlock
+
+	dec := gob.NewDecoder(bytes.NewReader(data))
+	err := dec.Decode(&block)
+	if err != nil {
+		return filteredBlock{}, err
+	}
+
+	return block, nil
+}
+
+// EnableLightMode switches Blockchain to light mode keeping only headers
+// and transactions of the wallet, the mode can not be switched off
+func (bc *Blockchain) EnableLightMode() error {
+	return bc.Db.Update(func(tx *bolt.Tx) error {
+		err := tx.Bucket([]byte(metaBucket)).Put(lightModeKey, []byte{1})
+		if err != nil {
+			return err
+		}
+		bc.Light = true
+
+		return nil
+	})
+}
+
+// IsLight returns true if Blockchain keeps only headers and transactions of the wallet
+func (bc *Blockchain) IsLight() bool {
+	return bc.Light
+}
+
+// loadLightMode reads light mode saved in database
+func (bc *Blockchain) loadLightMode(tx *bolt.Tx) {
+	bc.Light = tx.Bucket([]byte(metaBucket)).Get(lightModeKey) != nil
+}
+
+// hasTransactions returns true if full body or filtered transactions of the block are stored
+func hasTransactions(tx *bolt.Tx, hash []byte) bool {
+	return tx.Bucket([]byte(filteredBucket)).Get(hash) != nil || tx.Bucket([]byte(BlocksBucket)).Get(hash) != nil
+}
+
+// HasFilteredBlock returns true if transactions of the block matching the filter are stored
+func (bc *Blockchain) HasFilteredBlock(blockHash []byte) bool {
+	exists := false
+
+	_ = bc.Db.View(func(tx *bolt.Tx) error {
+		exists = hasTransactions(tx, blockHash)
+		return nil
+	})
+
+	return exists
+}
+
+// filteredFork returns the highest block of the best header chain
+// which has transactions of all blocks below it stored
+func filteredFork(tx *bolt.Tx) (*Block, error) {
+	hash := tx.Bucket([]byte(metaBucket)).Get(filteredTipKey)
+	if hash == nil {
+		return chainTip(tx)
+	}
+
+	fork, err := getHeader(tx, hash)
+	if err != nil {
+		return nil, err
+	}
+
+	hc := tx.Bucket([]byte(headerChainBucket))
+
+	for !bytes.Equal(hc.Get(heightKey(fork.Height)), fork.Hash) {
+		fork, err = getHeader(tx, fork.PrevBlockHash)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return fork, nil
+}
+
+// FilteredBlocksToDownload returns up to max hashes of blocks of the best header chain
+// which filtered transactions are not downloaded yet, starting from the oldest one.
+// The tip is not returned, its merkle root is not committed until the next block is mined
+func (bc *Blockchain) FilteredBlocksToDownload(max int) [][]byte {
+	var missing [][]byte
+
+	_ = bc.Db.View(func(tx *bolt.Tx) error {
+		fork, err := filteredFork(tx)
+		if err != nil || fork == nil {
+			return err
+		}
+
+		best, err := headerTip(tx)
+		if err != nil {
+			return err
+		}
+
+		hc := tx.Bucket([]byte(headerChainBucket))
+
+		for height := fork.Height + 1; height < best.Height && len(missing) < max; height++ {
+			hash := hc.Get(heightKey(height))
+			if !hasTransactions(tx, hash) {
+				missing = append(missing, append([]byte{}, hash...))
+			}
+		}
+
+		return nil
+	})
+
+	return missing
+}
+
+// committedRoot returns the merkle root of the block of the best header chain committed
+// by proof of work of the next block. The root in the header of the block itself
+// is not covered by proof of work and may be forged by the peer which sent the header
+func committedRoot(tx *bolt.Tx, header *Block) ([]byte, error) {
+	hc := tx.Bucket([]byte(headerChainBucket))
+
+	if !bytes.Equal(hc.Get(heightKey(header.Height)), header.Hash) {
+		return nil, fmt.Errorf("Block %x is not in the best header chain ", header.Hash)
+	}
+
+	next := hc.Get(heightKey(header.Height + 1))
+	if next == nil {
+		return nil, fmt.Errorf("Merkle root of block %x is not committed yet ", header.Hash)
+	}
+
+	child, err := getHeader(tx, next)
+	if err != nil {
+		return nil, err
+	}
+
+	return child.ParentRoot, nil
+}
+
+// AddFilteredBlock checks that the transactions are proven by the partial merkle tree
+// to be in the block with known header and stores them. The tree must match the root
+// committed by the next block of the best header chain. InvalidBlockError is returned
+// if the header differs from the stored one or the proof does not match
+func (bc *Blockchain) AddFilteredBlock(header *Block, tree *PartialMerkleTree, transactions []*Transaction) error {
+	return bc.Db.Update(func(tx *bolt.Tx) error {
+		stored, err := getHeader(tx, header.Hash)
+		if err != nil {
+			return err
+		}
+
+		if !sameCommitted(stored, header) {
+			return &InvalidBlockError{fmt.Sprintf("Block %x does not match its header ", header.Hash)}
+		}
+
+		committed, err := committedRoot(tx, stored)
+		if err != nil {
+			return err
+		}
+
+		if len(committed) == 0 {
+			return fmt.Errorf("Block %x has no merkle root ", header.Hash)
+		}
+
+		root, matched, err := tree.Extract()
+		if err != nil {
+			return &InvalidBlockError{fmt.Sprintf("Block %x has invalid merkle tree: %s", header.Hash, err)}
+		}
+
+		if !bytes.Equal(root, committed) {
+			return &InvalidBlockError{fmt.Sprintf("Merkle tree does not match root of block %x ", header.Hash)}
+		}
+
+		if len(matched) != len(transactions) {
+			return &InvalidBlockError{fmt.Sprintf("Block %x has %d matched transactions instead of %d ", header.Hash, len(transactions), len(matched))}
+		}
+
+		for i, tnx := range transactions {
+			// id of the transaction is the hash of it before signing
+			unsigned := tnx.TrimmedCopy()
+			for j := range unsigned.Vin {
+				unsigned.Vin[j].PubKey = tnx.Vin[j].PubKey
+			}
+
+			if !bytes.Equal(tnx.ID, matched[i]) || !bytes.Equal(unsigned.Hash(), tnx.ID) {
+				return &InvalidBlockError{fmt.Sprintf("Transaction %x is not proven to be in block %x ", tnx.ID, header.Hash)}
+			}
+		}
+
+		err = tx.Bucket([]byte(filteredBucket)).Put(header.Hash, filteredBlock{Transactions: transactions}.serialize())
+		if err != nil {
+			return err
+		}
+
+		return advanceFilteredTip(tx)
+	})
+}
+
+// advanceFilteredTip moves the filtered tip up the best header chain
+// while transactions of the next blocks are stored
+func advanceFilteredTip(tx *bolt.Tx) error {
+	fork, err := filteredFork(tx)
+	if err != nil || fork == nil {
+		return err
+	}
+
+	hc := tx.Bucket([]byte(headerChainBucket))
+	tip := fork.Hash
+
+	for height := fork.Height + 1; ; height++ {
+		hash := hc.Get(heightKey(height))
+		if hash == nil || !hasTransactions(tx, hash) {
+			break
+		}
+		tip = hash
+	}
+
+	return tx.Bucket([]byte(metaBucket)).Put(filteredTipKey, tip)
+}
+
+// FindFilteredUnspentOutputs returns unspent outputs locked with the public key hash
+// found in stored transactions of the best header chain, it is used in light mode
+// where the UTXO set is not kept
+func (bc *Blockchain) FindFilteredUnspentOutputs(pubKeyHash []byte) []TXOutput {
+	var txOutputs []TXOutput
+
+	err := bc.Db.View(func(tx *bolt.Tx) error {
+		best, err := headerTip(tx)
+		if err != nil || best == nil {
+			return err
+		}
+
+		hc := tx.Bucket([]byte(headerChainBucket))
+		fb := tx.Bucket([]byte(filteredBucket))
+
+		unspent := make(map[string]TXOutput)
+		var order []string
+
+		for height := 1; height <= best.Height; height++ {
+			hash := hc.Get(heightKey(height))
+
+			var transactions []*Transaction
+			if data := fb.Get(hash); data != nil {
+				block, err := deserializeFilteredBlock(data)
+				if err != nil {
+					return err
+				}
+				transactions = block.Transactions
+			} else if body, err := getBody(tx, hash); err == nil {
+				transactions = body.Transactions
+			}
+
+			for _, tnx := range transactions {
+				// evidence against the wallet burns all its outputs
+				if tnx.IsEvidence() {
+					evidence, err := tnx.DoubleSign()
+					if err == nil && bytes.Equal(evidence.Offender(), pubKeyHash) {
+						unspent = make(map[string]TXOutput)
+					}
+					continue
+				}
+
+				if !tnx.IsCoinbase() {
+					for _, vin := range tnx.Vin {
+						delete(unspent, fmt.Sprintf("%x:%d", vin.OutTxID, vin.OutIndex))
+					}
+				}
+
+				for i, out := range tnx.Vout {
+					if out.IsLockedWithKey(pubKeyHash) {
+						key := fmt.Sprintf("%x:%d", tnx.ID, i)
+						unspent[key] = out
+						order = append(order, key)
+					}
+				}
+			}
+		}
+
+		for _, key := range order {
+			if out, ok := unspent[key]; ok {
+				txOutputs = append(txOutputs, out)
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return txOutputs
+}
@@ -0,0 +1,200 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+)
+
+// maxMerkleLeaves limits the number of transactions of the block the partial tree is built for
+const maxMerkleLeaves = 1 << 20
+
+// PartialMerkleTree proves that transactions are in the block with given merkle root
+// without the other transactions of the block. Flags tell in depth-first order whether
+// the node is a parent of a matched transaction, Hashes are the nodes which are not
+// descended into and the matched transactions
+type PartialMerkleTree struct {
+	Total  int
+	Hashes [][]byte
+	Flags  []bool
+}
+
+// hashPair returns sum256 hash of two nodes of the merkle tree
+func hashPair(left, right []byte) []byte {
+	hash := sha256.Sum256(bytes.Join([][]byte{left, right}, []byte{}))
+
+	return hash[:]
+}
+
+// MerkleRoot returns root of the merkle tree of the given transaction ids,
+// the last node of the level is paired with itself if the level is odd
+func MerkleRoot(ids [][]byte) []byte {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	level := ids
+	for len(level) > 1 {
+		var next [][]byte
+
+		for i := 0; i < len(level); i += 2 {
+			right := level[i]
+			if i + 1 < len(level) {
+				right = level[i + 1]
+			}
+			next = append(next, hashPair(level[i], right))
+		}
+
+		level = next
+	}
+
+	return level[0]
+}
+
+// transactionIDs returns ids of the transactions
+func transactionIDs(transactions []*Transaction) [][]byte {
+	var ids [][]byte
+
+	for _, tx := range transactions {
+		ids = append(ids, tx.ID)
+	}
+
+	return ids
+}
+
+// NewPartialMerkleTree returns PartialMerkleTree of the transactions which proves
+// the transactions with true in matches
+func NewPartialMerkleTree(ids [][]byte, matches []bool) *PartialMerkleTree {
+	tree := &PartialMerkleTree{Total: len(ids)}
+	tree.build(ids, matches, tree.height(), 0)
+
+	return tree
+}
+
+// width returns the number of nodes of the tree at the given height, leaves have height 0
+func (t *PartialMerkleTree) width(height uint) int {
+	return (t.Total + (1 << height) - 1) >> height
+}
+
+// height returns height of the root of the tree
+func (t *PartialMerkleTree) height() uint {
+	var height uint
+	for t.width(height) > 1 {
+		height++
+	}
+
+	return height
+}
+
+// calcHash returns hash of the node of the full tree
+func (t *PartialMerkleTree) calcHash(ids [][]byte, height uint, pos int) []byte {
+	if height == 0 {
+		return ids[pos]
+	}
+
+	left := t.calcHash(ids, height - 1, pos * 2)
+	right := left
+	if pos * 2 + 1 < t.width(height - 1) {
+		right = t.calcHash(ids, height - 1, pos * 2 + 1)
+	}
+
+	return hashPair(left, right)
+}
+
+// build adds the flag of the node and descends into it if a matched transaction is below,
+// otherwise the hash of the node is added
+func (t *PartialMerkleTree) build(ids [][]byte, matches []bool, height uint, pos int) {
+	parentOfMatch := false
+	for i := pos << height; i < (pos + 1) << height && i < t.Total; i++ {
+		parentOfMatch = parentOfMatch || matches[i]
+	}
+	t.Flags = append(t.Flags, parentOfMatch)
+
+	if height == 0 || !parentOfMatch {
+		t.Hashes = append(t.Hashes, t.calcHash(ids, height, pos))
+		return
+	}
+
+	t.build(ids, matches, height - 1, pos * 2)
+	if pos * 2 + 1 < t.width(height - 1) {
+		t.build(ids, matches, height - 1, pos * 2 + 1)
+	}
+}
+
+// merkleExtraction is the state of walking through the flags and hashes of the tree
+type merkleExtraction struct {
+	bitsUsed int
+	hashUsed int
+	matched  [][]byte
+}
+
+// Extract returns merkle root computed from the tree and ids of the matched transactions,
+// the error is returned if the tree is malformed
+func (t *PartialMerkleTree) Extract() ([]byte, [][]byte, error) {
+	if t.Total <= 0 || t.Total > maxMerkleLeaves {
+		return nil, nil, fmt.Errorf("Merkle tree has %d transactions ", t.Total)
+	}
+
+	if len(t.Hashes) > t.Total || len(t.Flags) < len(t.Hashes) {
+		return nil, nil, errors.New("Merkle tree has too many hashes ")
+	}
+
+	state := &merkleExtraction{}
+
+	root, err := t.extract(state, t.height(), 0)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if state.bitsUsed != len(t.Flags) || state.hashUsed != len(t.Hashes) {
+		return nil, nil, errors.New("Merkle tree has unused flags or hashes ")
+	}
+
+	return root, state.matched, nil
+}
+
+// extract returns hash of the node collecting matched transactions below it
+func (t *PartialMerkleTree) extract(state *merkleExtraction, height uint, pos int) ([]byte, error) {
+	if state.bitsUsed >= len(t.Flags) {
+		return nil, errors.New("Merkle tree has not enough flags ")
+	}
+
+	parentOfMatch := t.Flags[state.bitsUsed]
+	state.bitsUsed++
+
+	if height == 0 || !parentOfMatch {
+		if state.hashUsed >= len(t.Hashes) {
+			return nil, errors.New("Merkle tree has not enough hashes ")
+		}
+
+		hash := t.Hashes[state.hashUsed]
+		state.hashUsed++
+
+		if height == 0 && parentOfMatch {
+			state.matched = append(state.matched, hash)
+		}
+
+		return hash, nil
+	}
+
+	left, err := t.extract(state, height - 1, pos * 2)
+	if err != nil {
+		return nil, err
+	}
+
+	right := left
+	if pos * 2 + 1 < t.width(height - 1) {
+		right, err = t.extract(state, height - 1, pos * 2 + 1)
+		if err != nil {
+			return nil, err
+		}
+
+		// equal children would let the same tree prove another list of transactions
+		if bytes.Equal(left, right) {
+			return nil, errors.New("Merkle tree has equal children ")
+		}
+	}
+
+	return hashPair(left, right), nil
+}
@@ -0,0 +1,157 @@
+package blockchain
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	MainNetName = "main"
+	TestNetName = "test"
+	RegTestName = "regtest"
+)
+
+// ChainParams keeps parameters which define the network:
+// its genesis, consensus rules, addresses and the way nodes find each other
+type ChainParams struct {
+	Name string
+
+	// Magic identifies messages of the network on the wire
+	Magic [4]byte
+	DefaultPort string
+	SeedNodes   []string
+	// Seeders are services which crawl the network and give addresses of healthy nodes
+	Seeders    []string
+	SeederPort string
+
+	// AddressVersion is the first byte of base58 addresses
+	AddressVersion byte
+
+	// genesis block is built from these fields and must have the pinned hash
+	GenesisCoinbaseData string
+	GenesisTimestamp    int64
+	GenesisHash         string
+
+	TargetBits int
+	// Subsidy is the number of satoshies paid to the miner and to the stakeholder of a block
+	Subsidy          int
+	StakeholderConst string
+	// StakeVRF chooses stakeholders by the VRF output of the stakeholder of the parent block
+	// instead of the hash of the block, so miners can not choose them by grinding nonces
+	StakeVRF bool
+	// MineInterval is the pause of the mining node between blocks
+	MineInterval time.Duration
+	// StakeTimeout is how long the miner waits for the answer of the chosen stakeholder
+	// before the round falls back to the next derived index
+	StakeTimeout time.Duration
+	// MaxStakeAttempts is the number of attempts of the block right after its parent,
+	// one more attempt is allowed for every StakeTimeout between timestamps of the parent
+	// and the block which has passed by the clock of the node, so the miner can not try
+	// more stakeholders than rounds would ask
+	MaxStakeAttempts int
+	// MaxTimeDrift is how far timestamps of blocks may be ahead of the clock of the node
+	MaxTimeDrift time.Duration
+	// SelfStaking lets a node stake its blocks whoever owns the chosen satoshi,
+	// it also allows to generate blocks on demand and to move the clock
+	SelfStaking bool
+
+	// SnapshotHashes pins hashes of UTXO snapshots by height of their base block,
+	// snapshots at these heights must match the pinned hash, others are trusted
+	// only after blocks below them are downloaded and replayed
+	SnapshotHashes map[int]string
+}
+
+var MainNetParams = ChainParams{
+	Name: MainNetName,
+	Magic: [4]byte{0xb1, 0xb0, 0xc0, 0x01},
+	DefaultPort: "9000",
+	SeedNodes: []string{"172.20.10.12:9000"},
+	Seeders: []string{"172.20.10.12:9053"},
+	SeederPort: "9053",
+	AddressVersion: 0x00,
+	GenesisCoinbaseData: "We are ExtraSafe",
+	GenesisTimestamp: 1622505600,
+	GenesisHash: "54adf7db103da0f544c3fdf659b1511fdd715e605dd31d3775aced7c9db7d91f",
+	TargetBits: 1,
+	Subsidy: 10,
+	StakeholderConst: "so",
+	StakeVRF: true,
+	MineInterval: time.Second * 15,
+	StakeTimeout: time.Second * 10,
+	MaxStakeAttempts: 4,
+	MaxTimeDrift: time.Hour * 2,
+	SnapshotHashes: map[int]string{},
+}
+
+var TestNetParams = ChainParams{
+	Name: TestNetName,
+	Magic: [4]byte{0xb1, 0xb0, 0x7e, 0x57},
+	DefaultPort: "9100",
+	SeedNodes: []string{"127.0.0.1:9100"},
+	Seeders: []string{"127.0.0.1:9153"},
+	SeederPort: "9153",
+	AddressVersion: 0x6f,
+	GenesisCoinbaseData: "We are ExtraSafe testnet",
+	GenesisTimestamp: 1622505601,
+	GenesisHash: "6b67a37ee61bba9876e969c7d891f6090bedca7061d3d7ee10ad55064acdb587",
+	TargetBits: 1,
+	Subsidy: 10,
+	StakeholderConst: "so",
+	StakeVRF: true,
+	MineInterval: time.Second * 15,
+	StakeTimeout: time.Second * 10,
+	MaxStakeAttempts: 4,
+	MaxTimeDrift: time.Hour * 2,
+	SnapshotHashes: map[int]string{},
+}
+
+var RegTestParams = ChainParams{
+	Name: RegTestName,
+	Magic: [4]byte{0xb1, 0xb0, 0x4e, 0x67},
+	DefaultPort: "9200",
+	SeedNodes: []string{"127.0.0.1:9200"},
+	Seeders: []string{},
+	SeederPort: "9253",
+	AddressVersion: 0x6f,
+	GenesisCoinbaseData: "We are ExtraSafe regtest",
+	GenesisTimestamp: 1296688602,
+	GenesisHash: "b230383f8fb28f80ff98b1ff37768c5306b117cfd0325c14b6e7035aad64a839",
+	TargetBits: 0,
+	Subsidy: 10,
+	StakeholderConst: "so",
+	StakeVRF: true,
+	MineInterval: time.Second,
+	StakeTimeout: time.Second * 2,
+	MaxStakeAttempts: 4,
+	MaxTimeDrift: time.Hour * 2,
+	SelfStaking: true,
+	SnapshotHashes: map[int]string{},
+}
+
+// GetChainParams returns parameters of the network by its name
+func GetChainParams(name string) (*ChainParams, error) {
+	switch name {
+	case MainNetName:
+		return &MainNetParams, nil
+	case TestNetName:
+		return &TestNetParams, nil
+	case RegTestName:
+		return &RegTestParams, nil
+	}
+
+	return nil, fmt.Errorf("Unknown network %s ", name)
+}
+
+// DataFile returns name of the data file for the network,
+// files of the main network keep their names, others get the network suffix
+func (p *ChainParams) DataFile(file string) string {
+	if p.Name == MainNetName {
+		return file
+	}
+
+	ext := filepath.Ext(file)
+
+	return strings.TrimSuffix(file, ext) + "_" + p.Name + ext
+}
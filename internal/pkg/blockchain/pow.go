@@ -9,31 +9,40 @@ import (
 	"math/big"
 )
 
-const targetBits = 1
-
 type ProofOfWork struct {
-	block  *Block
-	target *big.Int
+	block      *Block
+	target     *big.Int
+	targetBits int
 }
 
-// NewProofOfWork returns newly created ProofOfWork
-func NewProofOfWork(b *Block) *ProofOfWork {
+// NewProofOfWork returns newly created ProofOfWork with the given difficulty
+func NewProofOfWork(b *Block, targetBits int) *ProofOfWork {
 	target := big.NewInt(1)
 	target.Lsh(target, uint(256 - targetBits))
 
-	pow := &ProofOfWork{block: b, target: target}
+	pow := &ProofOfWork{block: b, target: target, targetBits: targetBits}
 
 	return pow
 }
 
-// prepareData returns block data converted to bytes
+// work returns the expected number of hashes needed to find the proof of work
+func (pow *ProofOfWork) work() *big.Int {
+	max := big.NewInt(1)
+	max.Lsh(max, 256)
+
+	return max.Div(max, pow.target)
+}
+
+// prepareData returns block data converted to bytes, the root of the parent
+// is the last field, so blocks without it keep their hashes
 func (pow *ProofOfWork) prepareData(nonce int) []byte {
 	data := bytes.Join(
 		[][]byte{
 			pow.block.PrevBlockHash,
 			IntToHex(pow.block.Timestamp),
-			IntToHex(int64(targetBits)),
+			IntToHex(int64(pow.targetBits)),
 			IntToHex(int64(nonce)),
+			pow.block.ParentRoot,
 		},
 		[]byte{},
 	)
@@ -70,7 +79,7 @@ func (pow *ProofOfWork) Validate() bool {
 	hash := sha256.Sum256(data)
 	hashInt.SetBytes(hash[:])
 
-	isValid := hashInt.Cmp(pow.target) == -1
+	isValid := hashInt.Cmp(pow.target) == -1 && bytes.Equal(hash[:], pow.block.Hash)
 
 	return isValid
 }
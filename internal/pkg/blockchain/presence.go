@@ -0,0 +1,49 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"github.com/keithzetterstrom/BibCoin/tools/base58"
+)
+
+// Presence announces that the stakeholder with the public key is online
+// and answers miners at the network address until Expires (unix time)
+type Presence struct {
+	PubKey    []byte
+	NetAddr   string
+	Expires   int64
+	Signature []byte
+}
+
+// NewPresence returns Presence of the stakeholder signed with its key
+func NewPresence(netAddr string, expires int64, privKey ecdsa.PrivateKey, pubKey []byte) *Presence {
+	presence := &Presence{
+		PubKey: pubKey,
+		NetAddr: netAddr,
+		Expires: expires,
+	}
+	presence.Signature = signData(privKey, presence.signedData())
+
+	return presence
+}
+
+// PubKeyHash returns hash of the public key of the stakeholder, satoshis are owned by it
+func (p *Presence) PubKeyHash() []byte {
+	return base58.HashPubKey(p.PubKey)
+}
+
+// signedData returns hash of the fields of Presence covered by the signature
+func (p *Presence) signedData() []byte {
+	data := sha256.Sum256(bytes.Join(
+		[][]byte{p.PubKey, []byte(p.NetAddr), IntToHex(p.Expires)},
+		[]byte{},
+	))
+
+	return data[:]
+}
+
+// Verify returns true if Presence is signed with its public key
+func (p *Presence) Verify() bool {
+	return verifyData(p.PubKey, p.signedData(), p.Signature)
+}
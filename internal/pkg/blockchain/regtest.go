@@ -0,0 +1,97 @@
+package blockchain
+
+import (
+	"encoding/binary"
+	"errors"
+	"github.com/boltdb/bolt"
+	walletpkg "github.com/keithzetterstrom/BibCoin/internal/pkg/wallet"
+	"log"
+	"time"
+)
+
+const errorNotRegTest = "Command is available only in regtest "
+
+var timeOffsetKey = []byte("timeoffset")
+
+// nodeTime returns current time of the node shifted by WarpTime as it is stored in the transaction
+func nodeTime(tx *bolt.Tx) time.Time {
+	var offset int64
+
+	data := tx.Bucket([]byte(metaBucket)).Get(timeOffsetKey)
+	if data != nil {
+		offset = int64(binary.BigEndian.Uint64(data))
+	}
+
+	return time.Now().Add(time.Duration(offset) * time.Second)
+}
+
+// Now returns current time of the node shifted by WarpTime
+func (bc *Blockchain) Now() time.Time {
+	var now time.Time
+
+	err := bc.Db.View(func(tx *bolt.Tx) error {
+		now = nodeTime(tx)
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return now
+}
+
+// WarpTime moves the clock of the node forward by the given number of seconds
+func (bc *Blockchain) WarpTime(seconds int64) error {
+	if !bc.Params.SelfStaking {
+		return errors.New(errorNotRegTest)
+	}
+
+	if seconds < 0 {
+		return errors.New("Time can be moved only forward ")
+	}
+
+	return bc.Db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(metaBucket))
+
+		var offset int64
+		if data := b.Get(timeOffsetKey); data != nil {
+			offset = int64(binary.BigEndian.Uint64(data))
+		}
+
+		return b.Put(timeOffsetKey, IntToHex(offset + seconds))
+	})
+}
+
+// GenerateBlocks mines n blocks with the given transactions in the first one,
+// the address of the wallet gets rewards both as the miner and as the stakeholder
+// and the wallet signs extensions of the blocks
+func (bc *Blockchain) GenerateBlocks(n int, wallet *walletpkg.Wallet, transactions []*Transaction) ([][]byte, error) {
+	if !bc.Params.SelfStaking {
+		return nil, errors.New(errorNotRegTest)
+	}
+
+	address := string(wallet.GetAddress(bc.Params.AddressVersion))
+
+	var hashes [][]byte
+
+	for i := 0; i < n; i++ {
+		lastIndex, err := bc.GetLastSatoshiIndex()
+		if err != nil {
+			return hashes, err
+		}
+
+		cbTx := NewCoinbaseTX(address, address, "", lastIndex, bc.Params.Subsidy)
+		txs := append([]*Transaction{cbTx}, transactions...)
+		transactions = nil
+
+		block := bc.MineBlock(address)
+		extensionBlock, err := bc.AddNewBlock(block, txs, wallet)
+		if err != nil {
+			return hashes, err
+		}
+
+		hashes = append(hashes, extensionBlock.Hash)
+	}
+
+	return hashes, nil
+}
@@ -0,0 +1,487 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"io/ioutil"
+	"sort"
+)
+
+const (
+	errorSnapshotNotTrusted = "Snapshot hash does not match the hash pinned in chain parameters "
+	errorSnapshotInvalid    = "Snapshot does not match downloaded blocks "
+	errorChainNotEmpty      = "Snapshot can be loaded only into blockchain with genesis block "
+)
+
+const (
+	snapshotUTXOBucket     = "snapshotchainstate"
+	snapshotUndoBucket     = "snapshotundo"
+	snapshotEvidenceBucket = "snapshotevidence"
+)
+
+var (
+	snapshotKey     = []byte("snapshot")
+	snapshotHashKey = []byte("snapshothash")
+)
+
+// errRollback is returned from bolt transactions which are used
+// only to calculate something and must not change database
+var errRollback = errors.New("rollback")
+
+type snapshotEntry struct {
+	TxID    []byte
+	Outputs TXOutputs
+}
+
+// snapshotEvidence is the key of the processed evidence and the hash of the block which processed it
+type snapshotEvidence struct {
+	Key       []byte
+	BlockHash []byte
+}
+
+// Snapshot is the UTXO set at the given height together with headers
+// from genesis and the base block needed to continue the chain from it.
+// Evidence processed below the height is kept, so it is not processed again
+type Snapshot struct {
+	Height   int
+	Hash     []byte
+	Headers  []Block
+	Base     ExtensionBlock
+	Entries  []snapshotEntry
+	Evidence []snapshotEvidence
+}
+
+// hashOutputs returns sha256 hash of the UTXO set kept in bucket b and of the processed
+// evidence kept in bucket eb, bolt iterates keys in sorted order so the hash does not
+// depend on insertion order
+func hashOutputs(b, eb *bolt.Bucket) ([]byte, error) {
+	h := sha256.New()
+	c := b.Cursor()
+
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		outs, err := DeserializeOutputs(v)
+		if err != nil {
+			return nil, err
+		}
+
+		var indexes []int
+		for idx := range outs.Outputs {
+			indexes = append(indexes, idx)
+		}
+		sort.Ints(indexes)
+
+		h.Write(k)
+		for _, idx := range indexes {
+			out := outs.Outputs[idx]
+			h.Write(IntToHex(int64(idx)))
+			h.Write(IntToHex(int64(len(out.Value))))
+			for _, satoshi := range out.Value {
+				h.Write(IntToHex(int64(satoshi)))
+			}
+			h.Write(out.PubKeyHash)
+			h.Write(outs.Delegates[idx])
+		}
+	}
+
+	c = eb.Cursor()
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		h.Write(k)
+		h.Write(v)
+	}
+
+	return h.Sum(nil), nil
+}
+
+// DumpUTXO writes snapshot of the UTXO set at the given height to file
+// and returns hash of the set. Blocks above the height are disconnected
+// in a transaction which is rolled back, so they must not be pruned
+func (bc *Blockchain) DumpUTXO(height int, file string) ([]byte, error) {
+	var snapshot Snapshot
+
+	err := bc.Db.Update(func(tx *bolt.Tx) error {
+		header, err := getHeader(tx, bc.Tip)
+		if err != nil {
+			return err
+		}
+
+		if height < 1 || height > header.Height {
+			return fmt.Errorf("Height %d is out of chain ", height)
+		}
+
+		for header.Height > height {
+			header, err = disconnectBlock(tx, header)
+			if err != nil {
+				return err
+			}
+		}
+
+		base, err := getBody(tx, header.Hash)
+		if err != nil {
+			return err
+		}
+
+		snapshot.Height = height
+		snapshot.Base = *base
+
+		for {
+			snapshot.Headers = append([]Block{*header}, snapshot.Headers...)
+			if len(header.PrevBlockHash) == 0 {
+				break
+			}
+
+			header, err = getHeader(tx, header.PrevBlockHash)
+			if err != nil {
+				return err
+			}
+		}
+
+		b := tx.Bucket([]byte(utxoBucket))
+		err = b.ForEach(func(k, v []byte) error {
+			outs, err := DeserializeOutputs(v)
+			if err != nil {
+				return err
+			}
+
+			snapshot.Entries = append(snapshot.Entries, snapshotEntry{
+				TxID: append([]byte{}, k...),
+				Outputs: outs,
+			})
+
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		eb := tx.Bucket([]byte(evidenceBucket))
+		err = eb.ForEach(func(k, v []byte) error {
+			snapshot.Evidence = append(snapshot.Evidence, snapshotEvidence{
+				Key: append([]byte{}, k...),
+				BlockHash: append([]byte{}, v...),
+			})
+
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		snapshot.Hash, err = hashOutputs(b, eb)
+		if err != nil {
+			return err
+		}
+
+		return errRollback
+	})
+	if err != errRollback {
+		return nil, err
+	}
+
+	var content bytes.Buffer
+	err = gob.NewEncoder(&content).Encode(snapshot)
+	if err != nil {
+		return nil, err
+	}
+
+	err = ioutil.WriteFile(file, content.Bytes(), 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return snapshot.Hash, nil
+}
+
+// LoadSnapshot loads UTXO snapshot from file into Blockchain which has only genesis.
+// If the snapshot height is pinned in chain parameters the hash must match the pinned one.
+// Blocks below the snapshot base are downloaded later and checked by ValidateSnapshot,
+// pruned nodes download them too, so snapshots which are not pinned are validated as well
+func (bc *Blockchain) LoadSnapshot(file string) error {
+	genesis, err := GenesisBlock(bc.Params)
+	if err != nil {
+		return err
+	}
+
+	if bc.Tip != nil && !bytes.Equal(bc.Tip, genesis.Hash) {
+		return errors.New(errorChainNotEmpty)
+	}
+
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+
+	var snapshot Snapshot
+	err = gob.NewDecoder(bytes.NewReader(content)).Decode(&snapshot)
+	if err != nil {
+		return err
+	}
+
+	pinned, ok := bc.Params.SnapshotHashes[snapshot.Height]
+	if ok && pinned != hex.EncodeToString(snapshot.Hash) {
+		return errors.New(errorSnapshotNotTrusted)
+	}
+
+	err = validateHeaders(snapshot.Headers, bc.Params.TargetBits)
+	if err != nil {
+		return err
+	}
+
+	if !bytes.Equal(snapshot.Headers[0].Hash, genesis.Hash) {
+		return errors.New(errorGenesisMismatch)
+	}
+
+	last := snapshot.Headers[len(snapshot.Headers) - 1]
+	if !bytes.Equal(last.Hash, snapshot.Base.Hash) || last.Height != snapshot.Height {
+		return errors.New("Snapshot base block does not match headers ")
+	}
+
+	err = bc.Db.Update(func(tx *bolt.Tx) error {
+		hb := tx.Bucket([]byte(HeadersBucket))
+		for _, header := range snapshot.Headers {
+			err := hb.Put(header.Hash, header.Serialize())
+			if err != nil {
+				return err
+			}
+		}
+
+		b := tx.Bucket([]byte(BlocksBucket))
+		err := b.Put(snapshot.Base.Hash, snapshot.Base.Serialize())
+		if err != nil {
+			return err
+		}
+
+		ub := tx.Bucket([]byte(utxoBucket))
+		for _, entry := range snapshot.Entries {
+			err = ub.Put(entry.TxID, entry.Outputs.Serialize())
+			if err != nil {
+				return err
+			}
+		}
+
+		eb := tx.Bucket([]byte(evidenceBucket))
+		for _, evidence := range snapshot.Evidence {
+			err = eb.Put(evidence.Key, evidence.BlockHash)
+			if err != nil {
+				return err
+			}
+		}
+
+		hash, err := hashOutputs(ub, eb)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(hash, snapshot.Hash) {
+			return errors.New("Snapshot outputs do not match its hash ")
+		}
+
+		err = b.Put([]byte("l"), snapshot.Base.Hash)
+		if err != nil {
+			return err
+		}
+
+		err = setHeaderTip(tx, &last)
+		if err != nil {
+			return err
+		}
+
+		meta := tx.Bucket([]byte(metaBucket))
+		err = meta.Put(snapshotHashKey, snapshot.Hash)
+		if err != nil {
+			return err
+		}
+
+		return meta.Put(snapshotKey, snapshot.Base.Hash)
+	})
+	if err != nil {
+		return err
+	}
+	bc.Tip = snapshot.Base.Hash
+
+	return nil
+}
+
+// validateHeaders returns error if headers do not form a chain
+// starting from genesis or their proof of work is invalid
+func validateHeaders(headers []Block, targetBits int) error {
+	if len(headers) == 0 || len(headers[0].PrevBlockHash) != 0 {
+		return errors.New("Headers do not start from genesis ")
+	}
+
+	for i := range headers {
+		if !NewProofOfWork(&headers[i], targetBits).Validate() {
+			return fmt.Errorf("Header %x is invalid ", headers[i].Hash)
+		}
+
+		if i == 0 {
+			continue
+		}
+
+		if !bytes.Equal(headers[i].PrevBlockHash, headers[i - 1].Hash) || headers[i].Height != headers[i - 1].Height + 1 {
+			return fmt.Errorf("Header %x is not connected ", headers[i].Hash)
+		}
+	}
+
+	return nil
+}
+
+// NeedsBackfill returns true if Blockchain was loaded from snapshot
+// and blocks below the snapshot are not downloaded and validated yet
+func (bc *Blockchain) NeedsBackfill() bool {
+	needs := false
+
+	_ = bc.Db.View(func(tx *bolt.Tx) error {
+		needs = tx.Bucket([]byte(metaBucket)).Get(snapshotKey) != nil
+		return nil
+	})
+
+	return needs
+}
+
+// MissingBlocks returns up to max hashes of blocks below the snapshot base
+// which are not downloaded yet, starting from the oldest one
+func (bc *Blockchain) MissingBlocks(max int) [][]byte {
+	var missing [][]byte
+
+	err := bc.Db.View(func(tx *bolt.Tx) error {
+		hash := tx.Bucket([]byte(metaBucket)).Get(snapshotKey)
+		b := tx.Bucket([]byte(BlocksBucket))
+
+		for len(hash) != 0 {
+			header, err := getHeader(tx, hash)
+			if err != nil {
+				return err
+			}
+
+			if b.Get(header.Hash) == nil {
+				missing = append(missing, header.Hash)
+			}
+			hash = header.PrevBlockHash
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil
+	}
+
+	if len(missing) > max {
+		missing = missing[len(missing) - max:]
+	}
+
+	for i, j := 0, len(missing) - 1; i < j; i, j = i + 1, j - 1 {
+		missing[i], missing[j] = missing[j], missing[i]
+	}
+
+	return missing
+}
+
+// ValidateSnapshot replays all blocks from genesis to the snapshot base and compares
+// the resulting UTXO set with the hash of the loaded snapshot. Pruned nodes keep
+// the blocks until they are replayed and prune them after the snapshot is validated
+func (bc *Blockchain) ValidateSnapshot() error {
+	valid := false
+
+	err := bc.Db.Update(func(tx *bolt.Tx) error {
+		meta := tx.Bucket([]byte(metaBucket))
+		hash := meta.Get(snapshotKey)
+		if hash == nil {
+			return errors.New("Snapshot is not loaded ")
+		}
+		loaded := append([]byte{}, meta.Get(snapshotHashKey)...)
+
+		var headers []*Block
+		for len(hash) != 0 {
+			header, err := getHeader(tx, hash)
+			if err != nil {
+				return err
+			}
+			headers = append(headers, header)
+			hash = header.PrevBlockHash
+		}
+
+		b, err := tx.CreateBucket([]byte(snapshotUTXOBucket))
+		if err != nil {
+			return err
+		}
+		ub, err := tx.CreateBucket([]byte(snapshotUndoBucket))
+		if err != nil {
+			return err
+		}
+		eb, err := tx.CreateBucket([]byte(snapshotEvidenceBucket))
+		if err != nil {
+			return err
+		}
+
+		for i := len(headers) - 1; i >= 0; i-- {
+			block, err := getBody(tx, headers[i].Hash)
+			if err != nil {
+				return err
+			}
+
+			err = checkParentRoot(tx, block)
+			if err != nil {
+				return err
+			}
+
+			err = connectOutputs(b, ub, eb, block, bc.Params.Subsidy)
+			if err != nil {
+				return err
+			}
+		}
+
+		computed, err := hashOutputs(b, eb)
+		if err != nil {
+			return err
+		}
+
+		valid = bytes.Equal(loaded, computed)
+
+		return errRollback
+	})
+	if err != errRollback {
+		return err
+	}
+
+	if !valid {
+		return errors.New(errorSnapshotInvalid)
+	}
+
+	return bc.Db.Update(func(tx *bolt.Tx) error {
+		meta := tx.Bucket([]byte(metaBucket))
+		base := meta.Get(snapshotKey)
+
+		err := meta.Delete(snapshotKey)
+		if err != nil {
+			return err
+		}
+		err = meta.Delete(snapshotHashKey)
+		if err != nil {
+			return err
+		}
+
+		if !bc.IsPruned() {
+			return nil
+		}
+
+		header, err := getHeader(tx, base)
+		if err != nil {
+			return err
+		}
+		tip, err := getHeader(tx, bc.Tip)
+		if err != nil {
+			return err
+		}
+
+		// blocks above the base are pruned as usual
+		if tip.Height - header.Height < bc.PruneDepth {
+			return nil
+		}
+
+		return pruneBodies(tx, header)
+	})
+}
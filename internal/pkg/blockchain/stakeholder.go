@@ -1,34 +1,349 @@
 package blockchain
 
 import (
-	"hash/fnv"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"github.com/keithzetterstrom/BibCoin/tools/base58"
+	"log"
 	"math"
+	"math/big"
+	"time"
 )
 
-type rangeBounds struct {
-	b1, b2 int
+// GetStakeholderIndexByHash returns index of the satoshi in [0, lastIndex] chosen by the seed
+func GetStakeholderIndexByHash(seed []byte, lastIndex int, stakeholderConst string) int {
+	return GetStakeholderIndexByAttempt(seed, 0, lastIndex, stakeholderConst)
 }
 
-// mapRange converts number from first range to second range
-func mapRange(x, y rangeBounds, n int) int {
-	return y.b1 + (n - x.b1) * (y.b2 - y.b1) / (x.b2 - x.b1)
+// GetStakeholderIndexByAttempt returns index of the satoshi in [0, lastIndex] chosen by the seed
+// for the attempt of the round. Index is the remainder of the sha256 hash of the seed, the attempt
+// and the counter. Hashes above the largest multiple of the number of satoshis are rejected
+// and the counter is incremented, so every satoshi is chosen with the same probability
+func GetStakeholderIndexByAttempt(seed []byte, attempt, lastIndex int, stakeholderConst string) int {
+	count := uint64(lastIndex) + 1
+	// 2^64 mod count values at the top of the range are rejected
+	limit := uint64(math.MaxUint64) - (uint64(math.MaxUint64) % count + 1) % count
+
+	for counter := 0; ; counter++ {
+		hash := sha256.Sum256(bytes.Join(
+			[][]byte{seed, []byte(stakeholderConst), IntToHex(int64(attempt)), IntToHex(int64(counter))},
+			[]byte{},
+		))
+
+		value := binary.BigEndian.Uint64(hash[:8])
+		if value <= limit {
+			return int(value % count)
+		}
+	}
+}
+
+// stakeSeed returns the seed stakeholders of the block are chosen by. With StakeVRF the seed
+// is the VRF output of the stakeholder of the parent block, it does not depend on the block,
+// so the miner can not grind nonces to choose the stakeholder, and the stakeholder of the parent
+// can not choose it either. Hash of the block is the seed when the parent is genesis or the block
+// stored unsigned before extensions were signed, other parents must have valid VRF proofs
+func (bc *Blockchain) stakeSeed(parent *ExtensionBlock, block *Block) ([]byte, error) {
+	if !bc.Params.StakeVRF || len(parent.PrevBlockHash) == 0 || len(parent.Signature) == 0 {
+		return block.Hash, nil
+	}
+
+	output, err := parent.VRFOutput()
+	if err != nil {
+		return nil, &InvalidBlockError{fmt.Sprintf("Parent %x of block %x has no valid VRF proof ", parent.Hash, block.Hash)}
+	}
+
+	return output, nil
+}
+
+// stakeAttempts returns the number of attempts of the block in which its stakeholder may be chosen
+// at the given unix time. The time since the parent is counted up to the timestamp of the block
+// and not beyond now, so the miner stamping the block ahead within MaxTimeDrift does not get
+// attempts before the time of them comes
+func stakeAttempts(params *ChainParams, parent, block *Block, now int64) int {
+	end := block.Timestamp
+	if now < end {
+		end = now
+	}
+
+	elapsed := time.Duration(end - parent.Timestamp) * time.Second
+	if elapsed < 0 {
+		elapsed = 0
+	}
+
+	return params.MaxStakeAttempts + int(elapsed / params.StakeTimeout)
+}
+
+// StakeAttempts returns the number of attempts of the block on top of the chain
+// in which its stakeholder may be chosen now
+func (bc *Blockchain) StakeAttempts(block *Block) (int, error) {
+	var attempts int
+
+	err := bc.Db.View(func(tx *bolt.Tx) error {
+		parent, err := getHeader(tx, block.PrevBlockHash)
+		if err != nil {
+			return err
+		}
+		attempts = stakeAttempts(bc.Params, parent, block, nodeTime(tx).Unix())
+
+		return nil
+	})
+
+	return attempts, err
+}
+
+// stakeholderIndex returns index of the satoshi chosen for the attempt of the block among
+// satoshis minted in the parent of the block. Satoshis are minted from index 1, the last index
+// is the first satoshi of the next block, so they are not chosen. Zero is returned
+// if no satoshi is minted yet
+func (bc *Blockchain) stakeholderIndex(tx *bolt.Tx, block *Block, attempt int) (int, error) {
+	parent, err := getBody(tx, block.PrevBlockHash)
+	if err != nil {
+		return 0, err
+	}
+
+	lastIndex := lastSatoshiIndex(parent)
+	if lastIndex <= 1 {
+		return 0, nil
+	}
+
+	seed, err := bc.stakeSeed(parent, block)
+	if err != nil {
+		return 0, err
+	}
+
+	return GetStakeholderIndexByAttempt(seed, attempt, lastIndex - 2, bc.Params.StakeholderConst) + 1, nil
+}
+
+// StakeholderIndex returns index of the satoshi chosen for the attempt of the block on top of the chain
+func (bc *Blockchain) StakeholderIndex(block *Block, attempt int) (int, error) {
+	var index int
+
+	err := bc.Db.View(func(tx *bolt.Tx) error {
+		var err error
+		index, err = bc.stakeholderIndex(tx, block, attempt)
+
+		return err
+	})
+
+	return index, err
+}
+
+// checkStakeholder returns ErrStakeholderIndexNotFound if the public key hash does not stake
+// the satoshi chosen for the attempt of the block in the UTXO set of the transaction,
+// InvalidBlockError is returned if the attempt is not allowed by the timestamp of the block.
+// The attempt allowed by the timestamp but not by the clock of the node is rejected
+// with an ordinary error, the block may be valid later
+func (bc *Blockchain) checkStakeholder(tx *bolt.Tx, block *Block, attempt int, pubKeyHash []byte) error {
+	parent, err := getHeader(tx, block.PrevBlockHash)
+	if err != nil {
+		return err
+	}
+
+	if attempts := stakeAttempts(bc.Params, parent, block, block.Timestamp); attempt < 0 || attempt >= attempts {
+		return &InvalidBlockError{fmt.Sprintf("Attempt %d of block %x is out of %d allowed attempts ", attempt, block.Hash, attempts)}
+	}
+
+	if attempts := stakeAttempts(bc.Params, parent, block, nodeTime(tx).Unix()); attempt >= attempts {
+		return fmt.Errorf("Attempt %d of block %x is not allowed yet, %d attempts are allowed now ", attempt, block.Hash, attempts)
+	}
+
+	stakeholderIndex, err := bc.stakeholderIndex(tx, block, attempt)
+	if err != nil {
+		return err
+	}
+
+	// the first block after genesis is staked by anyone, no satoshi is minted before it
+	if bc.Params.SelfStaking || stakeholderIndex == 0 {
+		return nil
+	}
+
+	owner, staker, err := findSatoshiStaker(tx, stakeholderIndex)
+	if err != nil {
+		return err
+	}
+
+	if owner == nil || !bytes.Equal(staker, pubKeyHash) {
+		return ErrStakeholderIndexNotFound
+	}
+
+	return nil
 }
 
-func hash(s []byte) uint32 {
-	h := fnv.New32a()
-	h.Write(s)
-	return h.Sum32()
+// CheckStakeholder returns ErrStakeholderIndexNotFound if the public key hash does not stake
+// the satoshi chosen for the attempt of the block, delegated satoshis are staked by the delegate only.
+// Satoshis burned by evidence are not staked by anyone, the miner falls back to the next attempt
+func (bc *Blockchain) CheckStakeholder(block *Block, attempt int, pubKeyHash []byte) error {
+	return bc.Db.View(func(tx *bolt.Tx) error {
+		return bc.checkStakeholder(tx, block, attempt, pubKeyHash)
+	})
 }
 
-// GetStakeholderIndexByHash returns stakeholder index by given hash
-func GetStakeholderIndexByHash(blockHash []byte, lastIndex int) int {
-	blockHash = append(blockHash, []byte(stakeholderConst)...)
-	hash := hash(blockHash)
+// stakeOwner returns public key hash of the owner of the delegated satoshi chosen
+// for the attempt of the block in the UTXO set of the transaction
+func (bc *Blockchain) stakeOwner(tx *bolt.Tx, block *Block, attempt int) ([]byte, error) {
+	stakeholderIndex, err := bc.stakeholderIndex(tx, block, attempt)
+	if err != nil {
+		return nil, err
+	}
+
+	owner, staker, err := findSatoshiStaker(tx, stakeholderIndex)
+	if err != nil || bytes.Equal(owner, staker) {
+		return nil, err
+	}
+
+	return owner, nil
+}
+
+// StakeOwner returns public key hash of the owner of the satoshi chosen for the attempt of the block,
+// the stake reward is paid to it. Nil is returned if the satoshi is not delegated, the stakeholder
+// chooses the address of the reward itself
+func (bc *Blockchain) StakeOwner(block *Block, attempt int) ([]byte, error) {
+	var owner []byte
+
+	err := bc.Db.View(func(tx *bolt.Tx) error {
+		var err error
+		owner, err = bc.stakeOwner(tx, block, attempt)
+
+		return err
+	})
+
+	return owner, err
+}
+
+// checkStake returns error if the extension is not signed by the stakeholder chosen
+// for its attempt in the UTXO set of the transaction, which must be the state of the parent
+func (bc *Blockchain) checkStake(tx *bolt.Tx, block *ExtensionBlock) error {
+	err := block.VerifySignature(bc.Params.StakeVRF)
+	if err != nil {
+		return err
+	}
+
+	err = bc.checkStakeholder(tx, &block.Block, block.Attempt, base58.HashPubKey(block.StakeholderPubKey))
+	if err != nil {
+		return err
+	}
+
+	// the delegate can not take rewards of the stake it does not own
+	owner, err := bc.stakeOwner(tx, &block.Block, block.Attempt)
+	if err != nil || owner == nil {
+		return err
+	}
+
+	for _, tnx := range block.Transactions {
+		if !tnx.IsCoinbase() {
+			continue
+		}
+
+		paid := false
+		for _, out := range tnx.Vout {
+			paid = paid || out.IsLockedWithKey(owner)
+		}
+		if !paid {
+			return &InvalidBlockError{fmt.Sprintf("Extension of block %x does not pay stake reward to owner %x ", block.Hash, owner)}
+		}
+	}
+
+	return nil
+}
+
+// CheckStake returns error if the extension of the block on top of the chain
+// is not signed by the stakeholder chosen for its attempt
+func (bc *Blockchain) CheckStake(block *ExtensionBlock) error {
+	return bc.Db.View(func(tx *bolt.Tx) error {
+		return bc.checkStake(tx, block)
+	})
+}
+
+// connectedStake returns InvalidBlockError if the extension of the connected block
+// is not signed by its stakeholder, blocks are connected on the UTXO set of their parents
+func (bc *Blockchain) connectedStake(tx *bolt.Tx, block *ExtensionBlock) error {
+	if len(block.PrevBlockHash) == 0 {
+		return nil
+	}
+
+	err := bc.checkStake(tx, block)
+	if err == ErrStakeholderIndexNotFound {
+		return &InvalidBlockError{fmt.Sprintf("Extension of block %x is not signed by its stakeholder ", block.Hash)}
+	}
+
+	return err
+}
+
+// Decline is the answer of the chosen stakeholder which does not extend the block,
+// it is signed, so only the stakeholder can end the round of the block
+type Decline struct {
+	Hash      []byte
+	Attempt   int
+	Reason    string
+	PubKey    []byte
+	Signature []byte
+}
+
+// NewDecline returns Decline of the attempt of the block signed with the key of the stakeholder
+func NewDecline(blockHash []byte, attempt int, reason string, privKey ecdsa.PrivateKey, pubKey []byte) *Decline {
+	decline := &Decline{
+		Hash: blockHash,
+		Attempt: attempt,
+		Reason: reason,
+		PubKey: pubKey,
+	}
+	decline.Signature = signData(privKey, decline.signedData())
+
+	return decline
+}
+
+// signedData returns hash of the fields of Decline covered by the signature
+func (d *Decline) signedData() []byte {
+	data := sha256.Sum256(bytes.Join(
+		[][]byte{d.Hash, IntToHex(int64(d.Attempt)), []byte(d.Reason), d.PubKey},
+		[]byte{},
+	))
+
+	return data[:]
+}
+
+// Verify returns true if Decline is signed with its public key
+func (d *Decline) Verify() bool {
+	return verifyData(d.PubKey, d.signedData(), d.Signature)
+}
+
+// signData returns signature of the data, halves of the signature have the same length
+func signData(privKey ecdsa.PrivateKey, data []byte) []byte {
+	r, s, err := ecdsa.Sign(rand.Reader, &privKey, data)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	signature := make([]byte, 64)
+	r.FillBytes(signature[:32])
+	s.FillBytes(signature[32:])
+
+	return signature
+}
+
+// verifyData returns true if the signature of the data is made with the public key
+func verifyData(pubKey, data, signature []byte) bool {
+	if len(pubKey) != 64 || len(signature) != 64 {
+		return false
+	}
+
+	r := big.Int{}
+	s := big.Int{}
+	r.SetBytes(signature[:32])
+	s.SetBytes(signature[32:])
 
-	r1 := rangeBounds{0, math.MaxUint32}
-	r2 := rangeBounds{0, lastIndex}
+	x := big.Int{}
+	y := big.Int{}
+	x.SetBytes(pubKey[:32])
+	y.SetBytes(pubKey[32:])
 
-	n := int(hash)
+	rawPubKey := ecdsa.PublicKey{Curve: elliptic.P256(), X: &x, Y: &y}
 
-	return mapRange(r1, r2, n)
+	return ecdsa.Verify(&rawPubKey, data, &r, &s)
 }
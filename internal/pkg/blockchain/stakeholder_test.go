@@ -0,0 +1,176 @@
+package blockchain
+
+import (
+	"crypto/sha256"
+	walletpkg "github.com/keithzetterstrom/BibCoin/internal/pkg/wallet"
+	"math"
+	"testing"
+	"time"
+)
+
+// samplesPerIndex is the expected number of times every index is chosen in uniformity checks
+const samplesPerIndex = 2000
+
+// chiSquareZ is the quantile of the normal distribution, uniform selection fails
+// the check with probability 0.001
+const chiSquareZ = 3.09
+
+// chiSquareCritical returns critical value of the chi-square distribution with df degrees
+// of freedom by the Wilson-Hilferty approximation
+func chiSquareCritical(df int) float64 {
+	k := float64(df)
+	t := 1 - 2 / (9 * k) + chiSquareZ * math.Sqrt(2 / (9 * k))
+
+	return k * t * t * t
+}
+
+// TestStakeholderIndexUniform checks by the chi-square test that every satoshi is chosen
+// with the same probability, ranges which are not powers of two are biased by plain remainders
+func TestStakeholderIndexUniform(t *testing.T) {
+	for _, count := range []int{1, 2, 3, 10, 97, 1000} {
+		for attempt := 0; attempt < 2; attempt++ {
+			counts := make([]int, count)
+
+			for i := 0; i < count * samplesPerIndex; i++ {
+				seed := sha256.Sum256(IntToHex(int64(i)))
+
+				index := GetStakeholderIndexByAttempt(seed[:], attempt, count - 1, "so")
+				if index < 0 || index >= count {
+					t.Fatalf("Index %d is out of range of %d satoshis", index, count)
+				}
+				counts[index]++
+			}
+
+			if count == 1 {
+				continue
+			}
+
+			chiSquare := 0.0
+			for _, observed := range counts {
+				diff := float64(observed - samplesPerIndex)
+				chiSquare += diff * diff / samplesPerIndex
+			}
+
+			if critical := chiSquareCritical(count - 1); chiSquare > critical {
+				t.Errorf("Selection of %d satoshis in attempt %d is not uniform: chi-square %.1f above %.1f",
+					count, attempt, chiSquare, critical)
+			}
+		}
+	}
+}
+
+// TestStakeAttempts checks that one attempt is added for every StakeTimeout
+// since the parent and the time after the clock of the node is not counted
+func TestStakeAttempts(t *testing.T) {
+	params := &RegTestParams
+	timeout := int64(params.StakeTimeout / time.Second)
+	parent := &Block{Timestamp: 1000}
+
+	tests := []struct {
+		name      string
+		timestamp int64
+		now       int64
+		attempts  int
+	}{
+		{"right after parent", 1001, 1001, params.MaxStakeAttempts},
+		{"timeout later", 1000 + timeout, 1000 + timeout, params.MaxStakeAttempts + 1},
+		{"clock after block", 1000 + timeout, 1000 + 10 * timeout, params.MaxStakeAttempts + 1},
+		{"stamped ahead of clock", 1000 + 10 * timeout, 1001, params.MaxStakeAttempts},
+		{"clock before parent", 1000 + timeout, 900, params.MaxStakeAttempts},
+	}
+
+	for _, test := range tests {
+		attempts := stakeAttempts(params, parent, &Block{Timestamp: test.timestamp}, test.now)
+		if attempts != test.attempts {
+			t.Errorf("%s: %d attempts instead of %d", test.name, attempts, test.attempts)
+		}
+	}
+}
+
+// TestStoreHeaderTimestamp checks that the header stamped not after its parent is rejected
+func TestStoreHeaderTimestamp(t *testing.T) {
+	bc, wallet := newTestBlockchain(t, 2)
+	tip := bc.NewIterator().Next()
+	address := string(wallet.GetAddress(bc.Params.AddressVersion))
+
+	stale := NewBlock(tip.Hash, tip.MerkleRoot, tip.Height + 1, address, bc.Params.TargetBits, tip.Timestamp)
+	if _, ok := bc.AddHeaders([]Block{*stale}).(*InvalidBlockError); !ok {
+		t.Error("Header stamped at the time of its parent is accepted")
+	}
+
+	next := NewBlock(tip.Hash, tip.MerkleRoot, tip.Height + 1, address, bc.Params.TargetBits, tip.Timestamp + 1)
+	if err := bc.AddHeaders([]Block{*next}); err != nil {
+		t.Errorf("Header stamped after its parent is rejected: %s", err)
+	}
+}
+
+// signWithoutVRF returns the extension of the block signed by the wallet without VRF proof
+func signWithoutVRF(block *Block, wallet *walletpkg.Wallet) *ExtensionBlock {
+	extension := NewExtensionBlock(nil, block)
+	extension.Sign(wallet.PrivateKey, wallet.PublicKey)
+	extension.VRFProof = nil
+	extension.Signature = signData(wallet.PrivateKey, extension.signedData())
+
+	return extension
+}
+
+// TestVerifySignatureVRF checks that signed extensions must have valid VRF proofs
+// when stakeholders are chosen by them
+func TestVerifySignatureVRF(t *testing.T) {
+	wallet := walletpkg.NewWallet()
+	block := NewBlock([]byte("parent"), nil, 2, "miner", 0, 1000)
+
+	signed := NewExtensionBlock(nil, block)
+	signed.Sign(wallet.PrivateKey, wallet.PublicKey)
+	if err := signed.VerifySignature(true); err != nil {
+		t.Errorf("Signed extension is rejected: %s", err)
+	}
+
+	unproved := signWithoutVRF(block, wallet)
+	if _, ok := unproved.VerifySignature(true).(*InvalidBlockError); !ok {
+		t.Error("Extension without VRF proof is accepted")
+	}
+	if err := unproved.VerifySignature(false); err != nil {
+		t.Errorf("Extension without VRF proof is rejected when VRF is not used: %s", err)
+	}
+
+	forged := signWithoutVRF(block, wallet)
+	forged.VRFProof = VRFProve(wallet.PrivateKey, wallet.PublicKey, []byte("other block"))
+	forged.Signature = signData(wallet.PrivateKey, forged.signedData())
+	if _, ok := forged.VerifySignature(false).(*InvalidBlockError); !ok {
+		t.Error("Extension with VRF proof of another block is accepted")
+	}
+}
+
+// TestStakeSeed checks that stakeholders after genesis and unsigned blocks are chosen
+// by the hash of the block and other parents must prove their VRF outputs
+func TestStakeSeed(t *testing.T) {
+	bc, wallet := newTestBlockchain(t, 0)
+	genesis := bc.NewIterator().Next()
+	block := NewBlock([]byte("parent"), nil, 3, "miner", 0, 1000)
+
+	seed, err := bc.stakeSeed(genesis, block)
+	if err != nil || string(seed) != string(block.Hash) {
+		t.Errorf("Block on genesis is not chosen by its hash: %x %v", seed, err)
+	}
+
+	parentBlock := NewBlock(genesis.Hash, genesis.MerkleRoot, genesis.Height + 1, "miner", 0, genesis.Timestamp + 1)
+
+	unsigned := NewExtensionBlock(nil, parentBlock)
+	seed, err = bc.stakeSeed(unsigned, block)
+	if err != nil || string(seed) != string(block.Hash) {
+		t.Errorf("Block on unsigned parent is not chosen by its hash: %x %v", seed, err)
+	}
+
+	signed := NewExtensionBlock(nil, parentBlock)
+	signed.Sign(wallet.PrivateKey, wallet.PublicKey)
+	output, _ := signed.VRFOutput()
+	seed, err = bc.stakeSeed(signed, block)
+	if err != nil || string(seed) != string(output) {
+		t.Errorf("Block on signed parent is not chosen by its VRF output: %x %v", seed, err)
+	}
+
+	if _, err = bc.stakeSeed(signWithoutVRF(parentBlock, wallet), block); err == nil {
+		t.Error("Block on parent without VRF proof is chosen by its hash")
+	}
+}
@@ -46,6 +46,18 @@ func (tx Transaction) IsCoinbase() bool {
 	return len(tx.Vin) == 1 && len(tx.Vin[0].OutTxID) == 0 && tx.Vin[0].OutIndex == -1
 }
 
+// IsEvidence returns true if Transaction carries evidence of double signing,
+// like coinbase it has the only input which spends nothing
+func (tx Transaction) IsEvidence() bool {
+	return len(tx.Vin) == 1 && len(tx.Vin[0].OutTxID) == 0 && tx.Vin[0].OutIndex == evidenceIndex
+}
+
+// IsDelegation returns true if Transaction delegates staking of outputs to another key,
+// like coinbase it has the only input which spends nothing
+func (tx Transaction) IsDelegation() bool {
+	return len(tx.Vin) == 1 && len(tx.Vin[0].OutTxID) == 0 && tx.Vin[0].OutIndex == delegationIndex
+}
+
 // UsesKey returns true if TXInput contains input public key
 func (in *TXInput) UsesKey(pubKeyHash []byte) bool {
 	lockingHash := base58.HashPubKey(in.PubKey)
@@ -67,7 +79,7 @@ func (out *TXOutput) IsLockedWithKey(pubKeyHash []byte) bool {
 }
 
 // NewCoinbaseTX returns new coinbase Transaction with miner's and stakeholder's outputs
-func NewCoinbaseTX(minerAddr, stakeAddr, data string, satoshiIndex int) *Transaction {
+func NewCoinbaseTX(minerAddr, stakeAddr, data string, satoshiIndex, subsidy int) *Transaction {
 	if data == "" {
 		data = "some data"
 	}
@@ -114,7 +126,7 @@ func NewTransaction(from, to string, amount int, bc *Blockchain) (*Transaction,
 	var inputs []TXInput
 	var outputs []TXOutput
 
-	wallets, err := walletpkg.NewWallets(bc.AddrFile, bc.WalletFile)
+	wallets, err := walletpkg.NewWallets(bc.AddrFile, bc.WalletFile, bc.Params.AddressVersion)
 	if err != nil {
 		log.Panic(err)
 	}
@@ -185,7 +197,10 @@ func (tx *Transaction) Sign(privKey ecdsa.PrivateKey, prevTXs map[string]Transac
 		if err != nil {
 			log.Panic(err)
 		}
-		signature := append(r.Bytes(), s.Bytes()...)
+		// половины подписи одной длины, иначе Verify разделит её неправильно
+		signature := make([]byte, 64)
+		r.FillBytes(signature[:32])
+		s.FillBytes(signature[32:])
 
 		tx.Vin[inID].Signature = signature
 		txCopy.Vin[inID].PubKey = nil
@@ -209,6 +224,13 @@ func (tx *Transaction) Verify(prevTXs map[string]Transaction) bool {
 
 	for inID, vin := range tx.Vin {
 		prevTx := prevTXs[hex.EncodeToString(vin.OutTxID)]
+
+		// only the key of the output spends it, the delegate of the output
+		// or any other key signing the input does not
+		if !vin.UsesKey(prevTx.Vout[vin.OutIndex].PubKeyHash) {
+			return false
+		}
+
 		txCopy.Vin[inID].Signature = nil
 		txCopy.Vin[inID].PubKey = prevTx.Vout[vin.OutIndex].PubKeyHash
 
@@ -280,14 +302,14 @@ func (tx *Transaction) Hash() []byte {
 }
 
 // DeserializeTransaction deserializes Transaction from bytes
-func DeserializeTransaction(data []byte) Transaction {
+func DeserializeTransaction(data []byte) (Transaction, error) {
 	var transaction Transaction
 
 	decoder := gob.NewDecoder(bytes.NewReader(data))
 	err := decoder.Decode(&transaction)
 	if err != nil {
-		log.Panic(err)
+		return Transaction{}, err
 	}
 
-	return transaction
+	return transaction, nil
 }
@@ -0,0 +1,544 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"log"
+)
+
+// TXOutputs keeps unspent outputs of one transaction by their indexes
+// and public key hashes of staking keys the outputs are delegated to
+type TXOutputs struct {
+	Outputs   map[int]TXOutput
+	Delegates map[int][]byte
+}
+
+// spentOutput is an output removed from the UTXO set by a block,
+// it is kept in undo data to restore the set on disconnect
+type spentOutput struct {
+	TxID     []byte
+	Index    int
+	Output   TXOutput
+	Delegate []byte
+}
+
+type undoData struct {
+	Spent []spentOutput
+}
+
+// Serialize serializes TXOutputs into bytes
+func (outs TXOutputs) Serialize() []byte {
+	var buff bytes.Buffer
+
+	enc := gob.NewEncoder(&buff)
+	err := enc.Encode(outs)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return buff.Bytes()
+}
+
+// DeserializeOutputs deserializes TXOutputs from bytes
+func DeserializeOutputs(data []byte) (TXOutputs, error) {
+	var outputs TXOutputs
+
+	dec := gob.NewDecoder(bytes.NewReader(data))
+	err := dec.Decode(&outputs)
+	if err != nil {
+		return TXOutputs{}, err
+	}
+
+	return outputs, nil
+}
+
+// serialize serializes undoData into bytes
+func (u undoData) serialize() []byte {
+	var buff bytes.Buffer
+
+	enc := gob.NewEncoder(&buff)
+	err := enc.Encode(u)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return buff.Bytes()
+}
+
+// deserializeUndoData deserializes undoData from bytes
+func deserializeUndoData(data []byte) (undoData, error) {
+	var undo undoData
+
+	dec := gob.NewDecoder(bytes.NewReader(data))
+	err := dec.Decode(&undo)
+	if err != nil {
+		return undoData{}, err
+	}
+
+	return undo, nil
+}
+
+// FindUnspentTxOutputs returns unspent transactions outputs found by public key hash
+func (bc *Blockchain) FindUnspentTxOutputs(pubKeyHash []byte) []TXOutput {
+	var txOutputs []TXOutput
+
+	err := bc.Db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(utxoBucket))
+
+		return b.ForEach(func(k, v []byte) error {
+			outs, err := DeserializeOutputs(v)
+			if err != nil {
+				return err
+			}
+
+			for _, out := range outs.Outputs {
+				if out.IsLockedWithKey(pubKeyHash) {
+					txOutputs = append(txOutputs, out)
+				}
+			}
+
+			return nil
+		})
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return txOutputs
+}
+
+// FindSpendableOutputs returns transactions outputs by public key hash
+// and amount of satoshies which could be spent
+func (bc *Blockchain) FindSpendableOutputs(pubKeyHash []byte, amount int) ([]int, map[string][]int) {
+	unspentOutputs := make(map[string][]int)
+	var accumulated []int
+
+	err := bc.Db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(utxoBucket))
+		c := b.Cursor()
+
+		for k, v := c.First(); k != nil && len(accumulated) < amount; k, v = c.Next() {
+			txID := hex.EncodeToString(k)
+			outs, err := DeserializeOutputs(v)
+			if err != nil {
+				return err
+			}
+
+			for outIdx, out := range outs.Outputs {
+				if out.IsLockedWithKey(pubKeyHash) && len(accumulated) < amount {
+					accumulated = append(accumulated, out.Value...)
+					unspentOutputs[txID] = append(unspentOutputs[txID], outIdx)
+				}
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return accumulated, unspentOutputs
+}
+
+// FindSatoshiOwner returns public key hash of the unspent output
+// which contains satoshi with the given index or nil if nobody owns it
+func (bc *Blockchain) FindSatoshiOwner(index int) []byte {
+	owner, _ := bc.FindSatoshiStaker(index)
+
+	return owner
+}
+
+// findSatoshiStaker returns public key hashes of the owner of the satoshi with the given index
+// and of its staker in the UTXO set of the transaction
+func findSatoshiStaker(tx *bolt.Tx, index int) ([]byte, []byte, error) {
+	var owner, staker []byte
+
+	err := tx.Bucket([]byte(utxoBucket)).ForEach(func(k, v []byte) error {
+		if owner != nil {
+			return nil
+		}
+
+		outs, err := DeserializeOutputs(v)
+		if err != nil {
+			return err
+		}
+
+		for outIdx, out := range outs.Outputs {
+			if out.Value.FindIndex(out.Value, index) {
+				owner, staker = out.PubKeyHash, out.PubKeyHash
+				if delegate := outs.Delegates[outIdx]; delegate != nil {
+					staker = delegate
+				}
+			}
+		}
+
+		return nil
+	})
+
+	return owner, staker, err
+}
+
+// FindSatoshiStaker returns public key hashes of the owner of the satoshi with the given index
+// and of the key which stakes it, that is the delegate of the output or the owner
+func (bc *Blockchain) FindSatoshiStaker(index int) ([]byte, []byte) {
+	var owner, staker []byte
+
+	err := bc.Db.View(func(tx *bolt.Tx) error {
+		var err error
+		owner, staker, err = findSatoshiStaker(tx, index)
+
+		return err
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return owner, staker
+}
+
+// FindUnspentOutput returns output of the transaction with given id
+// and false if it is not in the UTXO set
+func (bc *Blockchain) FindUnspentOutput(txID []byte, index int) (TXOutput, bool) {
+	var out TXOutput
+	found := false
+
+	err := bc.Db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket([]byte(utxoBucket)).Get(txID)
+		if data == nil {
+			return nil
+		}
+
+		outs, err := DeserializeOutputs(data)
+		if err != nil {
+			return err
+		}
+
+		out, found = outs.Outputs[index]
+
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return out, found
+}
+
+// getPrevTransactions returns transactions referenced by inputs of the given Transaction.
+// Transactions are restored from the UTXO set, so only their unspent outputs are filled
+func (bc *Blockchain) getPrevTransactions(tnx *Transaction) (map[string]Transaction, error) {
+	var prevTXs map[string]Transaction
+
+	err := bc.Db.View(func(tx *bolt.Tx) error {
+		var err error
+		prevTXs, err = prevTransactions(tx.Bucket([]byte(utxoBucket)), tnx)
+
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return prevTXs, nil
+}
+
+// prevTransactions returns transactions referenced by inputs of the given Transaction
+// restored from the UTXO set kept in bucket b
+func prevTransactions(b *bolt.Bucket, tnx *Transaction) (map[string]Transaction, error) {
+	prevTXs := make(map[string]Transaction)
+
+	for _, vin := range tnx.Vin {
+		data := b.Get(vin.OutTxID)
+		if data == nil {
+			return nil, errors.New("Previous transaction is not found ")
+		}
+
+		outs, err := DeserializeOutputs(data)
+		if err != nil {
+			return nil, err
+		}
+
+		out, ok := outs.Outputs[vin.OutIndex]
+		if !ok {
+			return nil, errors.New("Output is already spent ")
+		}
+
+		id := hex.EncodeToString(vin.OutTxID)
+		prevTX, ok := prevTXs[id]
+		if !ok {
+			prevTX = Transaction{ID: vin.OutTxID}
+		}
+		for len(prevTX.Vout) <= vin.OutIndex {
+			prevTX.Vout = append(prevTX.Vout, TXOutput{})
+		}
+		prevTX.Vout[vin.OutIndex] = out
+		prevTXs[id] = prevTX
+	}
+
+	return prevTXs, nil
+}
+
+// verifySpending returns error if the transaction is not signed by owners of the outputs
+// it spends in the UTXO set kept in bucket b, or its outputs do not carry exactly
+// the satoshis of the spent outputs
+func verifySpending(b *bolt.Bucket, tnx *Transaction) error {
+	prevTXs, err := prevTransactions(b, tnx)
+	if err != nil {
+		return err
+	}
+
+	if !tnx.Verify(prevTXs) {
+		return errors.New("Transaction has invalid signature ")
+	}
+
+	spent := make(map[int]bool)
+	for _, vin := range tnx.Vin {
+		for _, index := range prevTXs[hex.EncodeToString(vin.OutTxID)].Vout[vin.OutIndex].Value {
+			spent[index] = true
+		}
+	}
+
+	for _, out := range tnx.Vout {
+		for _, index := range out.Value {
+			if !spent[index] {
+				return fmt.Errorf("Transaction has satoshi %d it does not spend ", index)
+			}
+			delete(spent, index)
+		}
+	}
+
+	if len(spent) != 0 {
+		return errors.New("Transaction loses spent satoshis ")
+	}
+
+	return nil
+}
+
+// checkMinted returns InvalidBlockError if coinbase transactions of the block do not mint
+// the 2 * subsidy satoshis following satoshis of its parent, the genesis block mints none
+func checkMinted(b *bolt.Bucket, block *ExtensionBlock, subsidy int) error {
+	first, count := 0, 0
+	if len(block.PrevBlockHash) != 0 {
+		parent, err := getBody(b.Tx(), block.PrevBlockHash)
+		if err != nil {
+			return err
+		}
+		first, count = lastSatoshiIndex(parent), 2 * subsidy
+	}
+
+	minted := make(map[int]bool)
+	for _, tnx := range block.Transactions {
+		if !tnx.IsCoinbase() {
+			continue
+		}
+
+		for _, out := range tnx.Vout {
+			for _, index := range out.Value {
+				if index < first || index >= first + count || minted[index] {
+					return &InvalidBlockError{fmt.Sprintf("Block %x mints satoshi %d beyond its subsidy ", block.Hash, index)}
+				}
+				minted[index] = true
+			}
+		}
+	}
+
+	// satoshis of the next block follow the last satoshi of this one, so none can be skipped
+	if len(minted) != count {
+		return &InvalidBlockError{fmt.Sprintf("Block %x mints %d satoshis instead of %d ", block.Hash, len(minted), count)}
+	}
+
+	return nil
+}
+
+// connectUTXO applies transactions of the given block to the UTXO set
+// and stores undo data needed to disconnect the block later
+func connectUTXO(tx *bolt.Tx, block *ExtensionBlock, subsidy int) error {
+	return connectOutputs(tx.Bucket([]byte(utxoBucket)), tx.Bucket([]byte(undoBucket)), tx.Bucket([]byte(evidenceBucket)), block, subsidy)
+}
+
+// connectOutputs applies transactions of the given block to the UTXO set
+// kept in bucket b, puts undo data into bucket ub and processed evidence into bucket eb.
+// Transactions are verified against the set, so the stakeholder can not spend outputs
+// delegated to it or mint more than subsidy in its own extension
+func connectOutputs(b, ub, eb *bolt.Bucket, block *ExtensionBlock, subsidy int) error {
+	var undo undoData
+
+	var evidence []*Transaction
+
+	err := checkMinted(b, block, subsidy)
+	if err != nil {
+		return err
+	}
+
+	for _, tnx := range block.Transactions {
+		if tnx.IsEvidence() {
+			evidence = append(evidence, tnx)
+			continue
+		}
+
+		if tnx.IsDelegation() {
+			err := delegateOutputs(b, block, tnx)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		// outputs of the transaction with the same id would replace unspent ones
+		if b.Get(tnx.ID) != nil {
+			return &InvalidBlockError{fmt.Sprintf("Block %x repeats transaction %x ", block.Hash, tnx.ID)}
+		}
+
+		if !tnx.IsCoinbase() {
+			err := verifySpending(b, tnx)
+			if err != nil {
+				return &InvalidBlockError{fmt.Sprintf("Block %x has invalid transaction %x: %s", block.Hash, tnx.ID, err)}
+			}
+
+			for _, vin := range tnx.Vin {
+				data := b.Get(vin.OutTxID)
+				if data == nil {
+					return &InvalidBlockError{fmt.Sprintf("Block %x spends unknown output %x:%d ", block.Hash, vin.OutTxID, vin.OutIndex)}
+				}
+
+				outs, err := DeserializeOutputs(data)
+				if err != nil {
+					return err
+				}
+
+				out, ok := outs.Outputs[vin.OutIndex]
+				if !ok {
+					return &InvalidBlockError{fmt.Sprintf("Block %x spends spent output %x:%d ", block.Hash, vin.OutTxID, vin.OutIndex)}
+				}
+				// spending the output ends its delegation
+				undo.Spent = append(undo.Spent, spentOutput{
+					TxID: vin.OutTxID,
+					Index: vin.OutIndex,
+					Output: out,
+					Delegate: outs.Delegates[vin.OutIndex],
+				})
+
+				delete(outs.Outputs, vin.OutIndex)
+				delete(outs.Delegates, vin.OutIndex)
+				if len(outs.Outputs) == 0 {
+					err = b.Delete(vin.OutTxID)
+				} else {
+					err = b.Put(vin.OutTxID, outs.Serialize())
+				}
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		if len(tnx.Vout) == 0 {
+			continue
+		}
+
+		outs := TXOutputs{Outputs: make(map[int]TXOutput)}
+		for outIdx, out := range tnx.Vout {
+			outs.Outputs[outIdx] = out
+		}
+
+		err := b.Put(tnx.ID, outs.Serialize())
+		if err != nil {
+			return err
+		}
+	}
+
+	// offenders are slashed after all transactions, so rewards they get in the block are burned too
+	for _, tnx := range evidence {
+		err := slashOutputs(b, eb, block, tnx, &undo)
+		if err != nil {
+			return err
+		}
+	}
+
+	return ub.Put(block.Hash, undo.serialize())
+}
+
+// disconnectUTXO reverts transactions of the given block in the UTXO set,
+// outputs burned by evidence are restored from undo data like spent ones
+func disconnectUTXO(tx *bolt.Tx, block *ExtensionBlock) error {
+	b := tx.Bucket([]byte(utxoBucket))
+	ub := tx.Bucket([]byte(undoBucket))
+
+	undoBytes := ub.Get(block.Hash)
+	if undoBytes == nil {
+		return fmt.Errorf("Undo data of block %x is not found ", block.Hash)
+	}
+
+	undo, err := deserializeUndoData(undoBytes)
+	if err != nil {
+		return err
+	}
+
+	for i := len(undo.Spent) - 1; i >= 0; i-- {
+		spent := undo.Spent[i]
+		outs := TXOutputs{Outputs: make(map[int]TXOutput)}
+
+		data := b.Get(spent.TxID)
+		if data != nil {
+			outs, err = DeserializeOutputs(data)
+			if err != nil {
+				return err
+			}
+		}
+		outs.Outputs[spent.Index] = spent.Output
+		if spent.Delegate != nil {
+			if outs.Delegates == nil {
+				outs.Delegates = make(map[int][]byte)
+			}
+			outs.Delegates[spent.Index] = spent.Delegate
+		}
+
+		err = b.Put(spent.TxID, outs.Serialize())
+		if err != nil {
+			return err
+		}
+	}
+
+	// delegations of the block end after restoring spent outputs,
+	// outputs delegated and spent inside the block come back undelegated
+	for _, tnx := range block.Transactions {
+		if tnx.IsDelegation() {
+			err = undelegateOutputs(b, tnx)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// outputs created by the block are removed after restoring spent ones,
+	// so outputs spent inside the block do not come back
+	for _, tnx := range block.Transactions {
+		err = b.Delete(tnx.ID)
+		if err != nil {
+			return err
+		}
+	}
+
+	// evidence of the block may be processed again by another block
+	for _, tnx := range block.Transactions {
+		if !tnx.IsEvidence() {
+			continue
+		}
+
+		evidence, err := tnx.DoubleSign()
+		if err != nil {
+			return err
+		}
+
+		err = tx.Bucket([]byte(evidenceBucket)).Delete(evidence.key())
+		if err != nil {
+			return err
+		}
+	}
+
+	return ub.Delete(block.Hash)
+}
@@ -0,0 +1,142 @@
+package blockchain
+
+import (
+	"encoding/hex"
+	walletpkg "github.com/keithzetterstrom/BibCoin/internal/pkg/wallet"
+	"github.com/keithzetterstrom/BibCoin/tools/base58"
+	"testing"
+)
+
+// spendTestOutput returns the transaction spending an output of the wallet into the outputs
+// made of its satoshis, the transaction is signed by the signer
+func spendTestOutput(t *testing.T, bc *Blockchain, wallet, signer *walletpkg.Wallet, outputs func(value satoshies) []TXOutput) *Transaction {
+	t.Helper()
+
+	_, spendable := bc.FindSpendableOutputs(base58.HashPubKey(wallet.PublicKey), 1)
+
+	for rawTxID, outs := range spendable {
+		txID, err := hex.DecodeString(rawTxID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tx := Transaction{Vin: []TXInput{{OutTxID: txID, OutIndex: outs[0], PubKey: signer.PublicKey}}}
+
+		out, ok := bc.FindUnspentOutput(tx.Vin[0].OutTxID, tx.Vin[0].OutIndex)
+		if !ok {
+			t.Fatal("Spendable output is not found")
+		}
+
+		tx.Vout = outputs(out.Value)
+		tx.ID = tx.Hash()
+		bc.SignTransaction(&tx, signer.PrivateKey)
+
+		return &tx
+	}
+
+	t.Fatal("Wallet has no outputs")
+	return nil
+}
+
+// TestConnectSpending checks that the block is rejected if its transaction is not signed
+// by the owner of the spent output or does not carry exactly the spent satoshis
+func TestConnectSpending(t *testing.T) {
+	bc, wallet := newTestBlockchain(t, 2)
+	address := string(wallet.GetAddress(bc.Params.AddressVersion))
+	other := walletpkg.NewWallet()
+	otherAddress := string(other.GetAddress(bc.Params.AddressVersion))
+
+	invalid := map[string]*Transaction{
+		"theft": spendTestOutput(t, bc, wallet, other, func(value satoshies) []TXOutput {
+			return []TXOutput{*NewTXOutput(value, otherAddress)}
+		}),
+		"minted satoshi": spendTestOutput(t, bc, wallet, wallet, func(value satoshies) []TXOutput {
+			return []TXOutput{*NewTXOutput(append(append(satoshies{}, value...), 100000), otherAddress)}
+		}),
+		"repeated satoshi": spendTestOutput(t, bc, wallet, wallet, func(value satoshies) []TXOutput {
+			return []TXOutput{*NewTXOutput(value, otherAddress), *NewTXOutput(value[:1], address)}
+		}),
+		"lost satoshi": spendTestOutput(t, bc, wallet, wallet, func(value satoshies) []TXOutput {
+			return []TXOutput{*NewTXOutput(value[1:], otherAddress)}
+		}),
+	}
+
+	for name, tx := range invalid {
+		if bc.VerifyTransaction(tx) {
+			t.Errorf("Transaction with %s is verified", name)
+		}
+
+		block := stakeTestBlock(t, bc, wallet, address, []*Transaction{tx})
+		if _, ok := bc.AddBlock(block).(*InvalidBlockError); !ok {
+			t.Errorf("Block with transaction with %s is not rejected", name)
+		}
+	}
+	if balance(bc, other) != 0 {
+		t.Fatal("Rejected transactions are connected")
+	}
+
+	valid := spendTestOutput(t, bc, wallet, wallet, func(value satoshies) []TXOutput {
+		return []TXOutput{*NewTXOutput(value, otherAddress)}
+	})
+	if !bc.VerifyTransaction(valid) {
+		t.Error("Valid transaction is not verified")
+	}
+	if err := bc.AddBlock(stakeTestBlock(t, bc, wallet, address, []*Transaction{valid})); err != nil {
+		t.Fatal(err)
+	}
+	if balance(bc, other) == 0 {
+		t.Error("Valid transaction is not connected")
+	}
+
+	replay := stakeTestBlock(t, bc, wallet, address, []*Transaction{valid})
+	if _, ok := bc.AddBlock(replay).(*InvalidBlockError); !ok {
+		t.Error("Block repeating the transaction is not rejected")
+	}
+}
+
+// TestConnectMinted checks that the block is rejected if its coinbase mints other satoshis
+// than the subsidy following satoshis of the parent
+func TestConnectMinted(t *testing.T) {
+	bc, wallet := newTestBlockchain(t, 2)
+	address := string(wallet.GetAddress(bc.Params.AddressVersion))
+
+	lastIndex, err := bc.GetLastSatoshiIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	coinbases := map[string]*Transaction{
+		"double subsidy": NewCoinbaseTX(address, address, "", lastIndex, bc.Params.Subsidy * 2),
+		"half subsidy": NewCoinbaseTX(address, address, "", lastIndex, bc.Params.Subsidy / 2),
+		"minted satoshis": NewCoinbaseTX(address, address, "", 1, bc.Params.Subsidy),
+		"skipped satoshis": NewCoinbaseTX(address, address, "", lastIndex + 1, bc.Params.Subsidy),
+	}
+
+	for name, coinbase := range coinbases {
+		block := stakeTestBlock(t, bc, wallet, address, nil)
+		block = replaceTestTransactions(block, wallet, []*Transaction{coinbase})
+
+		if _, ok := bc.AddBlock(block).(*InvalidBlockError); !ok {
+			t.Errorf("Block with coinbase with %s is not rejected", name)
+		}
+	}
+
+	block := stakeTestBlock(t, bc, wallet, address, nil)
+	block = replaceTestTransactions(block, wallet, []*Transaction{block.Transactions[0], NewCoinbaseTX(address, address, "more", lastIndex, bc.Params.Subsidy)})
+	if _, ok := bc.AddBlock(block).(*InvalidBlockError); !ok {
+		t.Error("Block with two coinbases is not rejected")
+	}
+
+	if err = bc.AddBlock(stakeTestBlock(t, bc, wallet, address, nil)); err != nil {
+		t.Errorf("Block minting subsidy is rejected: %s", err)
+	}
+}
+
+// replaceTestTransactions returns the extension of the same block and attempt
+// with the transactions signed by the wallet
+func replaceTestTransactions(block *ExtensionBlock, wallet *walletpkg.Wallet, transactions []*Transaction) *ExtensionBlock {
+	extension := NewExtensionBlock(transactions, &block.Block)
+	extension.Attempt = block.Attempt
+	extension.Sign(wallet.PrivateKey, wallet.PublicKey)
+
+	return extension
+}
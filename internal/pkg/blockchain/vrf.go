@@ -0,0 +1,166 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"errors"
+	"math/big"
+)
+
+// vrfSuite identifies the verifiable random function: ECVRF on P-256
+// with SHA-256 and try-and-increment hashing to the curve
+const vrfSuite = 0x01
+
+const (
+	vrfPointLength     = 33
+	vrfChallengeLength = 16
+	vrfScalarLength    = 32
+	// VRFProofLength is the length of the proof: Gamma, challenge and scalar
+	VRFProofLength = vrfPointLength + vrfChallengeLength + vrfScalarLength
+)
+
+var errorVRFProof = errors.New("VRF proof is invalid ")
+
+// VRFProve returns proof of the output of the verifiable random function of alpha
+// computed with the private key. The output is the same for the key and alpha,
+// so the owner of the key can not choose it, and nobody else can predict it
+func VRFProve(privKey ecdsa.PrivateKey, pubKey, alpha []byte) []byte {
+	curve := elliptic.P256()
+	q := curve.Params().N
+
+	hx, hy := vrfHashToCurve(pubKey, alpha)
+	gx, gy := curve.ScalarMult(hx, hy, privKey.D.Bytes())
+
+	// nonce is derived from the key and the point, so the same proof is made every time
+	kHash := sha256.Sum256(bytes.Join([][]byte{privKey.D.Bytes(), elliptic.MarshalCompressed(curve, hx, hy)}, []byte{}))
+	k := new(big.Int).SetBytes(kHash[:])
+	k.Mod(k, q)
+	if k.Sign() == 0 {
+		k.SetInt64(1)
+	}
+
+	ux, uy := curve.ScalarBaseMult(k.Bytes())
+	vx, vy := curve.ScalarMult(hx, hy, k.Bytes())
+
+	c := vrfChallenge(hx, hy, gx, gy, ux, uy, vx, vy)
+
+	s := new(big.Int).Mul(c, privKey.D)
+	s.Add(s, k)
+	s.Mod(s, q)
+
+	proof := make([]byte, VRFProofLength)
+	copy(proof, elliptic.MarshalCompressed(curve, gx, gy))
+	c.FillBytes(proof[vrfPointLength : vrfPointLength + vrfChallengeLength])
+	s.FillBytes(proof[vrfPointLength + vrfChallengeLength:])
+
+	return proof
+}
+
+// VRFVerify returns the output of the verifiable random function of alpha
+// if the proof is made with the private key of the public key
+func VRFVerify(pubKey, alpha, proof []byte) ([]byte, error) {
+	curve := elliptic.P256()
+	q := curve.Params().N
+
+	if len(pubKey) != 64 || len(proof) != VRFProofLength {
+		return nil, errorVRFProof
+	}
+
+	yx := new(big.Int).SetBytes(pubKey[:32])
+	yy := new(big.Int).SetBytes(pubKey[32:])
+	if !curve.IsOnCurve(yx, yy) {
+		return nil, errorVRFProof
+	}
+
+	gx, gy := elliptic.UnmarshalCompressed(curve, proof[:vrfPointLength])
+	if gx == nil {
+		return nil, errorVRFProof
+	}
+
+	c := new(big.Int).SetBytes(proof[vrfPointLength : vrfPointLength + vrfChallengeLength])
+	s := new(big.Int).SetBytes(proof[vrfPointLength + vrfChallengeLength:])
+	if s.Cmp(q) >= 0 {
+		return nil, errorVRFProof
+	}
+
+	hx, hy := vrfHashToCurve(pubKey, alpha)
+
+	// U = s*B - c*Y, V = s*H - c*Gamma
+	sbx, sby := curve.ScalarBaseMult(s.Bytes())
+	cyx, cyy := curve.ScalarMult(yx, yy, c.Bytes())
+	ux, uy := vrfSubtract(sbx, sby, cyx, cyy)
+
+	shx, shy := curve.ScalarMult(hx, hy, s.Bytes())
+	cgx, cgy := curve.ScalarMult(gx, gy, c.Bytes())
+	vx, vy := vrfSubtract(shx, shy, cgx, cgy)
+
+	if vrfChallenge(hx, hy, gx, gy, ux, uy, vx, vy).Cmp(c) != 0 {
+		return nil, errorVRFProof
+	}
+
+	return vrfOutput(gx, gy), nil
+}
+
+// vrfHashToCurve maps the public key and alpha to the point of the curve,
+// counter is incremented until the hash is x coordinate of a point
+func vrfHashToCurve(pubKey, alpha []byte) (*big.Int, *big.Int) {
+	curve := elliptic.P256()
+
+	for counter := 0; ; counter++ {
+		hash := sha256.Sum256(bytes.Join(
+			[][]byte{{vrfSuite, 0x01}, pubKey, alpha, {byte(counter), byte(counter >> 8)}, {0x00}},
+			[]byte{},
+		))
+
+		x, y := elliptic.UnmarshalCompressed(curve, append([]byte{0x02}, hash[:]...))
+		if x != nil {
+			return x, y
+		}
+	}
+}
+
+// vrfChallenge returns the challenge of the proof truncated to vrfChallengeLength bytes
+func vrfChallenge(points ...*big.Int) *big.Int {
+	data := []byte{vrfSuite, 0x02}
+	for i := 0; i < len(points); i += 2 {
+		data = append(data, vrfMarshal(points[i], points[i + 1])...)
+	}
+	data = append(data, 0x00)
+
+	hash := sha256.Sum256(data)
+
+	return new(big.Int).SetBytes(hash[:vrfChallengeLength])
+}
+
+// vrfOutput returns the output of the function by Gamma of the proof
+func vrfOutput(gx, gy *big.Int) []byte {
+	hash := sha256.Sum256(bytes.Join(
+		[][]byte{{vrfSuite, 0x03}, vrfMarshal(gx, gy), {0x00}},
+		[]byte{},
+	))
+
+	return hash[:]
+}
+
+// vrfMarshal returns the compressed point, the point at infinity is a single zero byte
+func vrfMarshal(x, y *big.Int) []byte {
+	if x.Sign() == 0 && y.Sign() == 0 {
+		return []byte{0x00}
+	}
+
+	return elliptic.MarshalCompressed(elliptic.P256(), x, y)
+}
+
+// vrfSubtract returns difference of the points, the negated point has the opposite y
+func vrfSubtract(x1, y1, x2, y2 *big.Int) (*big.Int, *big.Int) {
+	curve := elliptic.P256()
+
+	negY := new(big.Int)
+	if y2.Sign() != 0 {
+		negY.Sub(curve.Params().P, y2)
+	}
+
+	return curve.Add(x1, y1, x2, negY)
+}
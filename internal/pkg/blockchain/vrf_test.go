@@ -0,0 +1,45 @@
+package blockchain
+
+import (
+	"bytes"
+	walletpkg "github.com/keithzetterstrom/BibCoin/internal/pkg/wallet"
+	"testing"
+)
+
+// TestVRF checks that VRF output is the same for the key and input,
+// and proofs do not verify with other inputs and keys
+func TestVRF(t *testing.T) {
+	wallet := walletpkg.NewWallet()
+	other := walletpkg.NewWallet()
+	alpha := []byte("block")
+
+	proof := VRFProve(wallet.PrivateKey, wallet.PublicKey, alpha)
+	output, err := VRFVerify(wallet.PublicKey, alpha, proof)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	again, err := VRFVerify(wallet.PublicKey, alpha, VRFProve(wallet.PrivateKey, wallet.PublicKey, alpha))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(output, again) {
+		t.Error("VRF output differs for the same key and input")
+	}
+
+	if _, err = VRFVerify(wallet.PublicKey, []byte("other block"), proof); err == nil {
+		t.Error("VRF proof is verified with another input")
+	}
+	if _, err = VRFVerify(other.PublicKey, alpha, proof); err == nil {
+		t.Error("VRF proof is verified with another key")
+	}
+	if _, err = VRFVerify(wallet.PublicKey, alpha, nil); err == nil {
+		t.Error("Empty VRF proof is verified")
+	}
+
+	tampered := append([]byte{}, proof...)
+	tampered[len(tampered) - 1] ^= 1
+	if _, err = VRFVerify(wallet.PublicKey, alpha, tampered); err == nil {
+		t.Error("Tampered VRF proof is verified")
+	}
+}
@@ -0,0 +1,181 @@
+package bloom
+
+import (
+	"encoding/binary"
+	"fmt"
+	bcpkg "github.com/keithzetterstrom/BibCoin/internal/pkg/blockchain"
+	"github.com/keithzetterstrom/BibCoin/tools/base58"
+	"math"
+	"math/bits"
+)
+
+// limits of filters and elements received from light nodes, the largest filter
+// has false positive rate below 0.0001 for 20000 elements
+const (
+	MaxFilterSize    = 36000
+	MaxHashFuncs     = 50
+	MaxFilterAddSize = 520
+)
+
+// hashSeedStep separates seeds of hash functions of the filter
+const hashSeedStep = 0xFBA4C795
+
+// Filter is the bloom filter the light node loads onto full nodes,
+// they send only transactions matching it. Data is the bit field,
+// Tweak changes hash functions, so filters of different nodes differ
+type Filter struct {
+	Data      []byte
+	HashFuncs uint32
+	Tweak     uint32
+}
+
+// NewFilter returns empty Filter for the given number of elements
+// with the given false positive rate
+func NewFilter(elements int, fpRate float64, tweak uint32) *Filter {
+	if elements < 1 {
+		elements = 1
+	}
+
+	size := int(-1 / (math.Ln2 * math.Ln2) * float64(elements) * math.Log(fpRate) / 8)
+	if size > MaxFilterSize {
+		size = MaxFilterSize
+	}
+	if size < 1 {
+		size = 1
+	}
+
+	hashFuncs := uint32(float64(size * 8) / float64(elements) * math.Ln2)
+	if hashFuncs > MaxHashFuncs {
+		hashFuncs = MaxHashFuncs
+	}
+	if hashFuncs < 1 {
+		hashFuncs = 1
+	}
+
+	return &Filter{Data: make([]byte, size), HashFuncs: hashFuncs, Tweak: tweak}
+}
+
+// Validate returns error if the filter received from the node is too large
+func (f *Filter) Validate() error {
+	if len(f.Data) == 0 || len(f.Data) > MaxFilterSize {
+		return fmt.Errorf("Filter of %d bytes ", len(f.Data))
+	}
+
+	if f.HashFuncs == 0 || f.HashFuncs > MaxHashFuncs {
+		return fmt.Errorf("Filter with %d hash functions ", f.HashFuncs)
+	}
+
+	return nil
+}
+
+// bit returns index of the bit of the data for the hash function
+func (f *Filter) bit(hashNum uint32, data []byte) uint32 {
+	return murmur3(hashNum * hashSeedStep + f.Tweak, data) % uint32(len(f.Data) * 8)
+}
+
+// Add adds the data to the filter
+func (f *Filter) Add(data []byte) {
+	for i := uint32(0); i < f.HashFuncs; i++ {
+		index := f.bit(i, data)
+		f.Data[index >> 3] |= 1 << (index & 7)
+	}
+}
+
+// Contains returns true if the data is probably added to the filter
+func (f *Filter) Contains(data []byte) bool {
+	for i := uint32(0); i < f.HashFuncs; i++ {
+		index := f.bit(i, data)
+		if f.Data[index >> 3] & (1 << (index & 7)) == 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// MatchTransaction returns true if the filter contains id of the transaction,
+// public key hash of its output, hash of public key of its input or of the slashed stakeholder
+func (f *Filter) MatchTransaction(tx *bcpkg.Transaction) bool {
+	if f.Contains(tx.ID) {
+		return true
+	}
+
+	for _, out := range tx.Vout {
+		if f.Contains(out.PubKeyHash) {
+			return true
+		}
+	}
+
+	if tx.IsCoinbase() {
+		return false
+	}
+
+	// evidence burns outputs of the offender, so it matches the wallet of the offender
+	if tx.IsEvidence() {
+		evidence, err := tx.DoubleSign()
+		return err == nil && f.Contains(evidence.Offender())
+	}
+
+	// delegation matches wallets of the owner and of the staking key
+	if tx.IsDelegation() {
+		delegation, err := tx.Delegation()
+		return err == nil && (f.Contains(delegation.Owner()) || f.Contains(delegation.StakePubKeyHash))
+	}
+
+	for _, in := range tx.Vin {
+		if f.Contains(base58.HashPubKey(in.PubKey)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// murmur3 returns 32-bit MurmurHash3 of the data with the given seed
+func murmur3(seed uint32, data []byte) uint32 {
+	const (
+		c1 = 0xcc9e2d51
+		c2 = 0x1b873593
+	)
+
+	h := seed
+	blocks := len(data) / 4
+
+	for i := 0; i < blocks; i++ {
+		k := binary.LittleEndian.Uint32(data[i * 4:])
+		k *= c1
+		k = bits.RotateLeft32(k, 15)
+		k *= c2
+
+		h ^= k
+		h = bits.RotateLeft32(h, 13)
+		h = h * 5 + 0xe6546b64
+	}
+
+	var k uint32
+	tail := data[blocks * 4:]
+
+	switch len(tail) {
+	case 3:
+		k ^= uint32(tail[2]) << 16
+		fallthrough
+	case 2:
+		k ^= uint32(tail[1]) << 8
+		fallthrough
+	case 1:
+		k ^= uint32(tail[0])
+		k *= c1
+		k = bits.RotateLeft32(k, 15)
+		k *= c2
+		h ^= k
+	}
+
+	h ^= uint32(len(data))
+	h ^= h >> 16
+	h *= 0x85ebca6b
+	h ^= h >> 13
+	h *= 0xc2b2ae35
+	h ^= h >> 16
+
+	return h
+}
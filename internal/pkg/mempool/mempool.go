@@ -0,0 +1,728 @@
+package mempool
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	bcpkg "github.com/keithzetterstrom/BibCoin/internal/pkg/blockchain"
+	"sort"
+	"sync"
+	"time"
+)
+
+// mem pool keeps up to maxPoolSize bytes of transactions, when it is full
+// transactions with the lowest fee rate are evicted, the oldest first.
+// Transactions which are not mined in expiryTime are removed
+const (
+	maxPoolSize = 1 << 24
+	maxTxSize   = 1 << 17
+	expiryTime  = time.Hour * 24 * 14
+)
+
+// chains of unconfirmed transactions are limited, so adding
+// and removing of a transaction does not walk the whole pool
+const (
+	maxAncestors   = 25
+	maxDescendants = 25
+)
+
+const (
+	errorAlreadyInPool = "Transaction is already in mem pool "
+	errorMissingInputs = "Transaction spends unknown or spent output "
+	errorTxTooLarge    = "Transaction is too large "
+	errorPoolFull      = "Mem pool is full "
+)
+
+// InvalidTxError is returned when the transaction breaks consensus rules,
+// unlike other errors it means that the node sent the transaction is misbehaving
+type InvalidTxError struct {
+	Reason string
+}
+
+func (e *InvalidTxError) Error() string {
+	return e.Reason
+}
+
+// Policy is the rule of mem pool the valid transaction does not pass
+type Policy int
+
+const (
+	// PolicyDuplicate - the transaction or another one spending its outputs is already in the pool
+	PolicyDuplicate Policy = iota + 1
+	// PolicyNonstandard - the transaction is too large or has too long chain of unconfirmed transactions
+	PolicyNonstandard
+	// PolicyInsufficientFee - the pool is full and the fee does not evict other transactions
+	PolicyInsufficientFee
+)
+
+// RejectedTxError is returned when the valid transaction is not accepted
+// by the rules of mem pool, the node sent it is not misbehaving
+type RejectedTxError struct {
+	Policy Policy
+	Reason string
+}
+
+func (e *RejectedTxError) Error() string {
+	return e.Reason
+}
+
+// outpoint is the output of the transaction spent by the input
+type outpoint struct {
+	txID  string
+	index int
+}
+
+// entry is the transaction in mem pool with its parents and children
+// which are transactions in mem pool too
+type entry struct {
+	tx       bcpkg.Transaction
+	id       string
+	fee      int
+	size     int
+	added    time.Time
+	height   int
+	parents  map[string]*entry
+	children map[string]*entry
+}
+
+// Info describes the state of mem pool
+type Info struct {
+	Size     int
+	Bytes    int
+	MaxBytes int
+	// MinFeeRate is the fee rate in satoshies per kilobyte of the transaction
+	// which is evicted first, new transactions must pay more when the pool is full
+	MinFeeRate int
+}
+
+// EntryInfo describes the transaction in mem pool
+type EntryInfo struct {
+	ID     string
+	Size   int
+	Fee    int
+	Time   int64
+	Height int
+	// Depends are ids of transactions in mem pool the transaction spends
+	Depends []string
+	// SpentBy are ids of transactions in mem pool which spend the transaction
+	SpentBy         []string
+	AncestorCount   int
+	DescendantCount int
+}
+
+// Mempool keeps valid unconfirmed transactions which spend outputs
+// of the UTXO set or of other transactions in the pool
+type Mempool struct {
+	mu      sync.Mutex
+	bc      *bcpkg.Blockchain
+	entries map[string]*entry
+	// spent are outputs spent by transactions in the pool
+	spent map[outpoint]*entry
+	size  int
+}
+
+// NewMempool returns empty Mempool validating transactions against the blockchain
+func NewMempool(bc *bcpkg.Blockchain) *Mempool {
+	return &Mempool{
+		bc: bc,
+		entries: make(map[string]*entry),
+		spent: make(map[outpoint]*entry),
+	}
+}
+
+// Add validates the transaction and puts it into the pool, InvalidTxError is returned
+// if the transaction is invalid, RejectedTxError if it does not pass rules of the pool
+func (m *Mempool) Add(tx bcpkg.Transaction) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.bc.Now()
+	m.expire(now)
+
+	return m.add(tx, now)
+}
+
+// add validates the transaction added at the given time and puts it into the pool, mu must be held
+func (m *Mempool) add(tx bcpkg.Transaction, added time.Time) error {
+	id := hex.EncodeToString(tx.ID)
+	if _, ok := m.entries[id]; ok {
+		return &RejectedTxError{PolicyDuplicate, errorAlreadyInPool}
+	}
+
+	if tx.IsCoinbase() {
+		return &InvalidTxError{fmt.Sprintf("Coinbase transaction %s is not allowed in mem pool ", id)}
+	}
+
+	if tx.IsEvidence() {
+		return m.addEvidence(tx, id, added)
+	}
+
+	if tx.IsDelegation() {
+		return m.addDelegation(tx, id, added)
+	}
+
+	if len(tx.Vin) == 0 || len(tx.Vout) == 0 {
+		return &InvalidTxError{fmt.Sprintf("Transaction %s has no inputs or outputs ", id)}
+	}
+
+	// id of the transaction is the hash of it before signing
+	unsigned := tx.TrimmedCopy()
+	for i := range unsigned.Vin {
+		unsigned.Vin[i].PubKey = tx.Vin[i].PubKey
+	}
+	if !bytes.Equal(unsigned.Hash(), tx.ID) {
+		return &InvalidTxError{fmt.Sprintf("Transaction %s has wrong id ", id)}
+	}
+
+	size := len(tx.Serialize())
+	if size > maxTxSize {
+		return &RejectedTxError{PolicyNonstandard, errorTxTooLarge}
+	}
+
+	prevTXs := make(map[string]bcpkg.Transaction)
+	parents := make(map[string]*entry)
+	inputs := make(map[int]bool)
+	seen := make(map[outpoint]bool)
+
+	for _, vin := range tx.Vin {
+		op := outpoint{txID: hex.EncodeToString(vin.OutTxID), index: vin.OutIndex}
+
+		if seen[op] {
+			return &InvalidTxError{fmt.Sprintf("Transaction %s spends output %s:%d twice ", id, op.txID, op.index)}
+		}
+		seen[op] = true
+
+		if conflict, ok := m.spent[op]; ok {
+			return &RejectedTxError{PolicyDuplicate, fmt.Sprintf("Transaction %s spends output %s:%d spent by %s ", id, op.txID, op.index, conflict.id)}
+		}
+
+		var out bcpkg.TXOutput
+		found := false
+
+		if parent, ok := m.entries[op.txID]; ok {
+			if op.index >= 0 && op.index < len(parent.tx.Vout) {
+				out, found = parent.tx.Vout[op.index], true
+				parents[op.txID] = parent
+			}
+		} else {
+			out, found = m.bc.FindUnspentOutput(vin.OutTxID, vin.OutIndex)
+		}
+		if !found || op.index < 0 {
+			return errors.New(errorMissingInputs)
+		}
+
+		prevTX, ok := prevTXs[op.txID]
+		if !ok {
+			prevTX = bcpkg.Transaction{ID: vin.OutTxID}
+		}
+		for len(prevTX.Vout) <= op.index {
+			prevTX.Vout = append(prevTX.Vout, bcpkg.TXOutput{})
+		}
+		prevTX.Vout[op.index] = out
+		prevTXs[op.txID] = prevTX
+
+		for _, satoshi := range out.Value {
+			inputs[satoshi] = true
+		}
+	}
+
+	if !tx.Verify(prevTXs) {
+		return &InvalidTxError{fmt.Sprintf("Transaction %s has invalid signature ", id)}
+	}
+
+	// outputs may only take satoshies of inputs, the rest is the fee
+	fee := len(inputs)
+	for _, out := range tx.Vout {
+		for _, satoshi := range out.Value {
+			if !inputs[satoshi] {
+				return &InvalidTxError{fmt.Sprintf("Transaction %s creates satoshi %d ", id, satoshi)}
+			}
+			delete(inputs, satoshi)
+			fee--
+		}
+	}
+
+	ancestors := m.ancestors(parents)
+	if len(ancestors) + 1 > maxAncestors {
+		return &RejectedTxError{PolicyNonstandard, fmt.Sprintf("Transaction %s has more than %d unconfirmed ancestors ", id, maxAncestors)}
+	}
+	for _, ancestor := range ancestors {
+		if len(m.descendants(ancestor)) + 1 > maxDescendants {
+			return &RejectedTxError{PolicyNonstandard, fmt.Sprintf("Transaction %s has more than %d unconfirmed descendants ", ancestor.id, maxDescendants)}
+		}
+	}
+
+	height, err := m.bc.GetBestHeight()
+	if err != nil {
+		return err
+	}
+
+	for m.size + size > maxPoolSize {
+		victim := m.lowest(ancestors)
+		if victim == nil {
+			return &RejectedTxError{PolicyInsufficientFee, errorPoolFull}
+		}
+
+		fees, sizes := m.packageOf(victim)
+		// the new transaction must pay more than the evicted package, equal rates evict older transactions
+		if fee * sizes < fees * size {
+			return &RejectedTxError{PolicyInsufficientFee, errorPoolFull}
+		}
+
+		m.removeWithDescendants(victim)
+	}
+
+	e := &entry{
+		tx: tx,
+		id: id,
+		fee: fee,
+		size: size,
+		added: added,
+		height: height,
+		parents: parents,
+		children: make(map[string]*entry),
+	}
+
+	for _, parent := range parents {
+		parent.children[id] = e
+	}
+	for _, vin := range tx.Vin {
+		m.spent[outpoint{txID: hex.EncodeToString(vin.OutTxID), index: vin.OutIndex}] = e
+	}
+	m.entries[id] = e
+	m.size += size
+
+	return nil
+}
+
+// addEvidence validates the evidence of double signing and puts it into the pool, mu must be held.
+// Evidence spends nothing and pays no fee, it is not limited by the size of the pool,
+// so the pool filled with transactions does not stop the offender from being slashed
+func (m *Mempool) addEvidence(tx bcpkg.Transaction, id string, added time.Time) error {
+	size := len(tx.Serialize())
+	if size > maxTxSize {
+		return &RejectedTxError{PolicyNonstandard, errorTxTooLarge}
+	}
+
+	err := tx.VerifyEvidence()
+	if err != nil {
+		return &InvalidTxError{fmt.Sprintf("Transaction %s has invalid evidence: %s", id, err)}
+	}
+
+	evidence, err := tx.DoubleSign()
+	if err != nil {
+		return err
+	}
+
+	if m.bc.IsEvidenceProcessed(evidence) {
+		return &RejectedTxError{PolicyDuplicate, fmt.Sprintf("Double signing of evidence %s is already slashed ", id)}
+	}
+
+	// evidence against the stakeholder which has already been slashed burns nothing
+	offender := evidence.Offender()
+	if len(m.bc.FindUnspentTxOutputs(offender)) == 0 && len(m.bc.FindStakedTxOutputs(offender)) == 0 {
+		return &RejectedTxError{PolicyDuplicate, fmt.Sprintf("Stakeholder %x of evidence %s has no stake ", evidence.Offender(), id)}
+	}
+
+	height, err := m.bc.GetBestHeight()
+	if err != nil {
+		return err
+	}
+
+	m.entries[id] = &entry{
+		tx: tx,
+		id: id,
+		size: size,
+		added: added,
+		height: height,
+		parents: make(map[string]*entry),
+		children: make(map[string]*entry),
+	}
+	m.size += size
+
+	return nil
+}
+
+// addDelegation validates the delegation and puts it into the pool, mu must be held.
+// Delegation pays no fee, outputs it delegates are kept in spent of the pool,
+// so they are not spent by transactions of the pool before the delegation is mined
+func (m *Mempool) addDelegation(tx bcpkg.Transaction, id string, added time.Time) error {
+	size := len(tx.Serialize())
+	if size > maxTxSize {
+		return &RejectedTxError{PolicyNonstandard, errorTxTooLarge}
+	}
+
+	err := tx.VerifyDelegation()
+	if err != nil {
+		return &InvalidTxError{fmt.Sprintf("Transaction %s has invalid delegation: %s", id, err)}
+	}
+
+	for _, op := range outpointsOf(tx) {
+		if conflict, ok := m.spent[op]; ok {
+			return &RejectedTxError{PolicyDuplicate, fmt.Sprintf("Transaction %s delegates output %s:%d used by %s ", id, op.txID, op.index, conflict.id)}
+		}
+	}
+
+	// delegated outputs must be in the chain, they may be spent or delegated by other blocks
+	if !m.bc.VerifyTransaction(&tx) {
+		return errors.New(errorMissingInputs)
+	}
+
+	height, err := m.bc.GetBestHeight()
+	if err != nil {
+		return err
+	}
+
+	e := &entry{
+		tx: tx,
+		id: id,
+		size: size,
+		added: added,
+		height: height,
+		parents: make(map[string]*entry),
+		children: make(map[string]*entry),
+	}
+
+	for _, op := range outpointsOf(tx) {
+		m.spent[op] = e
+	}
+	m.entries[id] = e
+	m.size += size
+
+	return nil
+}
+
+// outpointsOf returns outputs used by the transaction, that is outputs spent by its inputs
+// or outputs of the delegation
+func outpointsOf(tx bcpkg.Transaction) []outpoint {
+	var outpoints []outpoint
+
+	if tx.IsDelegation() {
+		delegation, err := tx.Delegation()
+		if err != nil {
+			return nil
+		}
+
+		for _, out := range delegation.Outputs {
+			outpoints = append(outpoints, outpoint{txID: hex.EncodeToString(out.TxID), index: out.Index})
+		}
+
+		return outpoints
+	}
+
+	for _, vin := range tx.Vin {
+		outpoints = append(outpoints, outpoint{txID: hex.EncodeToString(vin.OutTxID), index: vin.OutIndex})
+	}
+
+	return outpoints
+}
+
+// ancestors returns the given parents and all their ancestors in the pool, mu must be held
+func (m *Mempool) ancestors(parents map[string]*entry) map[string]*entry {
+	ancestors := make(map[string]*entry)
+
+	queue := make([]*entry, 0, len(parents))
+	for _, parent := range parents {
+		queue = append(queue, parent)
+	}
+
+	for len(queue) > 0 {
+		e := queue[0]
+		queue = queue[1:]
+
+		if _, ok := ancestors[e.id]; ok {
+			continue
+		}
+		ancestors[e.id] = e
+
+		for _, parent := range e.parents {
+			queue = append(queue, parent)
+		}
+	}
+
+	return ancestors
+}
+
+// descendants returns all transactions in the pool which spend the entry directly or not, mu must be held
+func (m *Mempool) descendants(e *entry) map[string]*entry {
+	descendants := make(map[string]*entry)
+
+	queue := []*entry{e}
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+
+		for id, child := range current.children {
+			if _, ok := descendants[id]; !ok {
+				descendants[id] = child
+				queue = append(queue, child)
+			}
+		}
+	}
+
+	return descendants
+}
+
+// packageOf returns fee and size of the entry with its descendants, mu must be held
+func (m *Mempool) packageOf(e *entry) (int, int) {
+	fees, sizes := e.fee, e.size
+
+	for _, descendant := range m.descendants(e) {
+		fees += descendant.fee
+		sizes += descendant.size
+	}
+
+	return fees, sizes
+}
+
+// lowest returns the entry which package with descendants has the lowest fee rate,
+// the oldest of equal ones, entries of skip are not considered, mu must be held
+func (m *Mempool) lowest(skip map[string]*entry) *entry {
+	var lowest *entry
+	lowestFees, lowestSizes := 0, 1
+
+	for id, e := range m.entries {
+		if _, ok := skip[id]; ok {
+			continue
+		}
+
+		fees, sizes := m.packageOf(e)
+		if lowest == nil || fees * lowestSizes < lowestFees * sizes ||
+			(fees * lowestSizes == lowestFees * sizes && e.added.Before(lowest.added)) {
+			lowest, lowestFees, lowestSizes = e, fees, sizes
+		}
+	}
+
+	return lowest
+}
+
+// remove deletes the entry from the pool, its children stay in the pool, mu must be held
+func (m *Mempool) remove(e *entry) {
+	if _, ok := m.entries[e.id]; !ok {
+		return
+	}
+
+	for _, parent := range e.parents {
+		delete(parent.children, e.id)
+	}
+	for _, child := range e.children {
+		delete(child.parents, e.id)
+	}
+	for _, op := range outpointsOf(e.tx) {
+		delete(m.spent, op)
+	}
+
+	delete(m.entries, e.id)
+	m.size -= e.size
+}
+
+// removeWithDescendants deletes the entry and transactions spending it from the pool, mu must be held
+func (m *Mempool) removeWithDescendants(e *entry) {
+	for _, descendant := range m.descendants(e) {
+		m.remove(descendant)
+	}
+	m.remove(e)
+}
+
+// expire removes transactions added before expiryTime, mu must be held
+func (m *Mempool) expire(now time.Time) {
+	for _, e := range m.entries {
+		if now.Sub(e.added) > expiryTime {
+			m.removeWithDescendants(e)
+		}
+	}
+}
+
+// sorted returns entries ordered so that parents go before their children, mu must be held
+func (m *Mempool) sorted() []*entry {
+	depth := make(map[string]int)
+	entries := make([]*entry, 0, len(m.entries))
+
+	for _, e := range m.entries {
+		depth[e.id] = len(m.ancestors(e.parents))
+		entries = append(entries, e)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		if depth[entries[i].id] != depth[entries[j].id] {
+			return depth[entries[i].id] < depth[entries[j].id]
+		}
+		if !entries[i].added.Equal(entries[j].added) {
+			return entries[i].added.Before(entries[j].added)
+		}
+
+		return entries[i].id < entries[j].id
+	})
+
+	return entries
+}
+
+// Has returns true if the transaction with given id is in the pool
+func (m *Mempool) Has(txID []byte) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, ok := m.entries[hex.EncodeToString(txID)]
+
+	return ok
+}
+
+// Get returns the transaction with given id from the pool
+func (m *Mempool) Get(txID []byte) (bcpkg.Transaction, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	e, ok := m.entries[hex.EncodeToString(txID)]
+	if !ok {
+		return bcpkg.Transaction{}, false
+	}
+
+	return e.tx, true
+}
+
+// Transactions returns transactions of the pool, parents go before their children
+func (m *Mempool) Transactions() []bcpkg.Transaction {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var txs []bcpkg.Transaction
+	for _, e := range m.sorted() {
+		txs = append(txs, e.tx)
+	}
+
+	return txs
+}
+
+// Update removes transactions mined by the connected blocks and transactions
+// conflicting with them. When blocks are disconnected by reorganization their
+// transactions are returned to the pool and the whole pool is validated again
+func (m *Mempool) Update(connected, disconnected []*bcpkg.ExtensionBlock) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.bc.Now()
+
+	if len(disconnected) > 0 {
+		m.revalidate(disconnected, now)
+	} else {
+		for _, block := range connected {
+			m.removeForBlock(block)
+		}
+	}
+
+	m.expire(now)
+}
+
+// removeForBlock removes transactions of the block and transactions
+// spending the same outputs with their descendants, mu must be held
+func (m *Mempool) removeForBlock(block *bcpkg.ExtensionBlock) {
+	for _, tx := range block.Transactions {
+		if e, ok := m.entries[hex.EncodeToString(tx.ID)]; ok {
+			m.remove(e)
+		}
+	}
+
+	for _, tx := range block.Transactions {
+		if tx.IsCoinbase() {
+			continue
+		}
+
+		for _, op := range outpointsOf(*tx) {
+			conflict, ok := m.spent[op]
+			if ok {
+				m.removeWithDescendants(conflict)
+			}
+		}
+	}
+}
+
+// revalidate adds transactions of the disconnected blocks and transactions of the pool
+// again, the ones which became invalid for the new chain are dropped, mu must be held
+func (m *Mempool) revalidate(disconnected []*bcpkg.ExtensionBlock, now time.Time) {
+	var pending []bcpkg.Transaction
+	added := make(map[string]time.Time)
+
+	for i := len(disconnected) - 1; i >= 0; i-- {
+		for _, tx := range disconnected[i].Transactions {
+			if !tx.IsCoinbase() {
+				pending = append(pending, *tx)
+				added[hex.EncodeToString(tx.ID)] = now
+			}
+		}
+	}
+
+	for _, e := range m.sorted() {
+		pending = append(pending, e.tx)
+		added[e.id] = e.added
+	}
+
+	m.entries = make(map[string]*entry)
+	m.spent = make(map[outpoint]*entry)
+	m.size = 0
+
+	// transactions of different blocks may be disconnected in any order,
+	// so the ones which spend missing outputs are retried while others are added
+	for progress := true; progress; {
+		progress = false
+
+		var failed []bcpkg.Transaction
+		for _, tx := range pending {
+			if m.add(tx, added[hex.EncodeToString(tx.ID)]) == nil {
+				progress = true
+			} else {
+				failed = append(failed, tx)
+			}
+		}
+
+		pending = failed
+	}
+}
+
+// Info returns the state of the pool
+func (m *Mempool) Info() Info {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	info := Info{Size: len(m.entries), Bytes: m.size, MaxBytes: maxPoolSize}
+
+	if lowest := m.lowest(nil); lowest != nil {
+		fees, sizes := m.packageOf(lowest)
+		info.MinFeeRate = fees * 1000 / sizes
+	}
+
+	return info
+}
+
+// RawMempool returns descriptions of transactions of the pool, parents go before their children
+func (m *Mempool) RawMempool() []EntryInfo {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var infos []EntryInfo
+
+	for _, e := range m.sorted() {
+		info := EntryInfo{
+			ID: e.id,
+			Size: e.size,
+			Fee: e.fee,
+			Time: e.added.Unix(),
+			Height: e.height,
+			AncestorCount: len(m.ancestors(e.parents)) + 1,
+			DescendantCount: len(m.descendants(e)) + 1,
+		}
+
+		for id := range e.parents {
+			info.Depends = append(info.Depends, id)
+		}
+		for id := range e.children {
+			info.SpentBy = append(info.SpentBy, id)
+		}
+		sort.Strings(info.Depends)
+		sort.Strings(info.SpentBy)
+
+		infos = append(infos, info)
+	}
+
+	return infos
+}
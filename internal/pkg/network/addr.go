@@ -0,0 +1,185 @@
+package network
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// minAddrBookSize is the number of addresses below which the node asks seeders for more
+const minAddrBookSize = 8
+
+type getAddr struct {
+	AddrFrom string
+}
+
+type addr struct {
+	AddrFrom  string
+	Addresses []netAddress
+}
+
+// sendGetAddr sends commandGetAddr request for addresses known by the peer
+func (n *Network) sendGetAddr(p *peer) {
+	payload := gobEncode(getAddr{AddrFrom: n.NetAddr})
+
+	p.queueMessage(message{Command: commandGetAddr, Payload: payload})
+}
+
+// handleGetAddr handles getAddr request and answers over the same connection
+// with addresses from AddrBook and the address of the current node
+func (n *Network) handleGetAddr(p *peer, request []byte) {
+	var payload getAddr
+
+	err := getDataFromRequest(request, &payload)
+	if err != nil {
+		n.misbehaving(p, scoreMalformed, err.Error())
+		return
+	}
+
+	addresses := n.AddrBook.Addresses(maxAddrPerMessage - 1)
+	addresses = append(addresses, netAddress{Addr: n.NetAddr, Timestamp: time.Now().Unix()})
+
+	response := gobEncode(addr{AddrFrom: n.NetAddr, Addresses: addresses})
+	p.queueMessage(message{Command: commandAddr, Payload: response})
+}
+
+// handleAddr handles addr request, puts received addresses to AddrBook
+// and adds the best of them to KnownNodes
+func (n *Network) handleAddr(p *peer, request []byte) {
+	var payload addr
+
+	err := getDataFromRequest(request, &payload)
+	if err != nil {
+		n.misbehaving(p, scoreMalformed, err.Error())
+		return
+	}
+
+	if len(payload.Addresses) > maxAddrPerMessage {
+		n.misbehaving(p, scoreSpam, fmt.Sprintf("%d addresses", len(payload.Addresses)))
+		return
+	}
+
+	n.addAddresses(payload.Addresses)
+}
+
+// addAddresses puts addresses to AddrBook and adds the best of them to KnownNodes
+func (n *Network) addAddresses(addresses []netAddress) {
+	n.AddrBook.addAddresses(addresses, n.NetAddr)
+
+	n.fillKnownNodes()
+
+	err := n.AddrBook.Save()
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// fillKnownNodes adds the best addresses from AddrBook to KnownNodes
+// until there are maxOutboundPeers of them
+func (n *Network) fillKnownNodes() {
+	for _, address := range n.AddrBook.Best(maxOutboundPeers * 2) {
+		if len(n.knownNodes()) >= maxOutboundPeers {
+			return
+		}
+
+		if address != n.NetAddr {
+			n.addNode(address)
+		}
+	}
+}
+
+// bootstrap asks seeders of the network for addresses of healthy nodes
+// when the node knows too few of them
+func (n *Network) bootstrap() {
+	if n.AddrBook.Size() >= minAddrBookSize {
+		return
+	}
+
+	for _, seeder := range n.Bc.Params.Seeders {
+		err := n.querySeeder(seeder)
+		if err != nil {
+			log.Printf("Seeder %s is not available: %s\n", seeder, err)
+		}
+	}
+}
+
+// querySeeder requests addresses from the seeder and handles its answer
+func (n *Network) querySeeder(seeder string) error {
+	response, err := requestAddr(n.Transport, seeder, n.versionMessage(seeder, n.localServices()), n.NetAddr, n.Bc.Params.Magic)
+	if err != nil {
+		return err
+	}
+
+	var payload addr
+	err = getDataFromRequest(response, &payload)
+	if err != nil {
+		return err
+	}
+
+	if len(payload.Addresses) > maxAddrPerMessage {
+		payload.Addresses = payload.Addresses[:maxAddrPerMessage]
+	}
+	n.addAddresses(payload.Addresses)
+
+	return nil
+}
+
+// requestAddr connects to the node or seeder, makes handshake with the given
+// version message, sends getAddr request and returns payload of its addr answer
+func requestAddr(transport Transport, address string, hello message, addrFrom string, magic [magicLength]byte) ([]byte, error) {
+	request := message{Command: commandGetAddr, Payload: gobEncode(getAddr{AddrFrom: addrFrom})}
+
+	return requestReply(transport, address, hello, request, commandAddr, addrFrom, magic)
+}
+
+// requestReply connects to the node, makes handshake with the given version
+// message, sends the request and returns payload of the answer with given command
+func requestReply(transport Transport, address string, hello, request message, reply, addrFrom string, magic [magicLength]byte) ([]byte, error) {
+	conn, err := transport.Dial(address, dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	_ = conn.SetDeadline(time.Now().Add(ioTimeout))
+
+	_, err = conn.Write(encodeMessage(magic, hello))
+	if err != nil {
+		return nil, err
+	}
+
+	versionReceived, verackReceived, requested := false, false, false
+
+	for {
+		msg, err := readMessage(conn, magic)
+		if err != nil {
+			return nil, err
+		}
+
+		switch msg.Command {
+		case commandVersion:
+			versionReceived = true
+			response := message{Command: commandVerack, Payload: gobEncode(verack{AddrFrom: addrFrom})}
+
+			_, err = conn.Write(encodeMessage(magic, response))
+			if err != nil {
+				return nil, err
+			}
+		case commandVerack:
+			verackReceived = true
+		case reply:
+			if requested {
+				return msg.Payload, nil
+			}
+		}
+
+		if versionReceived && verackReceived && !requested {
+			requested = true
+
+			_, err = conn.Write(encodeMessage(magic, request))
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+}
@@ -0,0 +1,284 @@
+package network
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+const peersFileName = "peers.json"
+
+// maxAddrPerMessage limits the number of addresses in one addr message
+const maxAddrPerMessage = 1000
+
+const (
+	// addresses which failed so many times in a row
+	// and were not reachable for addrHorizon are removed
+	maxFailures = 10
+	addrHorizon = time.Hour * 24 * 7
+	// healthyHorizon is the time after successful connection
+	// during which the node is considered healthy
+	healthyHorizon = time.Hour
+)
+
+// netAddress is address of the node with the time it was seen last
+type netAddress struct {
+	Addr      string
+	Timestamp int64
+}
+
+// knownAddress keeps reachability of the node
+type knownAddress struct {
+	Addr        string
+	LastSeen    int64
+	LastAttempt int64
+	LastSuccess int64
+	// Failures is the number of failed connections since the last successful one
+	Failures int
+}
+
+// score returns reachability of the node, nodes with bigger score are tried first
+func (a *knownAddress) score(now int64) float64 {
+	score := 1.0
+	if a.LastSuccess > 0 {
+		score += 1.0
+	}
+
+	score /= float64(1 + a.Failures)
+
+	if days := (now - a.LastSeen) / int64(time.Hour * 24 / time.Second); days > 0 {
+		score /= float64(1 + days)
+	}
+
+	return score
+}
+
+// isBad returns true if the node should be removed from AddrBook
+func (a *knownAddress) isBad(now int64) bool {
+	if a.Failures < maxFailures {
+		return false
+	}
+
+	return now - a.LastSuccess > int64(addrHorizon / time.Second)
+}
+
+// AddrBook keeps addresses of nodes of the network in file
+type AddrBook struct {
+	mu      sync.Mutex
+	file    string
+	entries map[string]*knownAddress
+	dirty   bool
+}
+
+// NewAddrBook loads AddrBook from file, missing file gives empty AddrBook
+func NewAddrBook(file string) *AddrBook {
+	book := &AddrBook{
+		file: file,
+		entries: make(map[string]*knownAddress),
+	}
+
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return book
+	}
+
+	var entries []*knownAddress
+	err = json.Unmarshal(content, &entries)
+	if err != nil {
+		return book
+	}
+
+	for _, entry := range entries {
+		book.entries[entry.Addr] = entry
+	}
+
+	return book
+}
+
+// Save writes AddrBook to file if it has been changed
+func (b *AddrBook) Save() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.dirty || b.file == "" {
+		return nil
+	}
+
+	var entries []*knownAddress
+	for _, entry := range b.entries {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Addr < entries[j].Addr
+	})
+
+	content, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	err = ioutil.WriteFile(b.file, content, 0644)
+	if err != nil {
+		return err
+	}
+	b.dirty = false
+
+	return nil
+}
+
+// AddAddress adds address of the node seen at the given time,
+// timestamps from the future are replaced with the current time
+func (b *AddrBook) AddAddress(addr string, timestamp int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now().Unix()
+	if timestamp > now {
+		timestamp = now
+	}
+
+	entry, ok := b.entries[addr]
+	if !ok {
+		entry = &knownAddress{Addr: addr}
+		b.entries[addr] = entry
+		b.dirty = true
+	}
+
+	if timestamp > entry.LastSeen {
+		entry.LastSeen = timestamp
+		b.dirty = true
+	}
+}
+
+// addAddresses adds received addresses except the own address
+// of the node and addresses which can not be parsed
+func (b *AddrBook) addAddresses(addresses []netAddress, self string) {
+	for _, address := range addresses {
+		if address.Addr == self {
+			continue
+		}
+
+		_, _, err := net.SplitHostPort(address.Addr)
+		if err != nil {
+			continue
+		}
+
+		b.AddAddress(address.Addr, address.Timestamp)
+	}
+}
+
+// Good marks the node as reachable
+func (b *AddrBook) Good(addr string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now().Unix()
+
+	entry, ok := b.entries[addr]
+	if !ok {
+		entry = &knownAddress{Addr: addr}
+		b.entries[addr] = entry
+	}
+
+	entry.LastSeen = now
+	entry.LastAttempt = now
+	entry.LastSuccess = now
+	entry.Failures = 0
+	b.dirty = true
+}
+
+// Failed marks failed connection to the node and removes it if it is unreachable for a long time
+func (b *AddrBook) Failed(addr string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	entry, ok := b.entries[addr]
+	if !ok {
+		return
+	}
+
+	now := time.Now().Unix()
+	entry.LastAttempt = now
+	entry.Failures++
+
+	if entry.isBad(now) {
+		delete(b.entries, addr)
+	}
+	b.dirty = true
+}
+
+// Size returns the number of addresses in AddrBook
+func (b *AddrBook) Size() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return len(b.entries)
+}
+
+// Best returns up to max addresses with the best score
+func (b *AddrBook) Best(max int) []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now().Unix()
+
+	var entries []*knownAddress
+	for _, entry := range b.entries {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].score(now) > entries[j].score(now)
+	})
+
+	var addrs []string
+	for i := 0; i < len(entries) && i < max; i++ {
+		addrs = append(addrs, entries[i].Addr)
+	}
+
+	return addrs
+}
+
+// Healthy returns up to max addresses of nodes which were reachable recently
+func (b *AddrBook) Healthy(max int) []netAddress {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	horizon := time.Now().Add(-healthyHorizon).Unix()
+
+	var addrs []netAddress
+	for _, entry := range b.entries {
+		if len(addrs) >= max {
+			break
+		}
+
+		if entry.Failures == 0 && entry.LastSuccess >= horizon {
+			addrs = append(addrs, netAddress{Addr: entry.Addr, Timestamp: entry.LastSeen})
+		}
+	}
+
+	return addrs
+}
+
+// Addresses returns up to max addresses which were seen within addrHorizon
+func (b *AddrBook) Addresses(max int) []netAddress {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	horizon := time.Now().Add(-addrHorizon).Unix()
+
+	var addrs []netAddress
+	for _, entry := range b.entries {
+		if len(addrs) >= max {
+			break
+		}
+
+		if entry.LastSeen >= horizon {
+			addrs = append(addrs, netAddress{Addr: entry.Addr, Timestamp: entry.LastSeen})
+		}
+	}
+
+	return addrs
+}
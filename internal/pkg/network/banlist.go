@@ -0,0 +1,122 @@
+package network
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"sort"
+	"sync"
+	"time"
+)
+
+const bansFileName = "bans.json"
+
+// Ban is the host banned until the given time
+type Ban struct {
+	Host  string
+	Until int64
+}
+
+// BanList keeps banned hosts in file, bans expire after their time
+type BanList struct {
+	mu   sync.Mutex
+	file string
+	bans map[string]int64
+}
+
+// NewBanList loads BanList from file, missing file gives empty BanList
+func NewBanList(file string) *BanList {
+	list := &BanList{
+		file: file,
+		bans: make(map[string]int64),
+	}
+
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return list
+	}
+
+	var bans []Ban
+	err = json.Unmarshal(content, &bans)
+	if err != nil {
+		return list
+	}
+
+	for _, ban := range bans {
+		list.bans[ban.Host] = ban.Until
+	}
+
+	return list
+}
+
+// save writes BanList to file, mu must be held
+func (l *BanList) save() error {
+	content, err := json.MarshalIndent(l.list(), "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(l.file, content, 0644)
+}
+
+// list returns bans which are not expired sorted by host, mu must be held
+func (l *BanList) list() []Ban {
+	now := time.Now().Unix()
+
+	bans := []Ban{}
+	for host, until := range l.bans {
+		if until > now {
+			bans = append(bans, Ban{Host: host, Until: until})
+		}
+	}
+	sort.Slice(bans, func(i, j int) bool {
+		return bans[i].Host < bans[j].Host
+	})
+
+	return bans
+}
+
+// Ban bans the host for the given duration and saves BanList
+func (l *BanList) Ban(host string, duration time.Duration) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.bans[host] = time.Now().Add(duration).Unix()
+
+	return l.save()
+}
+
+// IsBanned returns true if the host is banned
+func (l *BanList) IsBanned(host string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	until, ok := l.bans[host]
+	if !ok {
+		return false
+	}
+
+	if until <= time.Now().Unix() {
+		delete(l.bans, host)
+		return false
+	}
+
+	return true
+}
+
+// List returns hosts which are banned now
+func (l *BanList) List() []Ban {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.list()
+}
+
+// Clear removes all bans and saves BanList
+func (l *BanList) Clear() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.bans = make(map[string]int64)
+
+	return l.save()
+}
@@ -1,7 +1,6 @@
 package network
 
 import (
-	"encoding/hex"
 	"fmt"
 	bcpkg "github.com/keithzetterstrom/BibCoin/internal/pkg/blockchain"
 	"log"
@@ -14,152 +13,63 @@ type block struct {
 	Block    []byte
 }
 
-type getBlocks struct {
-	AddrFrom string
-}
-
-// sendBlock sends commandBlock request with given block
-func (n *Network) sendBlock(addr string, b *bcpkg.ExtensionBlock) {
-	data := block{n.NetAddr, b.Serialize()}
-	payload := gobEncode(data)
-	request := append(commandToBytes(commandBlock), payload...)
-
-	n.sendData(addr, request)
-}
-
-// sendGetBlocks sends commandGetBlocks request
-func (n *Network) sendGetBlocks(address string) {
-	payload := gobEncode(getBlocks{n.NetAddr})
-	request := append(commandToBytes(commandGetBlocks), payload...)
-
-	n.sendData(address, request)
-}
-
-// sendNewBlock sends commandNewBlock request with given block
-// when a new block has been mined
-func (n *Network) sendNewBlock(addr string, b *bcpkg.Block) {
+// SendBlock sends commandBlock request with given block
+func (n *Network) SendBlock(addr string, b *bcpkg.ExtensionBlock) {
 	data := block{n.NetAddr, b.Serialize()}
 	payload := gobEncode(data)
-	request := append(commandToBytes(commandNewBlock), payload...)
-
-	n.sendData(addr, request)
+	n.sendMessage(addr, commandBlock, payload)
 }
 
-// handleBlock handles request with new block and adds it to Blockchain
-func (n *Network) handleBlock(request []byte) {
+// handleBlock handles request with new block, adds it to Blockchain
+// and requests next blocks of the best header chain
+func (n *Network) handleBlock(p *peer, request []byte) {
 	var payload block
 
 	err := getDataFromRequest(request, &payload)
 	if err != nil {
-		log.Panic(err)
+		n.misbehaving(p, scoreMalformed, err.Error())
+		return
 	}
 
 	blockData := payload.Block
 	block, err := bcpkg.DeserializeExtensionBlock(blockData)
 	if err != nil {
-		log.Println(err)
+		n.misbehaving(p, scoreMalformed, err.Error())
 		return
 	}
 
-	err = n.Bc.AddBlock(block)
-	if err != nil {
-		fmt.Println(err)
-	} else {
-		fmt.Printf("Added block %x with high %d \n", block.Hash, block.Height)
-	}
-
-	if len(n.memPool) > 0 {
-		for _, tx := range block.Transactions {
-			txID := hex.EncodeToString(tx.ID)
-			if _, ok := n.memPool[txID]; ok {
-				delete(n.memPool, txID)
-			}
-		}
-	}
-
-	if len(n.blocksInTransit) > 0 {
-		blockHash := n.blocksInTransit[0]
-		n.sendGetData(payload.AddrFrom, typeBlock, blockHash)
-
-		n.blocksInTransit = n.blocksInTransit[1:]
-	}
-}
-
-// handleGetBlocks handles getBlocks request and sends inventory
-func (n *Network) handleGetBlocks(request []byte) {
-	var payload getBlocks
-
-	err := getDataFromRequest(request, &payload)
-	if err != nil {
-		log.Panic(err)
-	}
-
-	blocks := n.Bc.GetBlockHashes()
-	n.sendInv(payload.AddrFrom, typeBlock, blocks)
-}
-
-// handleNewBlock handles newBlock request with block from miner
-func (n *Network) handleNewBlock(request []byte)  {
-	var payload block
-
-	err := getDataFromRequest(request, &payload)
-	if err != nil {
-		log.Panic(err)
-	}
-
-	if len(n.memPool) < txInPool {
-		n.sendOK(payload.AddrFrom)
+	if len(block.PrevBlockHash) != 0 && !n.Bc.HasHeader(block.PrevBlockHash) {
+		n.blockReceived(block.Hash)
+		n.addOrphan(p, block, len(blockData), payload.AddrFrom)
 		return
 	}
 
-	blockData := payload.Block
-	block, err := bcpkg.DeserializeBlock(blockData)
-	if err != nil {
-		log.Println(err)
-		return
-	}
+	n.acceptBlock(p, block, commandBlock, payload.AddrFrom)
+}
 
-	var txs []*bcpkg.Transaction
+// acceptBlock adds the block received from the peer in the message with the command
+// and requests next blocks of the best header chain
+func (n *Network) acceptBlock(p *peer, block *bcpkg.ExtensionBlock, command, addrFrom string) {
+	err := n.Bc.AddBlock(block)
+	n.blockReceived(block.Hash)
+	n.reportDoubleSigns()
 
-	for id := range n.memPool {
-		tx := n.memPool[id]
-		if n.Bc.VerifyTransaction(&tx) {
-			txs = append(txs, &tx)
-		}
+	if code, ok := blockRejectCode(err); ok {
+		n.sendReject(p, command, code, err.Error(), block.Hash)
 	}
-
-	if len(txs) == 0 {
-		fmt.Println("All transactions are invalid")
+	if _, ok := err.(*bcpkg.InvalidBlockError); ok {
+		n.misbehaving(p, scoreInvalidBlock, err.Error())
 		return
 	}
-
-	lastIndex, err := n.Bc.GetLastSatoshiIndex()
 	if err != nil {
-		log.Panic(err)
-	}
-
-	cbTx := bcpkg.NewCoinbaseTX(block.MinerAddress, n.Address, "", lastIndex)
-	txs = append(txs, cbTx)
-
-	newBlock, err := n.Bc.AddNewBlock(block, txs, n.Address)
-	if err != nil {
-		fmt.Println(err)
-		n.sendOK(payload.AddrFrom)
-		return
+		log.Printf("Block %x from %s is not accepted: %s\n", block.Hash, addrFrom, err)
 	} else {
 		fmt.Printf("Added block %x with high %d \n", block.Hash, block.Height)
+		n.updateMemPool()
+		n.announceToLightPeers(block.Hash)
+		n.connectOrphans([][]byte{block.Hash})
 	}
 
-	fmt.Println("New block is mined!")
-
-	for _, tx := range txs {
-		txID := hex.EncodeToString(tx.ID)
-		delete(n.memPool, txID)
-	}
-
-	for _, node := range n.KnownNodes {
-		if node != n.NetAddr {
-			n.sendInv(node, typeBlock, [][]byte{newBlock.Hash})
-		}
-	}
+	n.requestBlocks()
+	n.checkSynced()
 }
@@ -0,0 +1,376 @@
+package network
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	bcpkg "github.com/keithzetterstrom/BibCoin/internal/pkg/blockchain"
+	"log"
+	"time"
+)
+
+// compactBlocksVersion is the first version of the protocol with compact blocks,
+// new blocks are announced to peers with lower version by inv
+const compactBlocksVersion = 4
+
+// shortIDLength is the number of bytes of short transaction ids
+const shortIDLength = 6
+
+// maxCompactBlockTxs limits the number of transactions of compact block and requests of them
+const maxCompactBlockTxs = 100000
+
+// prefilledTx is the transaction sent in compact block as is, peers do not have
+// coinbase transactions in mem pool, so they are always prefilled
+type prefilledTx struct {
+	Index       int
+	Transaction []byte
+}
+
+// cmpctBlock is the new block with short ids of transactions instead of transactions,
+// the peer takes them from its mem pool. Nonce makes short ids different for every
+// block, so collisions can not be repeated
+type cmpctBlock struct {
+	AddrFrom        string
+	Header          bcpkg.Block
+	StakeholderHash []byte
+	// Attempt, StakeholderPubKey, Signature and VRFProof are the signature of the extension
+	Attempt           int
+	StakeholderPubKey []byte
+	Signature         []byte
+	VRFProof          []byte
+	Nonce             uint64
+	ShortIDs          [][]byte
+	Prefilled         []prefilledTx
+}
+
+// getBlockTxn requests transactions of the compact block missing in mem pool by their indexes
+type getBlockTxn struct {
+	AddrFrom  string
+	BlockHash []byte
+	Indexes   []int
+}
+
+type blockTxn struct {
+	AddrFrom     string
+	BlockHash    []byte
+	Transactions [][]byte
+}
+
+// partialBlock is the compact block waiting for transactions missing in mem pool
+type partialBlock struct {
+	peer     string
+	block    *bcpkg.ExtensionBlock
+	missing  []int
+	deadline time.Time
+}
+
+// shortIDKey returns key of short ids of the block
+func shortIDKey(blockHash []byte, nonce uint64) []byte {
+	var nonceBytes [8]byte
+	binary.LittleEndian.PutUint64(nonceBytes[:], nonce)
+
+	key := sha256.Sum256(bytes.Join([][]byte{blockHash, nonceBytes[:]}, []byte{}))
+
+	return key[:]
+}
+
+// shortTxID returns short id of the transaction with the key of the block
+func shortTxID(key, txID []byte) []byte {
+	hash := sha256.Sum256(bytes.Join([][]byte{key, txID}, []byte{}))
+
+	return hash[:shortIDLength]
+}
+
+// newCompactBlock returns compact block of the block with prefilled coinbase transactions
+func (n *Network) newCompactBlock(block *bcpkg.ExtensionBlock) cmpctBlock {
+	compact := cmpctBlock{
+		AddrFrom: n.NetAddr,
+		Header: block.Block,
+		StakeholderHash: block.StakeholderHash,
+		Attempt: block.Attempt,
+		StakeholderPubKey: block.StakeholderPubKey,
+		Signature: block.Signature,
+		VRFProof: block.VRFProof,
+		Nonce: randomNonce(),
+	}
+
+	key := shortIDKey(block.Hash, compact.Nonce)
+
+	for i, tnx := range block.Transactions {
+		if tnx.IsCoinbase() {
+			compact.Prefilled = append(compact.Prefilled, prefilledTx{Index: i, Transaction: tnx.Serialize()})
+		} else {
+			compact.ShortIDs = append(compact.ShortIDs, shortTxID(key, tnx.ID))
+		}
+	}
+
+	return compact
+}
+
+// announceBlock sends the new block to the node as compact block if the node supports them,
+// otherwise it is announced by inv. Version of the node is known after handshake,
+// so it is waited for in another goroutine
+func (n *Network) announceBlock(addr string, block *bcpkg.ExtensionBlock) {
+	p, err := n.connectPeer(addr)
+	if err != nil {
+		log.Printf("Failed to connect to %s: %s\n", addr, err)
+		return
+	}
+
+	go func() {
+		select {
+		case <-p.ready:
+		case <-p.done:
+			return
+		}
+
+		if !p.known.add(block.Hash) {
+			return
+		}
+
+		if p.getInfo().Version < compactBlocksVersion {
+			payload := gobEncode(inv{AddrFrom: n.NetAddr, Type: typeBlock, Items: [][]byte{block.Hash}})
+			p.queueMessage(message{Command: commandInv, Payload: payload})
+			return
+		}
+
+		payload := gobEncode(n.newCompactBlock(block))
+		p.queueMessage(message{Command: commandCmpctBlock, Payload: payload})
+	}()
+}
+
+// handleCmpctBlock handles compact block, the block is built from transactions
+// of mem pool and the missing ones are requested from the peer. The block
+// which parent is unknown is downloaded with headers
+func (n *Network) handleCmpctBlock(p *peer, request []byte) {
+	var payload cmpctBlock
+
+	err := getDataFromRequest(request, &payload)
+	if err != nil {
+		n.misbehaving(p, scoreMalformed, err.Error())
+		return
+	}
+
+	if len(payload.ShortIDs) + len(payload.Prefilled) > maxCompactBlockTxs {
+		n.misbehaving(p, scoreSpam, fmt.Sprintf("compact block of %d transactions", len(payload.ShortIDs) + len(payload.Prefilled)))
+		return
+	}
+
+	hash := payload.Header.Hash
+	p.known.add(hash)
+
+	if n.Bc.HasBlock(hash) {
+		return
+	}
+
+	if n.Bc.IsLight() || len(payload.Header.PrevBlockHash) != 0 && !n.Bc.HasHeader(payload.Header.PrevBlockHash) {
+		n.sendGetHeaders(p)
+		return
+	}
+
+	block, missing, err := n.reconstructBlock(&payload)
+	if err != nil {
+		n.misbehaving(p, scoreMalformed, err.Error())
+		return
+	}
+
+	if len(missing) == 0 {
+		n.completeCompactBlock(p, block, payload.AddrFrom)
+		return
+	}
+
+	n.mu.Lock()
+	n.partialBlocks[hex.EncodeToString(hash)] = &partialBlock{
+		peer: p.addr,
+		block: block,
+		missing: missing,
+		deadline: time.Now().Add(blockDownloadTimeout),
+	}
+	n.mu.Unlock()
+
+	response := gobEncode(getBlockTxn{AddrFrom: n.NetAddr, BlockHash: hash, Indexes: missing})
+	p.queueMessage(message{Command: commandGetBlockTxn, Payload: response})
+}
+
+// reconstructBlock returns the block of the compact block with transactions found
+// in mem pool and indexes of the missing ones. Transactions with the same short id
+// are ambiguous, so they are requested too
+func (n *Network) reconstructBlock(compact *cmpctBlock) (*bcpkg.ExtensionBlock, []int, error) {
+	transactions := make([]*bcpkg.Transaction, len(compact.ShortIDs) + len(compact.Prefilled))
+
+	for _, prefilled := range compact.Prefilled {
+		if prefilled.Index < 0 || prefilled.Index >= len(transactions) || transactions[prefilled.Index] != nil {
+			return nil, nil, fmt.Errorf("Compact block has wrong prefilled index %d ", prefilled.Index)
+		}
+
+		tnx, err := bcpkg.DeserializeTransaction(prefilled.Transaction)
+		if err != nil {
+			return nil, nil, err
+		}
+		transactions[prefilled.Index] = &tnx
+	}
+
+	key := shortIDKey(compact.Header.Hash, compact.Nonce)
+	pool := make(map[string]*bcpkg.Transaction)
+
+	txs := n.MemPool.Transactions()
+	for i := range txs {
+		id := hex.EncodeToString(shortTxID(key, txs[i].ID))
+		if _, ok := pool[id]; ok {
+			pool[id] = nil
+		} else {
+			pool[id] = &txs[i]
+		}
+	}
+
+	var missing []int
+	next := 0
+
+	for i := range transactions {
+		if transactions[i] != nil {
+			continue
+		}
+
+		shortID := compact.ShortIDs[next]
+		next++
+
+		if len(shortID) != shortIDLength {
+			return nil, nil, fmt.Errorf("Compact block has short id of %d bytes ", len(shortID))
+		}
+
+		if tnx := pool[hex.EncodeToString(shortID)]; tnx != nil {
+			transactions[i] = tnx
+		} else {
+			missing = append(missing, i)
+		}
+	}
+
+	block := &bcpkg.ExtensionBlock{
+		Block: compact.Header,
+		Transactions: transactions,
+		StakeholderHash: compact.StakeholderHash,
+		Attempt: compact.Attempt,
+		StakeholderPubKey: compact.StakeholderPubKey,
+		Signature: compact.Signature,
+		VRFProof: compact.VRFProof,
+	}
+
+	return block, missing, nil
+}
+
+// completeCompactBlock adds the built block. Short ids may collide,
+// so the block not matching its merkle root is downloaded in full
+func (n *Network) completeCompactBlock(p *peer, block *bcpkg.ExtensionBlock, addrFrom string) {
+	if len(block.MerkleRoot) != 0 {
+		var ids [][]byte
+		for _, tnx := range block.Transactions {
+			ids = append(ids, tnx.ID)
+		}
+
+		if !bytes.Equal(bcpkg.MerkleRoot(ids), block.MerkleRoot) {
+			log.Printf("Compact block %x from %s is built wrong, downloading full block\n", block.Hash, addrFrom)
+			payload := gobEncode(getData{AddrFrom: n.NetAddr, Type: typeBlock, ID: block.Hash})
+			p.queueMessage(message{Command: commandGetData, Payload: payload})
+			return
+		}
+	}
+
+	n.acceptBlock(p, block, commandCmpctBlock, addrFrom)
+}
+
+// handleGetBlockTxn handles request of transactions of the compact block
+func (n *Network) handleGetBlockTxn(p *peer, request []byte) {
+	var payload getBlockTxn
+
+	err := getDataFromRequest(request, &payload)
+	if err != nil {
+		n.misbehaving(p, scoreMalformed, err.Error())
+		return
+	}
+
+	if len(payload.Indexes) > maxCompactBlockTxs {
+		n.misbehaving(p, scoreSpam, fmt.Sprintf("request of %d transactions", len(payload.Indexes)))
+		return
+	}
+
+	block, err := n.Bc.GetBlock(payload.BlockHash)
+	if err != nil {
+		n.sendNotFound(p, typeBlock, payload.BlockHash)
+		return
+	}
+
+	response := blockTxn{AddrFrom: n.NetAddr, BlockHash: payload.BlockHash}
+
+	for _, index := range payload.Indexes {
+		if index < 0 || index >= len(block.Transactions) {
+			n.misbehaving(p, scoreMalformed, fmt.Sprintf("transaction %d of block with %d transactions", index, len(block.Transactions)))
+			return
+		}
+
+		response.Transactions = append(response.Transactions, block.Transactions[index].Serialize())
+	}
+
+	p.queueMessage(message{Command: commandBlockTxn, Payload: gobEncode(response)})
+}
+
+// handleBlockTxn handles transactions of the compact block missing in mem pool
+// and adds the block when it is complete
+func (n *Network) handleBlockTxn(p *peer, request []byte) {
+	var payload blockTxn
+
+	err := getDataFromRequest(request, &payload)
+	if err != nil {
+		n.misbehaving(p, scoreMalformed, err.Error())
+		return
+	}
+
+	id := hex.EncodeToString(payload.BlockHash)
+
+	n.mu.Lock()
+	partial, ok := n.partialBlocks[id]
+	if ok && partial.peer == p.addr {
+		delete(n.partialBlocks, id)
+	}
+	n.mu.Unlock()
+
+	if !ok || partial.peer != p.addr {
+		log.Printf("Transactions of block %x from %s are not requested\n", payload.BlockHash, payload.AddrFrom)
+		return
+	}
+
+	if len(payload.Transactions) != len(partial.missing) {
+		n.misbehaving(p, scoreMalformed, fmt.Sprintf("%d transactions instead of %d", len(payload.Transactions), len(partial.missing)))
+		return
+	}
+
+	for i, data := range payload.Transactions {
+		tnx, err := bcpkg.DeserializeTransaction(data)
+		if err != nil {
+			n.misbehaving(p, scoreMalformed, err.Error())
+			return
+		}
+		partial.block.Transactions[partial.missing[i]] = &tnx
+	}
+
+	n.completeCompactBlock(p, partial.block, payload.AddrFrom)
+}
+
+// expirePartialBlocks forgets compact blocks which transactions are not received in time,
+// the blocks are downloaded with headers from other peers
+func (n *Network) expirePartialBlocks(now time.Time) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	expired := false
+	for id, partial := range n.partialBlocks {
+		if now.After(partial.deadline) {
+			log.Printf("Transactions of block %s are not received from %s in time\n", id, partial.peer)
+			delete(n.partialBlocks, id)
+			expired = true
+		}
+	}
+
+	return expired
+}
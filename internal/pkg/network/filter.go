@@ -0,0 +1,222 @@
+package network
+
+import (
+	"fmt"
+	bcpkg "github.com/keithzetterstrom/BibCoin/internal/pkg/blockchain"
+	"github.com/keithzetterstrom/BibCoin/internal/pkg/bloom"
+	"github.com/keithzetterstrom/BibCoin/tools/base58"
+	"log"
+	"time"
+)
+
+// typeFilteredBlock is requested by light nodes, the block is sent
+// as merkleblock with transactions matching the filter of the node
+const typeFilteredBlock = "filteredblock"
+
+// filterFalsePositiveRate is the rate of transactions not of the wallet sent
+// to the light node, they hide which transactions are of the wallet
+const filterFalsePositiveRate = 0.0001
+
+// lightSyncInterval is how often the light node asks full nodes for new headers,
+// new blocks are announced only by connected peers which may miss them
+const lightSyncInterval = time.Minute
+
+type filterLoad struct {
+	AddrFrom string
+	Filter   bloom.Filter
+}
+
+type filterAdd struct {
+	AddrFrom string
+	Data     []byte
+}
+
+type filterClear struct {
+	AddrFrom string
+}
+
+// merkleBlock is the header of the block with transactions matching the filter
+// and partial merkle tree proving that they are in the block
+type merkleBlock struct {
+	AddrFrom     string
+	Header       bcpkg.Block
+	Tree         bcpkg.PartialMerkleTree
+	Transactions [][]byte
+}
+
+// walletFilter returns filter of public key hashes of the wallet,
+// the hash of Address is used if WalletKeys are not set
+func (n *Network) walletFilter() *bloom.Filter {
+	keys := n.WalletKeys
+	if len(keys) == 0 {
+		pubKeyHash := base58.DecodeBase58([]byte(n.Address))
+		keys = [][]byte{pubKeyHash[1 : len(pubKeyHash) - 4]}
+	}
+
+	// nonce of the node is random, so it is used as tweak
+	filter := bloom.NewFilter(len(keys), filterFalsePositiveRate, uint32(n.nonce))
+	for _, key := range keys {
+		filter.Add(key)
+	}
+
+	return filter
+}
+
+// sendFilterLoad loads filter of the wallet onto the peer
+func (n *Network) sendFilterLoad(p *peer) {
+	payload := gobEncode(filterLoad{AddrFrom: n.NetAddr, Filter: *n.walletFilter()})
+	p.queueMessage(message{Command: commandFilterLoad, Payload: payload})
+}
+
+// announceToLightPeers announces the block to connected light nodes,
+// they are not known nodes, so new blocks are not sent to them otherwise
+func (n *Network) announceToLightPeers(hash []byte) {
+	payload := gobEncode(inv{AddrFrom: n.NetAddr, Type: typeBlock, Items: [][]byte{hash}})
+
+	for _, p := range n.peers.list() {
+		select {
+		case <-p.ready:
+		default:
+			continue
+		}
+
+		if p.getInfo().Services & ServiceLight != 0 && p.known.add(hash) {
+			p.queueMessage(message{Command: commandInv, Payload: payload})
+		}
+	}
+}
+
+// handleFilterLoad handles filter of the light node, only blocks
+// and transactions matching it are sent to the node
+func (n *Network) handleFilterLoad(p *peer, request []byte) {
+	var payload filterLoad
+
+	err := getDataFromRequest(request, &payload)
+	if err != nil {
+		n.misbehaving(p, scoreMalformed, err.Error())
+		return
+	}
+
+	err = payload.Filter.Validate()
+	if err != nil {
+		n.misbehaving(p, scoreSpam, err.Error())
+		return
+	}
+
+	p.filter = &payload.Filter
+}
+
+// handleFilterAdd adds the element to the loaded filter of the light node
+func (n *Network) handleFilterAdd(p *peer, request []byte) {
+	var payload filterAdd
+
+	err := getDataFromRequest(request, &payload)
+	if err != nil {
+		n.misbehaving(p, scoreMalformed, err.Error())
+		return
+	}
+
+	if len(payload.Data) > bloom.MaxFilterAddSize {
+		n.misbehaving(p, scoreSpam, fmt.Sprintf("filter element of %d bytes", len(payload.Data)))
+		return
+	}
+
+	if p.filter == nil {
+		n.misbehaving(p, scoreSpam, "filteradd without filter")
+		return
+	}
+
+	p.filter.Add(payload.Data)
+}
+
+// handleFilterClear removes the filter of the light node
+func (n *Network) handleFilterClear(p *peer, request []byte) {
+	var payload filterClear
+
+	err := getDataFromRequest(request, &payload)
+	if err != nil {
+		n.misbehaving(p, scoreMalformed, err.Error())
+		return
+	}
+
+	p.filter = nil
+}
+
+// sendMerkleBlock sends the block with transactions matching the filter of the peer,
+// blocks without merkle root can not be proven, so they are not found
+func (n *Network) sendMerkleBlock(p *peer, id []byte) {
+	block, err := n.Bc.GetBlock(id)
+	if err != nil || p.filter == nil || len(block.MerkleRoot) == 0 {
+		n.sendNotFound(p, typeFilteredBlock, id)
+		return
+	}
+
+	var ids, transactions [][]byte
+	var matches []bool
+
+	for _, tnx := range block.Transactions {
+		matched := p.filter.MatchTransaction(tnx)
+		if matched {
+			transactions = append(transactions, tnx.Serialize())
+		}
+
+		ids = append(ids, tnx.ID)
+		matches = append(matches, matched)
+	}
+
+	response := merkleBlock{
+		AddrFrom: n.NetAddr,
+		Header: block.Block,
+		Tree: *bcpkg.NewPartialMerkleTree(ids, matches),
+		Transactions: transactions,
+	}
+	p.queueMessage(message{Command: commandMerkleBlock, Payload: gobEncode(response)})
+}
+
+// handleMerkleBlock handles block requested by the light node, transactions
+// proven to be in the block are stored and next blocks are requested
+func (n *Network) handleMerkleBlock(p *peer, request []byte) {
+	var payload merkleBlock
+
+	err := getDataFromRequest(request, &payload)
+	if err != nil {
+		n.misbehaving(p, scoreMalformed, err.Error())
+		return
+	}
+
+	if !n.Bc.IsLight() {
+		log.Printf("Merkle block %x from %s is not requested\n", payload.Header.Hash, payload.AddrFrom)
+		return
+	}
+
+	var transactions []*bcpkg.Transaction
+	for _, data := range payload.Transactions {
+		tnx, err := bcpkg.DeserializeTransaction(data)
+		if err != nil {
+			n.misbehaving(p, scoreMalformed, err.Error())
+			return
+		}
+		transactions = append(transactions, &tnx)
+	}
+
+	err = n.Bc.AddFilteredBlock(&payload.Header, &payload.Tree, transactions)
+
+	if _, ok := err.(*bcpkg.InvalidBlockError); ok {
+		n.blockReceived(payload.Header.Hash)
+		n.misbehaving(p, scoreInvalidBlock, err.Error())
+		return
+	}
+	if err != nil {
+		// the block is requested from another peer
+		log.Printf("Merkle block %x from %s is not accepted: %s\n", payload.Header.Hash, payload.AddrFrom, err)
+		n.blockFailed(payload.Header.Hash, p.addr)
+	} else {
+		n.blockReceived(payload.Header.Hash)
+		if len(transactions) > 0 {
+			fmt.Printf("Added %d transactions of block %x with high %d \n", len(transactions), payload.Header.Hash, payload.Header.Height)
+		}
+	}
+
+	n.requestBlocks()
+	n.checkSynced()
+}
@@ -1,8 +1,7 @@
 package network
 
 import (
-	"bytes"
-	"encoding/hex"
+	"fmt"
 	"log"
 )
 
@@ -16,42 +15,74 @@ type inv struct {
 func (n *Network) sendInv(address, kind string, items [][]byte) {
 	inventory := inv{AddrFrom: n.NetAddr, Type: kind, Items: items}
 	payload := gobEncode(inventory)
-	request := append(commandToBytes(commandInv), payload...)
-
-	n.sendData(address, request)
+	n.sendMessage(address, commandInv, payload)
 }
 
 // handleInv handles inventory request, detects its type
 // and sends getData request for missing data
-func (n *Network) handleInv(request []byte) {
+func (n *Network) handleInv(p *peer, request []byte) {
 	var payload inv
 
 	err := getDataFromRequest(request, &payload)
 	if err != nil {
-		log.Panic(err)
+		n.misbehaving(p, scoreMalformed, err.Error())
+		return
 	}
 
-	if payload.Type == typeBlock {
-		n.blocksInTransit = payload.Items
-
-		blockHash := payload.Items[0]
+	if len(payload.Items) > maxInvPerMessage {
+		n.misbehaving(p, scoreSpam, fmt.Sprintf("inventory of %d items", len(payload.Items)))
+		return
+	}
 
-		n.sendGetData(payload.AddrFrom, typeBlock, blockHash)
+	for _, item := range payload.Items {
+		p.known.add(item)
+	}
 
-		newInTransit := [][]byte{}
-		for _, b := range n.blocksInTransit {
-			if bytes.Compare(b, blockHash) != 0 {
-				newInTransit = append(newInTransit, b)
+	if payload.Type == typeBlock {
+		// о новых блоках узнаём по заголовкам, тела качаются после них
+		for _, hash := range payload.Items {
+			if !n.Bc.HasHeader(hash) {
+				n.sendGetHeaders(p)
+				return
 			}
 		}
-		n.blocksInTransit = newInTransit
+
+		n.notify(true)
 	}
 
-	if payload.Type == typeTx {
-		txID := payload.Items[0]
+	// light node does not keep mem pool
+	if payload.Type == typeTx && !n.Bc.IsLight() {
+		n.requestTransactions(p, payload.Items)
+	}
+}
 
-		if n.memPool[hex.EncodeToString(txID)].ID == nil {
-			n.sendGetData(payload.AddrFrom, typeTx, txID)
-		}
+// sendNotFound answers the peer over the same connection that requested data
+// is missing or pruned and can not be served
+func (n *Network) sendNotFound(p *peer, kind string, id []byte) {
+	payload := gobEncode(getData{AddrFrom: n.NetAddr, Type: kind, ID: id})
+	p.queueMessage(message{Command: commandNotFound, Payload: payload})
+}
+
+// handleNotFound handles notFound request, the missing block is requested
+// from another peer, the missing transaction may be requested on next inv
+func (n *Network) handleNotFound(p *peer, request []byte) {
+	var payload getData
+
+	err := getDataFromRequest(request, &payload)
+	if err != nil {
+		n.misbehaving(p, scoreMalformed, err.Error())
+		return
+	}
+
+	if payload.Type == typeBlock || payload.Type == typeFilteredBlock {
+		log.Printf("Block %x is not available on %s\n", payload.ID, payload.AddrFrom)
+		n.blockFailed(payload.ID, p.addr)
+
+		n.requestBlocks()
+		n.checkSynced()
+	}
+
+	if payload.Type == typeTx {
+		n.txReceived(payload.ID)
 	}
 }
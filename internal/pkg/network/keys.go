@@ -0,0 +1,172 @@
+package network
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"golang.org/x/crypto/curve25519"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+)
+
+const (
+	nodeKeyFileName    = "nodekey.dat"
+	pinnedKeysFileName = "pinnedkeys.json"
+)
+
+const errorKeyMismatch = "Static key of the node does not match the pinned key "
+
+// nodeKey is the static X25519 key identifying the node in encrypted connections
+type nodeKey struct {
+	private []byte
+	public  []byte
+}
+
+// loadNodeKey reads the private key from file, new key is generated
+// and saved if the file is missing
+func loadNodeKey(file string) (*nodeKey, error) {
+	private, err := ioutil.ReadFile(file)
+	if err == nil && len(private) == curve25519.ScalarSize {
+		public, err := curve25519.X25519(private, curve25519.Basepoint)
+		if err != nil {
+			return nil, err
+		}
+
+		return &nodeKey{private: private, public: public}, nil
+	}
+	if err == nil {
+		return nil, fmt.Errorf("Node key file %s is corrupt ", file)
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	private, public, err := newKeyPair()
+	if err != nil {
+		return nil, err
+	}
+
+	err = ioutil.WriteFile(file, private, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	return &nodeKey{private: private, public: public}, nil
+}
+
+// PublicKey returns the static key of the node other nodes may pin
+func (n *Network) PublicKey() []byte {
+	return n.key.public
+}
+
+// PinnedKey is the static key the node with the address must have
+type PinnedKey struct {
+	Addr string
+	Key  string
+}
+
+// PinnedKeys keeps static keys of known nodes in file, connections to these
+// nodes must be encrypted and authenticated by the pinned keys
+type PinnedKeys struct {
+	mu   sync.Mutex
+	file string
+	keys map[string][]byte
+}
+
+// NewPinnedKeys loads PinnedKeys from file, missing file gives empty PinnedKeys.
+// Corrupt file is an error, the node must not run without keys it has pinned
+func NewPinnedKeys(file string) (*PinnedKeys, error) {
+	pinned := &PinnedKeys{
+		file: file,
+		keys: make(map[string][]byte),
+	}
+
+	content, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return pinned, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []PinnedKey
+	err = json.Unmarshal(content, &keys)
+	if err != nil {
+		return nil, fmt.Errorf("Pinned keys file %s is corrupt: %s ", file, err)
+	}
+
+	for _, key := range keys {
+		public, err := hex.DecodeString(key.Key)
+		if err != nil || len(public) != keyLength {
+			return nil, fmt.Errorf("Pinned keys file %s has invalid key of %s ", file, key.Addr)
+		}
+		pinned.keys[key.Addr] = public
+	}
+
+	return pinned, nil
+}
+
+// Pin sets the static key of the node with the address and saves PinnedKeys
+func (k *PinnedKeys) Pin(addr, key string) error {
+	public, err := hex.DecodeString(key)
+	if err != nil || len(public) != keyLength {
+		return fmt.Errorf("Key %s is not a hex encoded X25519 public key ", key)
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	k.keys[addr] = public
+
+	return k.save()
+}
+
+// Get returns the static key pinned for the address, nil if there is no one
+func (k *PinnedKeys) Get(addr string) []byte {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	return k.keys[addr]
+}
+
+// Check returns false if the static key of the node does not match the pinned one,
+// nil key means that the connection is not encrypted
+func (k *PinnedKeys) Check(addr string, key []byte) bool {
+	pinned := k.Get(addr)
+
+	return pinned == nil || bytes.Equal(pinned, key)
+}
+
+// List returns pinned keys sorted by address
+func (k *PinnedKeys) List() []PinnedKey {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	return k.list()
+}
+
+// list returns pinned keys sorted by address, mu must be held
+func (k *PinnedKeys) list() []PinnedKey {
+	keys := []PinnedKey{}
+	for addr, public := range k.keys {
+		keys = append(keys, PinnedKey{Addr: addr, Key: hex.EncodeToString(public)})
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].Addr < keys[j].Addr
+	})
+
+	return keys
+}
+
+// save writes PinnedKeys to file, mu must be held
+func (k *PinnedKeys) save() error {
+	content, err := json.MarshalIndent(k.list(), "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(k.file, content, 0644)
+}
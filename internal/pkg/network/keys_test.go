@@ -0,0 +1,79 @@
+package network
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// TestNodeKey checks that the generated node key is loaded again and corrupt key is an error
+func TestNodeKey(t *testing.T) {
+	file := filepath.Join(t.TempDir(), nodeKeyFileName)
+
+	key, err := loadNodeKey(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := loadNodeKey(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hex.EncodeToString(loaded.public) != hex.EncodeToString(key.public) {
+		t.Error("Loaded node key differs from the generated one")
+	}
+
+	err = ioutil.WriteFile(file, []byte("short"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = loadNodeKey(file); err == nil {
+		t.Error("Corrupt node key is loaded")
+	}
+}
+
+// TestPinnedKeys checks that pinned keys are saved and checked, and corrupt pinned keys are not loaded
+func TestPinnedKeys(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, pinnedKeysFileName)
+	key, other := newTestKey(t), newTestKey(t)
+
+	pinned, err := NewPinnedKeys(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = pinned.Pin("10.0.0.1:9200", "00"); err == nil {
+		t.Error("Invalid key is pinned")
+	}
+	err = pinned.Pin("10.0.0.1:9200", hex.EncodeToString(key.public))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := NewPinnedKeys(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !loaded.Check("10.0.0.1:9200", key.public) || loaded.Check("10.0.0.1:9200", other.public) || loaded.Check("10.0.0.1:9200", nil) {
+		t.Error("Loaded key does not authenticate the node")
+	}
+	if !loaded.Check("10.0.0.2:9200", nil) {
+		t.Error("Node without pinned key is not accepted")
+	}
+
+	files := map[string]string{
+		"broken.json": "[{",
+		"badkey.json": `[{"Addr": "10.0.0.1:9200", "Key": "00"}]`,
+	}
+	for name, content := range files {
+		file = filepath.Join(dir, name)
+
+		err = ioutil.WriteFile(file, []byte(content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = NewPinnedKeys(file); err == nil {
+			t.Errorf("Corrupt pinned keys file %s is loaded", name)
+		}
+	}
+}
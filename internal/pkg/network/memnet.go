@@ -0,0 +1,545 @@
+package network
+
+import (
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const memNetwork = "mem"
+
+// retransmitTimeout is the delay of data which is lost and sent again
+const retransmitTimeout = time.Millisecond * 200
+
+const (
+	errorConnRefused = "Connection refused "
+	errorConnClosed  = "Connection is closed "
+	errorUnreachable = "Node is unreachable "
+	errorAddrInUse   = "Address is already in use "
+)
+
+// timeoutError is returned when deadline of the connection is exceeded
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// MemNetwork connects nodes of one process without sockets. It delays data
+// by latency, loses it and splits nodes into partitions to simulate the real network.
+// Lost data is sent again after retransmitTimeout as TCP does, so messages
+// are delayed but not corrupted, and lost dials fail
+type MemNetwork struct {
+	mu        sync.Mutex
+	listeners map[string]*memListener
+	conns     map[*memConn]bool
+	latency   time.Duration
+	jitter    time.Duration
+	loss      float64
+	// groups are partitions of nodes, nodes of different partitions can not
+	// reach each other, nodes which are not in any partition reach all nodes
+	groups map[string]int
+	rand   *rand.Rand
+	ports  int
+}
+
+// NewMemNetwork returns MemNetwork without latency, loss and partitions,
+// seed makes random delays and losses reproducible
+func NewMemNetwork(seed int64) *MemNetwork {
+	return &MemNetwork{
+		listeners: make(map[string]*memListener),
+		conns: make(map[*memConn]bool),
+		groups: make(map[string]int),
+		rand: rand.New(rand.NewSource(seed)),
+	}
+}
+
+// SetLatency sets the delay of data, every write is delayed by latency
+// and a random part of jitter
+func (m *MemNetwork) SetLatency(latency, jitter time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.latency = latency
+	m.jitter = jitter
+}
+
+// SetLoss sets the probability that a write or a dial is lost
+func (m *MemNetwork) SetLoss(loss float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.loss = loss
+}
+
+// Partition splits nodes with given addresses into groups which can not reach
+// each other, connections between the groups are broken
+func (m *MemNetwork) Partition(groups ...[]string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.groups = make(map[string]int)
+	for i, group := range groups {
+		for _, addr := range group {
+			m.groups[addr] = i + 1
+		}
+	}
+
+	for conn := range m.conns {
+		if !m.reachable(conn.node, conn.remoteNode) {
+			conn.reset()
+		}
+	}
+}
+
+// Heal removes all partitions
+func (m *MemNetwork) Heal() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.groups = make(map[string]int)
+}
+
+// Listening returns true if a node listens on the address
+func (m *MemNetwork) Listening(addr string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, ok := m.listeners[addr]
+
+	return ok
+}
+
+// Transport returns Transport of the node listening on the address
+func (m *MemNetwork) Transport(addr string) Transport {
+	return &memTransport{net: m, node: addr}
+}
+
+// reachable returns true if the nodes are not in different partitions, mu must be held
+func (m *MemNetwork) reachable(a, b string) bool {
+	groupA, groupB := m.groups[a], m.groups[b]
+
+	return groupA == 0 || groupB == 0 || groupA == groupB
+}
+
+// lost returns true if data must be lost, mu must be held
+func (m *MemNetwork) lost() bool {
+	return m.loss > 0 && m.rand.Float64() < m.loss
+}
+
+// delay returns the delay of data, mu must be held
+func (m *MemNetwork) delay() time.Duration {
+	delay := m.latency
+	if m.jitter > 0 {
+		delay += time.Duration(m.rand.Int63n(int64(m.jitter)))
+	}
+	if m.lost() {
+		delay += retransmitTimeout
+	}
+
+	return delay
+}
+
+// remove forgets the closed connection
+func (m *MemNetwork) remove(conn *memConn) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.conns, conn)
+}
+
+// memTransport is Transport of one node of MemNetwork
+type memTransport struct {
+	net  *MemNetwork
+	node string
+}
+
+// Dial connects to the node of MemNetwork listening on the address,
+// the remote address of the connection has the host of the dialing node
+func (t *memTransport) Dial(addr string, timeout time.Duration) (net.Conn, error) {
+	m := t.net
+
+	m.mu.Lock()
+	ln, ok := m.listeners[addr]
+	reachable := m.reachable(t.node, addr)
+	lost := m.lost()
+	delay := m.delay()
+
+	m.ports++
+	host, _, err := net.SplitHostPort(t.node)
+	if err != nil {
+		host = t.node
+	}
+	local := memAddr(net.JoinHostPort(host, strconv.Itoa(40000 + m.ports)))
+	m.mu.Unlock()
+
+	if !reachable || lost {
+		if timeout < delay {
+			delay = timeout
+		}
+		time.Sleep(delay)
+
+		return nil, errors.New(errorUnreachable)
+	}
+	if !ok {
+		return nil, errors.New(errorConnRefused)
+	}
+
+	time.Sleep(delay)
+
+	client, server := newMemConnPair(m, t.node, local, addr, memAddr(addr))
+
+	// the connection is registered before it is accepted, so partitions break it
+	m.mu.Lock()
+	m.conns[client] = true
+	m.conns[server] = true
+	m.mu.Unlock()
+
+	select {
+	case ln.accepted <- server:
+		return client, nil
+	case <-ln.closed:
+	default:
+	}
+
+	client.Close()
+	server.Close()
+
+	return nil, errors.New(errorConnRefused)
+}
+
+// Listen accepts connections of MemNetwork on the address
+func (t *memTransport) Listen(addr string) (net.Listener, error) {
+	m := t.net
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.listeners[addr]; ok {
+		return nil, errors.New(errorAddrInUse)
+	}
+
+	ln := &memListener{
+		net: m,
+		addr: memAddr(addr),
+		accepted: make(chan *memConn, sendQueueLength),
+		closed: make(chan struct{}),
+	}
+	m.listeners[addr] = ln
+
+	return ln, nil
+}
+
+// memAddr is the address of MemNetwork
+type memAddr string
+
+func (a memAddr) Network() string { return memNetwork }
+func (a memAddr) String() string  { return string(a) }
+
+// memListener accepts connections of MemNetwork
+type memListener struct {
+	net       *MemNetwork
+	addr      memAddr
+	accepted  chan *memConn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// Accept waits for the next connection
+func (l *memListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.accepted:
+		return conn, nil
+	case <-l.closed:
+		return nil, errors.New(errorConnClosed)
+	}
+}
+
+// Close stops accepting connections and frees the address
+func (l *memListener) Close() error {
+	l.closeOnce.Do(func() {
+		l.net.mu.Lock()
+		delete(l.net.listeners, string(l.addr))
+		l.net.mu.Unlock()
+
+		close(l.closed)
+	})
+
+	return nil
+}
+
+// Addr returns the address the listener accepts connections on
+func (l *memListener) Addr() net.Addr {
+	return l.addr
+}
+
+// chunk is data written to the connection which is delivered at the given time
+type chunk struct {
+	data []byte
+	at   time.Time
+}
+
+// memPipe keeps data sent in one direction of the connection
+type memPipe struct {
+	mu     sync.Mutex
+	chunks []chunk
+	closed bool
+	// discarding is set when the reader is closed, data written after
+	// that is dropped as TCP does until the reset reaches the writer
+	discarding bool
+	// notify wakes up the reader when data is written or the pipe is closed
+	notify chan struct{}
+}
+
+// newMemPipe returns empty memPipe
+func newMemPipe() *memPipe {
+	return &memPipe{notify: make(chan struct{}, 1)}
+}
+
+// wake wakes up the reader of the pipe
+func (p *memPipe) wake() {
+	select {
+	case p.notify <- struct{}{}:
+	default:
+	}
+}
+
+// write adds data delivered after the delay, data is never delivered
+// before the data written earlier
+func (p *memPipe) write(data []byte, delay time.Duration) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return errors.New(errorConnClosed)
+	}
+	if p.discarding {
+		return nil
+	}
+
+	at := time.Now().Add(delay)
+	if len(p.chunks) > 0 && at.Before(p.chunks[len(p.chunks) - 1].at) {
+		at = p.chunks[len(p.chunks) - 1].at
+	}
+	p.chunks = append(p.chunks, chunk{data: append([]byte{}, data...), at: at})
+	p.wake()
+
+	return nil
+}
+
+// close closes the pipe, data written before is still delivered
+func (p *memPipe) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.closed = true
+	p.wake()
+}
+
+// discard drops data written to the pipe from now on, the reader is closed
+func (p *memPipe) discard() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.discarding = true
+	p.chunks = nil
+}
+
+// read reads delivered data waiting for it until the deadline
+func (p *memPipe) read(b []byte, deadline time.Time, done <-chan struct{}) (int, error) {
+	for {
+		p.mu.Lock()
+		now := time.Now()
+
+		var wait time.Duration = -1
+		if len(p.chunks) > 0 {
+			first := &p.chunks[0]
+			if !first.at.After(now) {
+				n := copy(b, first.data)
+				first.data = first.data[n:]
+				if len(first.data) == 0 {
+					p.chunks = p.chunks[1:]
+				}
+				p.mu.Unlock()
+
+				return n, nil
+			}
+			wait = first.at.Sub(now)
+		} else if p.closed {
+			p.mu.Unlock()
+			return 0, io.EOF
+		}
+		p.mu.Unlock()
+
+		if !deadline.IsZero() {
+			if !deadline.After(now) {
+				return 0, timeoutError{}
+			}
+			if wait < 0 || deadline.Sub(now) < wait {
+				wait = deadline.Sub(now)
+			}
+		}
+
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if wait >= 0 {
+			timer = time.NewTimer(wait)
+			timeout = timer.C
+		}
+
+		select {
+		case <-p.notify:
+		case <-timeout:
+		case <-done:
+			return 0, errors.New(errorConnClosed)
+		}
+
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+// memConn is one side of the connection of MemNetwork
+type memConn struct {
+	net *MemNetwork
+	// node and remoteNode are addresses the nodes listen on, they define partitions
+	node       string
+	remoteNode string
+	local      memAddr
+	remote     memAddr
+	in         *memPipe
+	out        *memPipe
+
+	mu            sync.Mutex
+	readDeadline  time.Time
+	writeDeadline time.Time
+
+	closed    chan struct{}
+	closeOnce sync.Once
+	// peer is the other side of the connection
+	peer *memConn
+}
+
+// newMemConnPair returns connected client and server sides of the connection
+func newMemConnPair(m *MemNetwork, node string, local memAddr, remoteNode string, remote memAddr) (*memConn, *memConn) {
+	toServer, toClient := newMemPipe(), newMemPipe()
+
+	client := &memConn{
+		net: m,
+		node: node,
+		remoteNode: remoteNode,
+		local: local,
+		remote: remote,
+		in: toClient,
+		out: toServer,
+		closed: make(chan struct{}),
+	}
+	server := &memConn{
+		net: m,
+		node: remoteNode,
+		remoteNode: node,
+		local: remote,
+		remote: local,
+		in: toServer,
+		out: toClient,
+		closed: make(chan struct{}),
+	}
+	client.peer, server.peer = server, client
+
+	return client, server
+}
+
+// Read reads data delivered to the connection
+func (c *memConn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	deadline := c.readDeadline
+	c.mu.Unlock()
+
+	return c.in.read(b, deadline, c.closed)
+}
+
+// Write sends data to the other side of the connection
+func (c *memConn) Write(b []byte) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, errors.New(errorConnClosed)
+	default:
+	}
+
+	c.net.mu.Lock()
+	delay := c.net.delay()
+	c.net.mu.Unlock()
+
+	err := c.out.write(b, delay)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(b), nil
+}
+
+// Close closes the connection, the other side reads data sent before and then io.EOF,
+// its writes succeed but the data is dropped
+func (c *memConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.out.close()
+		c.in.discard()
+		c.net.remove(c)
+	})
+
+	return nil
+}
+
+// reset closes both sides of the connection at once as a broken connection,
+// MemNetwork.mu must be held
+func (c *memConn) reset() {
+	for _, side := range []*memConn{c, c.peer} {
+		side.closeOnce.Do(func() {
+			close(side.closed)
+			side.out.close()
+			side.in.close()
+		})
+		delete(c.net.conns, side)
+	}
+}
+
+func (c *memConn) LocalAddr() net.Addr  { return c.local }
+func (c *memConn) RemoteAddr() net.Addr { return c.remote }
+
+// SetDeadline sets deadlines of reading and writing
+func (c *memConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.readDeadline = t
+	c.writeDeadline = t
+
+	return nil
+}
+
+// SetReadDeadline sets deadline of reading
+func (c *memConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.readDeadline = t
+
+	return nil
+}
+
+// SetWriteDeadline sets deadline of writing, writing never blocks
+// as data is buffered without limit
+func (c *memConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.writeDeadline = t
+
+	return nil
+}
@@ -0,0 +1,94 @@
+package network
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// frame header: magic, command, payload length and payload checksum
+const (
+	magicLength    = 4
+	lengthLength   = 4
+	checksumLength = 4
+	headerLength   = magicLength + commandLength + lengthLength + checksumLength
+)
+
+// maxPayloadLength limits size of a single message,
+// bigger frames are rejected before their payload is read
+const maxPayloadLength = 32 * 1024 * 1024
+
+const (
+	errorWrongMagic      = "Message is from another network "
+	errorPayloadTooLarge = "Message payload is too large "
+	errorBadChecksum     = "Message checksum is invalid "
+)
+
+type message struct {
+	Command string
+	Payload []byte
+}
+
+// checksum returns the first bytes of double sha256 hash of the payload
+func checksum(payload []byte) []byte {
+	first := sha256.Sum256(payload)
+	second := sha256.Sum256(first[:])
+
+	return second[:checksumLength]
+}
+
+// encodeMessage puts command and payload into frame of the network with given magic
+func encodeMessage(magic [magicLength]byte, msg message) []byte {
+	var buff bytes.Buffer
+
+	buff.Write(magic[:])
+	buff.Write(commandToBytes(msg.Command))
+
+	length := make([]byte, lengthLength)
+	binary.BigEndian.PutUint32(length, uint32(len(msg.Payload)))
+	buff.Write(length)
+
+	buff.Write(checksum(msg.Payload))
+	buff.Write(msg.Payload)
+
+	return buff.Bytes()
+}
+
+// readMessage reads the next frame from r, frames of other networks, oversized
+// and corrupt frames are rejected. io.EOF is returned when the peer closed connection
+// between frames
+func readMessage(r io.Reader, magic [magicLength]byte) (*message, error) {
+	header := make([]byte, headerLength)
+
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return nil, err
+	}
+
+	if !bytes.Equal(header[:magicLength], magic[:]) {
+		return nil, errors.New(errorWrongMagic)
+	}
+
+	command := bytesToCommand(header[magicLength:magicLength + commandLength])
+
+	length := binary.BigEndian.Uint32(header[magicLength + commandLength:])
+	if length > maxPayloadLength {
+		return nil, fmt.Errorf("%s%d bytes in %s ", errorPayloadTooLarge, length, command)
+	}
+
+	payload := make([]byte, length)
+
+	_, err = io.ReadFull(r, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	if !bytes.Equal(checksum(payload), header[headerLength - checksumLength:]) {
+		return nil, errors.New(errorBadChecksum)
+	}
+
+	return &message{Command: command, Payload: payload}, nil
+}
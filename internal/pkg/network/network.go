@@ -3,30 +3,66 @@ package network
 import (
 	"bytes"
 	"encoding/gob"
-	"encoding/hex"
+	"errors"
 	"fmt"
 	bcpkg "github.com/keithzetterstrom/BibCoin/internal/pkg/blockchain"
-	"io"
-	"io/ioutil"
+	mempoolpkg "github.com/keithzetterstrom/BibCoin/internal/pkg/mempool"
+	walletpkg "github.com/keithzetterstrom/BibCoin/internal/pkg/wallet"
 	"log"
 	"net"
+	"path/filepath"
+	"sync"
 	"time"
 )
 
 const (
-	commandOK        = "ok"
-	commandVersion   = "version"
-	commandTx        = "tx"
-	commandBlock     = "block"
-	commandNewBlock  = "newblock"
-	commandInv       = "inv"
-	commandGetData   = "getdata"
-	commandGetBlocks = "getblocks"
+	commandOK          = "ok"
+	commandVersion     = "version"
+	commandVerack      = "verack"
+	commandTx          = "tx"
+	commandBlock       = "block"
+	commandNewBlock    = "newblock"
+	commandInv         = "inv"
+	commandGetData     = "getdata"
+	commandGetHeaders  = "getheaders"
+	commandHeaders     = "headers"
+	commandNotFound    = "notfound"
+	commandGetAddr     = "getaddr"
+	commandAddr        = "addr"
+	commandGetMempool  = "getmempool"
+	commandMempool     = "mempool"
+	commandPing        = "ping"
+	commandPong        = "pong"
+	commandGetPeerInfo = "getpeerinfo"
+	commandPeerInfo    = "peerinfo"
+	commandReject      = "reject"
+	commandFilterLoad  = "filterload"
+	commandFilterAdd   = "filteradd"
+	commandFilterClear = "filterclear"
+	commandMerkleBlock = "merkleblock"
+	commandCmpctBlock  = "cmpctblock"
+	commandGetBlockTxn = "getblocktxn"
+	commandBlockTxn    = "blocktxn"
+	commandExtension   = "extension"
+	commandDecline     = "decline"
+	commandPresence    = "presence"
+	commandGetPresence = "getpresence"
+	commandOnlineStake = "onlinestake"
 )
 
+const errorHostBanned = "Host is banned "
+
 const protocol = "tcp"
 const commandLength = 12
-const fullNodeAddress = "172.20.10.12:9000"
+
+// ioTimeout limits writing of a message and waiting for responses
+const ioTimeout = time.Minute
+
+// eventsLength is the number of handled messages the node may wait for
+const eventsLength = 16
+
+const backfillBatch = 16
+const backfillInterval = time.Second * 10
 
 type getData struct {
 	AddrFrom string
@@ -35,24 +71,118 @@ type getData struct {
 }
 
 type Network struct {
-	NetAddr         string
-	Address         string
-	Bc              *bcpkg.Blockchain
-	KnownNodes      []string
-	memPool         map[string]bcpkg.Transaction
-	blocksInTransit [][]byte
+	NetAddr string
+	Address string
+	Bc      *bcpkg.Blockchain
+	// Wallet signs extensions of blocks the node is chosen to stake,
+	// the node without it does not answer miners
+	Wallet  *walletpkg.Wallet
+	genesis []byte
+	peers   *peerManager
+	orphans *orphanPool
+	// MemPool keeps valid transactions which are not mined yet
+	MemPool   *mempoolpkg.Mempool
+	walletTxs *walletTxs
+	// presences are stakeholders which announced that they are online,
+	// miners send blocks directly to chosen ones
+	presences *presenceRegistry
+	// WalletKeys are public key hashes of the wallet loaded into filters of full nodes
+	// by the light node, the hash of Address is used if they are not set
+	WalletKeys [][]byte
+	// AddrBook keeps addresses of nodes learned from other nodes and seeders
+	AddrBook *AddrBook
+	// BanList keeps hosts of misbehaving nodes which are not allowed to connect
+	BanList *BanList
+	// PinnedKeys are static keys the nodes must have in encrypted connections
+	PinnedKeys *PinnedKeys
+	// Plaintext disables encryption of outbound connections
+	// except the ones to nodes with pinned keys
+	Plaintext bool
+	key       *nodeKey
+	// Transport connects the node to other nodes, TCPTransport by default
+	Transport Transport
+	// quit is closed by Stop to shut down the running server
+	quit     chan struct{}
+	stopOnce sync.Once
+	// events receives true when the blockchain is synchronized with a peer or commandOK
+	// is handled and false for other messages, it is used by nodes waiting for responses of their peers
+	events chan bool
+	// services are flags of the running server announced in version message
+	services uint64
+	nonce    uint64
+
+	// mu protects the fields below, handlers of different peers run concurrently
+	mu         sync.Mutex
+	KnownNodes []string
+	// headersRequested are the times when headers were requested from the peers by their addresses
+	headersRequested map[string]time.Time
+	// blocksInFlight are blocks of the best header chain which bodies are downloaded
+	blocksInFlight map[string]*blockRequest
+	// partialBlocks are compact blocks waiting for missing transactions
+	partialBlocks map[string]*partialBlock
+	// txsRequested are the times when transactions were requested from peers
+	txsRequested map[string]time.Time
+	// rejectWaiters receive rejects of submitted transactions
+	rejectWaiters map[string]chan *RejectError
+	// round is the round of the block mined by the node
+	round *stakeRound
+	// nextAttempt is the first attempt of the next round on top of roundParent,
+	// stakeholders of the same parent are chosen by the same sequence of attempts,
+	// so the next round goes on with the attempts not tried yet
+	roundParent []byte
+	nextAttempt int
+	// signed are extensions signed by the node as the stakeholder by their heights
+	signed map[int]*bcpkg.ExtensionBlock
 }
 
 // NewNetwork returns new Network object
 func NewNetwork(bc *bcpkg.Blockchain, netAddress, address string) *Network {
-	return &Network{
+	genesis, err := bcpkg.GenesisBlock(bc.Params)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	dataDir := filepath.Dir(bc.AddrFile)
+
+	key, err := loadNodeKey(filepath.Join(dataDir, bc.Params.DataFile(nodeKeyFileName)))
+	if err != nil {
+		log.Panic(err)
+	}
+
+	pinnedKeys, err := NewPinnedKeys(filepath.Join(dataDir, bc.Params.DataFile(pinnedKeysFileName)))
+	if err != nil {
+		log.Panic(err)
+	}
+
+	n := &Network{
 		Bc: bc,
 		NetAddr: netAddress,
 		Address: address,
-		KnownNodes: []string{fullNodeAddress},
-		memPool: make(map[string]bcpkg.Transaction),
-		blocksInTransit: [][]byte{},
+		KnownNodes: append([]string{}, bc.Params.SeedNodes...),
+		headersRequested: make(map[string]time.Time),
+		blocksInFlight: make(map[string]*blockRequest),
+		partialBlocks: make(map[string]*partialBlock),
+		txsRequested: make(map[string]time.Time),
+		rejectWaiters: make(map[string]chan *RejectError),
+		signed: make(map[int]*bcpkg.ExtensionBlock),
+		genesis: genesis.Hash,
+		peers: newPeerManager(),
+		orphans: newOrphanPool(),
+		MemPool: mempoolpkg.NewMempool(bc),
+		presences: newPresenceRegistry(),
+		walletTxs: newWalletTxs(filepath.Join(dataDir, bc.Params.DataFile(walletTxsFileName))),
+		AddrBook: NewAddrBook(filepath.Join(dataDir, bc.Params.DataFile(peersFileName))),
+		BanList: NewBanList(filepath.Join(dataDir, bc.Params.DataFile(bansFileName))),
+		PinnedKeys: pinnedKeys,
+		key: key,
+		Transport: TCPTransport{},
+		quit: make(chan struct{}),
+		events: make(chan bool, eventsLength),
+		nonce: randomNonce(),
 	}
+	n.fillKnownNodes()
+
+	return n
 }
 
 // commandToBytes converts command into slice of bytes
@@ -79,159 +209,431 @@ func bytesToCommand(bytes []byte) string {
 	return fmt.Sprintf("%s", command)
 }
 
-// sendData sends data to given network address and
-// if the node on given address is unreachable deletes it's address from KnownNodes
-func (n *Network) sendData(addr string, data []byte) {
-	conn, err := net.Dial(protocol, addr)
+// sendMessages queues messages to the peer with given network address, connects
+// to the node if it is not connected yet and if the node is unreachable
+// deletes it's address from KnownNodes
+func (n *Network) sendMessages(addr string, messages []message) {
+	p, err := n.connectPeer(addr)
 	if err != nil {
-		var updatedNodes []string
+		log.Printf("Failed to connect to %s: %s\n", addr, err)
+		return
+	}
 
-		for _, node := range n.KnownNodes {
-			if node != addr {
-				updatedNodes = append(updatedNodes, node)
-			}
+	for _, msg := range messages {
+		if !p.queueMessage(msg) {
+			log.Printf("Peer %s does not accept messages, disconnecting\n", addr)
+			p.close()
+			return
+		}
+	}
+}
+
+// connectPeer returns connected peer with given address
+// and connects to the node if it is not connected yet
+func (n *Network) connectPeer(addr string) (*peer, error) {
+	if p := n.peers.get(addr); p != nil {
+		return p, nil
+	}
+
+	return n.connect(addr)
+}
+
+// connect opens outbound connection to the node, starts its peer and handshake
+func (n *Network) connect(addr string) (*peer, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err == nil && n.BanList.IsBanned(host) {
+		n.forgetNode(addr)
+		return nil, errors.New(errorHostBanned)
+	}
+
+	conn, key, err := n.dial(addr)
+	if err != nil {
+		n.forgetNode(addr)
+		n.AddrBook.Failed(addr)
+		return nil, err
+	}
+
+	p := newPeer(conn, addr, false)
+	p.remoteKey = key
+
+	err = n.peers.add(p)
+	if err != nil {
+		conn.Close()
+
+		// the node may have been connected by another goroutine meanwhile
+		if existing := n.peers.get(addr); existing != nil {
+			return existing, nil
 		}
 
-		n.KnownNodes = updatedNodes
+		return nil, err
+	}
+
+	n.sendVersion(p)
+
+	go p.writeLoop(n.Bc.Params.Magic)
+	go p.readLoop(n)
 
+	return p, nil
+}
+
+// listen accepts inbound connections and starts their peers
+func (n *Network) listen(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			log.Println(err)
+			return
+		}
+
+		go n.accept(conn)
+	}
+}
+
+// accept makes encrypted handshake if the inbound connection
+// is encrypted and starts its peer. The slot of the peer is taken before
+// the handshake, so connections over the limit do not make handshakes
+func (n *Network) accept(conn net.Conn) {
+	host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	if n.BanList.IsBanned(host) {
+		conn.Close()
+		return
+	}
+
+	if !n.peers.reserveInbound() {
+		log.Printf("Rejected connection from %s: %s\n", conn.RemoteAddr(), errorPeerLimit)
+		conn.Close()
 		return
 	}
-	defer conn.Close()
 
-	_, err = io.Copy(conn, bytes.NewReader(data))
+	secure, key, err := n.secureInbound(conn)
+	n.peers.releaseInbound()
 	if err != nil {
-		log.Panic(err)
+		log.Printf("Rejected connection from %s: %s\n", conn.RemoteAddr(), err)
+		conn.Close()
+		return
 	}
+
+	p := newPeer(secure, conn.RemoteAddr().String(), true)
+	p.remoteKey = key
+
+	err = n.peers.add(p)
+	if err != nil {
+		log.Printf("Rejected connection from %s: %s\n", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+
+	go p.writeLoop(n.Bc.Params.Magic)
+	go p.readLoop(n)
+}
+
+// Close disconnects all peers after their queued messages are sent and saves AddrBook
+func (n *Network) Close() {
+	for _, p := range n.peers.list() {
+		p.close()
+		<-p.done
+		// the reading goroutine may still be running, the closed peer must not be reused
+		n.peers.remove(p)
+		n.peerDisconnected(p.addr)
+	}
+
+	err := n.AddrBook.Save()
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// sendMessage sends command with payload to given network address
+func (n *Network) sendMessage(addr, command string, payload []byte) {
+	n.sendMessages(addr, []message{{Command: command, Payload: payload}})
 }
 
 // sendGetData sends "get data" request with data type and its id
 func (n *Network) sendGetData(address, kind string, id []byte) {
 	payload := gobEncode(getData{AddrFrom: n.NetAddr, Type: kind, ID: id})
-	request := append(commandToBytes(commandGetData), payload...)
 
-	n.sendData(address, request)
+	n.sendMessage(address, commandGetData, payload)
 }
 
 // handleGetData handles "get data" request, detects type of the data
-// and sends needed response
-func (n *Network) handleGetData(request []byte) {
+// and answers over the same connection, the address given in the request
+// is not dialed, so the peer behind NAT gets the answer too
+func (n *Network) handleGetData(p *peer, request []byte) {
 	var payload getData
 
 	err := getDataFromRequest(request, &payload)
 	if err != nil {
-		log.Panic(err)
+		n.misbehaving(p, scoreMalformed, err.Error())
+		return
 	}
 
 	if payload.Type == typeBlock {
-		block, err := n.Bc.GetBlock(payload.ID)
+		b, err := n.Bc.GetBlock(payload.ID)
 		if err != nil {
+			n.sendNotFound(p, typeBlock, payload.ID)
 			return
 		}
 
-		n.sendBlock(payload.AddrFrom, &block)
+		response := gobEncode(block{n.NetAddr, b.Serialize()})
+		p.queueMessage(message{Command: commandBlock, Payload: response})
+	}
+
+	if payload.Type == typeFilteredBlock {
+		n.sendMerkleBlock(p, payload.ID)
 	}
 
 	if payload.Type == typeTx {
-		txID := hex.EncodeToString(payload.ID)
-		tx := n.memPool[txID]
+		tnx, ok := n.MemPool.Get(payload.ID)
+		if !ok {
+			n.sendNotFound(p, typeTx, payload.ID)
+			return
+		}
 
-		n.SendTx(payload.AddrFrom, &tx)
+		// the transaction is sent over the same connection, so the peer
+		// does not count it as flood
+		response := gobEncode(tx{AddFrom: n.NetAddr, Transaction: tnx.Serialize()})
+		p.queueMessage(message{Command: commandTx, Payload: response})
 	}
 }
 
-// handleConnection handles input requests, detects type of each command
-func (n *Network) handleConnection(conn net.Conn) bool {
-	defer conn.Close()
+// handleMessage detects type of the command received from the peer and handles its payload
+func (n *Network) handleMessage(p *peer, msg *message) {
+	request := msg.Payload
 
-	request, err := ioutil.ReadAll(conn)
-	if err != nil {
-		log.Println(err)
-		return false
+	// reject may tell why the handshake fails
+	if !p.handshakeDone && msg.Command != commandVersion && msg.Command != commandVerack && msg.Command != commandReject {
+		n.misbehaving(p, scoreBeforeHandshake, msg.Command + " before handshake")
+		return
 	}
 
-	command := bytesToCommand(request[:commandLength])
-
-	switch command {
+	switch msg.Command {
 	case commandBlock:
-		n.handleBlock(request)
+		n.handleBlock(p, request)
 	case commandNewBlock:
-		n.handleNewBlock(request)
+		n.handleNewBlock(p, request)
 	case commandInv:
-		n.handleInv(request)
-	case commandGetBlocks:
-		n.handleGetBlocks(request)
+		n.handleInv(p, request)
+	case commandGetHeaders:
+		n.handleGetHeaders(p, request)
+	case commandHeaders:
+		n.handleHeaders(p, request)
 	case commandGetData:
-		n.handleGetData(request)
+		n.handleGetData(p, request)
 	case commandTx:
-		n.handleTx(request)
+		n.handleTx(p, request)
 	case commandVersion:
-		n.handleVersion(request)
+		n.handleVersion(p, request)
+	case commandVerack:
+		n.handleVerack(p, request)
+	case commandNotFound:
+		n.handleNotFound(p, request)
+	case commandGetAddr:
+		n.handleGetAddr(p, request)
+	case commandAddr:
+		n.handleAddr(p, request)
+	case commandGetMempool:
+		n.handleGetMempool(p, request)
+	case commandGetPeerInfo:
+		n.handleGetPeerInfo(p, request)
+	case commandPing:
+		n.handlePing(p, request)
+		// keepalive messages are not responses the node may wait for
+		return
+	case commandPong:
+		n.handlePong(p, request)
+		return
+	case commandReject:
+		n.handleReject(p, request)
+	case commandFilterLoad:
+		n.handleFilterLoad(p, request)
+	case commandFilterAdd:
+		n.handleFilterAdd(p, request)
+	case commandFilterClear:
+		n.handleFilterClear(p, request)
+	case commandMerkleBlock:
+		n.handleMerkleBlock(p, request)
+	case commandCmpctBlock:
+		n.handleCmpctBlock(p, request)
+	case commandGetBlockTxn:
+		n.handleGetBlockTxn(p, request)
+	case commandBlockTxn:
+		n.handleBlockTxn(p, request)
+	case commandExtension:
+		n.handleExtension(p, request)
+	case commandDecline:
+		n.handleDecline(p, request)
+	case commandPresence:
+		n.handlePresence(p, request)
+	case commandGetPresence:
+		n.handleGetPresence(p, request)
 	case commandOK:
 		// fmt.Println("Every thing update")
-		return true
 	default:
 		fmt.Println("Unknown command!")
 	}
 
-	return false
+	n.notify(msg.Command == commandOK)
+}
+
+// notify sends event to the goroutine waiting for responses of peers
+func (n *Network) notify(synced bool) {
+	select {
+	case n.events <- synced:
+	default:
+	}
+}
+
+// drainEvents drops events of messages handled before the node started to wait
+func (n *Network) drainEvents() {
+	for {
+		select {
+		case <-n.events:
+		default:
+			return
+		}
+	}
 }
 
 // StartServer starts server for synchronization (updates your blockchain)
 func (n *Network) StartServer() {
-	ln, err := net.Listen(protocol, n.NetAddr)
+	ln, err := n.Transport.Listen(n.NetAddr)
 	if err != nil {
 		log.Println(err)
 		return
 	}
 	defer ln.Close()
 
-	n.synchronization(ln)
+	stop := make(chan struct{})
+	defer close(stop)
+
+	go n.listen(ln)
+	go n.downloadLoop(stop)
+
+	n.synchronization()
+	n.Close()
+}
+
+// Stop shuts down the running server, the server disconnects its peers before returning
+func (n *Network) Stop() {
+	n.stopOnce.Do(func() {
+		close(n.quit)
+	})
+}
+
+// Connect connects to the node unless it is connected already
+func (n *Network) Connect(addr string) error {
+	_, err := n.connectPeer(addr)
+
+	return err
+}
+
+// closeOnStop closes the listener when the node is stopped or stop is closed
+func (n *Network) closeOnStop(ln net.Listener, stop <-chan struct{}) {
+	select {
+	case <-n.quit:
+	case <-stop:
+	}
+
+	ln.Close()
 }
 
 // StartMineServer start mine node (miner)
 func (n *Network) StartMineServer() {
-	ln, err := net.Listen(protocol, n.NetAddr)
+	ln, err := n.Transport.Listen(n.NetAddr)
 	if err != nil {
 		log.Println(err)
 		return
 	}
 	defer ln.Close()
 
-	n.synchronization(ln)
+	stop := make(chan struct{})
+	defer close(stop)
+
+	n.services = ServiceMiner
+	go n.closeOnStop(ln, stop)
+	go n.listen(ln)
+	go n.downloadLoop(stop)
+	go n.rebroadcastLoop(stop)
+
+	n.synchronization()
+	go n.backfill()
 
 	for {
-		block := n.Bc.MineBlock(n.Address)
-		for _, node := range n.KnownNodes {
-			if node != n.NetAddr {
-				n.sendNewBlock(node, block)
-			}
-		}
-		conn, err := ln.Accept()
-		if err != nil {
-			log.Println(err)
+		select {
+		case <-n.quit:
+			n.Close()
 			return
+		default:
+		}
+
+		// ждём ответа стейкхолдера, прежде чем майнить следующий блок
+		block := n.Bc.MineBlock(n.Address)
+		n.runRound(block)
+
+		select {
+		case <-time.After(n.Bc.Params.MineInterval):
+		case <-n.quit:
 		}
-		n.handleConnection(conn)
-		time.Sleep(time.Second * 15)
 	}
 }
 
 // StartFullServer start full node (stakeholder)
 func (n *Network) StartFullServer() {
-	ln, err := net.Listen(protocol, n.NetAddr)
+	ln, err := n.Transport.Listen(n.NetAddr)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	defer ln.Close()
+
+	stop := make(chan struct{})
+	defer close(stop)
+
+	n.services = ServiceStakeholder
+	n.bootstrap()
+	go n.closeOnStop(ln, stop)
+	go n.backfill()
+	go n.downloadLoop(stop)
+	go n.rebroadcastLoop(stop)
+	go n.presenceLoop(stop)
+
+	n.listen(ln)
+	n.Close()
+}
+
+// StartLightServer starts light node which keeps only headers and transactions
+// of the wallet, they are downloaded from full nodes with proofs
+func (n *Network) StartLightServer() {
+	ln, err := n.Transport.Listen(n.NetAddr)
 	if err != nil {
 		log.Println(err)
 		return
 	}
 	defer ln.Close()
 
+	stop := make(chan struct{})
+	defer close(stop)
+
+	go n.closeOnStop(ln, stop)
+	go n.listen(ln)
+	go n.downloadLoop(stop)
+
+	n.synchronization()
+
 	for {
-		conn, err := ln.Accept()
-		if err != nil {
-			log.Println(err)
+		select {
+		case <-n.quit:
+			n.Close()
 			return
+		case <-time.After(lightSyncInterval):
+		}
+
+		for _, addr := range n.downloadPeers() {
+			if p := n.peers.get(addr); p != nil {
+				n.sendGetHeaders(p)
+				break
+			}
 		}
-		n.handleConnection(conn)
 	}
 }
 
@@ -248,22 +650,48 @@ func gobEncode(data interface{}) []byte {
 	return buff.Bytes()
 }
 
-// nodeIsKnown returns true if the address of the node
-// is in list of known nodes
-func (n *Network) nodeIsKnown(addr string) bool {
+// knownNodes returns copy of KnownNodes
+func (n *Network) knownNodes() []string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	return append([]string{}, n.KnownNodes...)
+}
+
+// addNode adds address of the node to KnownNodes if it is not there yet
+func (n *Network) addNode(addr string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
 	for _, node := range n.KnownNodes {
 		if node == addr {
-			return true
+			return
 		}
 	}
 
-	return false
+	n.KnownNodes = append(n.KnownNodes, addr)
+}
+
+// forgetNode deletes address of the node from KnownNodes
+func (n *Network) forgetNode(addr string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	var updatedNodes []string
+
+	for _, node := range n.KnownNodes {
+		if node != addr {
+			updatedNodes = append(updatedNodes, node)
+		}
+	}
+
+	n.KnownNodes = updatedNodes
 }
 
 // getDataFromRequest puts request data to payload
 func getDataFromRequest(request []byte, payload interface{}) (err error) {
 	var buff bytes.Buffer
-	buff.Write(request[commandLength:])
+	buff.Write(request)
 	dec := gob.NewDecoder(&buff)
 	err = dec.Decode(payload)
 	if err != nil {
@@ -273,22 +701,89 @@ func getDataFromRequest(request []byte, payload interface{}) (err error) {
 	return nil
 }
 
-// synchronization starts connection to the node
-// to synchronize the versions of blockchain
-func (n *Network) synchronization(ln net.Listener)  {
-	n.sendVersion(fullNodeAddress)
+// synchronization connects to the seed node and other known nodes and waits
+// until blocks they have are downloaded, handshake with a node which has
+// more blocks starts the download
+func (n *Network) synchronization()  {
+	n.bootstrap()
+	n.drainEvents()
+
+	seed := n.seedNode()
+	if seed == n.NetAddr {
+		return
+	}
 
 	for {
-		conn, err := ln.Accept()
-		if err != nil {
-			log.Println(err)
+		nodes := append([]string{seed}, n.knownNodes()...)
+		connected := make(map[string]bool)
+
+		for _, node := range nodes {
+			if node == n.NetAddr || connected[node] || len(connected) >= maxOutboundPeers {
+				continue
+			}
+			connected[node] = true
+
+			_, err := n.connectPeer(node)
+			if err != nil {
+				log.Printf("Failed to connect to %s: %s\n", node, err)
+			}
+		}
+
+		select {
+		case synced := <-n.events:
+			if synced {
+				return
+			}
+		case <-time.After(ioTimeout):
+		case <-n.quit:
 			return
 		}
+	}
+}
+
+// seedNode returns address of the seed node of the network
+// preferring the one which is not the current node
+func (n *Network) seedNode() string {
+	seeds := n.Bc.Params.SeedNodes
+
+	for _, node := range seeds {
+		if node != n.NetAddr {
+			return node
+		}
+	}
+
+	return seeds[0]
+}
+
+// backfill downloads blocks below the loaded UTXO snapshot in the background
+// and validates the snapshot when all of them are received
+func (n *Network) backfill() {
+	for n.Bc.NeedsBackfill() {
+		hashes := n.Bc.MissingBlocks(backfillBatch)
+		if len(hashes) == 0 {
+			err := n.Bc.ValidateSnapshot()
+			if err != nil {
+				log.Println(err)
+			} else {
+				log.Println("UTXO snapshot is validated")
+			}
 
-		if n.handleConnection(conn) {
-			conn.Close()
 			return
 		}
-		n.sendVersion(fullNodeAddress)
+
+		var requests []message
+		for _, hash := range hashes {
+			payload := gobEncode(getData{AddrFrom: n.NetAddr, Type: typeBlock, ID: hash})
+			requests = append(requests, message{Command: commandGetData, Payload: payload})
+		}
+
+		for _, node := range n.knownNodes() {
+			if node != n.NetAddr {
+				n.sendMessages(node, requests)
+				break
+			}
+		}
+
+		time.Sleep(backfillInterval)
 	}
 }
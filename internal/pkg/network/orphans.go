@@ -0,0 +1,160 @@
+package network
+
+import (
+	"encoding/hex"
+	"fmt"
+	bcpkg "github.com/keithzetterstrom/BibCoin/internal/pkg/blockchain"
+	"log"
+	"sync"
+	"time"
+)
+
+// orphan pool keeps up to maxOrphanBlocks blocks of maxOrphanPoolSize
+// bytes in total, the oldest orphans are evicted first
+const (
+	maxOrphanBlocks   = 100
+	maxOrphanPoolSize = 1 << 24
+)
+
+// orphanBlock is the block which parent is unknown yet
+type orphanBlock struct {
+	block *bcpkg.ExtensionBlock
+	size  int
+	// addrFrom is the address of the node which sent the block
+	addrFrom string
+	added    time.Time
+}
+
+// orphanPool keeps orphan blocks by their hashes and hashes of their parents
+type orphanPool struct {
+	mu     sync.Mutex
+	blocks map[string]*orphanBlock
+	byPrev map[string][]string
+	size   int
+}
+
+// newOrphanPool returns empty orphanPool
+func newOrphanPool() *orphanPool {
+	return &orphanPool{
+		blocks: make(map[string]*orphanBlock),
+		byPrev: make(map[string][]string),
+	}
+}
+
+// add puts the block into the pool evicting the oldest orphans
+// when the pool is full, returns false if the block is already there
+func (op *orphanPool) add(block *bcpkg.ExtensionBlock, size int, addrFrom string) bool {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+
+	id := hex.EncodeToString(block.Hash)
+	if _, ok := op.blocks[id]; ok {
+		return false
+	}
+
+	for len(op.blocks) > 0 && (len(op.blocks) >= maxOrphanBlocks || op.size + size > maxOrphanPoolSize) {
+		oldest := ""
+		for orphanID, orphan := range op.blocks {
+			if oldest == "" || orphan.added.Before(op.blocks[oldest].added) {
+				oldest = orphanID
+			}
+		}
+		op.remove(oldest)
+	}
+
+	op.blocks[id] = &orphanBlock{block: block, size: size, addrFrom: addrFrom, added: time.Now()}
+	prev := hex.EncodeToString(block.PrevBlockHash)
+	op.byPrev[prev] = append(op.byPrev[prev], id)
+	op.size += size
+
+	return true
+}
+
+// remove deletes the orphan from the pool, mu must be held
+func (op *orphanPool) remove(id string) {
+	orphan, ok := op.blocks[id]
+	if !ok {
+		return
+	}
+
+	delete(op.blocks, id)
+	op.size -= orphan.size
+
+	prev := hex.EncodeToString(orphan.block.PrevBlockHash)
+	var siblings []string
+	for _, sibling := range op.byPrev[prev] {
+		if sibling != id {
+			siblings = append(siblings, sibling)
+		}
+	}
+
+	if len(siblings) == 0 {
+		delete(op.byPrev, prev)
+	} else {
+		op.byPrev[prev] = siblings
+	}
+}
+
+// takeChildren removes from the pool and returns orphans which parent has the given hash
+func (op *orphanPool) takeChildren(hash []byte) []*orphanBlock {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+
+	var children []*orphanBlock
+	for _, id := range op.byPrev[hex.EncodeToString(hash)] {
+		children = append(children, op.blocks[id])
+	}
+
+	for _, child := range children {
+		op.remove(hex.EncodeToString(child.block.Hash))
+	}
+
+	return children
+}
+
+// addOrphan puts the block with unknown parent into orphan pool
+// and requests headers of its missing ancestors from the peer sent it
+func (n *Network) addOrphan(p *peer, block *bcpkg.ExtensionBlock, size int, addrFrom string) {
+	if !bcpkg.NewProofOfWork(&block.Block, n.Bc.Params.TargetBits).Validate() {
+		n.misbehaving(p, scoreInvalidBlock, fmt.Sprintf("orphan block %x has invalid proof of work", block.Hash))
+		return
+	}
+
+	if !n.orphans.add(block, size, addrFrom) {
+		return
+	}
+
+	log.Printf("Orphan block %x with high %d, requesting its ancestors from %s\n", block.Hash, block.Height, addrFrom)
+
+	n.mu.Lock()
+	_, requested := n.headersRequested[p.addr]
+	n.mu.Unlock()
+
+	if !requested {
+		n.sendGetHeaders(p)
+	}
+}
+
+// connectOrphans adds orphans which parents have the given hashes,
+// children of the added orphans are added after them
+func (n *Network) connectOrphans(parents [][]byte) {
+	queue := append([][]byte{}, parents...)
+
+	for len(queue) > 0 {
+		hash := queue[0]
+		queue = queue[1:]
+
+		for _, orphan := range n.orphans.takeChildren(hash) {
+			err := n.Bc.AddBlock(orphan.block)
+			if err != nil {
+				log.Printf("Orphan block %x from %s is not added: %s\n", orphan.block.Hash, orphan.addrFrom, err)
+				continue
+			}
+
+			fmt.Printf("Added orphan block %x with high %d \n", orphan.block.Hash, orphan.block.Height)
+			n.updateMemPool()
+
+			queue = append(queue, orphan.block.Hash)
+		}
+	}
+}
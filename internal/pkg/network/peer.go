@@ -0,0 +1,478 @@
+package network
+
+import (
+	"bytes"
+	"errors"
+	"github.com/keithzetterstrom/BibCoin/internal/pkg/bloom"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	maxInboundPeers  = 32
+	maxOutboundPeers = 8
+)
+
+// sendQueueLength is the number of messages waiting to be written to a peer,
+// the peer is disconnected if it does not read them fast enough
+const sendQueueLength = 256
+
+const dialTimeout = time.Second * 10
+
+// idleTimeout closes connections on which nothing is received for a long time,
+// live peers answer pings sent every pingInterval
+const idleTimeout = time.Minute * 30
+
+const errorPeerLimit = "Peer limit is reached "
+
+// peers are disconnected and their hosts are banned
+// for banDuration when their ban score reaches banThreshold
+const (
+	banThreshold = 100
+	banDuration  = time.Hour * 24
+)
+
+// ban scores of misbehavior
+const (
+	scoreMalformed    = 20
+	scoreCorruptFrame = 50
+	scoreInvalidBlock = 100
+	scoreInvalidTx    = 10
+	scoreSpam         = 20
+	scoreFlood        = 1
+)
+
+// scoreBeforeHandshake is for messages other than version, verack and reject sent before handshake
+const scoreBeforeHandshake = 10
+
+// maxMessagesPerSecond is the number of messages the peer may send
+// during one second, every message above it is scored as flood
+const maxMessagesPerSecond = 100
+
+// peer is a long-lived connection to another node,
+// messages are read and written by its own goroutines
+type peer struct {
+	// addr is the address the node is dialed on, for inbound peers it is
+	// the remote address of connection, the address they claim is kept in info
+	addr    string
+	conn    net.Conn
+	inbound bool
+	// remoteKey is the static key of the node, nil if the connection is not encrypted
+	remoteKey []byte
+	// fields below are used only by the goroutine reading from the peer,
+	// versionSent of outbound peer is set before the goroutines are started
+	versionSent     bool
+	versionReceived bool
+	verackReceived  bool
+	handshakeDone   bool
+	banScore        int
+	floodSecond     int64
+	floodCount      int
+	// txsRequested is the number of transactions requested from the peer,
+	// they are not counted as flood
+	txsRequested int
+	// filter is loaded by the light node, only matching transactions are sent to it
+	filter *bloom.Filter
+
+	mu   sync.Mutex
+	info peerInfo
+	// lastHeader is the hash of the last header the peer has sent
+	lastHeader []byte
+	// connected is the time the connection was opened
+	connected time.Time
+	// pingNonce is the nonce of the ping waiting for pong, zero if there is no such ping
+	pingNonce uint64
+	pingSent  time.Time
+	// pingTime is round-trip time of the last answered ping
+	pingTime      time.Duration
+	minPing       time.Duration
+	bytesSent     uint64
+	bytesReceived uint64
+	lastSend      time.Time
+	lastReceive   time.Time
+	// pongWaiters are closed when pongs with their nonces are received
+	pongWaiters map[uint64]chan struct{}
+
+	// known are blocks and transactions the peer has announced or was told about
+	known *knownInventory
+
+	send chan message
+	// ready is closed when handshake is completed, messages other than
+	// version, verack and reject are held until that
+	ready     chan struct{}
+	quit      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// peerInfo is what the peer told about itself in version message
+type peerInfo struct {
+	// Addr is the address the node listens on
+	Addr        string
+	Version     int
+	Services    uint64
+	UserAgent   string
+	StartHeight int
+	// TimeOffset is the difference between clocks of the peer and the node in seconds
+	TimeOffset int64
+}
+
+// newPeer returns peer for the given connection
+func newPeer(conn net.Conn, addr string, inbound bool) *peer {
+	return &peer{
+		addr: addr,
+		conn: conn,
+		inbound: inbound,
+		send: make(chan message, sendQueueLength),
+		ready: make(chan struct{}),
+		quit: make(chan struct{}),
+		done: make(chan struct{}),
+		known: newKnownInventory(),
+		connected: time.Now(),
+	}
+}
+
+// setInfo saves what the peer told about itself
+func (p *peer) setInfo(info peerInfo) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.info = info
+}
+
+// getInfo returns what the peer told about itself, zero Version means
+// that version of the peer is not received yet
+func (p *peer) getInfo() peerInfo {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.info
+}
+
+// setLastHeader saves the hash of the last header the peer has sent
+func (p *peer) setLastHeader(hash []byte) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.lastHeader = hash
+}
+
+// getLastHeader returns the hash of the last header the peer has sent
+func (p *peer) getLastHeader() []byte {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.lastHeader
+}
+
+// queueMessage puts message to the send queue of the peer,
+// returns false if the connection is closed or the queue is full
+func (p *peer) queueMessage(msg message) bool {
+	select {
+	case <-p.done:
+		return false
+	default:
+	}
+
+	select {
+	case p.send <- msg:
+		return true
+	default:
+		return false
+	}
+}
+
+// host returns host of the remote side of connection, bans are applied to hosts
+func (p *peer) host() string {
+	host, _, err := net.SplitHostPort(p.conn.RemoteAddr().String())
+	if err != nil {
+		return p.conn.RemoteAddr().String()
+	}
+
+	return host
+}
+
+// flooding counts the message and returns true if the peer sends
+// more than maxMessagesPerSecond messages. Messages of block download
+// are not counted, their rate is limited by the number of blocks in flight,
+// as well as requested transactions and transactions of compact blocks
+func (p *peer) flooding(command string) bool {
+	if command == commandGetData || command == commandBlock || command == commandHeaders {
+		return false
+	}
+
+	if command == commandGetBlockTxn || command == commandBlockTxn {
+		return false
+	}
+
+	if command == commandTx && p.txsRequested > 0 {
+		p.txsRequested--
+		return false
+	}
+
+	now := time.Now().Unix()
+	if now != p.floodSecond {
+		p.floodSecond = now
+		p.floodCount = 0
+	}
+	p.floodCount++
+
+	return p.floodCount > maxMessagesPerSecond
+}
+
+// close stops the peer, messages which are already queued are still written,
+// held messages are written if handshake is completed in ioTimeout
+func (p *peer) close() {
+	p.closeOnce.Do(func() {
+		close(p.quit)
+	})
+}
+
+// writeLoop writes queued messages to connection until the peer is closed,
+// only handshake messages and rejects are written before handshake is completed
+func (p *peer) writeLoop(magic [magicLength]byte) {
+	defer close(p.done)
+	defer p.conn.Close()
+
+	var held []message
+	ready := p.ready
+	quit := p.quit
+	var timeout <-chan time.Time
+
+	ticker := time.NewTicker(pingInterval)
+	defer ticker.Stop()
+
+	for {
+		if quit == nil && len(p.send) == 0 && (ready == nil || len(held) == 0) {
+			return
+		}
+
+		select {
+		case msg := <-p.send:
+			if ready != nil && msg.Command != commandVersion && msg.Command != commandVerack && msg.Command != commandReject {
+				held = append(held, msg)
+				continue
+			}
+
+			if !p.write(magic, msg) {
+				p.close()
+				return
+			}
+		case <-ready:
+			ready = nil
+			for _, msg := range held {
+				if !p.write(magic, msg) {
+					p.close()
+					return
+				}
+			}
+			held = nil
+		case <-quit:
+			quit = nil
+			timeout = time.After(ioTimeout)
+		case <-timeout:
+			return
+		case <-ticker.C:
+			// pings are sent only after handshake and not while the peer is closing
+			if ready != nil || quit == nil {
+				continue
+			}
+
+			if p.pingTimedOut() {
+				log.Printf("Peer %s does not answer ping, disconnecting\n", p.addr)
+				p.close()
+				return
+			}
+
+			if !p.sendPing(magic) {
+				p.close()
+				return
+			}
+		}
+	}
+}
+
+// write writes one message to connection
+func (p *peer) write(magic [magicLength]byte, msg message) bool {
+	_ = p.conn.SetWriteDeadline(time.Now().Add(ioTimeout))
+
+	data := encodeMessage(magic, msg)
+
+	_, err := io.Copy(p.conn, bytes.NewReader(data))
+	if err != nil {
+		log.Printf("Failed to send %s to %s: %s\n", msg.Command, p.conn.RemoteAddr(), err)
+		return false
+	}
+	p.countSent(len(data))
+
+	return true
+}
+
+// readLoop reads messages from connection and handles them
+// until the connection is closed
+func (p *peer) readLoop(n *Network) {
+	defer n.peers.remove(p)
+	defer p.close()
+	// the address of the inbound peer is known only after its version
+	defer func() { n.peerDisconnected(p.addr) }()
+
+	for {
+		_ = p.conn.SetReadDeadline(time.Now().Add(idleTimeout))
+
+		msg, err := readMessage(p.conn, n.Bc.Params.Magic)
+		if err != nil {
+			select {
+			case <-p.quit:
+			default:
+				if err != io.EOF {
+					log.Printf("Dropped connection with %s: %s\n", p.conn.RemoteAddr(), err)
+				}
+
+				if err.Error() == errorBadChecksum || strings.HasPrefix(err.Error(), errorPayloadTooLarge) {
+					n.misbehaving(p, scoreCorruptFrame, err.Error())
+				}
+			}
+
+			return
+		}
+		p.countReceived(headerLength + len(msg.Payload))
+
+		if p.flooding(msg.Command) {
+			n.misbehaving(p, scoreFlood, "flood")
+			continue
+		}
+
+		n.handleMessage(p, msg)
+	}
+}
+
+// misbehaving increases ban score of the peer, when the score reaches banThreshold
+// the peer is disconnected and its host is banned. It must be called
+// from the goroutine reading from the peer
+func (n *Network) misbehaving(p *peer, score int, reason string) {
+	p.banScore += score
+	log.Printf("Peer %s misbehaves: %s, ban score %d\n", p.addr, reason, p.banScore)
+
+	if p.banScore < banThreshold {
+		return
+	}
+
+	n.ban(p)
+}
+
+// ban disconnects the peer and bans its host for banDuration
+func (n *Network) ban(p *peer) {
+	log.Printf("Peer %s is banned\n", p.addr)
+
+	err := n.BanList.Ban(p.host(), banDuration)
+	if err != nil {
+		log.Println(err)
+	}
+
+	n.forgetNode(p.addr)
+	p.close()
+}
+
+// peerManager keeps connected peers by their addresses
+// and limits the number of inbound and outbound connections
+type peerManager struct {
+	mu       sync.Mutex
+	peers    map[string]*peer
+	inbound  int
+	outbound int
+	// handshakes are inbound connections making encrypted handshake,
+	// they take slots of inbound peers until the handshake is over
+	handshakes int
+}
+
+// newPeerManager returns empty peerManager
+func newPeerManager() *peerManager {
+	return &peerManager{peers: make(map[string]*peer)}
+}
+
+// get returns connected peer with the given address or nil
+func (pm *peerManager) get(addr string) *peer {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	return pm.peers[addr]
+}
+
+// add registers the peer if the limit of its direction is not reached
+func (pm *peerManager) add(p *peer) error {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	if p.inbound && pm.inbound >= maxInboundPeers || !p.inbound && pm.outbound >= maxOutboundPeers {
+		return errors.New(errorPeerLimit)
+	}
+
+	if _, ok := pm.peers[p.addr]; ok {
+		return errors.New("Peer is already connected ")
+	}
+
+	pm.peers[p.addr] = p
+	if p.inbound {
+		pm.inbound++
+	} else {
+		pm.outbound++
+	}
+
+	return nil
+}
+
+// reserveInbound takes the slot of inbound peer for the connection before its handshake,
+// false is returned if all slots are taken by peers and other handshakes
+func (pm *peerManager) reserveInbound() bool {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	if pm.inbound + pm.handshakes >= maxInboundPeers {
+		return false
+	}
+	pm.handshakes++
+
+	return true
+}
+
+// releaseInbound frees the slot taken by reserveInbound when the handshake is over
+func (pm *peerManager) releaseInbound() {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	pm.handshakes--
+}
+
+// remove deletes the peer from the manager
+func (pm *peerManager) remove(p *peer) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	if pm.peers[p.addr] != p {
+		return
+	}
+
+	delete(pm.peers, p.addr)
+	if p.inbound {
+		pm.inbound--
+	} else {
+		pm.outbound--
+	}
+}
+
+// list returns all connected peers
+func (pm *peerManager) list() []*peer {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	var peers []*peer
+	for _, p := range pm.peers {
+		peers = append(peers, p)
+	}
+
+	return peers
+}
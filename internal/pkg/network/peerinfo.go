@@ -0,0 +1,125 @@
+package network
+
+import (
+	"sort"
+	"time"
+)
+
+// PeerInfo describes the connected peer, its latency and traffic
+type PeerInfo struct {
+	// Addr is the address of the connection, ListenAddr is the address
+	// the node says it listens on, it is not checked for inbound peers
+	Addr        string
+	ListenAddr  string
+	Inbound     bool
+	Encrypted   bool
+	Version     int
+	Services    uint64
+	UserAgent   string
+	StartHeight int
+	// PingTime is round-trip time of the last answered ping, zero if no ping is answered yet
+	PingTime time.Duration
+	MinPing  time.Duration
+	// PingWait is how long the current ping waits for pong
+	PingWait      time.Duration
+	BytesSent     uint64
+	BytesReceived uint64
+	// LastSend, LastReceive and Connected are unix times
+	LastSend    int64
+	LastReceive int64
+	Connected   int64
+}
+
+type getPeerInfo struct {
+	AddrFrom string
+}
+
+type peerInfos struct {
+	AddrFrom string
+	Peers    []PeerInfo
+}
+
+// unixTime returns unix time or zero if the time is not set
+func unixTime(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+
+	return t.Unix()
+}
+
+// stats returns what is known about the peer
+func (p *peer) stats() PeerInfo {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	info := PeerInfo{
+		Addr: p.addr,
+		ListenAddr: p.info.Addr,
+		Inbound: p.inbound,
+		Encrypted: p.remoteKey != nil,
+		Version: p.info.Version,
+		Services: p.info.Services,
+		UserAgent: p.info.UserAgent,
+		StartHeight: p.info.StartHeight,
+		PingTime: p.pingTime,
+		MinPing: p.minPing,
+		BytesSent: p.bytesSent,
+		BytesReceived: p.bytesReceived,
+		LastSend: unixTime(p.lastSend),
+		LastReceive: unixTime(p.lastReceive),
+		Connected: unixTime(p.connected),
+	}
+	if p.pingNonce != 0 {
+		info.PingWait = time.Since(p.pingSent)
+	}
+
+	return info
+}
+
+// PeerInfo returns connected peers sorted by address
+func (n *Network) PeerInfo() []PeerInfo {
+	var infos []PeerInfo
+
+	for _, p := range n.peers.list() {
+		infos = append(infos, p.stats())
+	}
+
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Addr < infos[j].Addr
+	})
+
+	return infos
+}
+
+// handleGetPeerInfo answers over the same connection with peers of the node
+func (n *Network) handleGetPeerInfo(p *peer, request []byte) {
+	var payload getPeerInfo
+
+	err := getDataFromRequest(request, &payload)
+	if err != nil {
+		n.misbehaving(p, scoreMalformed, err.Error())
+		return
+	}
+
+	response := gobEncode(peerInfos{AddrFrom: n.NetAddr, Peers: n.PeerInfo()})
+	p.queueMessage(message{Command: commandPeerInfo, Payload: response})
+}
+
+// RequestPeerInfo asks the node for its peers, their latency and traffic
+func (n *Network) RequestPeerInfo(address string) ([]PeerInfo, error) {
+	request := message{Command: commandGetPeerInfo, Payload: gobEncode(getPeerInfo{AddrFrom: n.NetAddr})}
+
+	response, err := requestReply(n.Transport, address, n.versionMessage(address, 0), request, commandPeerInfo, n.NetAddr, n.Bc.Params.Magic)
+	if err != nil {
+		return nil, err
+	}
+
+	var payload peerInfos
+	err = getDataFromRequest(response, &payload)
+	if err != nil {
+		return nil, err
+	}
+
+	return payload.Peers, nil
+}
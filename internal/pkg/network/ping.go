@@ -0,0 +1,155 @@
+package network
+
+import (
+	"log"
+	"time"
+)
+
+// pingInterval is how often peers are pinged, pings keep connections
+// of live peers from being idle
+const pingInterval = time.Minute * 2
+
+// pingTimeout disconnects the peer which does not answer ping for a long time
+const pingTimeout = time.Minute * 20
+
+type ping struct {
+	Nonce uint64
+}
+
+type pong struct {
+	Nonce uint64
+}
+
+// startPing returns nonce of the new ping, false is returned
+// if the previous ping is not answered yet
+func (p *peer) startPing() (uint64, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.pingNonce != 0 {
+		return 0, false
+	}
+
+	p.pingNonce = randomNonce()
+	p.pingSent = time.Now()
+
+	return p.pingNonce, true
+}
+
+// pingTimedOut returns true if the ping is not answered in pingTimeout
+func (p *peer) pingTimedOut() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.pingNonce != 0 && time.Since(p.pingSent) > pingTimeout
+}
+
+// pongReceived measures round-trip time of the ping with the nonce,
+// returns false if no ping with the nonce is waiting for pong
+func (p *peer) pongReceived(nonce uint64) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.pingNonce == 0 || nonce != p.pingNonce {
+		return false
+	}
+
+	p.pingTime = time.Since(p.pingSent)
+	if p.minPing == 0 || p.pingTime < p.minPing {
+		p.minPing = p.pingTime
+	}
+	p.pingNonce = 0
+
+	return true
+}
+
+// expectPong returns nonce for the ping which is not keepalive one and the channel
+// closed when pong with the nonce is received
+func (p *peer) expectPong() (uint64, <-chan struct{}) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.pongWaiters == nil {
+		p.pongWaiters = make(map[uint64]chan struct{})
+	}
+
+	nonce := randomNonce()
+	waiter := make(chan struct{})
+	p.pongWaiters[nonce] = waiter
+
+	return nonce, waiter
+}
+
+// pongExpected closes the channel waiting for pong with the nonce,
+// returns false if nobody waits for it
+func (p *peer) pongExpected(nonce uint64) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	waiter, ok := p.pongWaiters[nonce]
+	if !ok {
+		return false
+	}
+
+	close(waiter)
+	delete(p.pongWaiters, nonce)
+
+	return true
+}
+
+// sendPing writes ping to the peer unless the previous one is not answered yet,
+// it is called by the goroutine writing to the peer
+func (p *peer) sendPing(magic [magicLength]byte) bool {
+	nonce, ok := p.startPing()
+	if !ok {
+		return true
+	}
+
+	return p.write(magic, message{Command: commandPing, Payload: gobEncode(ping{Nonce: nonce})})
+}
+
+// countSent adds the written message to statistics of the peer
+func (p *peer) countSent(bytes int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.bytesSent += uint64(bytes)
+	p.lastSend = time.Now()
+}
+
+// countReceived adds the read message to statistics of the peer
+func (p *peer) countReceived(bytes int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.bytesReceived += uint64(bytes)
+	p.lastReceive = time.Now()
+}
+
+// handlePing answers ping with pong with the same nonce
+func (n *Network) handlePing(p *peer, request []byte) {
+	var payload ping
+
+	err := getDataFromRequest(request, &payload)
+	if err != nil {
+		n.misbehaving(p, scoreMalformed, err.Error())
+		return
+	}
+
+	p.queueMessage(message{Command: commandPong, Payload: gobEncode(pong{Nonce: payload.Nonce})})
+}
+
+// handlePong handles answer to ping and measures latency of the peer
+func (n *Network) handlePong(p *peer, request []byte) {
+	var payload pong
+
+	err := getDataFromRequest(request, &payload)
+	if err != nil {
+		n.misbehaving(p, scoreMalformed, err.Error())
+		return
+	}
+
+	if !p.pongReceived(payload.Nonce) && !p.pongExpected(payload.Nonce) {
+		log.Printf("Unexpected pong with nonce %d from %s\n", payload.Nonce, p.addr)
+	}
+}
@@ -0,0 +1,310 @@
+package network
+
+import (
+	"encoding/hex"
+	"fmt"
+	bcpkg "github.com/keithzetterstrom/BibCoin/internal/pkg/blockchain"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// presenceInterval is how often the stakeholder announces that it is online,
+// announcements expire after presenceLifetime, so a few of them may be lost
+const (
+	presenceInterval = time.Minute * 10
+	presenceLifetime = time.Minute * 30
+)
+
+// maxPresences limits the number of stakeholders in the registry and in one message
+const maxPresences = 10000
+
+type presence struct {
+	AddrFrom  string
+	Presences []bcpkg.Presence
+}
+
+type getPresence struct {
+	AddrFrom string
+}
+
+type onlineStake struct {
+	AddrFrom   string
+	Stakes     []StakePresence
+	TotalStake int
+}
+
+// StakePresence describes the online stakeholder and the number of satoshis it owns
+type StakePresence struct {
+	PubKeyHash []byte
+	NetAddr    string
+	// Expires is unix time when the stakeholder is considered offline
+	// unless it announces itself again
+	Expires int64
+	Stake   int
+}
+
+// presenceRegistry keeps the latest presence of every stakeholder by its public key hash
+type presenceRegistry struct {
+	mu      sync.Mutex
+	entries map[string]bcpkg.Presence
+}
+
+// newPresenceRegistry returns empty presenceRegistry
+func newPresenceRegistry() *presenceRegistry {
+	return &presenceRegistry{entries: make(map[string]bcpkg.Presence)}
+}
+
+// update keeps the presence if it expires later than the known one,
+// returns false if the presence is not newer
+func (r *presenceRegistry) update(p bcpkg.Presence, now int64) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	key := hex.EncodeToString(p.PubKeyHash())
+
+	known, ok := r.entries[key]
+	if ok && known.Expires >= p.Expires {
+		return false
+	}
+
+	if !ok && len(r.entries) >= maxPresences {
+		r.expire(now)
+		if len(r.entries) >= maxPresences {
+			return false
+		}
+	}
+
+	r.entries[key] = p
+
+	return true
+}
+
+// lookup returns network address of the online stakeholder with the public key hash
+func (r *presenceRegistry) lookup(pubKeyHash []byte, now int64) (string, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	p, ok := r.entries[hex.EncodeToString(pubKeyHash)]
+	if !ok || p.Expires <= now {
+		return "", false
+	}
+
+	return p.NetAddr, true
+}
+
+// list returns presences of online stakeholders, expired ones are forgotten
+func (r *presenceRegistry) list(now int64) []bcpkg.Presence {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.expire(now)
+
+	var presences []bcpkg.Presence
+	for _, p := range r.entries {
+		presences = append(presences, p)
+	}
+
+	return presences
+}
+
+// expire forgets presences which expired, mu must be held
+func (r *presenceRegistry) expire(now int64) {
+	for key, p := range r.entries {
+		if p.Expires <= now {
+			delete(r.entries, key)
+		}
+	}
+}
+
+// announcePresence signs presence of the node with the key of its wallet
+// and sends it to connected peers
+func (n *Network) announcePresence() {
+	if n.Wallet == nil {
+		return
+	}
+
+	now := time.Now()
+	p := bcpkg.NewPresence(n.NetAddr, now.Add(presenceLifetime).Unix(), n.Wallet.PrivateKey, n.Wallet.PublicKey)
+
+	n.presences.update(*p, now.Unix())
+	n.relayPresences([]bcpkg.Presence{*p}, nil)
+}
+
+// presenceLoop announces presence of the stakeholder until stop is closed
+func (n *Network) presenceLoop(stop <-chan struct{}) {
+	ticker := time.NewTicker(presenceInterval)
+	defer ticker.Stop()
+
+	for {
+		n.announcePresence()
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// relayPresences sends presences to connected peers except the one they are received from,
+// light nodes neither stake nor mine, so they do not need them
+func (n *Network) relayPresences(presences []bcpkg.Presence, from *peer) {
+	payload := gobEncode(presence{AddrFrom: n.NetAddr, Presences: presences})
+
+	for _, p := range n.peers.list() {
+		if p == from {
+			continue
+		}
+
+		select {
+		case <-p.ready:
+		default:
+			continue
+		}
+
+		if p.getInfo().Services & ServiceLight != 0 {
+			continue
+		}
+
+		p.queueMessage(message{Command: commandPresence, Payload: payload})
+	}
+}
+
+// sendPresences sends presences of online stakeholders known to the node
+// to the peer which has just connected
+func (n *Network) sendPresences(p *peer) {
+	if p.getInfo().Services & ServiceLight != 0 {
+		return
+	}
+
+	presences := n.presences.list(time.Now().Unix())
+	if len(presences) == 0 {
+		return
+	}
+
+	payload := gobEncode(presence{AddrFrom: n.NetAddr, Presences: presences})
+	p.queueMessage(message{Command: commandPresence, Payload: payload})
+}
+
+// handlePresence handles presences of stakeholders, the ones which are new
+// to the node are relayed to other peers
+func (n *Network) handlePresence(p *peer, request []byte) {
+	var payload presence
+
+	err := getDataFromRequest(request, &payload)
+	if err != nil {
+		n.misbehaving(p, scoreMalformed, err.Error())
+		return
+	}
+
+	if len(payload.Presences) > maxPresences {
+		n.misbehaving(p, scoreSpam, fmt.Sprintf("%d presences", len(payload.Presences)))
+		return
+	}
+
+	now := time.Now().Unix()
+	// clocks of nodes may differ, but the presence must not stay for much longer than its lifetime
+	maxExpires := now + int64(presenceLifetime / time.Second) + maxTimeOffset
+
+	var fresh []bcpkg.Presence
+	for _, announced := range payload.Presences {
+		if !announced.Verify() {
+			n.misbehaving(p, scoreMalformed, fmt.Sprintf("presence of %s has invalid signature", announced.NetAddr))
+			return
+		}
+
+		if announced.Expires <= now || announced.Expires > maxExpires {
+			continue
+		}
+
+		if n.presences.update(announced, now) {
+			log.Printf("Stakeholder %x is online at %s\n", announced.PubKeyHash(), announced.NetAddr)
+			fresh = append(fresh, announced)
+		}
+	}
+
+	if len(fresh) != 0 {
+		n.relayPresences(fresh, p)
+	}
+}
+
+// stakeholderNode returns network address of the online stakeholder of the satoshi,
+// that is the delegate of the satoshi or its owner
+func (n *Network) stakeholderNode(index int) (string, bool) {
+	owner, staker := n.Bc.FindSatoshiStaker(index)
+	if owner == nil {
+		return "", false
+	}
+
+	return n.presences.lookup(staker, time.Now().Unix())
+}
+
+// OnlineStake returns online stakeholders sorted by their stake
+// and the number of satoshis of the chain
+func (n *Network) OnlineStake() ([]StakePresence, int, error) {
+	lastIndex, err := n.Bc.GetLastSatoshiIndex()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var stakes []StakePresence
+	for _, p := range n.presences.list(time.Now().Unix()) {
+		stake := 0
+		for _, out := range n.Bc.FindStakedTxOutputs(p.PubKeyHash()) {
+			stake += len(out.Value)
+		}
+
+		stakes = append(stakes, StakePresence{
+			PubKeyHash: p.PubKeyHash(),
+			NetAddr: p.NetAddr,
+			Expires: p.Expires,
+			Stake: stake,
+		})
+	}
+
+	sort.Slice(stakes, func(i, j int) bool {
+		return stakes[i].Stake > stakes[j].Stake
+	})
+
+	return stakes, lastIndex + 1, nil
+}
+
+// handleGetPresence answers over the same connection with online stakeholders known to the node
+func (n *Network) handleGetPresence(p *peer, request []byte) {
+	var payload getPresence
+
+	err := getDataFromRequest(request, &payload)
+	if err != nil {
+		n.misbehaving(p, scoreMalformed, err.Error())
+		return
+	}
+
+	stakes, total, err := n.OnlineStake()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	response := gobEncode(onlineStake{AddrFrom: n.NetAddr, Stakes: stakes, TotalStake: total})
+	p.queueMessage(message{Command: commandOnlineStake, Payload: response})
+}
+
+// RequestOnlineStake asks the node for online stakeholders and the number of satoshis of its chain
+func (n *Network) RequestOnlineStake(address string) ([]StakePresence, int, error) {
+	request := message{Command: commandGetPresence, Payload: gobEncode(getPresence{AddrFrom: n.NetAddr})}
+
+	response, err := requestReply(n.Transport, address, n.versionMessage(address, 0), request, commandOnlineStake, n.NetAddr, n.Bc.Params.Magic)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var payload onlineStake
+	err = getDataFromRequest(response, &payload)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return payload.Stakes, payload.TotalStake, nil
+}
@@ -0,0 +1,158 @@
+package network
+
+import (
+	"encoding/hex"
+	"fmt"
+	bcpkg "github.com/keithzetterstrom/BibCoin/internal/pkg/blockchain"
+	mempoolpkg "github.com/keithzetterstrom/BibCoin/internal/pkg/mempool"
+	"log"
+	"time"
+)
+
+// rejectTimeout limits waiting for answers of peers the transaction is submitted to
+const rejectTimeout = time.Second * 10
+
+// RejectCode tells why the node does not accept the block or transaction
+type RejectCode byte
+
+const (
+	RejectInvalid             RejectCode = 0x10
+	RejectObsolete            RejectCode = 0x11
+	RejectDuplicate           RejectCode = 0x12
+	RejectNonstandard         RejectCode = 0x40
+	RejectInsufficientFee     RejectCode = 0x42
+	RejectStakeholderNotFound RejectCode = 0x50
+)
+
+var rejectCodeNames = map[RejectCode]string{
+	RejectInvalid: "invalid",
+	RejectObsolete: "obsolete",
+	RejectDuplicate: "duplicate",
+	RejectNonstandard: "nonstandard",
+	RejectInsufficientFee: "insufficient-fee",
+	RejectStakeholderNotFound: "stakeholder-not-found",
+}
+
+func (c RejectCode) String() string {
+	name, ok := rejectCodeNames[c]
+	if !ok {
+		return fmt.Sprintf("unknown-%#x", byte(c))
+	}
+
+	return name
+}
+
+// reject tells the node that its message is not accepted,
+// Message is the command of the rejected message
+type reject struct {
+	AddrFrom string
+	Message  string
+	Code     RejectCode
+	Reason   string
+	Hash     []byte
+}
+
+// RejectError is returned when the node rejects the submitted transaction
+type RejectError struct {
+	Node    string
+	Message string
+	Code    RejectCode
+	Reason  string
+	Hash    []byte
+}
+
+func (e *RejectError) Error() string {
+	return fmt.Sprintf("Node %s rejected %s %x as %s: %s", e.Node, e.Message, e.Hash, e.Code, e.Reason)
+}
+
+// policyRejectCode returns the reject code for the rule of mem pool the transaction does not pass
+func policyRejectCode(policy mempoolpkg.Policy) RejectCode {
+	switch policy {
+	case mempoolpkg.PolicyDuplicate:
+		return RejectDuplicate
+	case mempoolpkg.PolicyInsufficientFee:
+		return RejectInsufficientFee
+	default:
+		return RejectNonstandard
+	}
+}
+
+// blockRejectCode returns the reject code for the error of adding the block,
+// false is returned for errors of the node itself, the block is not rejected then
+func blockRejectCode(err error) (RejectCode, bool) {
+	if _, ok := err.(*bcpkg.InvalidBlockError); ok {
+		return RejectInvalid, true
+	}
+
+	switch err {
+	case bcpkg.ErrBlockExists:
+		return RejectDuplicate, true
+	case bcpkg.ErrStakeholderIndexNotFound:
+		return RejectStakeholderNotFound, true
+	default:
+		return 0, false
+	}
+}
+
+// sendReject answers over the same connection that the message with the item is not accepted
+func (n *Network) sendReject(p *peer, command string, code RejectCode, reason string, hash []byte) {
+	payload := gobEncode(reject{AddrFrom: n.NetAddr, Message: command, Code: code, Reason: reason, Hash: hash})
+	p.queueMessage(message{Command: commandReject, Payload: payload})
+}
+
+// handleReject logs why the peer rejected the message and passes rejected
+// transactions to the wallet waiting for answers of peers
+func (n *Network) handleReject(p *peer, request []byte) {
+	var payload reject
+
+	err := getDataFromRequest(request, &payload)
+	if err != nil {
+		n.misbehaving(p, scoreMalformed, err.Error())
+		return
+	}
+
+	rejectErr := &RejectError{
+		Node: p.addr,
+		Message: payload.Message,
+		Code: payload.Code,
+		Reason: payload.Reason,
+		Hash: payload.Hash,
+	}
+	log.Println(rejectErr)
+
+	if payload.Message != commandTx {
+		return
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	waiter, ok := n.rejectWaiters[hex.EncodeToString(payload.Hash)]
+	if !ok {
+		return
+	}
+
+	select {
+	case waiter <- rejectErr:
+	default:
+	}
+}
+
+// watchRejects returns the channel receiving rejects of the transaction
+func (n *Network) watchRejects(txID []byte) <-chan *RejectError {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	waiter := make(chan *RejectError, maxOutboundPeers)
+	n.rejectWaiters[hex.EncodeToString(txID)] = waiter
+
+	return waiter
+}
+
+// unwatchRejects stops passing rejects of the transaction
+func (n *Network) unwatchRejects(txID []byte) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	delete(n.rejectWaiters, hex.EncodeToString(txID))
+}
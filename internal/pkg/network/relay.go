@@ -0,0 +1,211 @@
+package network
+
+import (
+	"encoding/hex"
+	"fmt"
+	bcpkg "github.com/keithzetterstrom/BibCoin/internal/pkg/blockchain"
+	"log"
+	"sync"
+	"time"
+)
+
+// maxInvPerMessage is the number of items one inv message may contain
+const maxInvPerMessage = 1000
+
+// maxKnownInventory is the number of items remembered as known by the peer,
+// the oldest ones are forgotten first
+const maxKnownInventory = 5000
+
+// a transaction is requested from one peer at a time, it is requested
+// from another peer if it is not received in txRequestTimeout
+const txRequestTimeout = time.Minute
+
+// rebroadcastInterval is how often unconfirmed wallet transactions are announced again
+const rebroadcastInterval = time.Minute * 10
+
+// knownInventory keeps ids of blocks and transactions the peer knows,
+// they are not announced to the peer again
+type knownInventory struct {
+	mu    sync.Mutex
+	ids   map[string]bool
+	order []string
+}
+
+// newKnownInventory returns empty knownInventory
+func newKnownInventory() *knownInventory {
+	return &knownInventory{ids: make(map[string]bool)}
+}
+
+// add remembers the item, returns false if it is already known
+func (k *knownInventory) add(id []byte) bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	key := hex.EncodeToString(id)
+	if k.ids[key] {
+		return false
+	}
+
+	if len(k.order) >= maxKnownInventory {
+		delete(k.ids, k.order[0])
+		k.order = k.order[1:]
+	}
+
+	k.ids[key] = true
+	k.order = append(k.order, key)
+
+	return true
+}
+
+// relayTransaction announces the transaction to connected peers which do not know it,
+// the peer it is received from already knows it. Rebroadcast announces
+// it to all peers as they may have dropped it
+func (n *Network) relayTransaction(txID []byte, rebroadcast bool) {
+	payload := gobEncode(inv{AddrFrom: n.NetAddr, Type: typeTx, Items: [][]byte{txID}})
+
+	for _, p := range n.peers.list() {
+		select {
+		case <-p.ready:
+		default:
+			continue
+		}
+
+		// light nodes do not keep mem pool
+		if p.getInfo().Services & ServiceLight != 0 {
+			continue
+		}
+
+		if p.known.add(txID) || rebroadcast {
+			p.queueMessage(message{Command: commandInv, Payload: payload})
+		}
+	}
+}
+
+// requestTransactions requests transactions of the inventory which are not in mem pool
+// and are not being received from another peer. It must be called from the goroutine
+// reading from the peer, the requested transactions are not counted as flood
+func (n *Network) requestTransactions(p *peer, items [][]byte) {
+	now := time.Now()
+
+	n.mu.Lock()
+	var ids [][]byte
+	for _, id := range items {
+		key := hex.EncodeToString(id)
+
+		if requested, ok := n.txsRequested[key]; ok && now.Sub(requested) < txRequestTimeout {
+			continue
+		}
+		if n.MemPool.Has(id) {
+			continue
+		}
+
+		n.txsRequested[key] = now
+		ids = append(ids, id)
+	}
+	n.mu.Unlock()
+
+	for _, id := range ids {
+		payload := gobEncode(getData{AddrFrom: n.NetAddr, Type: typeTx, ID: id})
+		if !p.queueMessage(message{Command: commandGetData, Payload: payload}) {
+			return
+		}
+		p.txsRequested++
+	}
+}
+
+// txReceived forgets that the transaction is requested
+func (n *Network) txReceived(txID []byte) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	delete(n.txsRequested, hex.EncodeToString(txID))
+}
+
+// BroadcastTx adds the transaction of the wallet to mem pool, sends it
+// to known nodes and keeps it, so it is announced again until it is mined.
+// RejectError is returned if a node does not accept the transaction
+func (n *Network) BroadcastTx(tnx *bcpkg.Transaction) error {
+	err := n.MemPool.Add(*tnx)
+	if err != nil {
+		return err
+	}
+
+	err = n.walletTxs.add(*tnx)
+	if err != nil {
+		return err
+	}
+
+	rejects := n.watchRejects(tnx.ID)
+	defer n.unwatchRejects(tnx.ID)
+
+	var submitted []submittedTx
+	sent := 0
+	for _, node := range n.knownNodes() {
+		if node == n.NetAddr || sent >= maxOutboundPeers {
+			continue
+		}
+
+		if s, ok := n.submitTx(node, tnx); ok {
+			submitted = append(submitted, s)
+		}
+		sent++
+	}
+
+	if sent == 0 {
+		return fmt.Errorf("No known nodes to send transaction %x to ", tnx.ID)
+	}
+
+	// a peer handles messages in order, so it has answered the transaction when pong is received
+	timeout := time.After(rejectTimeout)
+wait:
+	for _, s := range submitted {
+		select {
+		case <-s.pong:
+		case <-s.peer.done:
+		case <-timeout:
+			log.Printf("Peer %s does not answer transaction %x in time\n", s.peer.addr, tnx.ID)
+			break wait
+		}
+	}
+
+	select {
+	case rejectErr := <-rejects:
+		return rejectErr
+	default:
+		return nil
+	}
+}
+
+// rebroadcastLoop announces unconfirmed wallet transactions to peers every
+// rebroadcastInterval until stop is closed, the ones which are mined
+// or became invalid are forgotten
+func (n *Network) rebroadcastLoop(stop <-chan struct{}) {
+	ticker := time.NewTicker(rebroadcastInterval)
+	defer ticker.Stop()
+
+	for {
+		for _, tnx := range n.walletTxs.list() {
+			if !n.MemPool.Has(tnx.ID) {
+				err := n.MemPool.Add(tnx)
+				if err != nil {
+					log.Printf("Wallet transaction %x is forgotten: %s\n", tnx.ID, err)
+					n.walletTxs.remove(tnx.ID)
+					continue
+				}
+			}
+
+			n.relayTransaction(tnx.ID, true)
+		}
+
+		err := n.walletTxs.save()
+		if err != nil {
+			log.Println(err)
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
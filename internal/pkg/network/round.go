@@ -0,0 +1,400 @@
+package network
+
+import (
+	"bytes"
+	"fmt"
+	bcpkg "github.com/keithzetterstrom/BibCoin/internal/pkg/blockchain"
+	walletpkg "github.com/keithzetterstrom/BibCoin/internal/pkg/wallet"
+	"github.com/keithzetterstrom/BibCoin/tools/base58"
+	"log"
+	"time"
+)
+
+const errorMemPoolEmpty = "Mem pool has no valid transactions "
+
+// maxSignedHeights is the number of last heights the stakeholder remembers its extensions at
+const maxSignedHeights = 100
+
+// newBlock asks the stakeholder chosen for the attempt of the round to extend the block
+type newBlock struct {
+	AddrFrom string
+	Block    []byte
+	Attempt  int
+}
+
+// extension is the block extended and signed by the stakeholder
+type extension struct {
+	AddrFrom string
+	Block    []byte
+}
+
+type decline struct {
+	AddrFrom string
+	Decline  bcpkg.Decline
+}
+
+// roundResult is the answer of the stakeholder, reason tells why the block is declined
+type roundResult struct {
+	block  *bcpkg.ExtensionBlock
+	reason string
+}
+
+// stakeRound is the round of the mined block, stakeholders chosen for attempts of the round
+// are asked to extend the block one by one until one of them answers
+type stakeRound struct {
+	block   *bcpkg.Block
+	attempt int
+	index   int
+	started time.Time
+	done    chan roundResult
+}
+
+// finish ends the round with the answer of the stakeholder, only the first answer is taken
+func (r *stakeRound) finish(result roundResult) {
+	select {
+	case r.done <- result:
+	default:
+	}
+}
+
+// sendNewBlock sends commandNewBlock request with the mined block
+// to ask the stakeholder of the attempt to extend it
+func (n *Network) sendNewBlock(addr string, b *bcpkg.Block, attempt int) {
+	payload := gobEncode(newBlock{AddrFrom: n.NetAddr, Block: b.Serialize(), Attempt: attempt})
+	n.sendMessage(addr, commandNewBlock, payload)
+}
+
+// runRound asks MaxStakeAttempts stakeholders chosen for attempts of the round to extend
+// the mined block. The round ends when the extension is added or the stakeholder declines,
+// the next attempt is started if the chosen stakeholder does not answer in StakeTimeout.
+// The round of the next block on the same parent starts from the attempt the round ended on,
+// attempts the timestamp of the block does not allow yet are asked again
+func (n *Network) runRound(block *bcpkg.Block) {
+	attempts, err := n.Bc.StakeAttempts(block)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	round := &stakeRound{block: block, started: time.Now(), done: make(chan roundResult, 1)}
+	count := n.Bc.Params.MaxStakeAttempts
+
+	n.mu.Lock()
+	n.round = round
+	first := 0
+	if bytes.Equal(n.roundParent, block.PrevBlockHash) {
+		first = n.nextAttempt
+	}
+	if first > attempts - count {
+		first = attempts - count
+	}
+	n.mu.Unlock()
+
+	attempt := first
+
+	defer func() {
+		n.mu.Lock()
+		n.round = nil
+		n.roundParent = block.PrevBlockHash
+		n.nextAttempt = attempt + 1
+		n.mu.Unlock()
+	}()
+
+	for ; attempt < first + count; attempt++ {
+		index, err := n.Bc.StakeholderIndex(block, attempt)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+
+		n.mu.Lock()
+		round.attempt = attempt
+		round.index = index
+		n.mu.Unlock()
+
+		log.Printf("Round of block %x: attempt %d chooses satoshi %d\n", block.Hash, attempt, index)
+
+		// the block is sent directly to the owner of the satoshi if it is online,
+		// otherwise every node checks itself if it owns the satoshi
+		if node, ok := n.stakeholderNode(index); ok {
+			log.Printf("Round of block %x: satoshi %d is staked by %s\n", block.Hash, index, node)
+			n.sendNewBlock(node, block, attempt)
+		} else {
+			for _, node := range n.knownNodes() {
+				if node != n.NetAddr {
+					n.sendNewBlock(node, block, attempt)
+				}
+			}
+		}
+
+		select {
+		case result := <-round.done:
+			if result.block != nil {
+				log.Printf("Round of block %x: extended with %d transactions by %x in attempt %d in %s\n",
+					block.Hash, len(result.block.Transactions), result.block.StakeholderHash,
+					result.block.Attempt, time.Since(round.started).Round(time.Millisecond))
+			} else {
+				log.Printf("Round of block %x: declined in attempt %d: %s\n", block.Hash, attempt, result.reason)
+			}
+			return
+		case <-time.After(n.Bc.Params.StakeTimeout):
+			log.Printf("Round of block %x: stakeholder of satoshi %d does not answer in %s\n",
+				block.Hash, index, n.Bc.Params.StakeTimeout)
+		case <-n.quit:
+			return
+		}
+	}
+
+	// the last attempt is not repeated by the next round
+	attempt--
+
+	log.Printf("Round of block %x: stakeholders of %d attempts do not answer, the block is dropped\n",
+		block.Hash, count)
+}
+
+// currentRound returns the round of the miner with the block, nil is returned
+// if the miner does not run the round of the block
+func (n *Network) currentRound(hash []byte) (*stakeRound, int) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.round == nil || !bytes.Equal(n.round.block.Hash, hash) {
+		return nil, 0
+	}
+
+	return n.round, n.round.attempt
+}
+
+// handleNewBlock handles newBlock request with block from miner. The node checks
+// if it owns the satoshi chosen for the attempt and answers with the signed extension
+// of the block or with the decline, nodes which are not chosen do not answer
+func (n *Network) handleNewBlock(p *peer, request []byte) {
+	var payload newBlock
+
+	err := getDataFromRequest(request, &payload)
+	if err != nil {
+		n.misbehaving(p, scoreMalformed, err.Error())
+		return
+	}
+
+	block, err := bcpkg.DeserializeBlock(payload.Block)
+	if err != nil {
+		n.misbehaving(p, scoreMalformed, err.Error())
+		return
+	}
+
+	// the node without the key of its wallet can not sign, the miner falls back to the next attempt
+	if n.Wallet == nil {
+		return
+	}
+
+	err = n.Bc.CheckStakeholder(block, payload.Attempt, base58.HashPubKey(n.Wallet.PublicKey))
+	if err == bcpkg.ErrStakeholderIndexNotFound {
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	var txs []*bcpkg.Transaction
+
+	pool := n.MemPool.Transactions()
+	for i := range pool {
+		if n.Bc.VerifyTransaction(&pool[i]) {
+			txs = append(txs, &pool[i])
+		}
+	}
+
+	if len(txs) < txInPool {
+		n.sendDecline(p, block.Hash, payload.Attempt, errorMemPoolEmpty)
+		return
+	}
+
+	lastIndex, err := n.Bc.GetLastSatoshiIndex()
+	if err != nil {
+		log.Panic(err)
+	}
+
+	// the stake reward of delegated satoshis goes to their owner
+	stakeAddr := n.Address
+	owner, err := n.Bc.StakeOwner(block, payload.Attempt)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	if owner != nil {
+		stakeAddr = string(walletpkg.AddressFromPubKeyHash(owner, n.Bc.Params.AddressVersion))
+	}
+
+	cbTx := bcpkg.NewCoinbaseTX(block.MinerAddress, stakeAddr, "", lastIndex, n.Bc.Params.Subsidy)
+	txs = append(txs, cbTx)
+
+	extensionBlock, err := n.Bc.ExtendBlock(block, payload.Attempt, txs, n.Address)
+	if code, ok := blockRejectCode(err); ok {
+		n.sendReject(p, commandNewBlock, code, err.Error(), block.Hash)
+	}
+	if _, ok := err.(*bcpkg.InvalidBlockError); ok {
+		n.misbehaving(p, scoreInvalidBlock, err.Error())
+		return
+	}
+	if err != nil {
+		n.sendDecline(p, block.Hash, payload.Attempt, err.Error())
+		return
+	}
+
+	extensionBlock.Sign(n.Wallet.PrivateKey, n.Wallet.PublicKey)
+
+	// the miner asking again in the next attempt gets the same extension,
+	// another extension at the same height would be double signing
+	if known := n.keepSigned(extensionBlock); known != nil {
+		if !bytes.Equal(known.Hash, block.Hash) || len(known.Transactions) == 0 {
+			n.sendDecline(p, block.Hash, payload.Attempt,
+				fmt.Sprintf("Block %x is already signed at height %d ", known.Hash, known.Height))
+			return
+		}
+		extensionBlock = known
+	}
+
+	log.Printf("Extended block %x with %d transactions in attempt %d\n",
+		block.Hash, len(extensionBlock.Transactions), extensionBlock.Attempt)
+
+	response := gobEncode(extension{AddrFrom: n.NetAddr, Block: extensionBlock.Serialize()})
+	p.queueMessage(message{Command: commandExtension, Payload: response})
+}
+
+// keepSigned remembers the extension signed by the node and returns the extension
+// it signed before at the same height, the one stored in blockchain has no transactions
+func (n *Network) keepSigned(b *bcpkg.ExtensionBlock) *bcpkg.ExtensionBlock {
+	// the node may have signed the extension before restart
+	stored := n.Bc.FindSigned(b.Height, b.StakeholderHash)
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if known, ok := n.signed[b.Height]; ok {
+		return known
+	}
+	if stored != nil {
+		return stored
+	}
+
+	n.signed[b.Height] = b
+	for height := range n.signed {
+		if height <= b.Height - maxSignedHeights {
+			delete(n.signed, height)
+		}
+	}
+
+	return nil
+}
+
+// sendDecline answers the miner over the same connection that the block is not extended
+func (n *Network) sendDecline(p *peer, hash []byte, attempt int, reason string) {
+	d := bcpkg.NewDecline(hash, attempt, reason, n.Wallet.PrivateKey, n.Wallet.PublicKey)
+	log.Printf("Declined block %x in attempt %d: %s\n", hash, attempt, reason)
+
+	p.queueMessage(message{Command: commandDecline, Payload: gobEncode(decline{AddrFrom: n.NetAddr, Decline: *d})})
+}
+
+// handleExtension handles the block extended by the stakeholder, the block
+// of the running round signed by the chosen stakeholder is added and announced
+// to all nodes. Stakeholders of previous attempts may still answer
+func (n *Network) handleExtension(p *peer, request []byte) {
+	var payload extension
+
+	err := getDataFromRequest(request, &payload)
+	if err != nil {
+		n.misbehaving(p, scoreMalformed, err.Error())
+		return
+	}
+
+	block, err := bcpkg.DeserializeExtensionBlock(payload.Block)
+	if err != nil {
+		n.misbehaving(p, scoreMalformed, err.Error())
+		return
+	}
+
+	round, attempt := n.currentRound(block.Hash)
+	if round == nil || block.Attempt > attempt {
+		log.Printf("Extension of block %x from %s is not requested\n", block.Hash, payload.AddrFrom)
+		return
+	}
+
+	if !sameHeader(&block.Block, round.block) {
+		n.misbehaving(p, scoreInvalidBlock, fmt.Sprintf("extension of block %x changes its header", block.Hash))
+		return
+	}
+
+	// the stake of the extension is checked when it is added
+	err = n.Bc.AddBlock(block)
+	n.reportDoubleSigns()
+	if code, ok := blockRejectCode(err); ok {
+		n.sendReject(p, commandExtension, code, err.Error(), block.Hash)
+	}
+	if _, ok := err.(*bcpkg.InvalidBlockError); ok {
+		n.misbehaving(p, scoreInvalidBlock, err.Error())
+		return
+	}
+	if err != nil {
+		log.Printf("Extension of block %x from %s is not accepted: %s\n", block.Hash, payload.AddrFrom, err)
+		return
+	}
+
+	round.finish(roundResult{block: block})
+	fmt.Printf("Added block %x with high %d \n", block.Hash, block.Height)
+	fmt.Println("New block is mined!")
+
+	n.updateMemPool()
+
+	for _, node := range n.knownNodes() {
+		if node != n.NetAddr {
+			n.announceBlock(node, block)
+		}
+	}
+	n.announceToLightPeers(block.Hash)
+}
+
+// handleDecline handles the decline of the stakeholder chosen for the current attempt,
+// the round ends without the block
+func (n *Network) handleDecline(p *peer, request []byte) {
+	var payload decline
+
+	err := getDataFromRequest(request, &payload)
+	if err != nil {
+		n.misbehaving(p, scoreMalformed, err.Error())
+		return
+	}
+
+	d := &payload.Decline
+
+	round, attempt := n.currentRound(d.Hash)
+	if round == nil || d.Attempt != attempt {
+		log.Printf("Decline of block %x from %s is not requested\n", d.Hash, payload.AddrFrom)
+		return
+	}
+
+	if !d.Verify() {
+		n.misbehaving(p, scoreMalformed, fmt.Sprintf("decline of block %x has invalid signature", d.Hash))
+		return
+	}
+
+	err = n.Bc.CheckStakeholder(round.block, d.Attempt, base58.HashPubKey(d.PubKey))
+	if err != nil {
+		log.Printf("Decline of block %x from %s is not accepted: %s\n", d.Hash, payload.AddrFrom, err)
+		return
+	}
+
+	round.finish(roundResult{reason: d.Reason})
+}
+
+// sameHeader returns true if the extension keeps the header of the mined block
+func sameHeader(extended, mined *bcpkg.Block) bool {
+	return bytes.Equal(extended.Hash, mined.Hash) &&
+		bytes.Equal(extended.PrevBlockHash, mined.PrevBlockHash) &&
+		extended.Timestamp == mined.Timestamp &&
+		extended.Nonce == mined.Nonce &&
+		extended.Height == mined.Height &&
+		bytes.Equal(extended.ParentRoot, mined.ParentRoot) &&
+		extended.MinerAddress == mined.MinerAddress
+}
@@ -0,0 +1,162 @@
+package network
+
+import (
+	bcpkg "github.com/keithzetterstrom/BibCoin/internal/pkg/blockchain"
+	"log"
+	"net"
+	"time"
+)
+
+const crawlInterval = time.Minute * 5
+
+// Seeder crawls the network asking nodes for their addresses
+// and serves addresses of healthy nodes to new nodes
+type Seeder struct {
+	NetAddr  string
+	Params   *bcpkg.ChainParams
+	AddrBook *AddrBook
+	// Transport connects the seeder to nodes, TCPTransport by default
+	Transport Transport
+	genesis   []byte
+	nonce     uint64
+}
+
+// NewSeeder returns Seeder which keeps crawled addresses in file
+func NewSeeder(params *bcpkg.ChainParams, netAddress, file string) *Seeder {
+	genesis, err := bcpkg.GenesisBlock(params)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return &Seeder{
+		NetAddr: netAddress,
+		Params: params,
+		AddrBook: NewAddrBook(file),
+		Transport: TCPTransport{},
+		genesis: genesis.Hash,
+		nonce: randomNonce(),
+	}
+}
+
+// versionMessage returns commandVersion message of the seeder, it announces
+// no services so nodes do not use the seeder to sync
+func (s *Seeder) versionMessage(addrRecv string) message {
+	payload := gobEncode(version{
+		Version: nodeVersion,
+		UserAgent: userAgent,
+		AddrFrom: s.NetAddr,
+		AddrRecv: addrRecv,
+		Genesis: s.genesis,
+		Nonce: s.nonce,
+		Timestamp: time.Now().Unix(),
+	})
+
+	return message{Command: commandVersion, Payload: payload}
+}
+
+// Start starts crawling and serves getAddr requests,
+// the answer contains only nodes which were reachable recently
+func (s *Seeder) Start() {
+	ln, err := s.Transport.Listen(s.NetAddr)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	defer ln.Close()
+
+	go s.crawl()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			log.Println(err)
+			return
+		}
+
+		go s.serve(conn)
+	}
+}
+
+// serve makes handshake with the node and answers its getAddr request
+func (s *Seeder) serve(conn net.Conn) {
+	defer conn.Close()
+
+	_ = conn.SetDeadline(time.Now().Add(ioTimeout))
+
+	for {
+		msg, err := readMessage(conn, s.Params.Magic)
+		if err != nil {
+			return
+		}
+
+		var response []message
+
+		switch msg.Command {
+		case commandVersion:
+			response = []message{
+				s.versionMessage(conn.RemoteAddr().String()),
+				{Command: commandVerack, Payload: gobEncode(verack{AddrFrom: s.NetAddr})},
+			}
+		case commandGetAddr:
+			payload := gobEncode(addr{AddrFrom: s.NetAddr, Addresses: s.AddrBook.Healthy(maxAddrPerMessage)})
+			response = []message{{Command: commandAddr, Payload: payload}}
+		}
+
+		for _, msg := range response {
+			_, err = conn.Write(encodeMessage(s.Params.Magic, msg))
+			if err != nil {
+				log.Println(err)
+				return
+			}
+		}
+
+		if msg.Command == commandGetAddr {
+			return
+		}
+	}
+}
+
+// crawl periodically visits seed nodes and all nodes from AddrBook
+func (s *Seeder) crawl() {
+	for {
+		nodes := append([]string{}, s.Params.SeedNodes...)
+		nodes = append(nodes, s.AddrBook.Best(s.AddrBook.Size())...)
+
+		visited := make(map[string]bool)
+		for _, node := range nodes {
+			if visited[node] {
+				continue
+			}
+			visited[node] = true
+
+			s.visit(node)
+		}
+
+		err := s.AddrBook.Save()
+		if err != nil {
+			log.Println(err)
+		}
+
+		log.Printf("Crawled %d nodes, %d are healthy\n", len(visited), len(s.AddrBook.Healthy(maxAddrPerMessage)))
+
+		time.Sleep(crawlInterval)
+	}
+}
+
+// visit asks the node for addresses and updates its reachability
+func (s *Seeder) visit(node string) {
+	response, err := requestAddr(s.Transport, node, s.versionMessage(node), s.NetAddr, s.Params.Magic)
+	if err != nil {
+		s.AddrBook.Failed(node)
+		return
+	}
+	s.AddrBook.Good(node)
+
+	var payload addr
+	err = getDataFromRequest(response, &payload)
+	if err != nil || len(payload.Addresses) > maxAddrPerMessage {
+		return
+	}
+
+	s.AddrBook.addAddresses(payload.Addresses, s.NetAddr)
+}
@@ -0,0 +1,434 @@
+package network
+
+import (
+	"encoding/hex"
+	"fmt"
+	bcpkg "github.com/keithzetterstrom/BibCoin/internal/pkg/blockchain"
+	"log"
+	"time"
+)
+
+// maxHeadersPerMessage is the number of headers sent in one headers message,
+// the node asks for more headers when it receives the full message
+const maxHeadersPerMessage = 2000
+
+// maxLocatorLength is enough for a locator of a chain with 2^90 blocks
+const maxLocatorLength = 100
+
+// bodies of blocks are downloaded from several peers at once, every peer has up to
+// maxBlocksInFlightPerPeer requested blocks. Blocks which are not received
+// in blockDownloadTimeout are requested from another peer up to maxDownloadAttempts times
+const (
+	blockDownloadWindow      = 256
+	maxBlocksInFlightPerPeer = 16
+	blockDownloadTimeout     = time.Second * 30
+	maxDownloadAttempts      = 5
+	downloadCheckInterval    = time.Second * 5
+)
+
+type getHeaders struct {
+	AddrFrom string
+	Locator  [][]byte
+	// Stop is the hash of the last needed header, nil means as many as possible
+	Stop []byte
+}
+
+type headers struct {
+	AddrFrom string
+	Headers  []bcpkg.Block
+}
+
+// blockRequest is the block which body is downloaded
+type blockRequest struct {
+	// peer is the address of the peer the block is requested from,
+	// empty address means that the block waits for a free peer
+	peer     string
+	deadline time.Time
+	attempts int
+	// tried are the peers which did not send the block, they are tried
+	// again when all peers have failed, failed are all of them
+	tried  map[string]bool
+	failed map[string]bool
+}
+
+// sendGetHeaders sends commandGetHeaders request with locator of the best header chain
+// over the connection of the peer, the address the peer claims is not dialed
+func (n *Network) sendGetHeaders(p *peer) {
+	n.mu.Lock()
+	n.headersRequested[p.addr] = time.Now()
+	n.mu.Unlock()
+
+	payload := gobEncode(getHeaders{AddrFrom: n.NetAddr, Locator: n.Bc.BlockLocator()})
+	p.queueMessage(message{Command: commandGetHeaders, Payload: payload})
+}
+
+// handleGetHeaders handles getHeaders request and answers over the same connection
+// with headers of the chain following the fork point found by locator
+func (n *Network) handleGetHeaders(p *peer, request []byte) {
+	var payload getHeaders
+
+	err := getDataFromRequest(request, &payload)
+	if err != nil {
+		n.misbehaving(p, scoreMalformed, err.Error())
+		return
+	}
+
+	if len(payload.Locator) > maxLocatorLength {
+		n.misbehaving(p, scoreSpam, fmt.Sprintf("locator of %d hashes", len(payload.Locator)))
+		return
+	}
+
+	response := headers{
+		AddrFrom: n.NetAddr,
+		Headers: n.Bc.GetHeaders(payload.Locator, payload.Stop, maxHeadersPerMessage),
+	}
+	p.queueMessage(message{Command: commandHeaders, Payload: gobEncode(response)})
+}
+
+// handleHeaders handles headers, adds them to the header chain
+// and starts downloading of bodies of the new blocks
+func (n *Network) handleHeaders(p *peer, request []byte) {
+	var payload headers
+
+	err := getDataFromRequest(request, &payload)
+	if err != nil {
+		n.misbehaving(p, scoreMalformed, err.Error())
+		return
+	}
+
+	if len(payload.Headers) > maxHeadersPerMessage {
+		n.misbehaving(p, scoreSpam, fmt.Sprintf("%d headers", len(payload.Headers)))
+		return
+	}
+
+	n.mu.Lock()
+	delete(n.headersRequested, p.addr)
+	n.mu.Unlock()
+
+	if len(payload.Headers) > 0 {
+		err = n.Bc.AddHeaders(payload.Headers)
+		if _, ok := err.(*bcpkg.InvalidBlockError); ok {
+			n.misbehaving(p, scoreInvalidBlock, err.Error())
+			return
+		}
+		if err != nil {
+			log.Printf("Headers from %s are not accepted: %s\n", p.addr, err)
+			return
+		}
+
+		last := payload.Headers[len(payload.Headers) - 1]
+		p.setLastHeader(last.Hash)
+		fmt.Printf("Received %d headers up to %x with high %d \n", len(payload.Headers), last.Hash, last.Height)
+
+		n.retryAbandoned()
+
+		var hashes [][]byte
+		for _, header := range payload.Headers {
+			hashes = append(hashes, header.Hash)
+		}
+		n.connectOrphans(hashes)
+	}
+
+	n.requestBlocks()
+
+	if len(payload.Headers) == maxHeadersPerMessage {
+		n.sendGetHeaders(p)
+		return
+	}
+
+	n.checkSynced()
+}
+
+// downloadPeers returns addresses of peers blocks can be downloaded from,
+// pruned peers are used only when there are no full ones
+func (n *Network) downloadPeers() []string {
+	var full, pruned []string
+
+	for _, p := range n.peers.list() {
+		select {
+		case <-p.ready:
+		default:
+			continue
+		}
+
+		services := p.getInfo().Services
+		if services & ServiceFull != 0 {
+			full = append(full, p.addr)
+		} else if services & ServicePruned != 0 {
+			pruned = append(pruned, p.addr)
+		}
+	}
+
+	if len(full) > 0 {
+		return full
+	}
+
+	return pruned
+}
+
+// requestBlocks requests bodies of the next blocks of the best header chain
+// from the least busy peers which have not failed to send them yet,
+// light node requests only transactions matching its filter
+func (n *Network) requestBlocks() {
+	hashes := n.Bc.BlocksToDownload(blockDownloadWindow)
+	kind, has := typeBlock, n.Bc.HasBlock
+	if n.Bc.IsLight() {
+		hashes = n.Bc.FilteredBlocksToDownload(blockDownloadWindow)
+		kind, has = typeFilteredBlock, n.Bc.HasFilteredBlock
+	}
+	peers := n.downloadPeers()
+	requests := make(map[string][]message)
+
+	n.mu.Lock()
+
+	wanted := make(map[string]bool)
+	for _, hash := range hashes {
+		wanted[hex.EncodeToString(hash)] = true
+	}
+
+	inFlight := make(map[string]int)
+	for id, request := range n.blocksInFlight {
+		if request.peer != "" {
+			inFlight[request.peer]++
+		} else if !wanted[id] {
+			delete(n.blocksInFlight, id)
+		}
+	}
+
+	for _, hash := range hashes {
+		id := hex.EncodeToString(hash)
+
+		request, ok := n.blocksInFlight[id]
+		if !ok {
+			// the block may be added by another peer after the hashes were read
+			if has(hash) {
+				continue
+			}
+
+			request = &blockRequest{tried: make(map[string]bool), failed: make(map[string]bool)}
+			n.blocksInFlight[id] = request
+		}
+
+		if request.peer != "" || request.attempts >= maxDownloadAttempts {
+			continue
+		}
+
+		addr := pickPeer(peers, inFlight, request.tried)
+		if addr == "" && len(request.tried) > 0 {
+			// all peers have failed, they are tried again as the block may be received meanwhile
+			request.tried = make(map[string]bool)
+			addr = pickPeer(peers, inFlight, request.tried)
+		}
+		if addr == "" {
+			continue
+		}
+
+		request.peer = addr
+		request.deadline = time.Now().Add(blockDownloadTimeout)
+		request.attempts++
+		inFlight[addr]++
+
+		payload := gobEncode(getData{AddrFrom: n.NetAddr, Type: kind, ID: hash})
+		requests[addr] = append(requests[addr], message{Command: commandGetData, Payload: payload})
+	}
+
+	n.mu.Unlock()
+
+	for addr, messages := range requests {
+		n.sendMessages(addr, messages)
+	}
+}
+
+// pickPeer returns the peer with the fewest requested blocks
+// which has not been tried and is not fully loaded
+func pickPeer(peers []string, inFlight map[string]int, tried map[string]bool) string {
+	best := ""
+
+	for _, addr := range peers {
+		if tried[addr] || inFlight[addr] >= maxBlocksInFlightPerPeer {
+			continue
+		}
+
+		if best == "" || inFlight[addr] < inFlight[best] {
+			best = addr
+		}
+	}
+
+	return best
+}
+
+// blockReceived removes the block from requested ones
+func (n *Network) blockReceived(hash []byte) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	delete(n.blocksInFlight, hex.EncodeToString(hash))
+}
+
+// blockFailed marks that the peer can not send the block, so it is requested from another peer
+func (n *Network) blockFailed(hash []byte, addr string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	request, ok := n.blocksInFlight[hex.EncodeToString(hash)]
+	if !ok || request.peer != addr {
+		return
+	}
+
+	request.tried[addr] = true
+	request.failed[addr] = true
+	request.peer = ""
+}
+
+// retryAbandoned allows downloading of blocks which were requested too many times,
+// new headers mean that peers may have them now
+func (n *Network) retryAbandoned() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	for id, request := range n.blocksInFlight {
+		if request.peer == "" && request.attempts >= maxDownloadAttempts {
+			delete(n.blocksInFlight, id)
+		}
+	}
+}
+
+// peerDisconnected forgets headers requested from the disconnected node, blocks
+// and transactions of compact blocks requested from it are expired,
+// so downloadLoop requests them from other peers
+func (n *Network) peerDisconnected(addr string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	delete(n.headersRequested, addr)
+
+	now := time.Now()
+	for _, request := range n.blocksInFlight {
+		if request.peer == addr {
+			request.deadline = now
+		}
+	}
+	for _, partial := range n.partialBlocks {
+		if partial.peer == addr {
+			partial.deadline = now
+		}
+	}
+}
+
+// dropUnavailable removes branches of the header chain which blocks are not received
+// in maxDownloadAttempts, so the node does not wait for bodies of the chain which
+// has only headers. Full peers which sent headers of the branch and failed to send
+// the blocks are banned, pruned peers may not have old blocks. The headers
+// are requested again from other peers
+func (n *Network) dropUnavailable() {
+	unavailable := make(map[string]map[string]bool)
+
+	n.mu.Lock()
+	for id, request := range n.blocksInFlight {
+		if request.peer == "" && request.attempts >= maxDownloadAttempts {
+			unavailable[id] = request.failed
+			delete(n.blocksInFlight, id)
+		}
+	}
+	n.mu.Unlock()
+
+	if len(unavailable) == 0 {
+		return
+	}
+
+	for id, failed := range unavailable {
+		hash, _ := hex.DecodeString(id)
+
+		for _, p := range n.peers.list() {
+			if !failed[p.addr] || p.getInfo().Services & ServiceFull == 0 {
+				continue
+			}
+
+			if n.Bc.HeaderFollows(p.getLastHeader(), hash) {
+				log.Printf("Peer %s has sent headers of block %x without its body\n", p.addr, hash)
+				n.ban(p)
+			}
+		}
+
+		err := n.Bc.RemoveHeaders(hash)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+
+	for _, addr := range n.downloadPeers() {
+		if p := n.peers.get(addr); p != nil {
+			n.sendGetHeaders(p)
+		}
+	}
+}
+
+// checkSynced notifies the goroutine waiting for synchronization
+// when no headers are waited for and no blocks are being downloaded
+func (n *Network) checkSynced() {
+	n.mu.Lock()
+	downloading := false
+	for addr, requested := range n.headersRequested {
+		if time.Since(requested) > ioTimeout {
+			delete(n.headersRequested, addr)
+		} else {
+			downloading = true
+		}
+	}
+	for _, request := range n.blocksInFlight {
+		if request.peer != "" {
+			downloading = true
+			break
+		}
+	}
+	n.mu.Unlock()
+
+	if !downloading {
+		n.notify(true)
+	}
+}
+
+// downloadLoop requests blocks which are not received in time
+// from other peers until stop is closed
+func (n *Network) downloadLoop(stop <-chan struct{}) {
+	ticker := time.NewTicker(downloadCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		now := time.Now()
+		expired := false
+
+		n.mu.Lock()
+		for id, request := range n.blocksInFlight {
+			if request.peer != "" && now.After(request.deadline) {
+				log.Printf("Block %s is not received from %s in time\n", id, request.peer)
+				request.tried[request.peer] = true
+				request.failed[request.peer] = true
+				request.peer = ""
+				expired = true
+			}
+		}
+		n.mu.Unlock()
+
+		n.dropUnavailable()
+
+		if expired {
+			n.requestBlocks()
+			n.checkSynced()
+		}
+
+		if n.expirePartialBlocks(now) {
+			for _, addr := range n.downloadPeers() {
+				if p := n.peers.get(addr); p != nil {
+					n.sendGetHeaders(p)
+				}
+			}
+		}
+	}
+}
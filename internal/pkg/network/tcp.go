@@ -0,0 +1,28 @@
+package network
+
+import (
+	"net"
+	"time"
+)
+
+// Transport opens connections between nodes, nodes of the real network
+// use TCPTransport and simulated ones use transport of MemNetwork
+type Transport interface {
+	// Dial connects to the node listening on the address
+	Dial(addr string, timeout time.Duration) (net.Conn, error)
+	// Listen accepts connections on the address
+	Listen(addr string) (net.Listener, error)
+}
+
+// TCPTransport connects nodes over TCP
+type TCPTransport struct{}
+
+// Dial connects to the node over TCP
+func (TCPTransport) Dial(addr string, timeout time.Duration) (net.Conn, error) {
+	return net.DialTimeout(protocol, addr, timeout)
+}
+
+// Listen accepts TCP connections on the address
+func (TCPTransport) Listen(addr string) (net.Listener, error) {
+	return net.Listen(protocol, addr)
+}
@@ -1,8 +1,9 @@
 package network
 
 import (
-	"encoding/hex"
+	"fmt"
 	bcpkg "github.com/keithzetterstrom/BibCoin/internal/pkg/blockchain"
+	mempoolpkg "github.com/keithzetterstrom/BibCoin/internal/pkg/mempool"
 	"log"
 )
 
@@ -14,26 +15,155 @@ type tx struct {
 	Transaction []byte
 }
 
+type getMempool struct {
+	AddrFrom string
+}
+
+type mempool struct {
+	AddrFrom string
+	Info     mempoolpkg.Info
+	Entries  []mempoolpkg.EntryInfo
+}
+
 // SendTx sends commandTx request with given Transaction
 func (n *Network) SendTx(addr string, tnx *bcpkg.Transaction) {
 	data := tx{AddFrom: n.NetAddr, Transaction: tnx.Serialize()}
 	payload := gobEncode(data)
-	request := append(commandToBytes(commandTx), payload...)
+	n.sendMessage(addr, commandTx, payload)
+}
 
-	n.sendData(addr, request)
+// submittedTx is the transaction sent to the peer followed by ping,
+// pong is closed when the peer has handled both of them
+type submittedTx struct {
+	peer *peer
+	pong <-chan struct{}
 }
 
-// handleTx handles request with Transaction
-// and puts it to mem pool with transactions
-func (n *Network) handleTx(request []byte) {
+// submitTx sends the transaction and ping to the node, false is returned
+// if the node is not connected
+func (n *Network) submitTx(addr string, tnx *bcpkg.Transaction) (submittedTx, bool) {
+	p, err := n.connectPeer(addr)
+	if err != nil {
+		log.Printf("Failed to connect to %s: %s\n", addr, err)
+		return submittedTx{}, false
+	}
+
+	nonce, pong := p.expectPong()
+	messages := []message{
+		{Command: commandTx, Payload: gobEncode(tx{AddFrom: n.NetAddr, Transaction: tnx.Serialize()})},
+		{Command: commandPing, Payload: gobEncode(ping{Nonce: nonce})},
+	}
+
+	for _, msg := range messages {
+		if !p.queueMessage(msg) {
+			log.Printf("Peer %s does not accept messages, disconnecting\n", addr)
+			p.close()
+			return submittedTx{}, false
+		}
+	}
+
+	return submittedTx{peer: p, pong: pong}, true
+}
+
+// handleTx handles request with Transaction, puts it to mem pool and announces
+// it to other peers, not accepted transaction is rejected and the peer sent
+// invalid one is misbehaving
+func (n *Network) handleTx(p *peer, request []byte) {
 	var payload tx
 
 	err := getDataFromRequest(request, &payload)
 	if err != nil {
-		log.Panic(err)
+		n.misbehaving(p, scoreMalformed, err.Error())
+		return
 	}
 
 	txData := payload.Transaction
-	tx := bcpkg.DeserializeTransaction(txData)
-	n.memPool[hex.EncodeToString(tx.ID)] = tx
+	tx, err := bcpkg.DeserializeTransaction(txData)
+	if err != nil {
+		n.misbehaving(p, scoreMalformed, err.Error())
+		return
+	}
+
+	p.known.add(tx.ID)
+	n.txReceived(tx.ID)
+
+	// transactions spending unknown outputs are not rejected, the node may be behind
+	err = n.MemPool.Add(tx)
+	switch e := err.(type) {
+	case *mempoolpkg.InvalidTxError:
+		n.sendReject(p, commandTx, RejectInvalid, err.Error(), tx.ID)
+		n.misbehaving(p, scoreInvalidTx, err.Error())
+		return
+	case *mempoolpkg.RejectedTxError:
+		// the transaction the node already has is accepted, it is not rejected
+		if !n.MemPool.Has(tx.ID) {
+			n.sendReject(p, commandTx, policyRejectCode(e.Policy), err.Error(), tx.ID)
+		}
+	}
+	if err != nil {
+		log.Printf("Transaction %x from %s is not accepted: %s\n", tx.ID, payload.AddFrom, err)
+		return
+	}
+
+	fmt.Printf("Added transaction %x to mem pool \n", tx.ID)
+	n.relayTransaction(tx.ID, false)
+}
+
+// updateMemPool removes transactions mined by blocks connected to the chain
+// from mem pool and returns transactions of disconnected blocks to it
+func (n *Network) updateMemPool() {
+	connected, disconnected := n.Bc.TakeChainChanges()
+	n.MemPool.Update(connected, disconnected)
+}
+
+// reportDoubleSigns puts evidence of stakeholders which signed two extensions at the same height
+// into mem pool and relays it, stakeholders of next blocks include it to burn stake of offenders
+func (n *Network) reportDoubleSigns() {
+	for _, evidence := range n.Bc.TakeDoubleSigns() {
+		tnx := bcpkg.NewEvidenceTX(evidence)
+
+		err := n.MemPool.Add(*tnx)
+		if err != nil {
+			log.Printf("Evidence %x is not added to mem pool: %s\n", tnx.ID, err)
+			continue
+		}
+
+		log.Printf("Stakeholder %x signed blocks %x and %x at height %d, evidence %x is added to mem pool\n",
+			evidence.Offender(), evidence.First.Hash, evidence.Second.Hash, evidence.First.Height, tnx.ID)
+		n.relayTransaction(tnx.ID, false)
+	}
+}
+
+// handleGetMempool handles getMempool request and answers over the same
+// connection with the state of mem pool and its transactions
+func (n *Network) handleGetMempool(p *peer, request []byte) {
+	var payload getMempool
+
+	err := getDataFromRequest(request, &payload)
+	if err != nil {
+		n.misbehaving(p, scoreMalformed, err.Error())
+		return
+	}
+
+	response := gobEncode(mempool{AddrFrom: n.NetAddr, Info: n.MemPool.Info(), Entries: n.MemPool.RawMempool()})
+	p.queueMessage(message{Command: commandMempool, Payload: response})
+}
+
+// RequestMempool asks the node for the state of its mem pool and its transactions,
+// no services are announced, so the node does not sync from the current one
+func (n *Network) RequestMempool(address string) (mempoolpkg.Info, []mempoolpkg.EntryInfo, error) {
+	request := message{Command: commandGetMempool, Payload: gobEncode(getMempool{AddrFrom: n.NetAddr})}
+
+	response, err := requestReply(n.Transport, address, n.versionMessage(address, 0), request, commandMempool, n.NetAddr, n.Bc.Params.Magic)
+	if err != nil {
+		return mempoolpkg.Info{}, nil, err
+	}
+
+	var payload mempool
+	err = getDataFromRequest(response, &payload)
+	if err != nil {
+		return mempoolpkg.Info{}, nil, err
+	}
+
+	return payload.Info, payload.Entries, nil
 }
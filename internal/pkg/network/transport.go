@@ -0,0 +1,478 @@
+package network
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+	"io"
+	"net"
+	"time"
+)
+
+// encrypted connection starts with encryptionMagic instead of the magic of the network,
+// then the nodes make handshake following Noise XX pattern: they exchange ephemeral
+// keys and send their static keys encrypted, so both nodes are authenticated by
+// static keys and messages are encrypted with keys known only to them
+const protocolName = "Noise_XX_25519_ChaChaPoly_SHA256"
+
+const keyLength = curve25519.PointSize
+
+// tagLength is the length of Poly1305 authentication tag added to ciphertext
+const tagLength = 16
+
+// messages are split into records of up to maxRecordLength bytes of ciphertext
+const (
+	recordLengthLength = 2
+	maxRecordLength    = 1 << 16 - 1
+)
+
+const handshakeTimeout = time.Second * 10
+
+const (
+	errorHandshakeFailed = "Encrypted handshake failed "
+	errorBadRecord       = "Encrypted record is corrupt "
+)
+
+// encryptionMagic returns the first bytes of encrypted connection of the network with given magic
+func encryptionMagic(magic [magicLength]byte) []byte {
+	hash := sha256.Sum256(append([]byte(protocolName), magic[:]...))
+
+	return hash[:magicLength]
+}
+
+// handshakeState is the symmetric state of Noise handshake: chaining key,
+// hash of the handshake transcript and the key encrypting static keys
+type handshakeState struct {
+	ck    []byte
+	h     []byte
+	aead  cipher.AEAD
+	nonce uint64
+}
+
+// newHandshakeState returns handshakeState bound to the network with given magic,
+// the protocol name is not longer than the hash, so it is taken as is
+func newHandshakeState(magic [magicLength]byte) *handshakeState {
+	h := make([]byte, sha256.Size)
+	copy(h, protocolName)
+
+	s := &handshakeState{ck: h, h: h}
+	s.mixHash(magic[:])
+
+	return s
+}
+
+// mixHash adds data to the handshake transcript
+func (s *handshakeState) mixHash(data []byte) {
+	h := sha256.Sum256(append(append([]byte{}, s.h...), data...))
+	s.h = h[:]
+}
+
+// mixKey derives new chaining key and encryption key from the result of Diffie-Hellman
+func (s *handshakeState) mixKey(secret []byte) error {
+	ck, k, err := deriveKeys(s.ck, secret)
+	if err != nil {
+		return err
+	}
+
+	s.ck = ck
+	s.aead, err = chacha20poly1305.New(k)
+	s.nonce = 0
+
+	return err
+}
+
+// encryptAndHash encrypts data with the current key and adds ciphertext to the transcript,
+// data is sent as is before the first key is derived
+func (s *handshakeState) encryptAndHash(plaintext []byte) []byte {
+	if s.aead == nil {
+		s.mixHash(plaintext)
+		return plaintext
+	}
+
+	ciphertext := s.aead.Seal(nil, nonceBytes(s.nonce), plaintext, s.h)
+	s.nonce++
+	s.mixHash(ciphertext)
+
+	return ciphertext
+}
+
+// decryptAndHash decrypts data with the current key and adds ciphertext to the transcript
+func (s *handshakeState) decryptAndHash(ciphertext []byte) ([]byte, error) {
+	if s.aead == nil {
+		s.mixHash(ciphertext)
+		return ciphertext, nil
+	}
+
+	plaintext, err := s.aead.Open(nil, nonceBytes(s.nonce), ciphertext, s.h)
+	if err != nil {
+		return nil, errors.New(errorHandshakeFailed)
+	}
+	s.nonce++
+	s.mixHash(ciphertext)
+
+	return plaintext, nil
+}
+
+// split returns keys of messages sent by the initiator and by the responder
+func (s *handshakeState) split() (cipher.AEAD, cipher.AEAD, error) {
+	k1, k2, err := deriveKeys(s.ck, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	initiator, err := chacha20poly1305.New(k1)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	responder, err := chacha20poly1305.New(k2)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return initiator, responder, nil
+}
+
+// deriveKeys returns two keys derived by HKDF from the chaining key and the secret
+func deriveKeys(ck, secret []byte) ([]byte, []byte, error) {
+	keys := make([]byte, 2 * chacha20poly1305.KeySize)
+
+	_, err := io.ReadFull(hkdf.New(sha256.New, secret, ck, nil), keys)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return keys[:chacha20poly1305.KeySize], keys[chacha20poly1305.KeySize:], nil
+}
+
+// nonceBytes returns nonce of ChaCha20-Poly1305 with the given counter
+func nonceBytes(counter uint64) []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	binary.LittleEndian.PutUint64(nonce[4:], counter)
+
+	return nonce
+}
+
+// newKeyPair returns new X25519 private and public keys
+func newKeyPair() ([]byte, []byte, error) {
+	private := make([]byte, curve25519.ScalarSize)
+
+	_, err := rand.Read(private)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	public, err := curve25519.X25519(private, curve25519.Basepoint)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return private, public, nil
+}
+
+// secureConn encrypts messages written to the connection and decrypts read ones,
+// every record is the length of ciphertext followed by the ciphertext
+type secureConn struct {
+	net.Conn
+	send      cipher.AEAD
+	recv      cipher.AEAD
+	sendNonce uint64
+	recvNonce uint64
+	// pending are decrypted bytes which are not read yet
+	pending []byte
+	// remoteKey is the static key of the node on the other side
+	remoteKey []byte
+}
+
+// Read reads decrypted data from the connection
+func (c *secureConn) Read(b []byte) (int, error) {
+	if len(c.pending) == 0 {
+		header := make([]byte, recordLengthLength)
+
+		_, err := io.ReadFull(c.Conn, header)
+		if err != nil {
+			return 0, err
+		}
+
+		record := make([]byte, binary.BigEndian.Uint16(header))
+
+		_, err = io.ReadFull(c.Conn, record)
+		if err != nil {
+			return 0, err
+		}
+
+		c.pending, err = c.recv.Open(record[:0], nonceBytes(c.recvNonce), record, nil)
+		if err != nil {
+			return 0, errors.New(errorBadRecord)
+		}
+		c.recvNonce++
+	}
+
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+
+	return n, nil
+}
+
+// Write encrypts data and writes it to the connection
+func (c *secureConn) Write(b []byte) (int, error) {
+	var buff bytes.Buffer
+	maxPlaintext := maxRecordLength - c.send.Overhead()
+
+	for written := 0; written < len(b); written += maxPlaintext {
+		end := written + maxPlaintext
+		if end > len(b) {
+			end = len(b)
+		}
+
+		record := c.send.Seal(nil, nonceBytes(c.sendNonce), b[written:end], nil)
+		c.sendNonce++
+
+		header := make([]byte, recordLengthLength)
+		binary.BigEndian.PutUint16(header, uint16(len(record)))
+		buff.Write(header)
+		buff.Write(record)
+	}
+
+	_, err := c.Conn.Write(buff.Bytes())
+	if err != nil {
+		return 0, err
+	}
+
+	return len(b), nil
+}
+
+// prefixConn returns bytes read to detect the kind of connection before the rest of data
+type prefixConn struct {
+	net.Conn
+	prefix []byte
+}
+
+// Read reads the prefix and then data of the connection
+func (c *prefixConn) Read(b []byte) (int, error) {
+	if len(c.prefix) > 0 {
+		n := copy(b, c.prefix)
+		c.prefix = c.prefix[n:]
+
+		return n, nil
+	}
+
+	return c.Conn.Read(b)
+}
+
+// initiateEncryption makes handshake over outbound connection
+// and returns the encrypted connection
+func initiateEncryption(conn net.Conn, magic [magicLength]byte, key *nodeKey) (*secureConn, error) {
+	_ = conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	s := newHandshakeState(magic)
+
+	ephemeral, ephemeralPublic, err := newKeyPair()
+	if err != nil {
+		return nil, err
+	}
+
+	// -> e, every message ends with the payload which is empty
+	s.mixHash(ephemeralPublic)
+	s.encryptAndHash(nil)
+	_, err = conn.Write(append(encryptionMagic(magic), ephemeralPublic...))
+	if err != nil {
+		return nil, err
+	}
+
+	// <- e, ee, s, es
+	response := make([]byte, keyLength + keyLength + tagLength + tagLength)
+	_, err = io.ReadFull(conn, response)
+	if err != nil {
+		return nil, err
+	}
+
+	remoteEphemeral := response[:keyLength]
+	s.mixHash(remoteEphemeral)
+	err = mixDH(s, ephemeral, remoteEphemeral)
+	if err != nil {
+		return nil, err
+	}
+
+	remoteStatic, err := s.decryptAndHash(response[keyLength:keyLength + keyLength + tagLength])
+	if err != nil {
+		return nil, err
+	}
+	err = mixDH(s, ephemeral, remoteStatic)
+	if err != nil {
+		return nil, err
+	}
+	_, err = s.decryptAndHash(response[keyLength + keyLength + tagLength:])
+	if err != nil {
+		return nil, err
+	}
+
+	// -> s, se
+	message := s.encryptAndHash(key.public)
+	err = mixDH(s, key.private, remoteEphemeral)
+	if err != nil {
+		return nil, err
+	}
+	_, err = conn.Write(append(message, s.encryptAndHash(nil)...))
+	if err != nil {
+		return nil, err
+	}
+
+	send, recv, err := s.split()
+	if err != nil {
+		return nil, err
+	}
+
+	return &secureConn{Conn: conn, send: send, recv: recv, remoteKey: remoteStatic}, nil
+}
+
+// respondEncryption makes handshake over inbound connection which encryption magic
+// is already read and returns the encrypted connection
+func respondEncryption(conn net.Conn, magic [magicLength]byte, key *nodeKey) (*secureConn, error) {
+	_ = conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	s := newHandshakeState(magic)
+
+	// -> e
+	remoteEphemeral := make([]byte, keyLength)
+	_, err := io.ReadFull(conn, remoteEphemeral)
+	if err != nil {
+		return nil, err
+	}
+	s.mixHash(remoteEphemeral)
+	_, err = s.decryptAndHash(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// <- e, ee, s, es
+	ephemeral, ephemeralPublic, err := newKeyPair()
+	if err != nil {
+		return nil, err
+	}
+
+	s.mixHash(ephemeralPublic)
+	err = mixDH(s, ephemeral, remoteEphemeral)
+	if err != nil {
+		return nil, err
+	}
+
+	response := append(ephemeralPublic, s.encryptAndHash(key.public)...)
+	err = mixDH(s, key.private, remoteEphemeral)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = conn.Write(append(response, s.encryptAndHash(nil)...))
+	if err != nil {
+		return nil, err
+	}
+
+	// -> s, se
+	message := make([]byte, keyLength + tagLength + tagLength)
+	_, err = io.ReadFull(conn, message)
+	if err != nil {
+		return nil, err
+	}
+
+	remoteStatic, err := s.decryptAndHash(message[:keyLength + tagLength])
+	if err != nil {
+		return nil, err
+	}
+	err = mixDH(s, ephemeral, remoteStatic)
+	if err != nil {
+		return nil, err
+	}
+	_, err = s.decryptAndHash(message[keyLength + tagLength:])
+	if err != nil {
+		return nil, err
+	}
+
+	recv, send, err := s.split()
+	if err != nil {
+		return nil, err
+	}
+
+	return &secureConn{Conn: conn, send: send, recv: recv, remoteKey: remoteStatic}, nil
+}
+
+// mixDH mixes result of Diffie-Hellman of the keys into the handshake state,
+// low order public keys giving zero result are rejected
+func mixDH(s *handshakeState, private, public []byte) error {
+	secret, err := curve25519.X25519(private, public)
+	if err != nil {
+		return errors.New(errorHandshakeFailed)
+	}
+
+	return s.mixKey(secret)
+}
+
+// secureInbound detects whether the inbound connection is encrypted and makes
+// handshake, static key of the node is returned for encrypted connection
+func (n *Network) secureInbound(conn net.Conn) (net.Conn, []byte, error) {
+	_ = conn.SetReadDeadline(time.Now().Add(handshakeTimeout))
+
+	prefix := make([]byte, magicLength)
+	_, err := io.ReadFull(conn, prefix)
+	if err != nil {
+		return nil, nil, err
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+
+	if !bytes.Equal(prefix, encryptionMagic(n.Bc.Params.Magic)) {
+		return &prefixConn{Conn: conn, prefix: prefix}, nil, nil
+	}
+
+	secure, err := respondEncryption(conn, n.Bc.Params.Magic, n.key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return secure, secure.remoteKey, nil
+}
+
+// dial connects to the node, the connection is encrypted if the node supports it
+// and the current node is not configured to use plaintext. Connections
+// to nodes with pinned keys must be encrypted with the pinned keys
+func (n *Network) dial(addr string) (net.Conn, []byte, error) {
+	conn, err := n.Transport.Dial(addr, dialTimeout)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	pinned := n.PinnedKeys.Get(addr)
+	if n.Plaintext && pinned == nil {
+		return conn, nil, nil
+	}
+
+	secure, err := initiateEncryption(conn, n.Bc.Params.Magic, n.key)
+	if err == nil {
+		if pinned != nil && !bytes.Equal(pinned, secure.remoteKey) {
+			conn.Close()
+			return nil, nil, errors.New(errorKeyMismatch)
+		}
+
+		return secure, secure.remoteKey, nil
+	}
+	conn.Close()
+
+	if pinned != nil {
+		return nil, nil, err
+	}
+
+	// the node does not support encryption, it closes connection on unknown magic
+	conn, err = n.Transport.Dial(addr, dialTimeout)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return conn, nil, nil
+}
@@ -0,0 +1,382 @@
+package network
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+var testMagic = [magicLength]byte{0xb1, 0xb0, 0x4e, 0x67}
+
+// noiseState is the symmetric state of Noise handshake written after the specification
+// apart from the transport, so the handshake of nodes is checked against it
+type noiseState struct {
+	ck []byte
+	h  []byte
+	k  []byte
+	n  uint64
+}
+
+// noiseHKDF returns two outputs of HKDF defined by Noise
+func noiseHKDF(ck, ikm []byte) ([]byte, []byte) {
+	mac := hmac.New(sha256.New, ck)
+	mac.Write(ikm)
+	tempKey := mac.Sum(nil)
+
+	mac = hmac.New(sha256.New, tempKey)
+	mac.Write([]byte{0x01})
+	output1 := mac.Sum(nil)
+
+	mac = hmac.New(sha256.New, tempKey)
+	mac.Write(append(append([]byte{}, output1...), 0x02))
+
+	return output1, mac.Sum(nil)
+}
+
+// noiseEncrypt encrypts with ChaChaPoly cipher of Noise
+func noiseEncrypt(k []byte, n uint64, ad, plaintext []byte) []byte {
+	aead, _ := chacha20poly1305.New(k)
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	binary.LittleEndian.PutUint64(nonce[4:], n)
+
+	return aead.Seal(nil, nonce, plaintext, ad)
+}
+
+// noiseDecrypt decrypts with ChaChaPoly cipher of Noise
+func noiseDecrypt(k []byte, n uint64, ad, ciphertext []byte) ([]byte, error) {
+	aead, _ := chacha20poly1305.New(k)
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	binary.LittleEndian.PutUint64(nonce[4:], n)
+
+	return aead.Open(nil, nonce, ciphertext, ad)
+}
+
+func newNoiseState(prologue []byte) *noiseState {
+	h := make([]byte, sha256.Size)
+	copy(h, "Noise_XX_25519_ChaChaPoly_SHA256")
+
+	s := &noiseState{ck: h, h: h}
+	s.mixHash(prologue)
+
+	return s
+}
+
+func (s *noiseState) mixHash(data []byte) {
+	h := sha256.Sum256(append(append([]byte{}, s.h...), data...))
+	s.h = h[:]
+}
+
+func (s *noiseState) mixKey(ikm []byte) {
+	s.ck, s.k = noiseHKDF(s.ck, ikm)
+	s.n = 0
+}
+
+func (s *noiseState) dh(private, public []byte) {
+	secret, _ := curve25519.X25519(private, public)
+	s.mixKey(secret)
+}
+
+func (s *noiseState) encryptAndHash(plaintext []byte) []byte {
+	ciphertext := plaintext
+	if s.k != nil {
+		ciphertext = noiseEncrypt(s.k, s.n, s.h, plaintext)
+		s.n++
+	}
+	s.mixHash(ciphertext)
+
+	return ciphertext
+}
+
+func (s *noiseState) decryptAndHash(ciphertext []byte) ([]byte, error) {
+	plaintext := ciphertext
+	if s.k != nil {
+		var err error
+		plaintext, err = noiseDecrypt(s.k, s.n, s.h, ciphertext)
+		if err != nil {
+			return nil, err
+		}
+		s.n++
+	}
+	s.mixHash(ciphertext)
+
+	return plaintext, nil
+}
+
+// split returns keys of messages sent by the initiator and by the responder
+func (s *noiseState) split() ([]byte, []byte) {
+	return noiseHKDF(s.ck, nil)
+}
+
+// noiseInitiate makes handshake as the initiator following the specification,
+// keys of sending and receiving and the static key of the responder are returned
+func noiseInitiate(conn net.Conn, static *nodeKey) ([]byte, []byte, []byte, error) {
+	s := newNoiseState(testMagic[:])
+	e, ePublic, err := newKeyPair()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	// -> e
+	s.mixHash(ePublic)
+	message := append(append(encryptionMagic(testMagic), ePublic...), s.encryptAndHash(nil)...)
+	if _, err = conn.Write(message); err != nil {
+		return nil, nil, nil, err
+	}
+
+	// <- e, ee, s, es
+	message = make([]byte, keyLength + keyLength + tagLength + tagLength)
+	if _, err = io.ReadFull(conn, message); err != nil {
+		return nil, nil, nil, err
+	}
+	re := message[:keyLength]
+	s.mixHash(re)
+	s.dh(e, re)
+	rs, err := s.decryptAndHash(message[keyLength:keyLength + keyLength + tagLength])
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	s.dh(e, rs)
+	if _, err = s.decryptAndHash(message[keyLength + keyLength + tagLength:]); err != nil {
+		return nil, nil, nil, err
+	}
+
+	// -> s, se
+	message = s.encryptAndHash(static.public)
+	s.dh(static.private, re)
+	if _, err = conn.Write(append(message, s.encryptAndHash(nil)...)); err != nil {
+		return nil, nil, nil, err
+	}
+
+	send, recv := s.split()
+
+	return send, recv, rs, nil
+}
+
+// noiseRespond makes handshake as the responder following the specification,
+// keys of sending and receiving and the static key of the initiator are returned
+func noiseRespond(conn net.Conn, static *nodeKey) ([]byte, []byte, []byte, error) {
+	s := newNoiseState(testMagic[:])
+
+	// -> e
+	message := make([]byte, magicLength + keyLength)
+	if _, err := io.ReadFull(conn, message); err != nil {
+		return nil, nil, nil, err
+	}
+	if !bytes.Equal(message[:magicLength], encryptionMagic(testMagic)) {
+		return nil, nil, nil, errors.New("Encrypted connection does not start with encryption magic ")
+	}
+	re := message[magicLength:]
+	s.mixHash(re)
+	if _, err := s.decryptAndHash(nil); err != nil {
+		return nil, nil, nil, err
+	}
+
+	// <- e, ee, s, es
+	e, ePublic, err := newKeyPair()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	s.mixHash(ePublic)
+	s.dh(e, re)
+	message = append(append([]byte{}, ePublic...), s.encryptAndHash(static.public)...)
+	s.dh(static.private, re)
+	if _, err = conn.Write(append(message, s.encryptAndHash(nil)...)); err != nil {
+		return nil, nil, nil, err
+	}
+
+	// -> s, se
+	message = make([]byte, keyLength + tagLength + tagLength)
+	if _, err = io.ReadFull(conn, message); err != nil {
+		return nil, nil, nil, err
+	}
+	rs, err := s.decryptAndHash(message[:keyLength + tagLength])
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	s.dh(e, rs)
+	if _, err = s.decryptAndHash(message[keyLength + tagLength:]); err != nil {
+		return nil, nil, nil, err
+	}
+
+	recv, send := s.split()
+
+	return send, recv, rs, nil
+}
+
+// newTestKey returns new static key of the node
+func newTestKey(t *testing.T) *nodeKey {
+	private, public, err := newKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &nodeKey{private: private, public: public}
+}
+
+// testPipe returns ends of the connection, the test fails instead of waiting
+// for the handshake which does not finish
+func testPipe(t *testing.T) (net.Conn, net.Conn) {
+	conn, remote := net.Pipe()
+	t.Cleanup(func() {
+		conn.Close()
+		remote.Close()
+	})
+
+	deadline := time.Now().Add(handshakeTimeout)
+	_ = conn.SetDeadline(deadline)
+	_ = remote.SetDeadline(deadline)
+
+	return conn, remote
+}
+
+// checkRecords checks that the record sent by the node is decrypted with the key
+// of receiving and the record encrypted with the key of sending is read by the node
+func checkRecords(t *testing.T, node *secureConn, remote net.Conn, send, recv []byte) {
+	go func() {
+		_, _ = node.Write([]byte("version"))
+	}()
+
+	header := make([]byte, recordLengthLength)
+	if _, err := io.ReadFull(remote, header); err != nil {
+		t.Fatal(err)
+	}
+	record := make([]byte, binary.BigEndian.Uint16(header))
+	if _, err := io.ReadFull(remote, record); err != nil {
+		t.Fatal(err)
+	}
+	plaintext, err := noiseDecrypt(recv, 0, nil, record)
+	if err != nil || string(plaintext) != "version" {
+		t.Fatalf("Record of the node is not decrypted: %q %v", plaintext, err)
+	}
+
+	record = noiseEncrypt(send, 0, nil, []byte("verack"))
+	binary.BigEndian.PutUint16(header, uint16(len(record)))
+	go func() {
+		_, _ = remote.Write(append(header, record...))
+	}()
+
+	buff := make([]byte, len("verack"))
+	if _, err = io.ReadFull(node, buff); err != nil || string(buff) != "verack" {
+		t.Fatalf("Record of the peer is not read: %q %v", buff, err)
+	}
+}
+
+// TestInitiateEncryption checks the handshake of the outbound connection
+// against the responder following Noise specification
+func TestInitiateEncryption(t *testing.T) {
+	key, remoteKey := newTestKey(t), newTestKey(t)
+	conn, remote := testPipe(t)
+
+	var send, recv, static []byte
+	var remoteErr error
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		send, recv, static, remoteErr = noiseRespond(remote, remoteKey)
+	}()
+
+	secure, err := initiateEncryption(conn, testMagic, key)
+	<-done
+	if err != nil || remoteErr != nil {
+		t.Fatal(err, remoteErr)
+	}
+
+	if !bytes.Equal(secure.remoteKey, remoteKey.public) || !bytes.Equal(static, key.public) {
+		t.Fatal("Static keys are not exchanged")
+	}
+
+	checkRecords(t, secure, remote, send, recv)
+}
+
+// TestRespondEncryption checks the handshake of the inbound connection
+// against the initiator following Noise specification
+func TestRespondEncryption(t *testing.T) {
+	key, remoteKey := newTestKey(t), newTestKey(t)
+	conn, remote := testPipe(t)
+
+	var send, recv, static []byte
+	var remoteErr error
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		send, recv, static, remoteErr = noiseInitiate(remote, remoteKey)
+	}()
+
+	// the encryption magic is read before the handshake
+	prefix := make([]byte, magicLength)
+	if _, err := io.ReadFull(conn, prefix); err != nil {
+		t.Fatal(err)
+	}
+	secure, err := respondEncryption(conn, testMagic, key)
+	<-done
+	if err != nil || remoteErr != nil {
+		t.Fatal(err, remoteErr)
+	}
+
+	if !bytes.Equal(secure.remoteKey, remoteKey.public) || !bytes.Equal(static, key.public) {
+		t.Fatal("Static keys are not exchanged")
+	}
+
+	checkRecords(t, secure, remote, send, recv)
+}
+
+// TestHandshakeOtherNetwork checks that nodes of different networks do not make handshake
+func TestHandshakeOtherNetwork(t *testing.T) {
+	conn, remote := testPipe(t)
+
+	other := testMagic
+	other[0]++
+	remoteKey := newTestKey(t)
+
+	go func() {
+		prefix := make([]byte, magicLength)
+		if _, err := io.ReadFull(remote, prefix); err == nil {
+			_, _ = respondEncryption(remote, other, remoteKey)
+		}
+		remote.Close()
+	}()
+
+	if _, err := initiateEncryption(conn, testMagic, newTestKey(t)); err == nil {
+		t.Error("Handshake with the node of another network succeeded")
+	}
+}
+
+// TestCorruptRecord checks that the modified record is not read
+func TestCorruptRecord(t *testing.T) {
+	key, remoteKey := newTestKey(t), newTestKey(t)
+	conn, remote := testPipe(t)
+
+	var send []byte
+	var remoteErr error
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		send, _, _, remoteErr = noiseRespond(remote, remoteKey)
+	}()
+
+	secure, err := initiateEncryption(conn, testMagic, key)
+	<-done
+	if err != nil || remoteErr != nil {
+		t.Fatal(err, remoteErr)
+	}
+
+	record := noiseEncrypt(send, 0, nil, []byte("verack"))
+	record[0] ^= 1
+	header := make([]byte, recordLengthLength)
+	binary.BigEndian.PutUint16(header, uint16(len(record)))
+	go func() {
+		_, _ = remote.Write(append(header, record...))
+	}()
+
+	if _, err = secure.Read(make([]byte, len(record))); err == nil || err.Error() != errorBadRecord {
+		t.Errorf("Corrupt record is read: %v", err)
+	}
+}
@@ -1,62 +1,328 @@
 package network
 
 import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
 	"log"
+	"net"
+	"sort"
+	"strings"
+	"time"
 )
 
-const nodeVersion = 1
+// nodeVersion is the version of the protocol spoken by the node,
+// peers with version below minPeerVersion are disconnected
+const (
+	nodeVersion    = 9
+	minPeerVersion = 3
+)
+
+const userAgent = "/BibCoin:0.9.0/"
+
+// maxTimeOffset is the difference between clocks of the node and its peers
+// above which the node warns that its clock is probably wrong
+const maxTimeOffset = 70 * 60
+
+// service flags announced in version message
+const (
+	// ServiceFull - the node keeps and serves all blocks
+	ServiceFull uint64 = 1 << iota
+	// ServicePruned - the node serves only the last blocks
+	ServicePruned
+	// ServiceMiner - the node mines blocks
+	ServiceMiner
+	// ServiceStakeholder - the node stakes blocks mined by miners
+	ServiceStakeholder
+	// ServiceLight - the node keeps only headers and relevant transactions
+	ServiceLight
+)
+
+var serviceNames = []string{"full", "pruned", "miner", "stakeholder", "light"}
 
 type version struct {
 	Version    int
+	Services   uint64
+	UserAgent  string
 	BestHeight int
 	AddrFrom   string
+	AddrRecv   string
+	Genesis    []byte
+	// Nonce is random number of the node, receiving own nonce means connection to itself
+	Nonce     uint64
+	Timestamp int64
+}
+
+type verack struct {
+	AddrFrom string
+}
+
+// ServicesString returns names of the service flags
+func ServicesString(services uint64) string {
+	var names []string
+
+	for i, name := range serviceNames {
+		if services & (1 << uint(i)) != 0 {
+			names = append(names, name)
+		}
+	}
+
+	if len(names) == 0 {
+		return "none"
+	}
+
+	return strings.Join(names, ",")
+}
+
+// randomNonce returns random nonce of the node
+func randomNonce() uint64 {
+	var data [8]byte
+
+	_, err := rand.Read(data[:])
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return binary.BigEndian.Uint64(data[:])
 }
 
-// sendVersion sends commandVersion request with
-// actual height of blockchain in current node
-func (n *Network) sendVersion(addr string) {
+// localServices returns service flags of the current node
+func (n *Network) localServices() uint64 {
+	services := n.services
+
+	if n.Bc.IsLight() {
+		return services | ServiceLight
+	}
+
+	if n.Bc.IsPruned() {
+		services |= ServicePruned
+	} else {
+		services |= ServiceFull
+	}
+
+	return services
+}
+
+// versionMessage returns commandVersion message for the node with given address
+// announcing the given services
+func (n *Network) versionMessage(addrRecv string, services uint64) message {
 	bestHeight, err := n.Bc.GetBestHeight()
 	if err != nil {
 		bestHeight = -1
 	}
 
-	bestHeight = bestHeight - len(n.blocksInTransit)
-
-	payload := gobEncode(version{Version: nodeVersion, BestHeight: bestHeight, AddrFrom: n.NetAddr})
+	payload := gobEncode(version{
+		Version: nodeVersion,
+		Services: services,
+		UserAgent: userAgent,
+		BestHeight: bestHeight,
+		AddrFrom: n.NetAddr,
+		AddrRecv: addrRecv,
+		Genesis: n.genesis,
+		Nonce: n.nonce,
+		Timestamp: time.Now().Unix(),
+	})
 
-	request := append(commandToBytes(commandVersion), payload...)
+	return message{Command: commandVersion, Payload: payload}
+}
 
-	n.sendData(addr, request)
+// sendVersion starts handshake with the peer, it is called before the goroutines
+// of outbound peer are started or by the goroutine reading from inbound peer
+func (n *Network) sendVersion(p *peer) {
+	p.versionSent = true
+	p.queueMessage(n.versionMessage(p.addr, n.localServices()))
 }
 
 // sendOK sends commandOK
 func (n *Network) sendOK(addr string) {
-	n.sendData(addr, commandToBytes(commandOK))
+	n.sendMessage(addr, commandOK, nil)
 }
 
-// handleVersion handles request with version of other node
-// and compares it with current node version
-func (n *Network) handleVersion(request []byte) {
+// handleVersion handles version of other node, checks that the node is compatible
+// and answers with own version if it has not been sent and verack
+func (n *Network) handleVersion(p *peer, request []byte) {
+	if p.versionReceived {
+		n.misbehaving(p, scoreSpam, "duplicate version")
+		return
+	}
+
 	var payload version
 
 	err := getDataFromRequest(request, &payload)
 	if err != nil {
-		log.Panic(err)
+		n.misbehaving(p, scoreMalformed, err.Error())
+		return
+	}
+
+	if payload.Nonce == n.nonce {
+		log.Printf("Connected to itself through %s\n", p.addr)
+		n.forgetNode(p.addr)
+		p.close()
+		return
 	}
 
-	myBestHeight, _ := n.Bc.GetBestHeight()
+	if !bytes.Equal(payload.Genesis, n.genesis) {
+		log.Printf("Node %s is on another network with genesis %x\n", payload.AddrFrom, payload.Genesis)
+		n.forgetNode(payload.AddrFrom)
+		p.close()
+		return
+	}
 
-	foreignerBestHeight := payload.BestHeight
+	if payload.Version < minPeerVersion {
+		log.Printf("Node %s has obsolete version %d\n", payload.AddrFrom, payload.Version)
+		n.sendReject(p, commandVersion, RejectObsolete, fmt.Sprintf("Version %d is older than %d ", payload.Version, minPeerVersion), nil)
+		n.forgetNode(payload.AddrFrom)
+		p.close()
+		return
+	}
+
+	// the inbound node claiming the address with pinned key must prove it has the key
+	if p.inbound && !n.PinnedKeys.Check(payload.AddrFrom, p.remoteKey) {
+		log.Printf("Node %s is not authenticated by its pinned key\n", payload.AddrFrom)
+		p.close()
+		return
+	}
+
+	p.versionReceived = true
+
+	negotiated := payload.Version
+	if negotiated > nodeVersion {
+		negotiated = nodeVersion
+	}
 
-	if myBestHeight < foreignerBestHeight {
-		n.sendGetBlocks(payload.AddrFrom)
-	} else if myBestHeight > foreignerBestHeight {
-		n.sendVersion(payload.AddrFrom)
+	p.setInfo(peerInfo{
+		Addr: payload.AddrFrom,
+		Version: negotiated,
+		Services: payload.Services,
+		UserAgent: payload.UserAgent,
+		StartHeight: payload.BestHeight,
+		TimeOffset: payload.Timestamp - time.Now().Unix(),
+	})
+
+	if !p.versionSent {
+		n.sendVersion(p)
+	}
+	p.queueMessage(message{Command: commandVerack, Payload: gobEncode(verack{AddrFrom: n.NetAddr})})
+
+	n.checkHandshake(p)
+}
+
+// handleVerack handles verack which confirms that the node has accepted our version
+func (n *Network) handleVerack(p *peer, request []byte) {
+	if p.verackReceived {
+		n.misbehaving(p, scoreSpam, "duplicate verack")
+		return
+	}
+
+	var payload verack
+
+	err := getDataFromRequest(request, &payload)
+	if err != nil {
+		n.misbehaving(p, scoreMalformed, err.Error())
+		return
+	}
+
+	p.verackReceived = true
+
+	n.checkHandshake(p)
+}
+
+// checkHandshake completes handshake when both version and verack are received,
+// other messages are sent to the peer and accepted from it only after that
+func (n *Network) checkHandshake(p *peer) {
+	if !p.versionReceived || !p.verackReceived || p.handshakeDone {
+		return
+	}
+
+	p.handshakeDone = true
+	close(p.ready)
+
+	info := p.getInfo()
+	encryption := "plaintext"
+	if p.remoteKey != nil {
+		encryption = fmt.Sprintf("encrypted with key %x", p.remoteKey)
+	}
+	log.Printf("Connected to %s %s version %d, services %s, height %d, %s\n",
+		info.Addr, info.UserAgent, info.Version, ServicesString(info.Services), info.StartHeight, encryption)
+
+	if offset := n.timeOffset(); offset > maxTimeOffset || offset < -maxTimeOffset {
+		log.Printf("Clock differs from clocks of peers by %d seconds, check date and time\n", offset)
+	}
+
+	n.sendPresences(p)
+
+	// only nodes which serve blocks are announced and used to sync
+	if info.Services & (ServiceFull | ServicePruned) == 0 {
+		return
+	}
+
+	// the address the inbound node claims is not checked,
+	// it becomes known only after the outbound connection to it succeeds
+	if p.inbound {
+		n.dialBack(p, info.Addr)
 	} else {
-		n.sendOK(payload.AddrFrom)
+		n.addNode(p.addr)
+		n.AddrBook.Good(p.addr)
 	}
+	n.sendGetAddr(p)
 
-	if !n.nodeIsKnown(payload.AddrFrom) {
-		n.KnownNodes = append(n.KnownNodes, payload.AddrFrom)
+	// the filter is loaded before blocks are requested from the peer
+	if n.Bc.IsLight() {
+		n.sendFilterLoad(p)
+	}
+
+	myHeaderHeight, _ := n.Bc.GetHeaderHeight()
+
+	if myHeaderHeight < info.StartHeight {
+		if info.Services & ServicePruned != 0 {
+			log.Printf("Node %s is pruned, old blocks may be unavailable\n", info.Addr)
+		}
+		n.sendGetHeaders(p)
+	} else {
+		n.checkSynced()
 	}
 }
+
+// dialBack puts the address the inbound node listens on to AddrBook and connects to it.
+// Only the address on the host of the connection is dialed, so the node
+// can not make us connect to other hosts
+func (n *Network) dialBack(p *peer, addr string) {
+	host, _, err := net.SplitHostPort(addr)
+	remote, _, _ := net.SplitHostPort(p.addr)
+	if err != nil || host != remote || addr == n.NetAddr || n.peers.get(addr) != nil {
+		return
+	}
+
+	n.AddrBook.AddAddress(addr, time.Now().Unix())
+
+	go func() {
+		_, err := n.connectPeer(addr)
+		if err != nil {
+			log.Printf("Failed to connect to %s: %s\n", addr, err)
+		}
+	}()
+}
+
+// timeOffset returns median of the differences between clocks of peers and the node
+func (n *Network) timeOffset() int64 {
+	var offsets []int64
+
+	for _, p := range n.peers.list() {
+		info := p.getInfo()
+		if info.Version != 0 {
+			offsets = append(offsets, info.TimeOffset)
+		}
+	}
+
+	if len(offsets) == 0 {
+		return 0
+	}
+
+	sort.Slice(offsets, func(i, j int) bool {
+		return offsets[i] < offsets[j]
+	})
+
+	return offsets[len(offsets) / 2]
+}
+
@@ -0,0 +1,92 @@
+package network
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/hex"
+	bcpkg "github.com/keithzetterstrom/BibCoin/internal/pkg/blockchain"
+	"io/ioutil"
+	"sort"
+	"sync"
+)
+
+const walletTxsFileName = "wallettxs.dat"
+
+// walletTxs keeps transactions sent from the wallet of the node in file
+// until they are mined, so they are announced again after restart
+type walletTxs struct {
+	mu   sync.Mutex
+	file string
+	txs  map[string]bcpkg.Transaction
+}
+
+// newWalletTxs loads walletTxs from file, missing file gives empty walletTxs
+func newWalletTxs(file string) *walletTxs {
+	w := &walletTxs{
+		file: file,
+		txs: make(map[string]bcpkg.Transaction),
+	}
+
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return w
+	}
+
+	var txs []bcpkg.Transaction
+	err = gob.NewDecoder(bytes.NewReader(content)).Decode(&txs)
+	if err != nil {
+		return w
+	}
+
+	for _, tx := range txs {
+		w.txs[hex.EncodeToString(tx.ID)] = tx
+	}
+
+	return w
+}
+
+// add puts the transaction into walletTxs and saves it
+func (w *walletTxs) add(tx bcpkg.Transaction) error {
+	w.mu.Lock()
+	w.txs[hex.EncodeToString(tx.ID)] = tx
+	w.mu.Unlock()
+
+	return w.save()
+}
+
+// remove deletes the transaction from walletTxs
+func (w *walletTxs) remove(txID []byte) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	delete(w.txs, hex.EncodeToString(txID))
+}
+
+// list returns transactions of walletTxs sorted by id
+func (w *walletTxs) list() []bcpkg.Transaction {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	var ids []string
+	for id := range w.txs {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	var txs []bcpkg.Transaction
+	for _, id := range ids {
+		txs = append(txs, w.txs[id])
+	}
+
+	return txs
+}
+
+// save writes walletTxs to file
+func (w *walletTxs) save() error {
+	txs := w.list()
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return ioutil.WriteFile(w.file, gobEncode(txs), 0644)
+}
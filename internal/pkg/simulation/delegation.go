@@ -0,0 +1,280 @@
+package simulation
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	bcpkg "github.com/keithzetterstrom/BibCoin/internal/pkg/blockchain"
+	mempoolpkg "github.com/keithzetterstrom/BibCoin/internal/pkg/mempool"
+	"github.com/keithzetterstrom/BibCoin/tools/base58"
+	"time"
+)
+
+// delegatedBlocks limits blocks mined until the staking node stakes satoshis of the owner
+const delegatedBlocks = 10
+
+// signStake returns the extension of the block for the attempt with the coinbase
+// paying the stake reward to the address, signed by the node
+func signStake(s *Simulation, signer *Node, block *bcpkg.Block, attempt int, stakeAddr string) (*bcpkg.ExtensionBlock, error) {
+	lastIndex, err := signer.Bc.GetLastSatoshiIndex()
+	if err != nil {
+		return nil, err
+	}
+
+	cbTx := bcpkg.NewCoinbaseTX(block.MinerAddress, stakeAddr, "", lastIndex, s.Params.Subsidy)
+
+	extension := bcpkg.NewExtensionBlock([]*bcpkg.Transaction{cbTx}, block)
+	extension.Attempt = attempt
+	extension.Sign(signer.Wallet.PrivateKey, signer.Wallet.PublicKey)
+
+	return extension, nil
+}
+
+// delegatedAttempt returns the block mined on the tip of the staking node and its first attempt
+// staking satoshis delegated by the owner, the clock of the node allows the attempt
+func delegatedAttempt(s *Simulation, owner, staker, miner *Node) (*bcpkg.Block, int, error) {
+	tip := staker.Tip()
+	block := bcpkg.NewBlock(tip.Hash, tip.MerkleRoot, tip.Height + 1, miner.Address, s.Params.TargetBits, tip.Timestamp + 1)
+
+	attempt := -1
+	for i := 0; i < delegatedBlocks * 10 && attempt < 0; i++ {
+		stakeOwner, err := staker.Bc.StakeOwner(block, i)
+		if err != nil {
+			return nil, 0, err
+		}
+		if bytes.Equal(stakeOwner, base58.HashPubKey(owner.Wallet.PublicKey)) {
+			attempt = i
+		}
+	}
+	if attempt < 0 {
+		return nil, 0, errors.New("Delegated satoshis are not chosen in any attempt ")
+	}
+
+	// the attempt is allowed by the time passed since the tip, satoshis of attempts
+	// do not depend on the block
+	elapsed := 1 + int64(attempt) * int64(s.Params.StakeTimeout / time.Second)
+	block = bcpkg.NewBlock(tip.Hash, tip.MerkleRoot, tip.Height + 1, miner.Address, s.Params.TargetBits, tip.Timestamp + elapsed)
+
+	return block, attempt, s.WaitClock(staker, block.Timestamp)
+}
+
+// checkStakeRewards checks that the extension of delegated satoshis is accepted only
+// when it is signed by the staking key and pays the stake reward to the owner,
+// both in the round and when the extension is relayed
+func checkStakeRewards(s *Simulation, owner, staker, miner *Node) error {
+	block, attempt, err := delegatedAttempt(s, owner, staker, miner)
+	if err != nil {
+		return err
+	}
+
+	stolen, err := signStake(s, staker, block, attempt, staker.Address)
+	if err != nil {
+		return err
+	}
+	if _, ok := staker.Bc.CheckStake(stolen).(*bcpkg.InvalidBlockError); !ok {
+		return errors.New("Extension taking the reward of delegated satoshis is accepted ")
+	}
+
+	paid, err := signStake(s, staker, block, attempt, owner.Address)
+	if err != nil {
+		return err
+	}
+	err = staker.Bc.CheckStake(paid)
+	if err != nil {
+		return fmt.Errorf("Extension of delegated satoshis is not accepted: %s", err)
+	}
+
+	// the owner gave staking of the satoshis away
+	byOwner, err := signStake(s, owner, block, attempt, owner.Address)
+	if err != nil {
+		return err
+	}
+	if staker.Bc.CheckStake(byOwner) != bcpkg.ErrStakeholderIndexNotFound {
+		return errors.New("Owner stakes delegated satoshis ")
+	}
+
+	// relayed extensions are checked like extensions of rounds
+	unsigned := bcpkg.NewExtensionBlock(paid.Transactions, block)
+	for _, extension := range []*bcpkg.ExtensionBlock{stolen, byOwner, unsigned} {
+		if _, ok := staker.Bc.AddBlock(extension).(*bcpkg.InvalidBlockError); !ok {
+			return fmt.Errorf("Relayed extension of block %x with invalid stake is added ", extension.Hash)
+		}
+	}
+
+	return nil
+}
+
+// checkTheft checks that the staking node can not spend delegated outputs
+// by the transaction it puts into its own extension staking them
+func checkTheft(s *Simulation, owner, staker, miner *Node, theft *bcpkg.Transaction) error {
+	block, attempt, err := delegatedAttempt(s, owner, staker, miner)
+	if err != nil {
+		return err
+	}
+
+	paid, err := signStake(s, staker, block, attempt, owner.Address)
+	if err != nil {
+		return err
+	}
+
+	extension := bcpkg.NewExtensionBlock(append(paid.Transactions, theft), block)
+	extension.Attempt = attempt
+	extension.Sign(staker.Wallet.PrivateKey, staker.Wallet.PublicKey)
+
+	// the stake is valid, the block is rejected only for the transaction
+	err = staker.Bc.CheckStake(extension)
+	if err != nil {
+		return fmt.Errorf("Extension of delegated satoshis is not accepted: %s", err)
+	}
+
+	if _, ok := staker.Bc.AddBlock(extension).(*bcpkg.InvalidBlockError); !ok {
+		return errors.New("Extension spending delegated outputs by the staking key is added ")
+	}
+
+	out, ok := staker.Bc.FindUnspentOutput(theft.Vin[0].OutTxID, theft.Vin[0].OutIndex)
+	if staker.HasBlock(extension.Hash) || !ok || !out.IsLockedWithKey(base58.HashPubKey(owner.Wallet.PublicKey)) {
+		return errors.New("Staking key spent delegated output in its extension ")
+	}
+
+	return nil
+}
+
+// runDelegation checks that the wallet which does not run a node delegates staking
+// of its outputs to the staking node, the staking node can not spend them
+// and rewards of their stakes are paid to the wallet
+func runDelegation(s *Simulation) error {
+	miners, err := addNodes(s, "miner", RoleMiner, 1)
+	if err != nil {
+		return err
+	}
+	stakeholders, err := addNodes(s, "stakeholder", RoleStakeholder, 2)
+	if err != nil {
+		return err
+	}
+	wallets, err := addNodes(s, "wallet", RoleWallet, 2)
+	if err != nil {
+		return err
+	}
+
+	err = fund(s, stakeholders, 1)
+	if err != nil {
+		return err
+	}
+	err = fund(s, wallets[:1], 6)
+	if err != nil {
+		return err
+	}
+	err = fund(s, wallets[1:], 2)
+	if err != nil {
+		return err
+	}
+
+	err = s.Start()
+	if err != nil {
+		return err
+	}
+
+	nodes := append(append([]*Node{}, miners...), stakeholders...)
+	owner, payer, staker := wallets[0], wallets[1], stakeholders[0]
+	ownerHash := base58.HashPubKey(owner.Wallet.PublicKey)
+	stakerHash := base58.HashPubKey(staker.Wallet.PublicKey)
+
+	outputs := owner.Bc.FindUndelegatedOutputs(ownerHash)
+	if len(outputs) == 0 {
+		return errors.New("Owner has no outputs to delegate ")
+	}
+
+	// delegations which are not signed by the owner or delegate to the owner are rejected
+	forged := bcpkg.NewDelegation(outputs, stakerHash, *owner.Wallet)
+	forged.StakePubKeyHash = base58.HashPubKey(miners[0].Wallet.PublicKey)
+	for _, delegation := range []*bcpkg.Delegation{forged, bcpkg.NewDelegation(outputs, ownerHash, *owner.Wallet)} {
+		err = staker.Network.MemPool.Add(*bcpkg.NewDelegationTX(delegation))
+		if _, ok := err.(*mempoolpkg.InvalidTxError); !ok {
+			return fmt.Errorf("Invalid delegation is not rejected: %v ", err)
+		}
+	}
+	if staker.Network.MemPool.Add(*bcpkg.NewDelegationTX(bcpkg.NewDelegation(outputs, stakerHash, *staker.Wallet))) == nil {
+		return errors.New("Delegation of outputs of another wallet is accepted ")
+	}
+
+	before := miners[0].Balance(owner.Address)
+
+	delegation := bcpkg.NewDelegationTX(bcpkg.NewDelegation(outputs, stakerHash, *owner.Wallet))
+	owner.Network.StartServer()
+	err = owner.Network.BroadcastTx(delegation)
+	owner.Network.Close()
+	if err != nil {
+		return err
+	}
+
+	err = mine(s, payer, payer.Address, 1, nodes)
+	if err != nil {
+		return err
+	}
+	err = waitMined(s, delegation.ID, nodes)
+	if err != nil {
+		return err
+	}
+
+	for _, node := range nodes {
+		for _, out := range outputs {
+			if !bytes.Equal(node.Bc.FindDelegate(out.TxID, out.Index), stakerHash) {
+				return fmt.Errorf("Output %x:%d is not delegated in chain of %s ", out.TxID, out.Index, node.Name)
+			}
+		}
+	}
+
+	// the delegation can not be replayed while the outputs are delegated
+	if staker.Network.MemPool.Add(*delegation) == nil {
+		return errors.New("Delegation of delegated outputs is accepted ")
+	}
+
+	// the staking key can not spend delegated outputs
+	out, _ := staker.Bc.FindUnspentOutput(outputs[0].TxID, outputs[0].Index)
+	theft := bcpkg.Transaction{
+		Vin: []bcpkg.TXInput{{OutTxID: outputs[0].TxID, OutIndex: outputs[0].Index, PubKey: staker.Wallet.PublicKey}},
+		Vout: []bcpkg.TXOutput{*bcpkg.NewTXOutput(out.Value, staker.Address)},
+	}
+	theft.ID = theft.Hash()
+	staker.Bc.SignTransaction(&theft, staker.Wallet.PrivateKey)
+	if _, ok := staker.Network.MemPool.Add(theft).(*mempoolpkg.InvalidTxError); !ok {
+		return errors.New("Staking key spends delegated output ")
+	}
+	err = checkTheft(s, owner, staker, miners[0], &theft)
+	if err != nil {
+		return err
+	}
+
+	stakes, _, err := miners[0].Network.OnlineStake()
+	if err != nil {
+		return err
+	}
+	for _, stake := range stakes {
+		if bytes.Equal(stake.PubKeyHash, stakerHash) && stake.Stake < before {
+			return fmt.Errorf("Online stake of the staking node is %d, %d satoshis are delegated to it ", stake.Stake, before)
+		}
+	}
+
+	err = checkStakeRewards(s, owner, staker, miners[0])
+	if err != nil {
+		return err
+	}
+
+	// the owner does not run a node, it gets rewards only by the staking node
+	for i := 0; i < delegatedBlocks && miners[0].Balance(owner.Address) == before; i++ {
+		err = mine(s, payer, payer.Address, 1, nodes)
+		if err != nil {
+			return err
+		}
+	}
+
+	rewards := miners[0].Balance(owner.Address) - before
+	if rewards == 0 {
+		return fmt.Errorf("Owner got no stake rewards in %d blocks ", delegatedBlocks)
+	}
+	if rewards % s.Params.Subsidy != 0 {
+		return fmt.Errorf("Owner got %d satoshis which are not stake rewards ", rewards)
+	}
+
+	return nil
+}
@@ -0,0 +1,569 @@
+package simulation
+
+import (
+	"errors"
+	"fmt"
+	bcpkg "github.com/keithzetterstrom/BibCoin/internal/pkg/blockchain"
+	"time"
+)
+
+// blockTimeout limits waiting for a transaction to be mined and spread to all nodes
+const blockTimeout = time.Minute
+
+// settleAttempts is the number of transactions sent to resolve competing blocks
+const settleAttempts = 5
+
+// Scenario is the script run on the simulated network
+type Scenario struct {
+	Name        string
+	Description string
+	Run         func(s *Simulation) error
+}
+
+// Scenarios are scripts for mining, staking, forks, selection of stakeholders and transport
+var Scenarios = []Scenario{
+	{
+		Name: "mining",
+		Description: "miner mines blocks with transactions of the wallet, all nodes get the same chain",
+		Run: runMining,
+	},
+	{
+		Name: "staking",
+		Description: "stakeholders owning chosen satoshis fill blocks and get rewards",
+		Run: runStaking,
+	},
+	{
+		Name: "forks",
+		Description: "partitioned halves of the network mine own chains, the shorter one is reorganized after healing",
+		Run: runForks,
+	},
+	{
+		Name: "spv",
+		Description: "light node downloads only headers and its transactions with proofs and gets the same balance",
+		Run: runSPV,
+	},
+	{
+		Name: "presence",
+		Description: "miner learns which stakeholders are online and skips stake of the offline wallet",
+		Run: runPresence,
+	},
+	{
+		Name: "selection",
+		Description: "satoshis are chosen uniformly by VRF outputs which the miner can not grind",
+		Run: runSelection,
+	},
+	{
+		Name: "slashing",
+		Description: "stakeholder signing two blocks at the same height is reported and its stake is burned",
+		Run: runSlashing,
+	},
+	{
+		Name: "delegation",
+		Description: "wallet delegates staking of its outputs to the staking node which can not spend them, rewards go to the wallet",
+		Run: runDelegation,
+	},
+	{
+		Name: "transport",
+		Description: "encrypted and plaintext nodes talk to each other, mismatched pinned keys and plaintext connections of pinned nodes are refused",
+		Run: runTransport,
+	},
+}
+
+// FindScenario returns the scenario with the name
+func FindScenario(name string) (Scenario, bool) {
+	for _, scenario := range Scenarios {
+		if scenario.Name == name {
+			return scenario, true
+		}
+	}
+
+	return Scenario{}, false
+}
+
+// addNodes adds nodes with the role named by prefix and number
+func addNodes(s *Simulation, prefix string, role Role, count int) ([]*Node, error) {
+	var nodes []*Node
+
+	for i := 1; i <= count; i++ {
+		node, err := s.AddNode(fmt.Sprintf("%s%d", prefix, i), role)
+		if err != nil {
+			return nil, err
+		}
+
+		nodes = append(nodes, node)
+	}
+
+	return nodes, nil
+}
+
+// fund generates blocks paying to every node
+func fund(s *Simulation, nodes []*Node, blocks int) error {
+	for _, node := range nodes {
+		err := s.Fund(node, blocks)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// mine sends coins from the wallet and waits until the transaction
+// is in chains of all nodes and they have the same tip
+func mine(s *Simulation, wallet *Node, to string, amount int, nodes []*Node) error {
+	txID, err := s.Send(wallet, to, amount)
+	if err != nil {
+		return err
+	}
+
+	err = waitMined(s, txID, nodes)
+	if err != nil {
+		return err
+	}
+
+	return settle(s, wallet, nodes)
+}
+
+// waitMined waits until the transaction is in chains of all nodes
+func waitMined(s *Simulation, txID []byte, nodes []*Node) error {
+	return s.WaitFor(fmt.Sprintf("transaction %x in chains of all nodes", txID), blockTimeout, func() bool {
+		for _, node := range nodes {
+			if !node.HasTransaction(txID) {
+				return false
+			}
+		}
+
+		return true
+	})
+}
+
+// settle waits until the nodes have the same tip. Stakeholders of different
+// rounds may fill competing blocks of the same height, only the next block
+// decides between them, so the wallet sends coins to itself until it is mined
+func settle(s *Simulation, wallet *Node, nodes []*Node) error {
+	for i := 0; i < settleAttempts; i++ {
+		err := s.WaitFor("nodes to have the same tip", time.Second * 5, func() bool {
+			return Converged(0, nodes...)
+		})
+		if err == nil {
+			return nil
+		}
+
+		txID, err := s.Send(wallet, wallet.Address, 1)
+		if err != nil {
+			return err
+		}
+
+		err = waitMined(s, txID, nodes)
+		if err != nil {
+			return err
+		}
+	}
+
+	if !Converged(0, nodes...) {
+		return errors.New("Nodes have different tips ")
+	}
+
+	return nil
+}
+
+// runMining checks that transactions are mined and blocks reach all nodes
+func runMining(s *Simulation) error {
+	miners, err := addNodes(s, "miner", RoleMiner, 1)
+	if err != nil {
+		return err
+	}
+	stakeholders, err := addNodes(s, "stakeholder", RoleStakeholder, 3)
+	if err != nil {
+		return err
+	}
+	wallets, err := addNodes(s, "wallet", RoleWallet, 1)
+	if err != nil {
+		return err
+	}
+
+	err = fund(s, stakeholders, 3)
+	if err != nil {
+		return err
+	}
+	err = fund(s, wallets, 1)
+	if err != nil {
+		return err
+	}
+
+	err = s.Start()
+	if err != nil {
+		return err
+	}
+
+	nodes := append(append([]*Node{}, miners...), stakeholders...)
+	start := nodes[0].Height()
+
+	for i := 0; i < 3; i++ {
+		err = mine(s, wallets[0], stakeholders[i].Address, 1, nodes)
+		if err != nil {
+			return err
+		}
+	}
+
+	if height := nodes[0].Height(); height < start + 3 {
+		return fmt.Errorf("Height is %d, expected at least %d ", height, start + 3)
+	}
+
+	return nil
+}
+
+// runStaking checks that blocks are filled only by stakeholders owning chosen
+// satoshis and every node sees the same rewards
+func runStaking(s *Simulation) error {
+	miners, err := addNodes(s, "miner", RoleMiner, 1)
+	if err != nil {
+		return err
+	}
+	stakeholders, err := addNodes(s, "stakeholder", RoleStakeholder, 3)
+	if err != nil {
+		return err
+	}
+	wallets, err := addNodes(s, "wallet", RoleWallet, 1)
+	if err != nil {
+		return err
+	}
+
+	err = fund(s, stakeholders, 3)
+	if err != nil {
+		return err
+	}
+	err = fund(s, wallets, 1)
+	if err != nil {
+		return err
+	}
+
+	err = s.Start()
+	if err != nil {
+		return err
+	}
+
+	nodes := append(append([]*Node{}, miners...), stakeholders...)
+	start := nodes[0].Height()
+
+	before := make(map[string]int)
+	for _, node := range stakeholders {
+		before[node.Address] = node.Balance(node.Address)
+	}
+
+	receiver := stakeholders[0].Address
+	for i := 0; i < 3; i++ {
+		err = mine(s, wallets[0], receiver, 1, nodes)
+		if err != nil {
+			return err
+		}
+	}
+
+	// a block filled with a transaction returned to mem pool may be still spreading
+	err = s.WaitFor("nodes to agree on balances", blockTimeout, func() bool {
+		if !Converged(0, nodes...) {
+			return false
+		}
+
+		for _, node := range stakeholders {
+			for _, other := range nodes {
+				if other.Balance(node.Address) != nodes[0].Balance(node.Address) {
+					return false
+				}
+			}
+		}
+
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	blocks := nodes[0].Height() - start
+	rewards := 0
+	for _, node := range stakeholders {
+		rewards += nodes[0].Balance(node.Address) - before[node.Address]
+	}
+
+	// every block pays subsidy to its stakeholder, the receiver gets the sent coins
+	expected := blocks * s.Params.Subsidy + 3
+	if rewards != expected {
+		return fmt.Errorf("Stakeholders got %d satoshis for %d blocks, expected %d ", rewards, blocks, expected)
+	}
+
+	return nil
+}
+
+// runForks splits the network into two halves which mine their own chains,
+// after healing the shorter chain is reorganized and its transactions are mined again
+func runForks(s *Simulation) error {
+	miners, err := addNodes(s, "miner", RoleMiner, 2)
+	if err != nil {
+		return err
+	}
+	stakeholders, err := addNodes(s, "stakeholder", RoleStakeholder, 4)
+	if err != nil {
+		return err
+	}
+	wallets, err := addNodes(s, "wallet", RoleWallet, 2)
+	if err != nil {
+		return err
+	}
+
+	err = fund(s, stakeholders, 3)
+	if err != nil {
+		return err
+	}
+	err = fund(s, wallets, 2)
+	if err != nil {
+		return err
+	}
+
+	left := []*Node{miners[0], stakeholders[0], stakeholders[1], wallets[0]}
+	right := []*Node{miners[1], stakeholders[2], stakeholders[3], wallets[1]}
+
+	// blocks do not commit to the miner, miners of the halves mining in the same
+	// second would mine the same block. Stakeholders of the half count attempts
+	// of the blocks by their clocks, so the whole half is moved
+	for _, node := range right {
+		err = s.Warp(node, 3600)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = s.Start()
+	if err != nil {
+		return err
+	}
+	leftChain := []*Node{miners[0], stakeholders[0], stakeholders[1]}
+	rightChain := []*Node{miners[1], stakeholders[2], stakeholders[3]}
+
+	// all nodes must know each other before the partition, so they reconnect after it
+	s.Connect(s.Nodes...)
+
+	s.Partition(left, right)
+	s.Connect(left...)
+	s.Connect(right...)
+
+	for i := 0; i < 3; i++ {
+		err = mine(s, wallets[0], stakeholders[0].Address, 1, leftChain)
+		if err != nil {
+			return err
+		}
+	}
+
+	orphaned, err := s.Send(wallets[1], stakeholders[2].Address, 1)
+	if err != nil {
+		return err
+	}
+	err = s.WaitFor("transaction mined by the right half", blockTimeout, func() bool {
+		return Converged(0, rightChain...) && rightChain[0].HasTransaction(orphaned)
+	})
+	if err != nil {
+		return err
+	}
+
+	leftHeight, rightHeight := leftChain[0].Height(), rightChain[0].Height()
+	if leftHeight <= rightHeight {
+		return fmt.Errorf("Left chain with height %d is not longer than right one with %d ", leftHeight, rightHeight)
+	}
+	leftTip := leftChain[0].Tip().Hash
+
+	s.Heal()
+
+	all := append(append([]*Node{}, leftChain...), rightChain...)
+	err = s.WaitFor("nodes to reorganize to the longer chain", blockTimeout, func() bool {
+		for _, node := range all {
+			if !node.HasBlock(leftTip) {
+				return false
+			}
+		}
+
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	// the transaction of the orphaned block returns to mem pools and is mined again
+	err = waitMined(s, orphaned, all)
+	if err != nil {
+		return err
+	}
+
+	return settle(s, wallets[0], all)
+}
+
+// runSPV checks that the light node gets its balance from transactions
+// matching its filter without downloading bodies of blocks
+func runSPV(s *Simulation) error {
+	miners, err := addNodes(s, "miner", RoleMiner, 1)
+	if err != nil {
+		return err
+	}
+	stakeholders, err := addNodes(s, "stakeholder", RoleStakeholder, 2)
+	if err != nil {
+		return err
+	}
+	wallets, err := addNodes(s, "wallet", RoleWallet, 1)
+	if err != nil {
+		return err
+	}
+	lights, err := addNodes(s, "light", RoleLight, 1)
+	if err != nil {
+		return err
+	}
+
+	err = fund(s, stakeholders, 3)
+	if err != nil {
+		return err
+	}
+	// light nodes trust the merkle root of the block when the next block commits to it,
+	// so the block funding the light node is not the tip
+	err = fund(s, append(lights, wallets...), 1)
+	if err != nil {
+		return err
+	}
+
+	err = s.Start()
+	if err != nil {
+		return err
+	}
+
+	nodes := append(append([]*Node{}, miners...), stakeholders...)
+	light := lights[0]
+
+	// the light node has the balance of the full nodes when it has their headers
+	synced := func() bool {
+		height, err := light.Bc.GetHeaderHeight()
+		if err != nil || height != stakeholders[0].Height() {
+			return false
+		}
+
+		return light.Balance(light.Address) == stakeholders[0].Balance(light.Address)
+	}
+
+	err = s.WaitFor("light node to get its funds", blockTimeout, synced)
+	if err != nil {
+		return err
+	}
+	if light.Balance(light.Address) == 0 {
+		return errors.New("Light node has no funds ")
+	}
+
+	err = mine(s, wallets[0], light.Address, 1, nodes)
+	if err != nil {
+		return err
+	}
+	err = mine(s, wallets[0], stakeholders[0].Address, 1, nodes)
+	if err != nil {
+		return err
+	}
+
+	err = s.WaitFor("light node to get the sent coins", blockTimeout, synced)
+	if err != nil {
+		return err
+	}
+
+	if light.Bc.HasBlock(stakeholders[0].Tip().Hash) {
+		return errors.New("Light node has downloaded the full block ")
+	}
+
+	return checkForgedRoot(light, stakeholders[0])
+}
+
+// checkForgedRoot checks that the light node rejects transactions proven by the forged
+// merkle root in the header of the block instead of the root committed by the next block
+func checkForgedRoot(light, full *Node) error {
+	tip := full.Tip()
+	parent, err := full.Bc.GetBlock(tip.PrevBlockHash)
+	if err != nil {
+		return err
+	}
+
+	balance := light.Balance(light.Address)
+	forged := bcpkg.NewCoinbaseTX(light.Address, light.Address, "forged", 0, 1000)
+	tree := bcpkg.NewPartialMerkleTree([][]byte{forged.ID}, []bool{true})
+
+	for _, block := range []bcpkg.Block{parent.Block, tip.Block} {
+		header := block
+		header.MerkleRoot = bcpkg.MerkleRoot([][]byte{forged.ID})
+
+		err = light.Bc.AddFilteredBlock(&header, tree, []*bcpkg.Transaction{forged})
+		if err == nil {
+			return fmt.Errorf("Light node accepted forged merkle root of block %x ", header.Hash)
+		}
+	}
+
+	// the root of the parent is committed by the tip, so the proof is invalid
+	err = light.Bc.AddFilteredBlock(&parent.Block, tree, []*bcpkg.Transaction{forged})
+	if _, ok := err.(*bcpkg.InvalidBlockError); !ok {
+		return fmt.Errorf("Forged proof of block %x is not invalid: %v ", parent.Hash, err)
+	}
+
+	if light.Balance(light.Address) != balance {
+		return errors.New("Forged transaction changed balance of the light node ")
+	}
+
+	return nil
+}
+
+// runPresence checks that the miner knows online stakeholders and their stake, blocks
+// are mined although most satoshis are owned by the wallet which does not run a node
+func runPresence(s *Simulation) error {
+	miners, err := addNodes(s, "miner", RoleMiner, 1)
+	if err != nil {
+		return err
+	}
+	stakeholders, err := addNodes(s, "stakeholder", RoleStakeholder, 3)
+	if err != nil {
+		return err
+	}
+	wallets, err := addNodes(s, "wallet", RoleWallet, 1)
+	if err != nil {
+		return err
+	}
+
+	err = fund(s, stakeholders, 1)
+	if err != nil {
+		return err
+	}
+	err = fund(s, wallets, 6)
+	if err != nil {
+		return err
+	}
+
+	err = s.Start()
+	if err != nil {
+		return err
+	}
+
+	miner := miners[0]
+
+	err = s.WaitFor("miner to learn online stakeholders", blockTimeout, func() bool {
+		stakes, _, err := miner.Network.OnlineStake()
+		return err == nil && len(stakes) == len(stakeholders)
+	})
+	if err != nil {
+		return err
+	}
+
+	stakes, total, err := miner.Network.OnlineStake()
+	if err != nil {
+		return err
+	}
+	for _, stake := range stakes {
+		if stake.Stake == 0 {
+			return fmt.Errorf("Stakeholder at %s has no stake ", stake.NetAddr)
+		}
+		total -= stake.Stake
+	}
+	if total < wallets[0].Balance(wallets[0].Address) {
+		return fmt.Errorf("Offline stake is %d, the wallet owns %d ", total, wallets[0].Balance(wallets[0].Address))
+	}
+
+	nodes := append(append([]*Node{}, miners...), stakeholders...)
+
+	return mine(s, wallets[0], stakeholders[0].Address, 1, nodes)
+}
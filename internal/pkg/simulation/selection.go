@@ -0,0 +1,146 @@
+package simulation
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	bcpkg "github.com/keithzetterstrom/BibCoin/internal/pkg/blockchain"
+	"github.com/keithzetterstrom/BibCoin/tools/base58"
+	"time"
+)
+
+// runSelection checks that blocks mined on the same parent with different nonces
+// choose the same stakeholders and attempts of blocks are limited
+func runSelection(s *Simulation) error {
+	miners, err := addNodes(s, "miner", RoleMiner, 1)
+	if err != nil {
+		return err
+	}
+	stakeholders, err := addNodes(s, "stakeholder", RoleStakeholder, 2)
+	if err != nil {
+		return err
+	}
+	wallets, err := addNodes(s, "wallet", RoleWallet, 1)
+	if err != nil {
+		return err
+	}
+
+	err = fund(s, append(stakeholders, wallets...), 2)
+	if err != nil {
+		return err
+	}
+
+	err = s.Start()
+	if err != nil {
+		return err
+	}
+
+	nodes := append(append([]*Node{}, miners...), stakeholders...)
+
+	err = mine(s, wallets[0], stakeholders[0].Address, 1, nodes)
+	if err != nil {
+		return err
+	}
+
+	node := stakeholders[0]
+	tip := node.Tip()
+	if len(tip.VRFProof) == 0 {
+		return errors.New("Staked block has no VRF proof ")
+	}
+
+	// the miner grinding nonces on the tip gets the same stakeholders
+	first := bcpkg.NewBlock(tip.Hash, tip.MerkleRoot, tip.Height + 1, miners[0].Address, s.Params.TargetBits, tip.Timestamp + 1)
+	second := bcpkg.NewBlock(tip.Hash, tip.MerkleRoot, tip.Height + 1, miners[0].Address, s.Params.TargetBits, tip.Timestamp + 2)
+	if bytes.Equal(first.Hash, second.Hash) {
+		return errors.New("Blocks with different timestamps have the same hash ")
+	}
+
+	for attempt := 0; attempt < 2; attempt++ {
+		a, err := node.Bc.StakeholderIndex(first, attempt)
+		if err != nil {
+			return err
+		}
+		b, err := node.Bc.StakeholderIndex(second, attempt)
+		if err != nil {
+			return err
+		}
+
+		if a != b {
+			return fmt.Errorf("Blocks on the same parent choose satoshis %d and %d in attempt %d ", a, b, attempt)
+		}
+	}
+
+	return checkAttempts(s, node, first)
+}
+
+// checkAttempts checks that the block mined right after its parent has MaxStakeAttempts attempts,
+// one more is allowed for every StakeTimeout passed by the clock of the node, the block stamped
+// ahead of the clock does not get more, the block stamped not after its parent is rejected
+// and attempts choose only owned satoshis
+func checkAttempts(s *Simulation, node *Node, block *bcpkg.Block) error {
+	attempts, err := node.Bc.StakeAttempts(block)
+	if err != nil {
+		return err
+	}
+	if attempts != s.Params.MaxStakeAttempts {
+		return fmt.Errorf("Block mined right after its parent has %d attempts instead of %d ", attempts, s.Params.MaxStakeAttempts)
+	}
+
+	pubKeyHash := base58.HashPubKey(node.Wallet.PublicKey)
+	if _, ok := node.Bc.CheckStakeholder(block, attempts, pubKeyHash).(*bcpkg.InvalidBlockError); !ok {
+		return fmt.Errorf("Attempt %d over the limit is accepted ", attempts)
+	}
+
+	parent := node.Tip()
+	timeout := int64(s.Params.StakeTimeout / time.Second)
+
+	stale := bcpkg.NewBlock(parent.Hash, parent.MerkleRoot, parent.Height + 1, block.MinerAddress, s.Params.TargetBits, parent.Timestamp)
+	if _, ok := node.Bc.AddHeaders([]bcpkg.Block{*stale}).(*bcpkg.InvalidBlockError); !ok {
+		return errors.New("Block stamped not after its parent is accepted ")
+	}
+
+	ahead := bcpkg.NewBlock(parent.Hash, parent.MerkleRoot, parent.Height + 1, block.MinerAddress, s.Params.TargetBits,
+		node.Bc.Now().Unix() + 10 * timeout)
+	aheadAttempts, err := node.Bc.StakeAttempts(ahead)
+	if err != nil {
+		return err
+	}
+	elapsed := node.Bc.Now().Unix() - parent.Timestamp
+	if elapsed < 0 {
+		elapsed = 0
+	}
+	if byClock := s.Params.MaxStakeAttempts + int(elapsed / timeout); aheadAttempts > byClock {
+		return fmt.Errorf("Block stamped ahead of the clock has %d attempts, the clock allows %d ", aheadAttempts, byClock)
+	}
+
+	later := bcpkg.NewBlock(parent.Hash, parent.MerkleRoot, parent.Height + 1, block.MinerAddress, s.Params.TargetBits,
+		block.Timestamp + timeout)
+	err = s.WaitClock(node, later.Timestamp)
+	if err != nil {
+		return err
+	}
+	more, err := node.Bc.StakeAttempts(later)
+	if err != nil {
+		return err
+	}
+	if more != attempts + 1 {
+		return fmt.Errorf("Block mined a stake timeout later has %d attempts instead of %d ", more, attempts + 1)
+	}
+
+	lastIndex, err := node.Bc.GetLastSatoshiIndex()
+	if err != nil {
+		return err
+	}
+
+	for attempt := 0; attempt < more; attempt++ {
+		index, err := node.Bc.StakeholderIndex(later, attempt)
+		if err != nil {
+			return err
+		}
+		if index < 1 || index >= lastIndex || node.Bc.FindSatoshiOwner(index) == nil {
+			return fmt.Errorf("Attempt %d chooses satoshi %d which is not owned ", attempt, index)
+		}
+	}
+
+	return nil
+}
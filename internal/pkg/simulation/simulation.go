@@ -0,0 +1,500 @@
+package simulation
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	bcpkg "github.com/keithzetterstrom/BibCoin/internal/pkg/blockchain"
+	networkpkg "github.com/keithzetterstrom/BibCoin/internal/pkg/network"
+	walletpkg "github.com/keithzetterstrom/BibCoin/internal/pkg/wallet"
+	"github.com/keithzetterstrom/BibCoin/tools/base58"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// stopTimeout limits waiting for servers of nodes to stop
+const stopTimeout = time.Second * 10
+
+// pollInterval is how often conditions of WaitFor are checked
+const pollInterval = time.Millisecond * 50
+
+// Role is what the node does in the simulation
+type Role int
+
+const (
+	// RoleMiner mines empty blocks and sends them to stakeholders
+	RoleMiner Role = iota
+	// RoleStakeholder fills blocks with transactions when it owns the chosen satoshi
+	RoleStakeholder
+	// RoleWallet synchronizes its chain and sends transactions
+	RoleWallet
+	// RoleLight keeps only headers and transactions of its wallet downloaded from stakeholders
+	RoleLight
+)
+
+// String returns name of the role
+func (r Role) String() string {
+	switch r {
+	case RoleMiner:
+		return "miner"
+	case RoleStakeholder:
+		return "stakeholder"
+	case RoleWallet:
+		return "wallet"
+	case RoleLight:
+		return "light"
+	}
+
+	return "unknown"
+}
+
+// Node is the node of the simulation with its chain, network and wallet
+type Node struct {
+	Name    string
+	Role    Role
+	Addr    string
+	Address string
+	Bc      *bcpkg.Blockchain
+	Network *networkpkg.Network
+	Wallet  *walletpkg.Wallet
+	// done is closed when the server of the node stops
+	done chan struct{}
+}
+
+// Simulation runs nodes of the regtest network connected by MemNetwork in one process.
+// Chains of the nodes are kept in a temporary directory removed by Close.
+// Blocks and clocks are set up while nodes are stopped, then nodes are started and
+// stakeholders are chosen by satoshis they own as in the main network
+type Simulation struct {
+	Net    *networkpkg.MemNetwork
+	Params *bcpkg.ChainParams
+	Nodes  []*Node
+	dir    string
+	// funder is the chain blocks are generated on before the start,
+	// they are copied to chains of all nodes
+	funder  *bcpkg.Blockchain
+	started bool
+}
+
+// New returns Simulation without nodes, seed makes the network reproducible
+func New(seed int64) (*Simulation, error) {
+	dir, err := ioutil.TempDir("", "bibcoin-simulation")
+	if err != nil {
+		return nil, err
+	}
+
+	params := bcpkg.RegTestParams
+	params.Seeders = nil
+	params.SeedNodes = nil
+
+	s := &Simulation{
+		Net: networkpkg.NewMemNetwork(seed),
+		Params: &params,
+		dir: dir,
+	}
+
+	s.funder, err = s.createChain("funder")
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// createChain creates chain with genesis block in the directory of the simulation
+func (s *Simulation) createChain(name string) (*bcpkg.Blockchain, error) {
+	dir := filepath.Join(s.dir, name)
+
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	bc := bcpkg.CreateEmptyBlockchain(
+		filepath.Join(dir, "blockchain.db"),
+		filepath.Join(dir, "addr.json"),
+		filepath.Join(dir, "wallet.dat"),
+		s.Params,
+	)
+	bc.AddGenesisBlock()
+
+	return bc, nil
+}
+
+// AddNode adds stopped node with the role, every node gets its own host
+func (s *Simulation) AddNode(name string, role Role) (*Node, error) {
+	if s.started {
+		return nil, errors.New("Nodes can be added only before the start ")
+	}
+
+	bc, err := s.createChain(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if role == RoleLight {
+		err = bc.EnableLightMode()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	host := "10.0.0." + strconv.Itoa(len(s.Nodes) + 1)
+	wallet := walletpkg.NewWallet()
+
+	node := &Node{
+		Name: name,
+		Role: role,
+		Addr: net.JoinHostPort(host, s.Params.DefaultPort),
+		Address: string(wallet.GetAddress(s.Params.AddressVersion)),
+		Bc: bc,
+		Wallet: wallet,
+		done: make(chan struct{}),
+	}
+	node.Network = networkpkg.NewNetwork(bc, node.Addr, node.Address)
+	node.Network.Wallet = wallet
+	node.Network.Transport = s.Net.Transport(node.Addr)
+
+	s.Nodes = append(s.Nodes, node)
+
+	return node, nil
+}
+
+// Fund generates blocks paying to the node before the start,
+// the node owns their satoshis and may be chosen to stake
+func (s *Simulation) Fund(node *Node, blocks int) error {
+	if s.started {
+		return errors.New("Nodes can be funded only before the start ")
+	}
+
+	_, err := s.funder.GenerateBlocks(blocks, node.Wallet, nil)
+
+	return err
+}
+
+// Warp moves the clock of the node forward before the start, miners
+// with different clocks mine different blocks on the same parent
+func (s *Simulation) Warp(node *Node, seconds int64) error {
+	if s.started {
+		return errors.New("Clocks can be moved only before the start ")
+	}
+
+	return node.Bc.WarpTime(seconds)
+}
+
+// Start copies generated blocks to all nodes except light ones and starts stakeholders,
+// miners and light nodes, every node knows all stakeholders
+func (s *Simulation) Start() error {
+	if s.started {
+		return errors.New("Simulation is already started ")
+	}
+
+	blocks, err := chainBlocks(s.funder)
+	if err != nil {
+		return err
+	}
+
+	var stakeholders []string
+	for _, node := range s.Nodes {
+		// light nodes download transactions of their wallets after the start
+		if node.Role == RoleLight {
+			continue
+		}
+
+		for _, block := range blocks {
+			err = node.Bc.AddBlock(block)
+			if err != nil {
+				return fmt.Errorf("Failed to copy block to %s: %s ", node.Name, err)
+			}
+		}
+
+		if node.Role == RoleStakeholder {
+			stakeholders = append(stakeholders, node.Addr)
+		}
+	}
+	if len(stakeholders) == 0 {
+		return errors.New("Simulation has no stakeholders ")
+	}
+
+	s.Params.SeedNodes = stakeholders[:1]
+	s.Params.SelfStaking = false
+	s.started = true
+
+	for _, node := range s.Nodes {
+		for _, addr := range stakeholders {
+			if addr != node.Addr {
+				node.Network.KnownNodes = append(node.Network.KnownNodes, addr)
+			}
+		}
+	}
+
+	// miners, light nodes and wallets connect to stakeholders, so stakeholders start first
+	for _, role := range []Role{RoleStakeholder, RoleMiner, RoleLight} {
+		var started []*Node
+
+		for _, node := range s.Nodes {
+			if node.Role != role {
+				continue
+			}
+
+			go func(node *Node) {
+				defer close(node.done)
+
+				switch node.Role {
+				case RoleMiner:
+					node.Network.StartMineServer()
+				case RoleLight:
+					node.Network.StartLightServer()
+				default:
+					node.Network.StartFullServer()
+				}
+			}(node)
+			started = append(started, node)
+		}
+
+		err = s.WaitFor(role.String() + "s to listen", stopTimeout, func() bool {
+			for _, node := range started {
+				if !s.Net.Listening(node.Addr) {
+					return false
+				}
+			}
+
+			return true
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// chainBlocks returns blocks of the chain after genesis starting from the oldest one
+func chainBlocks(bc *bcpkg.Blockchain) ([]*bcpkg.ExtensionBlock, error) {
+	var blocks []*bcpkg.ExtensionBlock
+
+	it := bc.NewIterator()
+	for {
+		block := it.Next()
+		if block == nil {
+			return nil, errors.New("Chain has pruned blocks ")
+		}
+		if len(block.PrevBlockHash) == 0 {
+			break
+		}
+
+		blocks = append([]*bcpkg.ExtensionBlock{block}, blocks...)
+	}
+
+	return blocks, nil
+}
+
+// Close stops all nodes and removes their chains
+func (s *Simulation) Close() {
+	for _, node := range s.Nodes {
+		node.Network.Stop()
+	}
+
+	for _, node := range s.Nodes {
+		if s.started && node.Role != RoleWallet {
+			select {
+			case <-node.done:
+			case <-time.After(stopTimeout):
+			}
+		} else {
+			node.Network.Close()
+		}
+
+		node.Bc.Db.Close()
+	}
+
+	s.funder.Db.Close()
+	os.RemoveAll(s.dir)
+}
+
+// Connect connects every pair of the nodes, it is used to restore
+// connections broken by partitions. Wallets are skipped, they connect
+// only while sending as the command line wallet does
+func (s *Simulation) Connect(nodes ...*Node) {
+	for _, a := range nodes {
+		for _, b := range nodes {
+			if a != b && a.Role != RoleWallet && b.Role != RoleWallet {
+				_ = a.Network.Connect(b.Addr)
+			}
+		}
+	}
+}
+
+// Partition splits nodes into groups which can not reach each other
+func (s *Simulation) Partition(groups ...[]*Node) {
+	var addrs [][]string
+
+	for _, group := range groups {
+		var addrGroup []string
+		for _, node := range group {
+			addrGroup = append(addrGroup, node.Addr)
+		}
+		addrs = append(addrs, addrGroup)
+	}
+
+	s.Net.Partition(addrs...)
+}
+
+// Heal removes partitions and connects all nodes again
+func (s *Simulation) Heal() {
+	s.Net.Heal()
+	s.Connect(s.Nodes...)
+}
+
+// Send synchronizes the chain of the wallet node and sends coins to the address
+// through the network, it returns id of the transaction
+func (s *Simulation) Send(from *Node, to string, amount int) ([]byte, error) {
+	from.Network.StartServer()
+
+	pubKeyHash := base58.HashPubKey(from.Wallet.PublicKey)
+	acc, outputs := from.Bc.FindSpendableOutputs(pubKeyHash, amount)
+	if len(acc) < amount {
+		return nil, fmt.Errorf("%s has not enough funds ", from.Name)
+	}
+
+	var inputs []bcpkg.TXInput
+	for rawTxID, outs := range outputs {
+		txID, err := hex.DecodeString(rawTxID)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, out := range outs {
+			inputs = append(inputs, bcpkg.TXInput{OutTxID: txID, OutIndex: out, PubKey: from.Wallet.PublicKey})
+		}
+	}
+
+	outs := []bcpkg.TXOutput{*bcpkg.NewTXOutput(acc[:amount], to)}
+	if len(acc) > amount {
+		outs = append(outs, *bcpkg.NewTXOutput(acc[amount:], from.Address))
+	}
+
+	tx := bcpkg.Transaction{Vin: inputs, Vout: outs}
+	tx.ID = tx.Hash()
+	from.Bc.SignTransaction(&tx, from.Wallet.PrivateKey)
+
+	// the wallet disconnects after sending as the command line wallet does,
+	// so the next synchronization makes handshakes again
+	err := from.Network.BroadcastTx(&tx)
+	from.Network.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return tx.ID, nil
+}
+
+// WaitFor waits until the condition is true, the description of the condition
+// is returned in the error when the timeout expires
+func (s *Simulation) WaitFor(description string, timeout time.Duration, condition func() bool) error {
+	deadline := time.Now().Add(timeout)
+
+	for !condition() {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("Timed out waiting for %s ", description)
+		}
+
+		time.Sleep(pollInterval)
+	}
+
+	return nil
+}
+
+// WaitClock waits until the clock of the node reaches the unix time, attempts
+// of blocks stamped ahead of the clock are not allowed before their time
+func (s *Simulation) WaitClock(node *Node, timestamp int64) error {
+	timeout := time.Duration(timestamp - node.Bc.Now().Unix()) * time.Second + time.Second * 5
+
+	return s.WaitFor(fmt.Sprintf("clock of %s to reach %d", node.Name, timestamp), timeout, func() bool {
+		return node.Bc.Now().Unix() >= timestamp
+	})
+}
+
+// Tip returns the last block of the chain of the node
+func (n *Node) Tip() *bcpkg.ExtensionBlock {
+	return n.Bc.NewIterator().Next()
+}
+
+// Height returns height of the chain of the node
+func (n *Node) Height() int {
+	height, err := n.Bc.GetBestHeight()
+	if err != nil {
+		return -1
+	}
+
+	return height
+}
+
+// Balance returns the number of satoshis of the address in the chain of the node,
+// light node counts only transactions downloaded by its filter
+func (n *Node) Balance(address string) int {
+	pubKeyHash := base58.DecodeBase58([]byte(address))
+	pubKeyHash = pubKeyHash[1 : len(pubKeyHash) - 4]
+
+	outputs := n.Bc.FindUnspentTxOutputs(pubKeyHash)
+	if n.Bc.IsLight() {
+		outputs = n.Bc.FindFilteredUnspentOutputs(pubKeyHash)
+	}
+
+	balance := 0
+	for _, out := range outputs {
+		balance += len(out.Value)
+	}
+
+	return balance
+}
+
+// HasBlock returns true if the block is in the chain of the node, blocks
+// of side branches are not counted
+func (n *Node) HasBlock(hash []byte) bool {
+	it := n.Bc.NewIterator()
+	for {
+		block := it.Next()
+		if block == nil {
+			return false
+		}
+		if bytes.Equal(block.Hash, hash) {
+			return true
+		}
+		if len(block.PrevBlockHash) == 0 {
+			return false
+		}
+	}
+}
+
+// HasTransaction returns true if the transaction is in the chain of the node
+func (n *Node) HasTransaction(txID []byte) bool {
+	_, err := n.Bc.FindTransaction(txID)
+
+	return err == nil
+}
+
+// Converged returns true if the nodes have the same tip at the height or above
+func Converged(height int, nodes ...*Node) bool {
+	var tip []byte
+
+	for _, node := range nodes {
+		block := node.Tip()
+		if block == nil || block.Height < height {
+			return false
+		}
+
+		if tip != nil && !bytes.Equal(tip, block.Hash) {
+			return false
+		}
+		tip = block.Hash
+	}
+
+	return true
+}
@@ -0,0 +1,208 @@
+package simulation
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	bcpkg "github.com/keithzetterstrom/BibCoin/internal/pkg/blockchain"
+	mempoolpkg "github.com/keithzetterstrom/BibCoin/internal/pkg/mempool"
+	"github.com/keithzetterstrom/BibCoin/tools/base58"
+	"time"
+)
+
+// signSibling returns the extension of the block mined on the parent of the tip
+// signed by the stakeholder, the timestamp makes blocks of the same parent different
+func signSibling(s *Simulation, stakeholder, miner *Node, tip *bcpkg.ExtensionBlock, timestamp int64) (*bcpkg.ExtensionBlock, error) {
+	parent, err := stakeholder.Bc.GetBlock(tip.PrevBlockHash)
+	if err != nil {
+		return nil, err
+	}
+
+	block := bcpkg.NewBlock(tip.PrevBlockHash, parent.MerkleRoot, tip.Height, miner.Address, s.Params.TargetBits, timestamp)
+
+	lastIndex, err := stakeholder.Bc.GetLastSatoshiIndex()
+	if err != nil {
+		return nil, err
+	}
+
+	cbTx := bcpkg.NewCoinbaseTX(miner.Address, stakeholder.Address, "", lastIndex, s.Params.Subsidy)
+
+	// evidence does not depend on the satoshi the stakeholder is chosen by
+	extension := bcpkg.NewExtensionBlock([]*bcpkg.Transaction{cbTx}, block)
+	extension.Sign(stakeholder.Wallet.PrivateKey, stakeholder.Wallet.PublicKey)
+
+	return extension, nil
+}
+
+// runSlashing checks that the stakeholder which signs two blocks at the same height
+// is reported by the node receiving them, evidence is mined and stake of the offender is burned
+func runSlashing(s *Simulation) error {
+	miners, err := addNodes(s, "miner", RoleMiner, 1)
+	if err != nil {
+		return err
+	}
+	stakeholders, err := addNodes(s, "stakeholder", RoleStakeholder, 3)
+	if err != nil {
+		return err
+	}
+	wallets, err := addNodes(s, "wallet", RoleWallet, 1)
+	if err != nil {
+		return err
+	}
+
+	err = fund(s, append(stakeholders, wallets...), 2)
+	if err != nil {
+		return err
+	}
+
+	err = s.Start()
+	if err != nil {
+		return err
+	}
+
+	nodes := append(append([]*Node{}, miners...), stakeholders...)
+
+	err = mine(s, wallets[0], stakeholders[0].Address, 1, nodes)
+	if err != nil {
+		return err
+	}
+
+	// the offender does not stake the tip, otherwise each sibling conflicts with the tip too
+	tip := stakeholders[0].Tip()
+	var honest, offender *Node
+	for _, node := range stakeholders {
+		if offender == nil && !bytes.Equal(tip.StakeholderHash, base58.HashPubKey(node.Wallet.PublicKey)) {
+			offender = node
+		} else if honest == nil {
+			honest = node
+		}
+	}
+
+	first, err := signSibling(s, offender, miners[0], tip, tip.Timestamp + 1)
+	if err != nil {
+		return err
+	}
+	second, err := signSibling(s, offender, miners[0], tip, tip.Timestamp + 2)
+	if err != nil {
+		return err
+	}
+
+	// evidence which does not prove double signing is rejected
+	invalid := []*bcpkg.DoubleSign{bcpkg.NewDoubleSign(first, first), bcpkg.NewDoubleSign(first, second)}
+	invalid[1].Second.Height++
+	for _, evidence := range invalid {
+		err = honest.Network.MemPool.Add(*bcpkg.NewEvidenceTX(evidence))
+		if _, ok := err.(*mempoolpkg.InvalidTxError); !ok {
+			return fmt.Errorf("Invalid evidence is not rejected: %v ", err)
+		}
+	}
+
+	evidenceID := bcpkg.NewEvidenceTX(bcpkg.NewDoubleSign(first, second)).ID
+
+	offender.Network.SendBlock(honest.Addr, first)
+	offender.Network.SendBlock(honest.Addr, second)
+
+	err = s.WaitFor("evidence in mem pools of all nodes", blockTimeout, func() bool {
+		for _, node := range nodes {
+			if !node.Network.MemPool.Has(evidenceID) {
+				return false
+			}
+		}
+
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	err = mine(s, wallets[0], honest.Address, 1, nodes)
+	if err != nil {
+		return err
+	}
+
+	err = waitMined(s, evidenceID, nodes)
+	if err != nil {
+		return err
+	}
+
+	for _, node := range nodes {
+		if balance := node.Balance(offender.Address); balance != 0 {
+			return fmt.Errorf("Offender keeps %d satoshis in chain of %s ", balance, node.Name)
+		}
+		if node.Balance(honest.Address) == 0 {
+			return fmt.Errorf("Honest stakeholder has no stake in chain of %s ", node.Name)
+		}
+	}
+
+	// evidence against the slashed stakeholder is not accepted again
+	err = honest.Network.MemPool.Add(*bcpkg.NewEvidenceTX(bcpkg.NewDoubleSign(first, second)))
+	if err == nil {
+		return errors.New("Evidence against the slashed stakeholder is accepted again ")
+	}
+
+	return checkReplayedEvidence(s, honest, offender, miners[0], wallets[0], append(stakeholders, wallets...), bcpkg.NewDoubleSign(first, second))
+}
+
+// stakeBlock returns the block mined on the tip of the node with the transactions,
+// it is signed by the node staking the satoshi of the first attempt staked by one of the nodes
+func stakeBlock(s *Simulation, node, miner *Node, signers []*Node, transactions []*bcpkg.Transaction) (*bcpkg.ExtensionBlock, error) {
+	tip := node.Tip()
+	probe := bcpkg.NewBlock(tip.Hash, tip.MerkleRoot, tip.Height + 1, miner.Address, s.Params.TargetBits, tip.Timestamp + 1)
+
+	for attempt := 0; attempt < delegatedBlocks * 10; attempt++ {
+		index, err := node.Bc.StakeholderIndex(probe, attempt)
+		if err != nil {
+			return nil, err
+		}
+		_, staker := node.Bc.FindSatoshiStaker(index)
+
+		for _, signer := range signers {
+			if !bytes.Equal(staker, base58.HashPubKey(signer.Wallet.PublicKey)) {
+				continue
+			}
+
+			// the attempt is allowed by the time passed since the tip
+			elapsed := 1 + int64(attempt) * int64(s.Params.StakeTimeout / time.Second)
+			block := bcpkg.NewBlock(tip.Hash, tip.MerkleRoot, tip.Height + 1, miner.Address, s.Params.TargetBits, tip.Timestamp + elapsed)
+			err = s.WaitClock(node, block.Timestamp)
+			if err != nil {
+				return nil, err
+			}
+
+			extension, err := signStake(s, signer, block, attempt, signer.Address)
+			if err != nil {
+				return nil, err
+			}
+			extension = bcpkg.NewExtensionBlock(append(extension.Transactions, transactions...), block)
+			extension.Attempt = attempt
+			extension.Sign(signer.Wallet.PrivateKey, signer.Wallet.PublicKey)
+
+			return extension, nil
+		}
+	}
+
+	return nil, errors.New("Satoshis of signers are not chosen in any attempt ")
+}
+
+// checkReplayedEvidence checks that the block replaying evidence of slashed double signing
+// is rejected and does not burn outputs the offender got after slashing
+func checkReplayedEvidence(s *Simulation, honest, offender, miner, wallet *Node, signers []*Node, evidence *bcpkg.DoubleSign) error {
+	err := mine(s, wallet, offender.Address, 1, []*Node{miner, honest, offender})
+	if err != nil {
+		return err
+	}
+
+	replay, err := stakeBlock(s, honest, miner, signers, []*bcpkg.Transaction{bcpkg.NewEvidenceTX(evidence)})
+	if err != nil {
+		return err
+	}
+
+	if _, ok := honest.Bc.AddBlock(replay).(*bcpkg.InvalidBlockError); !ok {
+		return errors.New("Block replaying processed evidence is not rejected ")
+	}
+	if honest.HasBlock(replay.Hash) || honest.Balance(offender.Address) == 0 {
+		return errors.New("Replayed evidence burned outputs of the offender ")
+	}
+
+	return nil
+}
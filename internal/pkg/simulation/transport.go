@@ -0,0 +1,146 @@
+package simulation
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	networkpkg "github.com/keithzetterstrom/BibCoin/internal/pkg/network"
+	"time"
+)
+
+// connectTimeout limits waiting for the handshake of connected nodes
+const connectTimeout = time.Second * 10
+
+// findPeer returns what the node knows about the connected peer with the address,
+// the peer is returned only after it has sent its version
+func findPeer(node *Node, addr string) (networkpkg.PeerInfo, bool) {
+	for _, info := range node.Network.PeerInfo() {
+		if (info.Addr == addr || info.ListenAddr == addr) && info.Version != 0 {
+			return info, true
+		}
+	}
+
+	return networkpkg.PeerInfo{}, false
+}
+
+// waitPeer waits until the node has the handshake with the peer encrypted or not as expected
+func waitPeer(s *Simulation, node, peer *Node, encrypted bool) error {
+	err := s.WaitFor(fmt.Sprintf("%s to connect to %s", peer.Name, node.Name), connectTimeout, func() bool {
+		_, ok := findPeer(node, peer.Addr)
+		return ok
+	})
+	if err != nil {
+		return err
+	}
+
+	info, _ := findPeer(node, peer.Addr)
+	if info.Encrypted != encrypted {
+		return fmt.Errorf("Connection of %s to %s is encrypted %t, expected %t ", peer.Name, node.Name, info.Encrypted, encrypted)
+	}
+
+	return nil
+}
+
+// runTransport checks that encrypted and plaintext nodes talk to each other,
+// and connections to nodes with pinned keys are encrypted and authenticated by them
+func runTransport(s *Simulation) error {
+	stakeholders, err := addNodes(s, "stakeholder", RoleStakeholder, 2)
+	if err != nil {
+		return err
+	}
+	wallets, err := addNodes(s, "wallet", RoleWallet, 3)
+	if err != nil {
+		return err
+	}
+
+	err = s.Start()
+	if err != nil {
+		return err
+	}
+
+	node := stakeholders[0]
+
+	// encrypted nodes
+	err = stakeholders[1].Network.Connect(node.Addr)
+	if err != nil {
+		return err
+	}
+	err = waitPeer(s, node, stakeholders[1], true)
+	if err != nil {
+		return err
+	}
+
+	// the plaintext node connects to the encrypted one
+	plain := wallets[0]
+	plain.Network.Plaintext = true
+
+	err = plain.Network.Connect(node.Addr)
+	if err != nil {
+		return err
+	}
+	err = waitPeer(s, node, plain, false)
+	if err != nil {
+		return err
+	}
+
+	// the node with the wrong pinned key is refused, the right key encrypts
+	// the connection although the node is configured to use plaintext
+	pinning := wallets[1]
+	pinning.Network.Plaintext = true
+
+	err = pinning.Network.PinnedKeys.Pin(node.Addr, hex.EncodeToString(stakeholders[1].Network.PublicKey()))
+	if err != nil {
+		return err
+	}
+	err = pinning.Network.Connect(node.Addr)
+	if err == nil || err.Error() != "Static key of the node does not match the pinned key " {
+		return fmt.Errorf("Node with mismatched pinned key is connected: %v ", err)
+	}
+
+	err = pinning.Network.PinnedKeys.Pin(node.Addr, hex.EncodeToString(node.Network.PublicKey()))
+	if err != nil {
+		return err
+	}
+	err = pinning.Network.Connect(node.Addr)
+	if err != nil {
+		return err
+	}
+	err = waitPeer(s, node, pinning, true)
+	if err != nil {
+		return err
+	}
+
+	// the node which pinned the key of the plaintext node does not accept it
+	pinned := wallets[2]
+	pinned.Network.Plaintext = true
+
+	err = node.Network.PinnedKeys.Pin(pinned.Addr, hex.EncodeToString(pinned.Network.PublicKey()))
+	if err != nil {
+		return err
+	}
+	err = pinned.Network.Connect(node.Addr)
+	if err != nil {
+		return err
+	}
+	err = s.WaitFor("plaintext node with pinned key to be disconnected", connectTimeout, func() bool {
+		return len(pinned.Network.PeerInfo()) == 0
+	})
+	if err != nil {
+		return err
+	}
+	if _, ok := findPeer(node, pinned.Addr); ok {
+		return errors.New("Plaintext node with pinned key is accepted ")
+	}
+
+	pinned.Network.Plaintext = false
+	err = pinned.Network.Connect(node.Addr)
+	if err != nil {
+		return err
+	}
+	err = waitPeer(s, node, pinned, true)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -10,7 +10,6 @@ import (
 	"github.com/keithzetterstrom/BibCoin/tools/base58"
 )
 
-const version = byte(0x00)
 const addressChecksumLen = 4
 
 type Wallet struct {
@@ -26,10 +25,13 @@ func NewWallet() *Wallet {
 	return &wallet
 }
 
-// GetAddress returns address of the Wallet
-func (w Wallet) GetAddress() []byte {
-	pubKeyHash := base58.HashPubKey(w.PublicKey)
+// GetAddress returns address of the Wallet with the given version byte of the network
+func (w Wallet) GetAddress(version byte) []byte {
+	return AddressFromPubKeyHash(base58.HashPubKey(w.PublicKey), version)
+}
 
+// AddressFromPubKeyHash returns address of the public key hash with the given version byte of the network
+func AddressFromPubKeyHash(pubKeyHash []byte, version byte) []byte {
 	versionedPayload := append([]byte{version}, pubKeyHash...)
 	checksum := checksum(versionedPayload)
 
@@ -53,7 +55,10 @@ func newKeyPair() (ecdsa.PrivateKey, []byte) {
 	if err != nil {
 		log.Panic(err)
 	}
-	pubKey := append(private.PublicKey.X.Bytes(), private.PublicKey.Y.Bytes()...)
+	// coordinates have the same length, so the key can be split in half
+	pubKey := make([]byte, 64)
+	private.PublicKey.X.FillBytes(pubKey[:32])
+	private.PublicKey.Y.FillBytes(pubKey[32:])
 
 	return *private, pubKey
 }
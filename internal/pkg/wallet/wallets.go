@@ -17,15 +17,17 @@ type Wallets struct {
 	Wallets    map[string]*Wallet
 	filePath   string
 	walletPath string
+	version    byte
 }
 
 type Address struct {
 	Address string `json:"address"`
 }
 
-// NewWallets returns wallets from file
-func NewWallets(fileAddr, fileWallet string) (*Wallets, error) {
-	wallets := Wallets{filePath: fileAddr, walletPath: fileWallet}
+// NewWallets returns wallets from file, addresses
+// are created with the given version byte of the network
+func NewWallets(fileAddr, fileWallet string, version byte) (*Wallets, error) {
+	wallets := Wallets{filePath: fileAddr, walletPath: fileWallet, version: version}
 	wallets.Wallets = make(map[string]*Wallet)
 
 	err := wallets.LoadFromFile()
@@ -36,7 +38,7 @@ func NewWallets(fileAddr, fileWallet string) (*Wallets, error) {
 // CreateWallet creates new wallet and returns it's address
 func (ws *Wallets) CreateWallet() string {
 	wallet := NewWallet()
-	address := fmt.Sprintf("%s", wallet.GetAddress())
+	address := fmt.Sprintf("%s", wallet.GetAddress(ws.version))
 
 	addr := Address{Address: address}
 	addrByte, _ := json.Marshal(addr)
@@ -113,14 +115,19 @@ func (ws Wallets) SaveToFile() {
 }
 
 // ValidateAddress returns true if address is valid
-func ValidateAddress(address string) bool {
+// and belongs to the network with the given version byte
+func ValidateAddress(address string, version byte) bool {
 	pubKeyHash := base58.DecodeBase58([]byte(address))
+	if len(pubKeyHash) <= addressChecksumLen {
+		return false
+	}
+
 	actualChecksum := pubKeyHash[len(pubKeyHash) - addressChecksumLen:]
-	version := pubKeyHash[0]
+	actualVersion := pubKeyHash[0]
 	pubKeyHash = pubKeyHash[1 : len(pubKeyHash) - addressChecksumLen]
-	targetChecksum := checksum(append([]byte{version}, pubKeyHash...))
+	targetChecksum := checksum(append([]byte{actualVersion}, pubKeyHash...))
 
-	return bytes.Compare(actualChecksum, targetChecksum) == 0
+	return actualVersion == version && bytes.Compare(actualChecksum, targetChecksum) == 0
 }
 
 func (ws Wallets) PrintWallets() {
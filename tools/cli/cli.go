@@ -14,6 +14,26 @@ type FlagsCLI struct {
 	StartNode       bool
 	StartFullNode   bool
 	StartMiningNode bool
+	Prune           int
+	DumpUTXO        int
+	LoadUTXO        string
+	Network         string
+	Mine            bool
+	Generate        int
+	Warp            int64
+	ListBanned      bool
+	Ban             string
+	BanTime         int64
+	ClearBanned     bool
+	GetMempoolInfo  bool
+	GetRawMempool   bool
+	NodeKey         bool
+	Pin             string
+	ListPinned      bool
+	Plaintext       bool
+	GetPeerInfo     bool
+	GetOnlineStake  bool
+	Delegate        string
 }
 
 func NewFlagCLI() *FlagsCLI {
@@ -29,6 +49,26 @@ func (f *FlagsCLI) FlagsCLI()  {
 	flag.BoolVar(&f.StartNode, "sn", false, "")
 	flag.BoolVar(&f.StartFullNode, "sfn", false, "")
 	flag.BoolVar(&f.StartMiningNode, "smn", false, "")
+	flag.IntVar(&f.Prune, "prune", 0, "")
+	flag.IntVar(&f.DumpUTXO, "dumputxo", 0, "")
+	flag.StringVar(&f.LoadUTXO, "loadutxo", "", "")
+	flag.StringVar(&f.Network, "net", "main", "")
+	flag.BoolVar(&f.Mine, "mine", false, "")
+	flag.IntVar(&f.Generate, "generate", 0, "")
+	flag.Int64Var(&f.Warp, "warp", 0, "")
+	flag.BoolVar(&f.ListBanned, "listbanned", false, "")
+	flag.StringVar(&f.Ban, "ban", "", "")
+	flag.Int64Var(&f.BanTime, "bantime", 86400, "")
+	flag.BoolVar(&f.ClearBanned, "clearbanned", false, "")
+	flag.BoolVar(&f.GetMempoolInfo, "getmempoolinfo", false, "")
+	flag.BoolVar(&f.GetRawMempool, "getrawmempool", false, "")
+	flag.BoolVar(&f.NodeKey, "nodekey", false, "")
+	flag.StringVar(&f.Pin, "pin", "", "")
+	flag.BoolVar(&f.ListPinned, "listpinned", false, "")
+	flag.BoolVar(&f.Plaintext, "plaintext", false, "")
+	flag.BoolVar(&f.GetPeerInfo, "getpeerinfo", false, "")
+	flag.BoolVar(&f.GetOnlineStake, "getonlinestake", false, "")
+	flag.StringVar(&f.Delegate, "delegate", "", "")
 
 	flag.Parse()
 }
@@ -43,4 +83,23 @@ func (f *FlagsCLI) PrintUsage() {
 	fmt.Println("  -sn: sync node")
 	fmt.Println("  -sfn: start full node")
 	fmt.Println("  -smn: start mining node")
+	fmt.Println("  -prune N: keep only the last N blocks with full data")
+	fmt.Println("  -dumputxo HEIGHT FILE: write UTXO snapshot at the height to file")
+	fmt.Println("  -loadutxo FILE: load UTXO snapshot into empty blockchain")
+	fmt.Println("  -net main|test|regtest: network to work with")
+	fmt.Println("  -mine: with -s, append block with the transaction locally")
+	fmt.Println("  -generate N ADDR: generate N blocks to the address (regtest)")
+	fmt.Println("  -warp SECONDS: move the clock of the node forward (regtest)")
+	fmt.Println("  -listbanned: list banned hosts")
+	fmt.Println("  -ban HOST [-bantime SECONDS]: ban host, for a day by default")
+	fmt.Println("  -clearbanned: remove all bans")
+	fmt.Println("  -getmempoolinfo [NODE]: show mem pool of the node, a known node by default")
+	fmt.Println("  -getrawmempool [NODE]: list transactions in mem pool of the node")
+	fmt.Println("  -nodekey: show static key of the node used in encrypted connections")
+	fmt.Println("  -pin NODE KEY: require the node to authenticate with the key")
+	fmt.Println("  -listpinned: list pinned keys of nodes")
+	fmt.Println("  -plaintext: do not encrypt connections to nodes without pinned keys")
+	fmt.Println("  -getpeerinfo [NODE]: show peers of the node with their latency and traffic")
+	fmt.Println("  -getonlinestake [NODE]: show stakeholders known to the node as online and their stake")
+	fmt.Println("  -delegate FROM_ADDR STAKE_ADDR: let the staking address stake outputs of the wallet, rewards go to the wallet")
 }